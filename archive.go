@@ -0,0 +1,285 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/paleotronic/diskm8/disk"
+	"github.com/paleotronic/diskm8/loggy"
+)
+
+/*
+	Archives...
+
+	Disk images inside zip, gzip and tar archives (nested to any depth) are
+	addressed by the archive path and the member path joined with "!/":
+
+	  /library/games.zip!/disks/choplifter.dsk
+	  /library/bundle.tar.gz!/apps.zip!/appleworks.po
+	  /library/karateka.dsk.gz!/karateka.dsk
+
+	Archives are read only, so disks mounted from them cannot be written.
+	Members are read into memory, so any over maxArchiveMember are skipped
+	rather than read in part; no disk image comes close.
+*/
+
+const archiveSeparator = "!/"
+
+// largest archive member read into memory
+const maxArchiveMember = 64 * 1024 * 1024
+
+var errArchiveStop = errors.New("stop")
+
+var errArchiveMemberSize = fmt.Errorf("larger than %dMB, too big to be a disk image", maxArchiveMember/(1024*1024))
+
+type archiveMemberFunc func(member string, r io.Reader, size int64) error
+
+func isArchive(name string) bool {
+	return archiveKind(name) != ""
+}
+
+func archiveKind(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tgz"
+	case strings.HasSuffix(name, ".gz"):
+		return "gz"
+	}
+	return ""
+}
+
+func isArchivePath(p string) bool {
+	return strings.Contains(p, archiveSeparator)
+}
+
+// splitArchivePath returns the outermost archive and the member path
+func splitArchivePath(p string) (string, string) {
+	parts := strings.SplitN(p, archiveSeparator, 2)
+	if len(parts) != 2 {
+		return p, ""
+	}
+	return parts[0], parts[1]
+}
+
+// readArchiveMember reads a member into memory, refusing one too large
+// rather than cutting it short
+func readArchiveMember(r io.Reader, size int64) ([]byte, error) {
+
+	if size > maxArchiveMember {
+		return nil, errArchiveMemberSize
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxArchiveMember+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxArchiveMember {
+		return nil, errArchiveMemberSize
+	}
+
+	return data, nil
+}
+
+// archiveMembers calls fn for every regular file in the archive, which is
+// read from r.  The archive type comes from name.
+func archiveMembers(name string, r io.Reader, size int64, fn archiveMemberFunc) error {
+
+	switch archiveKind(name) {
+	case "zip":
+		ra, ok := r.(io.ReaderAt)
+		if !ok {
+			data, err := readArchiveMember(r, size)
+			if err != nil {
+				return err
+			}
+			ra, size = bytes.NewReader(data), int64(len(data))
+		}
+		zr, err := zip.NewReader(ra, size)
+		if err != nil {
+			return err
+		}
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(path.Clean(zf.Name), rc, int64(zf.UncompressedSize64))
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "tar":
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !hdr.FileInfo().Mode().IsRegular() {
+				continue
+			}
+			if err := fn(path.Clean(hdr.Name), tr, hdr.Size); err != nil {
+				return err
+			}
+		}
+
+	case "tgz":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		return archiveMembers(".tar", zr, -1, fn)
+
+	case "gz":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		base := path.Base(strings.Replace(name, "\\", "/", -1))
+		return fn(base[:len(base)-len(".gz")], zr, -1)
+	}
+
+	return fmt.Errorf("Not an archive: %s", name)
+}
+
+// walkArchive calls fn with the path and contents of every disk image in
+// the archive, descending into nested archives.
+func walkArchive(archive string, r io.Reader, size int64, fn func(p string, data []byte) error) error {
+
+	l := loggy.Get(0)
+
+	return archiveMembers(archive, r, size, func(member string, mr io.Reader, msize int64) error {
+
+		p := archive + archiveSeparator + member
+
+		switch {
+		case isArchive(member):
+			if err := walkArchive(p, mr, msize, fn); err != nil {
+				if err == errArchiveStop {
+					return err
+				}
+				l.Errorf("Error reading archive %s: %v", p, err)
+			}
+		default:
+			data, err := readArchiveMember(mr, msize)
+			if err == errArchiveMemberSize {
+				if acceptedExtension(p) {
+					skip(p, err.Error())
+				} else {
+					ignore()
+				}
+				return nil
+			}
+			if err != nil {
+				l.Errorf("Error reading %s: %v", p, err)
+				return nil
+			}
+			if ingestCandidate(p, int64(len(data)), data) {
+				return fn(p, data)
+			}
+		}
+
+		return nil
+	})
+}
+
+// readArchivePath returns the contents of an archive member, which may be
+// inside nested archives.
+func readArchivePath(p string) ([]byte, error) {
+
+	archive, member := splitArchivePath(p)
+	if member == "" {
+		return nil, errors.New("Not an archive member: " + p)
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = f
+	size := info.Size()
+	name := archive
+
+	var data []byte
+	for _, part := range strings.Split(member, archiveSeparator) {
+
+		found := false
+		err := archiveMembers(name, r, size, func(m string, mr io.Reader, msize int64) error {
+			if m != part {
+				return nil
+			}
+			var err error
+			data, err = readArchiveMember(mr, msize)
+			if err != nil {
+				return fmt.Errorf("%s: %v", part, err)
+			}
+			found = true
+			return errArchiveStop
+		})
+		if err != nil && err != errArchiveStop {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("%s not found in %s", part, name)
+		}
+
+		r, size, name = bytes.NewReader(data), int64(len(data)), part
+	}
+
+	return data, nil
+}
+
+// readDiskImage reads a disk image from a file or from inside an archive
+func readDiskImage(p string) ([]byte, error) {
+
+	if isArchivePath(p) {
+		if _, err := os.Stat(p); err != nil {
+			return readArchivePath(p)
+		}
+	}
+
+	return ioutil.ReadFile(p)
+}
+
+// loadDisk opens a disk image from a file or from inside an archive
+func loadDisk(p string) (*disk.DSKWrapper, error) {
+
+	data, err := readDiskImage(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return disk.NewDSKWrapperBin(defNibbler, data, p)
+}
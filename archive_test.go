@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// bootImage is a 140K image with boot code and nothing else, enough to be
+// ingested as a disk
+func bootImage(n byte) []byte {
+	data := make([]byte, 143360)
+	data[0], data[1] = 1, n
+	return data
+}
+
+type archiveFile struct {
+	name string
+	data []byte
+}
+
+func zipData(t *testing.T, files ...archiveFile) []byte {
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(f.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// archiveLibrary writes a zip with a disk, a nested zip with another, a
+// text file and a compressed member too big to be a disk
+func archiveLibrary(t *testing.T, dir string) string {
+
+	lib := filepath.Join(dir, "library")
+	if err := os.MkdirAll(lib, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	data := zipData(t,
+		archiveFile{"disks/a.dsk", bootImage(1)},
+		archiveFile{"readme.txt", []byte("Some disks")},
+		archiveFile{"more.zip", zipData(t, archiveFile{"b.dsk", bootImage(2)})},
+		archiveFile{"big.dsk.gz", gzipData(t, make([]byte, maxArchiveMember+1))},
+	)
+	archive := filepath.Join(lib, "games.zip")
+	if err := ioutil.WriteFile(archive, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return archive
+}
+
+func TestIngestArchive(t *testing.T) {
+
+	dir := tempDatastore(t)
+	archive := archiveLibrary(t, dir)
+
+	ingestLibrary(filepath.Dir(archive))
+
+	c := &apiDiskCollector{}
+	Aggregate(AggregateAPIDisks, c, nil)
+	var paths []string
+	for _, d := range c.disks {
+		paths = append(paths, d.FullPath)
+	}
+	sort.Strings(paths)
+
+	expected := []string{archive + "!/disks/a.dsk", archive + "!/more.zip!/b.dsk"}
+	if strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v to be ingested, got %v", expected, paths)
+	}
+
+	big := archive + "!/big.dsk.gz!/big.dsk"
+	if skipped[big] != errArchiveMemberSize.Error() {
+		t.Fatalf("Expected %s to be skipped as too big, got %q", big, skipped[big])
+	}
+
+	if processed != 2 || ignored != 1 || len(skipped) != 1 {
+		t.Fatalf("Expected 2 disks, the text file ignored and the big disk skipped, got %d, %d and %v", processed, ignored, skipped)
+	}
+
+	if e := LoadManifest().Get(manifestKey(archive)); e == nil || len(e.Members) != 2 {
+		t.Fatalf("Expected the manifest to list both disks in the archive, got %+v", e)
+	}
+
+}
+
+func TestExtractArchiveDisk(t *testing.T) {
+
+	dir := tempDatastore(t)
+	archive := archiveLibrary(t, dir)
+
+	for n, member := range []string{"!/disks/a.dsk", "!/more.zip!/b.dsk"} {
+		p := archive + member
+		if err := ExtractDisk(p); err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		data, err := ioutil.ReadFile(binpath() + "/extract" + p + "/" + filepath.Base(p))
+		if err != nil || !bytes.Equal(data, bootImage(byte(n+1))) {
+			t.Fatalf("%s: expected the disk to be extracted (%v)", p, err)
+		}
+	}
+
+	for _, member := range []string{"!/missing.dsk", "!/more.zip!/a.dsk", "!/disks/a.dsk!/a.dsk"} {
+		if err := ExtractDisk(archive + member); err == nil {
+			t.Errorf("%s: expected an error", member)
+		}
+	}
+
+	if err := ExtractDisk(archive + "!/big.dsk.gz!/big.dsk"); err == nil || !strings.Contains(err.Error(), errArchiveMemberSize.Error()) {
+		t.Errorf("Expected the big member to be refused, got %v", err)
+	}
+
+}
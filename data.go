@@ -2,7 +2,7 @@ package main
 
 import (
 	"crypto/md5"
-	"encoding/gob"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -19,8 +19,12 @@ import (
 type Disk struct {
 	FullPath                string
 	Filename                string
+	Archive                 string // Archive the disk was read from, if any
+	ArchiveMember           string // Path of the disk inside the archive
 	SHA256                  string // Sha of whole disk
 	SHA256Active            string // Sha of active sectors/blocks only
+	CanonicalSHA256         string // Sha of whole disk in logical order, the same for any image format
+	CanonicalSHA256Active   string // Sha of active sectors/blocks in logical order
 	Format                  string
 	FormatID                disk.DiskFormat
 	Bitmap                  []bool
@@ -30,11 +34,23 @@ type Disk struct {
 	//ActiveBlocks             DiskBlocks
 	InactiveSectors DiskSectors
 	//InactiveBlocks           DiskBlocks
+	BootSHA256               string // Sha of the boot sector
+	BootCode                 string // Matching boot sector signature
+	DOSImage                 string // DOS variant on tracks 0-2
+	DOSImageSHA256           string
+	ProDOSVersion            string // Kernel version from the PRODOS file
+	Bootable                 bool
 	MatchFactor              float64
 	MatchFiles               map[*DiskFile]*DiskFile
 	MissingFiles, ExtraFiles []*DiskFile
+	ModifiedFiles            []*FileModification
 	IngestMode               int
+	LinkedTo                 string  // disk this copy was linked to by -dedupe
+	FileMinHash              MinHash // signatures for similarity reports, see minhash.go
+	ActiveMinHash            MinHash
+	SectorMinHash            MinHash
 	source                   string
+	inMemory                 bool // fingerprinted for one command, not stored
 }
 
 type ByMatchFactor []*Disk
@@ -61,18 +77,20 @@ const (
 )
 
 type DiskFile struct {
-	Filename    string
-	Type        string
-	Ext         string
-	TypeCode    TypeCode
-	SHA256      string
-	Size        int
-	LoadAddress int
-	Text        []byte
-	Data        []byte
-	Locked      bool
-	Created     time.Time
-	Modified    time.Time
+	Filename         string
+	Type             string
+	Ext              string
+	TypeCode         TypeCode
+	SHA256           string
+	NormalizedSHA256 string // SHA256 with slack bytes trimmed, see normalize.go
+	FuzzyHash        string // piecewise hash of the data, see filesim.go
+	Size             int
+	LoadAddress      int
+	Text             []byte
+	Data             []byte
+	Locked           bool
+	Created          time.Time
+	Modified         time.Time
 }
 
 func (d *DiskFile) GetNameAdorned() string {
@@ -175,6 +193,37 @@ func (i Disk) LogBitmap(id int) {
 
 }
 
+// BootDescription summarises the boot and OS fingerprint of the disk
+func (d Disk) BootDescription() string {
+
+	parts := make([]string, 0)
+
+	if d.BootCode != "" {
+		parts = append(parts, "Boot: "+d.BootCode)
+	}
+	if d.DOSImage != "" {
+		parts = append(parts, "DOS: "+d.DOSImage)
+	}
+	if d.ProDOSVersion != "" {
+		parts = append(parts, "ProDOS: "+d.ProDOSVersion)
+	}
+	if d.Bootable {
+		parts = append(parts, "bootable")
+	} else {
+		parts = append(parts, "not bootable")
+	}
+
+	return strings.Join(parts, ", ")
+
+}
+
+// ID is a short identifier for the disk made from its path, which stays
+// the same as long as the disk does not move
+func (d Disk) ID() string {
+	sum := sha256.Sum256([]byte(d.FullPath))
+	return hex.EncodeToString(sum[:8])
+}
+
 func (d Disk) GetFilename() string {
 
 	sum := md5.Sum([]byte(d.Filename))
@@ -192,49 +241,47 @@ func (d Disk) GetFilename() string {
 
 }
 
+// WriteToFile stores the fingerprint in the datastore under the path the
+// fingerprint file would have had.
 func (d Disk) WriteToFile(filename string) error {
 
-	// b, err := yaml.Marshal(d)
-
-	// if err != nil {
-	// 	return err
-	// }
 	l := loggy.Get(0)
 
-	_ = os.MkdirAll(filepath.Dir(filename), 0755)
+	d.updateMinHashes()
 
-	f, err := os.Create(filename)
+	err := writeStore(func(s *Store) error {
+		return s.Put(fingerprintKey(filename), &d)
+	})
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	enc.Encode(d)
 
 	l.Logf("Created %s", filename)
 
 	return nil
 }
 
+// ReadFromFile decodes a fingerprint from the datastore.  Fingerprints that
+// exist but will not decode are noted so reports can list them.
 func (d *Disk) ReadFromFile(filename string) error {
-	// b, err := ioutil.ReadFile(filename)
-	// if err != nil {
-	// 	return err
-	// }
-	// err = yaml.Unmarshal(b, d)
 
-	f, err := os.Open(filename)
+	s, err := getStore()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	dec := gob.NewDecoder(f)
-	err = dec.Decode(d)
+	d2, err := s.Get(fingerprintKey(filename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			corruptFingerprints.Add(filename, err)
+		}
+		return err
+	}
 
+	*d = *d2
 	d.source = filename
 
-	return err
+	return nil
 }
 
 // GetExactBinaryMatches returns disks with the same Global SHA256
@@ -244,7 +291,7 @@ func (d *Disk) GetExactBinaryMatches(filter []string) []*Disk {
 
 	var out []*Disk = make([]*Disk, 0)
 
-	exists, matches := existsPattern(*baseName, filter, fmt.Sprintf("%d", d.FormatID)+"_"+d.SHA256+"_*_*.fgp")
+	exists, matches := existsIndexed(*baseName, filter, IndexDiskSHA, d.SHA256)
 	if !exists {
 		return out
 	}
@@ -268,7 +315,7 @@ func (d *Disk) GetActiveSectorBinaryMatches(filter []string) []*Disk {
 
 	var out []*Disk = make([]*Disk, 0)
 
-	exists, matches := existsPattern(*baseName, filter, fmt.Sprintf("%d", d.FormatID)+"_*_"+d.SHA256Active+"_*.fgp")
+	exists, matches := existsIndexed(*baseName, filter, IndexActiveSHA, d.SHA256Active)
 	if !exists {
 		return out
 	}
@@ -292,7 +339,7 @@ func (d *Disk) GetFileMap() map[string]*DiskFile {
 
 	for _, file := range d.Files {
 		f := file
-		out[file.SHA256] = f
+		out[file.matchSHA256()] = f
 	}
 
 	return out
@@ -468,7 +515,7 @@ func (d *Disk) GetPartialMatches(filter []string) ([]*Disk, []*Disk, []*Disk) {
 	var subset []*Disk = make([]*Disk, 0)
 	var identical []*Disk = make([]*Disk, 0)
 
-	exists, matches := existsPattern(*baseName, filter, fmt.Sprintf("%d", d.FormatID)+"_*_*_*.fgp")
+	exists, matches := existsIndexed(*baseName, filter, IndexFormat, fmt.Sprintf("%d", d.FormatID.ID))
 	if !exists {
 		return superset, subset, identical
 	}
@@ -506,7 +553,7 @@ func (d *Disk) GetPartialMatchesWithThreshold(t float64, filter []string) []*Dis
 
 	var matchlist []*Disk = make([]*Disk, 0)
 
-	exists, matches := existsPattern(*baseName, filter, fmt.Sprintf("%d", d.FormatID)+"_*_*_*.fgp")
+	exists, matches := existsIndexed(*baseName, filter, IndexFormat, fmt.Sprintf("%d", d.FormatID.ID))
 	if !exists {
 		return matchlist
 	}
@@ -635,6 +682,14 @@ func (d *Disk) CompareFiles(b *Disk) float64 {
 
 	}
 
+	b.ModifiedFiles = nil
+	if mods, missing, extras := matchModifiedFiles(b.MissingFiles, b.ExtraFiles); len(mods) > 0 {
+		b.ModifiedFiles = mods
+		b.MissingFiles = missing
+		b.ExtraFiles = extras
+		return modifiedScore(int(sameFiles), len(missing), len(extras), mods)
+	}
+
 	// return sameSectors / dTotal, sameSectors / bTotal, diffSectors / dTotal, diffSectors / btotal
 	return sameFiles / (sameFiles + extraFiles + missingFiles)
 
@@ -685,7 +740,7 @@ func (d *Disk) GetPartialFileMatchesWithThreshold(t float64, filter []string) []
 func (d *Disk) HasFileSHA256(sha string) (bool, *DiskFile) {
 
 	for _, file := range d.Files {
-		if sha == file.SHA256 {
+		if sha == file.matchSHA256() {
 			return true, file
 		}
 	}
@@ -698,7 +753,7 @@ func (d *Disk) GetFileChecksum(filename string) (bool, string) {
 
 	for _, f := range d.Files {
 		if strings.ToLower(filename) == strings.ToLower(f.Filename) {
-			return true, f.SHA256
+			return true, f.matchSHA256()
 		}
 	}
 
@@ -712,17 +767,17 @@ func (d *Disk) GetFileMatches(filename string, filter []string) []*Disk {
 
 	var matchlist []*Disk = make([]*Disk, 0)
 
-	exists, matches := existsPattern(*baseName, filter, "*_*_*_*.fgp")
-	if !exists {
-		return matchlist
-	}
-
 	fileexists, SHA256 := d.GetFileChecksum(filename)
 	if !fileexists {
 		os.Stderr.WriteString("File does not exist on this volume: " + filename + "\n")
 		return matchlist
 	}
 
+	exists, matches := existsIndexed(*baseName, filter, IndexFileSHA, SHA256)
+	if !exists {
+		return matchlist
+	}
+
 	_, srcFile := d.HasFileSHA256(SHA256)
 
 	var lastPc int = -1
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+/*
+	Datastore locking...
+
+	Ingest and quarantine change the datastore and take an exclusive lock,
+	reports and searches only read it and take a shared lock, so several
+	reports can run together but never alongside an ingest.  The lock is
+	advisory and held on the .lock file at the top of the datastore.
+
+	Writes to the fingerprint store outside an ingest (eg. from shell
+	commands) take the exclusive lock just for the write.
+
+	Locking again while this process holds the lock reuses it, and only
+	the outer Unlock releases it.  A shared lock can't be turned into an
+	exclusive one that way, as another reader may hold it too; asking for
+	one is an error rather than waiting on ourselves.  The lock for a
+	single write isn't recorded as held, and writes made that way (eg. by
+	ingest workers with no lock around them) take it one at a time.
+*/
+
+const datastoreLockFile = ".lock"
+
+const (
+	lockNone = iota
+	lockShared
+	lockExclusive
+)
+
+type datastoreLock struct {
+	f         *os.File
+	exclusive bool
+	temporary bool
+	nested    bool // inside a lock already held, so Unlock leaves it
+}
+
+// lock currently held by this process, not counting locks for one write
+var heldLock = lockNone
+var heldLockMu sync.Mutex
+
+// one write at a time outside a held lock
+var writeLockMu sync.Mutex
+
+var errLockUpgrade = errors.New("Datastore is locked for reading")
+
+func currentLock() int {
+	heldLockMu.Lock()
+	defer heldLockMu.Unlock()
+	return heldLock
+}
+
+func setLock(how int) {
+	heldLockMu.Lock()
+	heldLock = how
+	heldLockMu.Unlock()
+}
+
+func lockDatastore(exclusive bool) (*datastoreLock, error) {
+
+	held := currentLock()
+	switch {
+	case held == lockShared && exclusive:
+		return nil, errLockUpgrade
+	case held != lockNone:
+		return &datastoreLock{exclusive: held == lockExclusive, nested: true}, nil
+	}
+
+	dl, err := takeDatastoreLock(exclusive)
+	if err != nil {
+		return nil, err
+	}
+
+	if exclusive {
+		setLock(lockExclusive)
+	} else {
+		setLock(lockShared)
+	}
+
+	return dl, nil
+}
+
+// takeDatastoreLock locks the .lock file, waiting for other processes
+func takeDatastoreLock(exclusive bool) (*datastoreLock, error) {
+
+	if err := os.MkdirAll(*baseName, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(*baseName, datastoreLockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(f, exclusive, false)
+	if err == errLockBusy {
+		os.Stderr.WriteString("Waiting for another diskm8 process to release the datastore...\n")
+		err = lockFile(f, exclusive, true)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// pick up changes made while we were not holding the lock, including
+	// another process compacting the store into a new file
+	if store != nil {
+		store.Lock()
+		err = store.refresh(exclusive)
+		store.Unlock()
+		if err != nil {
+			os.Stderr.WriteString("Error reading datastore: " + err.Error() + "\n")
+		}
+	}
+
+	return &datastoreLock{f: f, exclusive: exclusive}, nil
+}
+
+func (dl *datastoreLock) Unlock() {
+	if dl == nil || dl.nested {
+		return
+	}
+
+	if dl.exclusive && store != nil {
+		min := 1
+		if dl.temporary {
+			min = storeIndexThreshold
+		}
+		if err := store.Flush(min); err != nil {
+			os.Stderr.WriteString("Error writing datastore index: " + err.Error() + "\n")
+		}
+		if !dl.temporary {
+			if err := store.Compact(); err != nil {
+				os.Stderr.WriteString("Error compacting datastore: " + err.Error() + "\n")
+			}
+		}
+	}
+
+	if !dl.temporary {
+		setLock(lockNone)
+	}
+	unlockFile(dl.f)
+	dl.f.Close()
+}
+
+// writeStore runs f against the fingerprint store, taking the exclusive
+// lock for the duration unless this process already holds it.
+func writeStore(f func(s *Store) error) error {
+
+	switch currentLock() {
+	case lockShared:
+		return errLockUpgrade
+	case lockNone:
+		writeLockMu.Lock()
+		defer writeLockMu.Unlock()
+		dl, err := takeDatastoreLock(true)
+		if err != nil {
+			return err
+		}
+		dl.temporary = true
+		defer dl.Unlock()
+	}
+
+	s, err := getStore()
+	if err != nil {
+		return err
+	}
+
+	return f(s)
+}
+
+var errLockBusy = errors.New("Datastore is locked")
+
+// withDatastoreLock runs f holding the datastore lock, listing any corrupt
+// fingerprints found along the way.
+func withDatastoreLock(exclusive bool, f func()) {
+
+	dl, err := lockDatastore(exclusive)
+	if err != nil {
+		os.Stderr.WriteString("Unable to lock datastore: " + err.Error() + "\n")
+		return
+	}
+	defer dl.Unlock()
+
+	f()
+
+	reportCorruptFingerprints(os.Stderr)
+}
+
+type corruptList struct {
+	sync.Mutex
+	files map[string]error
+}
+
+var corruptFingerprints = &corruptList{files: make(map[string]error)}
+
+func (cl *corruptList) Add(filename string, err error) {
+	cl.Lock()
+	cl.files[filename] = err
+	cl.Unlock()
+}
+
+// reportCorruptFingerprints lists fingerprints that could not be decoded
+// since the last call.
+func reportCorruptFingerprints(w io.Writer) {
+
+	corruptFingerprints.Lock()
+	defer corruptFingerprints.Unlock()
+
+	if len(corruptFingerprints.files) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(corruptFingerprints.files))
+	for k := range corruptFingerprints.files {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "\n%d corrupt fingerprint(s) skipped, re-ingest the disks to repair:\n", len(names))
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s: %v\n", name, corruptFingerprints.files[name])
+	}
+
+	corruptFingerprints.files = make(map[string]error)
+}
@@ -0,0 +1,23 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+var lockWarning sync.Once
+
+// No portable advisory lock in the standard library here, so rely on the
+// atomic fingerprint writes alone, and say so once.
+func lockFile(f *os.File, exclusive bool, wait bool) error {
+	lockWarning.Do(func() {
+		os.Stderr.WriteString("Warning: the datastore can't be locked on this system, so don't run more than one diskm8 against it at a time\n")
+	})
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNestedDatastoreLock(t *testing.T) {
+
+	tempDatastore(t)
+
+	outer, err := lockDatastore(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// taken again, eg. by writeStore during an ingest, the lock is reused
+	for _, exclusive := range []bool{true, false} {
+		inner, err := lockDatastore(exclusive)
+		if err != nil || !inner.nested {
+			t.Fatalf("Exclusive %v: expected to reuse the lock held (%v)", exclusive, err)
+		}
+		inner.Unlock()
+		if heldLock != lockExclusive {
+			t.Fatalf("Exclusive %v: expected the outer lock to be kept", exclusive)
+		}
+	}
+
+	if err := writeStore(func(s *Store) error { return nil }); err != nil {
+		t.Fatalf("Expected to write under the lock held: %v", err)
+	}
+	if heldLock != lockExclusive {
+		t.Fatalf("Expected writeStore to leave the outer lock alone")
+	}
+
+	outer.Unlock()
+	if heldLock != lockNone {
+		t.Fatalf("Expected the lock to be released")
+	}
+
+}
+
+func TestSharedDatastoreLockUpgrade(t *testing.T) {
+
+	tempDatastore(t)
+
+	dl, err := lockDatastore(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Unlock()
+
+	if inner, err := lockDatastore(false); err != nil || !inner.nested {
+		t.Fatalf("Expected to reuse the shared lock (%v)", err)
+	}
+	if _, err := lockDatastore(true); err != errLockUpgrade {
+		t.Fatalf("Expected an exclusive lock to be refused, got %v", err)
+	}
+	if err := writeStore(func(s *Store) error { return nil }); err != errLockUpgrade {
+		t.Fatalf("Expected a write to be refused, got %v", err)
+	}
+
+}
+
+func TestConcurrentWriteStore(t *testing.T) {
+
+	tempDatastore(t)
+
+	// writes with no lock held take one each, one at a time
+	var inside, most int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := writeStore(func(s *Store) error {
+				n := atomic.AddInt32(&inside, 1)
+				for {
+					m := atomic.LoadInt32(&most)
+					if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&inside, -1)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if most != 1 {
+		t.Fatalf("Expected one write at a time, got %d together", most)
+	}
+	if currentLock() != lockNone {
+		t.Fatalf("Expected no lock to be left held")
+	}
+
+}
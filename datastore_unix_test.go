@@ -0,0 +1,83 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// otherLock opens the lock file the way another diskm8 process would
+func otherLock(t *testing.T) *os.File {
+
+	f, err := os.OpenFile(filepath.Join(*baseName, datastoreLockFile), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	return f
+}
+
+func TestDatastoreLockExclusive(t *testing.T) {
+
+	tempDatastore(t)
+
+	dl, err := lockDatastore(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := otherLock(t)
+	for _, exclusive := range []bool{true, false} {
+		if err := lockFile(f, exclusive, false); err != errLockBusy {
+			t.Fatalf("Exclusive %v: expected the lock to be busy, got %v", exclusive, err)
+		}
+	}
+
+	// a waiting lock gets it once released
+	done := make(chan error)
+	go func() { done <- lockFile(f, false, true) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Expected to wait for the exclusive lock, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	dl.Unlock()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the lock once released")
+	}
+	unlockFile(f)
+
+}
+
+func TestDatastoreLockShared(t *testing.T) {
+
+	tempDatastore(t)
+
+	dl, err := lockDatastore(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Unlock()
+
+	f := otherLock(t)
+	if err := lockFile(f, false, false); err != nil {
+		t.Fatalf("Expected readers to share the lock, got %v", err)
+	}
+	unlockFile(f)
+	if err := lockFile(f, true, false); err != errLockBusy {
+		t.Fatalf("Expected a writer to be kept out, got %v", err)
+	}
+
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/*
+	Dedupe...
+
+	An alternative to quarantine for whole disk dupes that keeps the folder
+	structure: every copy but the one kept is replaced with a hard link to
+	it, or a symbolic link with -dedupe symlink, so the space is reclaimed
+	but every path still opens the disk.  The disk to keep is chosen the
+	same way as for quarantine (-keep, or asked).
+
+	Disks are grouped by canonical SHA256, so the same disk kept as a .dsk
+	and a .po is found even though the files differ.  Each copy is
+	compared byte for byte with the one kept first.  Copies that differ,
+	disks inside archives and copies already linked are left alone.  Each
+	link is made beside the copy and renamed over it, so a copy is never
+	lost half way.  The manifest entry of each path is updated from the
+	file it now opens so the next ingest sees it as unchanged.
+
+	The fingerprint of a linked copy keeps its own FullPath, since that
+	path still opens the disk and is what the manifest, extract and the
+	next ingest look it up by; pointing it at the kept disk would leave
+	two fingerprints claiming the same file.  The kept disk goes in
+	LinkedTo instead, so the dupe reports and quarantine leave the copy
+	out while it is still a link.
+*/
+
+const (
+	DedupeHard    = "hard"
+	DedupeSymlink = "symlink"
+)
+
+// sameContents compares two files byte for byte
+func sameContents(a, b string) (bool, error) {
+
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	ia, err := fa.Stat()
+	if err != nil {
+		return false, err
+	}
+	ib, err := fb.Stat()
+	if err != nil {
+		return false, err
+	}
+	if ia.Size() != ib.Size() {
+		return false, nil
+	}
+
+	bufa := make([]byte, 64*1024)
+	bufb := make([]byte, 64*1024)
+	for {
+		na, erra := io.ReadFull(fa, bufa)
+		nb, errb := io.ReadFull(fb, bufb)
+		if !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+		if erra == io.EOF || erra == io.ErrUnexpectedEOF {
+			return errb == erra, nil
+		}
+		if erra != nil {
+			return false, erra
+		}
+		if errb != nil {
+			return false, errb
+		}
+	}
+}
+
+// linkCopy replaces copy with a link to keeper
+func linkCopy(keeper, copy string, mode string) error {
+
+	tmp := copy + ".diskm8-link"
+	os.Remove(tmp)
+
+	var err error
+	if mode == DedupeSymlink {
+		target := keeper
+		if rel, e := filepath.Rel(filepath.Dir(copy), keeper); e == nil {
+			target = rel
+		}
+		err = os.Symlink(target, tmp)
+	} else {
+		err = os.Link(keeper, tmp)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, copy); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// isLinkedCopy is true if a disk was linked to another by dedupe and its
+// path still opens the same file as that disk
+func isLinkedCopy(d *Disk) bool {
+
+	if d.LinkedTo == "" {
+		return false
+	}
+
+	info, err := os.Stat(d.FullPath)
+	if err != nil {
+		return false
+	}
+	kinfo, err := os.Stat(d.LinkedTo)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(info, kinfo)
+}
+
+// markLinked records in the fingerprint of a copy the disk it is linked to
+func markLinked(c *quarantineCandidate, keeper string) {
+
+	if c.disk.LinkedTo == keeper || c.disk.source == "" {
+		return
+	}
+
+	c.disk.LinkedTo = keeper
+	if err := c.disk.WriteToFile(c.disk.source); err != nil {
+		os.Stderr.WriteString("  Unable to update the fingerprint of " + c.path() + ": " + err.Error() + "\n")
+	}
+}
+
+// dedupeWholeDisks links the copies in each group of whole disk dupes to
+// the one kept.  keep is a -keep policy, or empty to ask.
+func dedupeWholeDisks(filter []string, mode string, keep string, dryRun bool) int {
+
+	if mode != DedupeHard && mode != DedupeSymlink {
+		os.Stderr.WriteString("Dedupe mode must be hard or symlink\n")
+		return -1
+	}
+
+	var rules []keepRule
+	if keep != "" {
+		var err error
+		if rules, err = ParseKeepPolicy(keep); err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			return -1
+		}
+	}
+
+	groups, err := quarantineGroups(QuarantineWholeDupes, filter)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return -1
+	}
+
+	manifest = LoadManifest()
+
+	reader := bufio.NewReader(os.Stdin)
+	linked := 0
+	var reclaimed int64
+
+	for _, g := range groups {
+
+		var idx int
+		if rules != nil {
+			idx = chooseKeeper(g.members, rules)
+		} else {
+			var quit bool
+			if idx, quit = askKeeper(reader, g); quit {
+				break
+			} else if idx < 0 {
+				continue
+			}
+		}
+
+		keeper := g.members[idx]
+		if keeper.disk.Archive != "" {
+			fmt.Printf("Skipping group of %s (inside an archive)\n", keeper.path())
+			continue
+		}
+		kinfo, err := os.Stat(keeper.path())
+		if err != nil {
+			fmt.Printf("Skipping group of %s (%v)\n", keeper.path(), err)
+			continue
+		}
+
+		fmt.Printf("Keeping %s\n", keeper.path())
+
+		for _, v := range g.members {
+
+			if v == keeper {
+				continue
+			}
+			if v.disk.Archive != "" {
+				fmt.Printf("  Leaving %s (inside an archive)\n", v.path())
+				continue
+			}
+
+			linfo, err := os.Lstat(v.path())
+			if err != nil {
+				fmt.Printf("  Leaving %s (%v)\n", v.path(), err)
+				continue
+			}
+			if info, err := os.Stat(v.path()); err == nil && os.SameFile(info, kinfo) {
+				fmt.Printf("  Leaving %s (already linked)\n", v.path())
+				if !dryRun {
+					markLinked(v, keeper.path())
+				}
+				continue
+			}
+			if linfo.Mode()&os.ModeSymlink != 0 {
+				fmt.Printf("  Leaving %s (already a symbolic link)\n", v.path())
+				continue
+			}
+
+			same, err := sameContents(keeper.path(), v.path())
+			if err != nil {
+				fmt.Printf("  Leaving %s (%v)\n", v.path(), err)
+				continue
+			}
+			if !same {
+				fmt.Printf("  Leaving %s (same disk, different file; another image format?)\n", v.path())
+				continue
+			}
+
+			if dryRun {
+				fmt.Printf("  Would link %s\n", v.path())
+				linked++
+				reclaimed += linfo.Size()
+				continue
+			}
+
+			if err := linkCopy(keeper.path(), v.path(), mode); err != nil {
+				os.Stderr.WriteString("  Unable to link " + v.path() + ": " + err.Error() + "\n")
+				continue
+			}
+			fmt.Printf("  Linked %s\n", v.path())
+			linked++
+			reclaimed += linfo.Size()
+
+			markLinked(v, keeper.path())
+
+			key := manifestKey(v.path())
+			if e := manifest.Get(key); e != nil {
+				if info, err := os.Stat(v.path()); err == nil {
+					updated := *e
+					updated.Size, updated.ModTime = info.Size(), info.ModTime().UnixNano()
+					manifest.Put(key, &updated)
+				}
+			}
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("\n%d copies would be linked, reclaiming %d KB\n", linked, reclaimed/1024)
+		return 0
+	}
+
+	if err := manifest.Save(); err != nil {
+		os.Stderr.WriteString("Failed to save manifest: " + err.Error() + "\n")
+	}
+
+	fmt.Printf("\n%d copies linked, %d KB reclaimed\n", linked, reclaimed/1024)
+
+	return 0
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// dedupeDisks ingests a disk and a copy of it, with a manifest entry for
+// the copy, returning the paths and the fingerprint of the copy
+func dedupeDisks(t *testing.T, dir string) (string, string, string) {
+
+	keep := filepath.Join(dir, "library", "a.dsk")
+	dupe := filepath.Join(dir, "library", "games", "a copy.dsk")
+	ingestedDisk(t, keep, "same")
+	fingerprint := ingestedDisk(t, dupe, "same")
+
+	manifest = LoadManifest()
+	manifest.Put(manifestKey(dupe), &ManifestEntry{Size: 4})
+	if err := manifest.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	return keep, dupe, fingerprint
+}
+
+// checkLinked checks dupe now opens keep, and the manifest and fingerprint
+// of dupe were updated to match
+func checkLinked(t *testing.T, keep, dupe, fingerprint string) {
+
+	t.Helper()
+
+	kinfo, err := os.Stat(keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dupe)
+	if err != nil || !os.SameFile(info, kinfo) {
+		t.Fatalf("Expected %s to be linked to %s (%v)", dupe, keep, err)
+	}
+
+	e := LoadManifest().Get(manifestKey(dupe))
+	if e == nil || e.Size != kinfo.Size() || e.ModTime != kinfo.ModTime().UnixNano() {
+		t.Fatalf("Expected the manifest entry of %s to match %s, got %+v", dupe, keep, e)
+	}
+
+	var d Disk
+	if err := d.ReadFromFile(fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if d.FullPath != dupe || d.LinkedTo != keep {
+		t.Fatalf("Expected the fingerprint of %s to be linked to %s, got %s -> %s", dupe, keep, d.FullPath, d.LinkedTo)
+	}
+
+}
+
+func TestDedupeHard(t *testing.T) {
+
+	dir := tempDatastore(t)
+	keep, dupe, fingerprint := dedupeDisks(t, dir)
+
+	if r := dedupeWholeDisks(nil, DedupeHard, "shortest", false); r != 0 {
+		t.Fatalf("Dedupe failed: %d", r)
+	}
+
+	if info, err := os.Lstat(dupe); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		t.Fatalf("Expected %s to be a hard link (%v)", dupe, err)
+	}
+	checkLinked(t, keep, dupe, fingerprint)
+
+	// linked copies are left out of the dupe groups
+	groups, err := quarantineGroups(QuarantineWholeDupes, nil)
+	if err != nil || len(groups) != 0 {
+		t.Fatalf("Expected no dupes left, got %d (%v)", len(groups), err)
+	}
+
+}
+
+func TestDedupeSymlink(t *testing.T) {
+
+	dir := tempDatastore(t)
+	keep, dupe, fingerprint := dedupeDisks(t, dir)
+
+	if r := dedupeWholeDisks(nil, DedupeSymlink, "shortest", false); r != 0 {
+		t.Fatalf("Dedupe failed: %d", r)
+	}
+
+	info, err := os.Lstat(dupe)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("Expected %s to be a symbolic link (%v)", dupe, err)
+	}
+	if target, err := os.Readlink(dupe); err != nil || filepath.IsAbs(target) {
+		t.Fatalf("Expected a relative link, got %q (%v)", target, err)
+	}
+	checkLinked(t, keep, dupe, fingerprint)
+
+}
+
+func TestDedupeDifferentBytes(t *testing.T) {
+
+	dir := tempDatastore(t)
+	keep, dupe, fingerprint := dedupeDisks(t, dir)
+
+	// the same disk as far as the fingerprints go, but not the same file
+	if err := ioutil.WriteFile(dupe, []byte("SAME"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{DedupeHard, DedupeSymlink} {
+		if r := dedupeWholeDisks(nil, mode, "shortest", false); r != 0 {
+			t.Fatalf("Dedupe failed: %d", r)
+		}
+	}
+
+	kinfo, _ := os.Stat(keep)
+	info, err := os.Lstat(dupe)
+	if err != nil || !info.Mode().IsRegular() || os.SameFile(info, kinfo) {
+		t.Fatalf("Expected %s to be left alone (%v)", dupe, err)
+	}
+	if data, err := ioutil.ReadFile(dupe); err != nil || string(data) != "SAME" {
+		t.Fatalf("Expected the contents of %s to be left alone, got %q (%v)", dupe, data, err)
+	}
+
+	var d Disk
+	if err := d.ReadFromFile(fingerprint); err != nil || d.LinkedTo != "" {
+		t.Fatalf("Expected the fingerprint of %s to be left alone, linked to %q (%v)", dupe, d.LinkedTo, err)
+	}
+	if e := LoadManifest().Get(manifestKey(dupe)); e == nil || e.Size != 4 || e.ModTime != 0 {
+		t.Fatalf("Expected the manifest entry of %s to be left alone, got %+v", dupe, e)
+	}
+
+}
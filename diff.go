@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/paleotronic/diskm8/disk"
+)
+
+/*
+	Disk diff...
+
+	-diff a.dsk b.dsk (or diff <slot> <slot> in the shell) compares two
+	disks in detail: files only on one of them, files with the same name
+	but different content, and a map of the sectors or blocks that differ.
+	Changed BASIC programs and text files are shown as a unified diff of
+	their listings, anything else as a hex diff of the rows of 16 bytes
+	that differ.  Sectors are compared in logical order (see
+	disk/diskimagelogical.go), so a .dsk and a .po of the same disk show no
+	changes.
+*/
+
+const (
+	diffContext    = 3  // lines of context around changes in listings
+	diffMaxHexRows = 64 // rows shown per file before the rest are counted
+)
+
+// diffImages loads two disk images and writes the differences between them
+func diffImages(pathA, pathB string) int {
+
+	a, err := loadDisk(pathA)
+	if err != nil {
+		os.Stderr.WriteString("Unable to read " + pathA + ": " + err.Error() + "\n")
+		return -1
+	}
+	b, err := loadDisk(pathB)
+	if err != nil {
+		os.Stderr.WriteString("Unable to read " + pathB + ": " + err.Error() + "\n")
+		return -1
+	}
+
+	return diffReport(pathA, pathB, a, b)
+}
+
+func diffReport(pathA, pathB string, a, b *disk.DSKWrapper) int {
+
+	// file content is needed whatever -ingest-mode says, and the disks are
+	// only fingerprinted for the diff, not added to the datastore
+	fa, err := analyzeInMemory(pathA, *ingestMode|1)
+	if err != nil {
+		os.Stderr.WriteString("Unable to read files on " + pathA + ": " + err.Error() + "\n")
+		return -1
+	}
+	fb, err := analyzeInMemory(pathB, *ingestMode|1)
+	if err != nil {
+		os.Stderr.WriteString("Unable to read files on " + pathB + ": " + err.Error() + "\n")
+		return -1
+	}
+
+	var w *os.File
+
+	if *reportFile != "" {
+		w, err = os.Create(*reportFile)
+		if err != nil {
+			os.Stderr.WriteString("Unable to create report: " + err.Error() + "\n")
+			return -1
+		}
+		defer w.Close()
+	} else {
+		w = os.Stdout
+	}
+
+	w.WriteString(fmt.Sprintf("DIFF OF %s AND %s\n\n", fa.FullPath, fb.FullPath))
+
+	writeFileDiffs(w, fa, fb)
+	writeSectorMap(w, fa.Filename, fb.Filename, a, b)
+
+	return 0
+}
+
+func diffFileMap(files []*DiskFile) (map[string]*DiskFile, []string) {
+	m := make(map[string]*DiskFile, len(files))
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if _, ok := m[f.Filename]; !ok {
+			names = append(names, f.Filename)
+		}
+		m[f.Filename] = f
+	}
+	sort.Strings(names)
+	return m, names
+}
+
+func writeFileDiffs(w *os.File, fa, fb *Disk) {
+
+	ma, namesA := diffFileMap(fa.Files)
+	mb, namesB := diffFileMap(fb.Files)
+
+	var onlyA, onlyB, changed []string
+	var same int
+	for _, name := range namesA {
+		f2, ok := mb[name]
+		switch {
+		case !ok:
+			onlyA = append(onlyA, name)
+		case ma[name].matchSHA256() != f2.matchSHA256() || ma[name].Ext != f2.Ext:
+			changed = append(changed, name)
+		default:
+			same++
+		}
+	}
+	for _, name := range namesB {
+		if _, ok := ma[name]; !ok {
+			onlyB = append(onlyB, name)
+		}
+	}
+
+	w.WriteString(fmt.Sprintf("FILES ONLY IN %s (%d)\n\n", fa.Filename, len(onlyA)))
+	for _, name := range onlyA {
+		w.WriteString(fmt.Sprintf("\t -- %s\n", name))
+	}
+	if len(onlyA) > 0 {
+		w.WriteString("\n")
+	}
+
+	w.WriteString(fmt.Sprintf("FILES ONLY IN %s (%d)\n\n", fb.Filename, len(onlyB)))
+	for _, name := range onlyB {
+		w.WriteString(fmt.Sprintf("\t ++ %s\n", name))
+	}
+	if len(onlyB) > 0 {
+		w.WriteString("\n")
+	}
+
+	w.WriteString(fmt.Sprintf("CHANGED FILES (%d, %d the same)\n\n", len(changed), same))
+	for _, name := range changed {
+		writeFileDiff(w, fa.Filename, fb.Filename, ma[name], mb[name])
+	}
+}
+
+func writeFileDiff(w *os.File, diskA, diskB string, f1, f2 *DiskFile) {
+
+	w.WriteString(fmt.Sprintf("\t ~~ %s (%s, %d bytes -> %s, %d bytes)\n\n", f1.Filename, f1.Ext, len(f1.Data), f2.Ext, len(f2.Data)))
+
+	labelA := diskA + ":" + f1.Filename
+	labelB := diskB + ":" + f2.Filename
+
+	if len(f1.Text) > 0 && len(f2.Text) > 0 {
+		edits := disk.DiffLines(diffTextLines(f1.Text), diffTextLines(f2.Text))
+		if writeUnifiedDiff(w, labelA, labelB, edits) {
+			w.WriteString("\n")
+			return
+		}
+		w.WriteString("\tListings are the same, data differs\n\n")
+	}
+
+	writeHexDiff(w, labelA, labelB, f1.Data, f2.Data)
+	w.WriteString("\n")
+}
+
+// diffTextLines splits a listing or text file on CR, LF or CR LF
+func diffTextLines(text []byte) []string {
+	s := strings.Replace(string(text), "\r\n", "\n", -1)
+	s = strings.Replace(s, "\r", "\n", -1)
+	s = strings.TrimRight(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// writeUnifiedDiff writes edits as hunks with diffContext lines around each
+// change, returning false if there are no changes
+func writeUnifiedDiff(w *os.File, labelA, labelB string, edits []disk.LineEdit) bool {
+
+	// line numbers in each text before each edit
+	lineA := make([]int, len(edits)+1)
+	lineB := make([]int, len(edits)+1)
+	for i, e := range edits {
+		lineA[i+1], lineB[i+1] = lineA[i], lineB[i]
+		if e.Op != '+' {
+			lineA[i+1]++
+		}
+		if e.Op != '-' {
+			lineB[i+1]++
+		}
+	}
+
+	header := false
+	for i := 0; i < len(edits); {
+
+		if edits[i].Op == ' ' {
+			i++
+			continue
+		}
+
+		// take in changes until the gap between them is too long to join
+		last := i
+		for j := i + 1; j < len(edits); j++ {
+			if edits[j].Op != ' ' {
+				if j-last-1 > 2*diffContext {
+					break
+				}
+				last = j
+			}
+		}
+
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		stop := last + 1 + diffContext
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+
+		if !header {
+			w.WriteString(fmt.Sprintf("\t--- %s\n\t+++ %s\n", labelA, labelB))
+			header = true
+		}
+
+		countA, countB := lineA[stop]-lineA[start], lineB[stop]-lineB[start]
+		fromA, fromB := lineA[start]+1, lineB[start]+1
+		if countA == 0 {
+			fromA--
+		}
+		if countB == 0 {
+			fromB--
+		}
+		w.WriteString(fmt.Sprintf("\t@@ -%d,%d +%d,%d @@\n", fromA, countA, fromB, countB))
+		for _, e := range edits[start:stop] {
+			w.WriteString(fmt.Sprintf("\t%c%s\n", e.Op, e.Text))
+		}
+
+		i = stop
+	}
+
+	return header
+}
+
+func hexRow(data []byte, off int) []byte {
+	if off >= len(data) {
+		return nil
+	}
+	end := off + 16
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[off:end]
+}
+
+// writeHexDiff writes the rows of 16 bytes that differ, by offset
+func writeHexDiff(w *os.File, labelA, labelB string, a, b []byte) {
+
+	l := len(a)
+	if len(b) > l {
+		l = len(b)
+	}
+
+	var bytesDiffer, rows int
+	for i := 0; i < l; i++ {
+		if i >= len(a) || i >= len(b) || a[i] != b[i] {
+			bytesDiffer++
+		}
+	}
+
+	w.WriteString(fmt.Sprintf("\t--- %s\n\t+++ %s\n", labelA, labelB))
+	w.WriteString(fmt.Sprintf("\t%d of %d bytes differ\n", bytesDiffer, l))
+
+	for off := 0; off < l; off += 16 {
+		ra, rb := hexRow(a, off), hexRow(b, off)
+		if bytes.Equal(ra, rb) {
+			continue
+		}
+		rows++
+		if rows > diffMaxHexRows {
+			continue
+		}
+		if len(ra) > 0 {
+			w.WriteString(fmt.Sprintf("\t-%.4x: % x\n", off, ra))
+		}
+		if len(rb) > 0 {
+			w.WriteString(fmt.Sprintf("\t+%.4x: % x\n", off, rb))
+		}
+	}
+
+	if rows > diffMaxHexRows {
+		w.WriteString(fmt.Sprintf("\t... %d more rows differ\n", rows-diffMaxHexRows))
+	}
+}
+
+func unitKind(spt int) string {
+	if spt == 0 {
+		return "blocks"
+	}
+	return fmt.Sprintf("%d sector tracks", spt)
+}
+
+// writeSectorMap writes a map of the sectors (or blocks) of two disks:
+// . same, * changed, - only on the first, + only on the second
+func writeSectorMap(w *os.File, nameA, nameB string, a, b *disk.DSKWrapper) {
+
+	ua, sptA := a.LogicalUnits()
+	ub, sptB := b.LogicalUnits()
+
+	unit := "SECTOR"
+	if sptA == 0 {
+		unit = "BLOCK"
+	}
+
+	w.WriteString(unit + " MAP\n\n")
+
+	if sptA != sptB {
+		w.WriteString(fmt.Sprintf("Not compared: %s has %s, %s has %s\n\n", nameA, unitKind(sptA), nameB, unitKind(sptB)))
+		return
+	}
+
+	n := len(ua)
+	if len(ub) > n {
+		n = len(ub)
+	}
+
+	var differ int
+	cell := func(i int) byte {
+		switch {
+		case i >= len(ua):
+			differ++
+			return '+'
+		case i >= len(ub):
+			differ++
+			return '-'
+		case !bytes.Equal(ua[i], ub[i]):
+			differ++
+			return '*'
+		}
+		return '.'
+	}
+
+	w.WriteString(fmt.Sprintf(". same, * changed, - only in %s, + only in %s\n\n", nameA, nameB))
+
+	perRow := sptA
+	if perRow == 0 {
+		perRow = 32
+	} else {
+		head := make([]byte, perRow)
+		for s := range head {
+			head[s] = "0123456789ABCDEFGHIJKLMNOPQRSTUV"[s%32]
+		}
+		w.WriteString(fmt.Sprintf("     %s\n", head))
+	}
+
+	for row := 0; row*perRow < n; row++ {
+		line := make([]byte, 0, perRow)
+		for i := row * perRow; i < (row+1)*perRow && i < n; i++ {
+			line = append(line, cell(i))
+		}
+		if sptA == 0 {
+			w.WriteString(fmt.Sprintf("%4d %s\n", row*perRow, line))
+		} else {
+			w.WriteString(fmt.Sprintf("T%.2d  %s\n", row, line))
+		}
+	}
+
+	w.WriteString(fmt.Sprintf("\n%d of %d %ss differ\n", differ, n, strings.ToLower(unit)))
+}
+
+// slotVolume returns the disk mounted in a shell slot given as an argument
+func slotVolume(arg string) (*disk.DSKWrapper, string, bool) {
+
+	tmp, err := strconv.ParseInt(arg, 10, 32)
+	if err != nil {
+		os.Stderr.WriteString("Invalid slot number: " + arg + "\n")
+		return nil, "", false
+	}
+
+	slotid := int(tmp)
+	if slotid < 0 || slotid >= MAXVOL {
+		os.Stderr.WriteString(fmt.Sprintf("Valid slots are %d to %d.\n", 0, MAXVOL-1))
+		return nil, "", false
+	}
+
+	d := commandVolumes[slotid]
+	if d == nil {
+		os.Stderr.WriteString(fmt.Sprintf("Nothing mounted in slot %d (use disks to see mounts)\n", slotid))
+		return nil, "", false
+	}
+
+	fullpath, _ := filepath.Abs(d.Filename)
+
+	return d, fullpath, true
+}
+
+func shellDiff(args []string) int {
+
+	a, pathA, ok := slotVolume(args[0])
+	if !ok {
+		return -1
+	}
+	b, pathB, ok := slotVolume(args[1])
+	if !ok {
+		return -1
+	}
+
+	return diffReport(pathA, pathB, a, b)
+}
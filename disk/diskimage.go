@@ -1,11 +1,9 @@
 package disk
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
-	"io"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -321,6 +319,7 @@ type DSKWrapper struct {
 	WriteProtected     bool
 	NibblesChanged     bool
 	DOSVolumeID        int
+	SourceFormat       string // "nib" or "woz" when decoded from a nibble image
 }
 
 // SectoreMapperDOS33 handles the interleaving for dos sectors
@@ -335,43 +334,6 @@ func SectorMapperDOS33(wanted int) int {
 
 	// 0x00, 0x07, 0x0E, 0x06, 0x0D, 0x05, 0x0C, 0x04,
 	// 0x0B, 0x03, 0x0A, 0x02, 0x09, 0x01, 0x08, 0x0F,
-
-	switch wanted {
-	case 0x00:
-		return 0x00
-	case 0x07:
-		return 0x01
-	case 0x0e:
-		return 0x02
-	case 0x06:
-		return 0x03
-	case 0x0d:
-		return 0x04
-	case 0x05:
-		return 0x05
-	case 0x0c:
-		return 0x06
-	case 0x04:
-		return 0x07
-	case 0x0b:
-		return 0x08
-	case 0x03:
-		return 0x09
-	case 0x0a:
-		return 0x0a
-	case 0x02:
-		return 0x0b
-	case 0x09:
-		return 0x0c
-	case 0x01:
-		return 0x0d
-	case 0x08:
-		return 0x0e
-	case 0x0f:
-		return 0x0f
-	}
-
-	return -1 // invalid sector
 }
 
 func SectorMapperDOS33Alt(wanted int) int {
@@ -417,43 +379,6 @@ func SectorMapperDOS33Alt(wanted int) int {
 func SectorMapperDOS33bad(wanted int) int {
 
 	return wanted
-
-	switch wanted {
-	case 0:
-		return 0
-	case 1:
-		return 13
-	case 2:
-		return 11
-	case 3:
-		return 9
-	case 4:
-		return 7
-	case 5:
-		return 5
-	case 6:
-		return 3
-	case 7:
-		return 1
-	case 8:
-		return 14
-	case 9:
-		return 12
-	case 10:
-		return 10
-	case 11:
-		return 8
-	case 12:
-		return 6
-	case 13:
-		return 4
-	case 14:
-		return 2
-	case 15:
-		return 15
-	}
-
-	return -1 // invalid sector
 }
 
 // SectoreMapperProDOS handles the interleaving for dos sectors
@@ -677,6 +602,20 @@ func NewDSKWrapper(nibbler Nibbler, filename string) (*DSKWrapper, error) {
 
 func NewDSKWrapperBin(nibbler Nibbler, data []byte, filename string) (*DSKWrapper, error) {
 
+	// nibble images are decoded to sectors when they hold standard tracks
+	source := ""
+	if IsWOZ(data) {
+		sectors, _, err := DeWOZ(data)
+		if err != nil {
+			return nil, err
+		}
+		data, source = sectors, SniffKindWOZ
+	} else if len(data) == DISK_NIBBLE_LENGTH {
+		if sectors, _, err := Denibblize(data); err == nil {
+			data, source = sectors, SniffKindNIB
+		}
+	}
+
 	if len(data) != 232960 &&
 		len(data) != STD_DISK_BYTES &&
 		len(data) != STD_DISK_BYTES_OLD &&
@@ -697,6 +636,7 @@ func NewDSKWrapperBin(nibbler Nibbler, data []byte, filename string) (*DSKWrappe
 	this.CurrentSectorOrder = DOS_33_SECTOR_ORDER
 	this.Nibbles = nibbler
 	this.WriteProtected = false
+	this.SourceFormat = source
 
 	this.Identify()
 
@@ -751,6 +691,11 @@ func (dsk *DSKWrapper) Identify() {
 		dsk.SetData(zdsk.Data)
 		dsk.Layout = Layout
 		dsk.Format = Format
+		dsk.CurrentSectorOrder = zdsk.CurrentSectorOrder
+		dsk.DOSVolumeID = zdsk.DOSVolumeID
+		if Layout == SectorOrderProDOSLinear {
+			dsk.CurrentSectorOrder = PRODOS_SECTOR_ORDER
+		}
 		return
 	}
 
@@ -829,6 +774,9 @@ func (dsk *DSKWrapper) Identify() {
 		case SectorOrderDiversiDOS:
 			dsk.CurrentSectorOrder = DIVERSE_SECTOR_ORDER
 		}
+		if vtoc, e := dsk.AppleDOSGetVTOC(); e == nil {
+			dsk.DOSVolumeID = int(vtoc.GetVolumeID())
+		}
 		dsk.SetNibbles(dsk.Nibblize())
 		return
 	}
@@ -857,6 +805,7 @@ func (dsk *DSKWrapper) Identify() {
 	if e == nil && vtoc.GetTracks() == 35 {
 		t := vtoc.GetTracks()
 		s := vtoc.GetSectors()
+		dsk.DOSVolumeID = int(vtoc.GetVolumeID())
 
 		if t == 35 && s == 16 {
 			dsk.Layout = SectorOrderDOS33
@@ -1025,33 +974,12 @@ func PokeToAscii(v uint, usealt bool) int {
 
 func (d *DSKWrapper) Nibblize() []byte {
 
-	if len(d.Data) != STD_DISK_BYTES {
-		return make([]byte, 232960)
+	nibbles, err := d.NibblizeWithOptions(d.NibbleOptions())
+	if err != nil {
+		return make([]byte, DISK_NIBBLE_LENGTH)
 	}
 
-	data := d.Data
-
-	output := bytes.NewBuffer([]byte(nil))
-
-	for track := 0; track < STD_TRACKS_PER_DISK; track++ {
-		//d.writeJunkBytes(output, 48);
-		for sector := 0; sector < STD_SECTORS_PER_TRACK; sector++ {
-			//gap2 := int((rand.Float32() * 5.0) + 4)
-			gap2 := 6
-			// 15 junk bytes
-			d.writeJunkBytes(output, 15)
-			// Address block
-			d.writeAddressBlock(output, track, sector, 254)
-			// 4 junk bytes
-			d.writeJunkBytes(output, gap2)
-			// Data block
-			d.nibblizeBlock(output, track, d.CurrentSectorOrder[sector], data)
-			// 34 junk bytes
-			d.writeJunkBytes(output, 38-gap2)
-		}
-	}
-
-	return output.Bytes()
+	return nibbles
 
 }
 
@@ -1063,75 +991,6 @@ func (d *DSKWrapper) NibbleOffsetToTS(offset int) (int, int) {
 	return track, sector
 }
 
-func (d *DSKWrapper) nibblizeBlock(output io.Writer, track, sector int, nibbles []byte) {
-
-	//log.Printf("NibblizeBlock(%d, %d)", track, sector)
-
-	offset := ((track * SECTOR_COUNT) + sector) * 256
-	temp := make([]int, 342)
-	for i := 0; i < 256; i++ {
-		temp[i] = int((nibbles[offset+i] & 0x0ff) >> 2)
-	}
-	hi := 0x001
-	med := 0x0AB
-	low := 0x055
-
-	for i := 0; i < 0x56; i++ {
-		value := ((nibbles[offset+hi] & 1) << 5) |
-			((nibbles[offset+hi] & 2) << 3) |
-			((nibbles[offset+med] & 1) << 3) |
-			((nibbles[offset+med] & 2) << 1) |
-			((nibbles[offset+low] & 1) << 1) |
-			((nibbles[offset+low] & 2) >> 1)
-		temp[i+256] = int(value)
-		hi = (hi - 1) & 0x0ff
-		med = (med - 1) & 0x0ff
-		low = (low - 1) & 0x0ff
-	}
-	output.Write([]byte{0x0d5, 0x0aa, 0x0ad})
-
-	last := 0
-	for i := len(temp) - 1; i > 255; i-- {
-		value := temp[i] ^ last
-		output.Write([]byte{NIBBLE_62[value]})
-		last = temp[i]
-	}
-	for i := 0; i < 256; i++ {
-		value := temp[i] ^ last
-		output.Write([]byte{NIBBLE_62[value]})
-		last = temp[i]
-	}
-	// Last data byte used as checksum
-	output.Write([]byte{NIBBLE_62[last]})
-	output.Write([]byte{0x0de, 0x0aa, 0x0eb})
-
-}
-
-func (d *DSKWrapper) writeJunkBytes(output io.Writer, i int) {
-	for c := 0; c < i; c++ {
-		output.Write([]byte{0xff})
-	}
-}
-
-func (d *DSKWrapper) writeAddressBlock(output io.Writer, track, sector int, volumeNumber int) {
-	output.Write([]byte{0x0d5, 0x0aa, 0x096})
-
-	var checksum int = 0x00
-	// volume
-	checksum ^= volumeNumber
-	output.Write(d.getOddEven(volumeNumber))
-	// track
-	checksum ^= track
-	output.Write(d.getOddEven(track))
-	// sector
-	checksum ^= sector
-	output.Write(d.getOddEven(sector))
-	// checksum
-	output.Write(d.getOddEven(checksum & 0x0ff))
-
-	output.Write([]byte{0xde, 0xaa, 0xeb})
-}
-
 func (d *DSKWrapper) getOddEven(i int) []byte {
 	out := []byte{0, 0}
 	out[0] = byte(0xAA | (i >> 1))
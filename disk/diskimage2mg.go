@@ -84,6 +84,15 @@ func (dsk *DSKWrapper) Is2MG() (bool, DiskFormat, SectorOrder, *DSKWrapper) {
 
 	data := dsk.Data[start : start+size]
 	format := h.GetImageFormat()
+
+	// a 140Kb image may hold any filesystem, in either order, so it is
+	// identified from its contents the same as a .dsk or .po would be
+	if size == STD_DISK_BYTES && (format == 0x00 || format == 0x01) {
+		zdsk, err := NewDSKWrapperBin(dsk.Nibbles, data, dsk.Filename)
+		if err == nil {
+			return true, zdsk.Format, zdsk.Layout, zdsk
+		}
+	}
 	switch format {
 	case 0x00: /* DOS sector order */
 		zdsk, _ := NewDSKWrapperBin(dsk.Nibbles, data, dsk.Filename)
@@ -0,0 +1,322 @@
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	Boot and OS fingerprinting...
+
+	Signatures are matched against three regions of a disk:
+
+	  boot     the boot sector (track 0, sector 0)
+	  dos      the DOS image on tracks 0-2, in DOS sector order, with the
+	           greeting program name blanked
+	  prodos   the contents of the PRODOS file in the volume directory
+
+	and can be extended from a plain text file, one signature per line:
+
+	  # kind   match                  name
+	  boot     prefix:01a527c909d018  DOS 3.3 boot sector
+	  dos      text:DIVERSI-DOS       DiversiDOS
+	  prodos   sha256:<hex>           ProDOS 8 V2.4.2
+
+	Match can be sha256:<hex> (whole region), prefix:<hex>, bytes:<offset>:<hex>
+	or text:<string> (case insensitive, high bit ignored, no spaces).  The
+	first matching signature wins and user signatures are tried before the
+	built in ones.
+*/
+
+const (
+	BootSigBoot   = "boot"
+	BootSigDOS    = "dos"
+	BootSigProDOS = "prodos"
+)
+
+const DOS_IMAGE_TRACKS = 3
+const DOS_GREETING_TRACK = 1
+const DOS_GREETING_SECTOR = 9
+const DOS_GREETING_SECTOR_OFFSET = 0x75
+const DOS_GREETING_LENGTH = 30
+
+type BootSignature struct {
+	Kind    string
+	Match   string
+	Name    string
+	sha256  string
+	offset  int
+	pattern []byte
+	text    string
+}
+
+var builtinBootSignatures = []string{
+	"boot    prefix:01a527c909d018a52b4a4a4a4a09c0853fa95c853e18adfe086dff088dfe08ae  DOS 3.3 boot sector",
+	"boot    prefix:99b900080a0a0a990008c8d0f4a62ba9098527adcc03854184408a4a4a4a4a09  DOS 3.2 boot sector",
+	"boot    prefix:0138b0034c32a18643c903088a29704a4a4a4a09c08549a0ff844828c8b148d0  ProDOS boot block",
+	"dos     text:DIVERSI-DOS   DiversiDOS",
+	"dos     text:PRONTO-DOS    ProntoDOS",
+	"dos     text:DAVID-DOS     David-DOS",
+	"dos     text:BEAGLE        Beagle Bros DOS",
+}
+
+var BootSignatures []*BootSignature
+
+func init() {
+	for i, line := range builtinBootSignatures {
+		sig, err := ParseBootSignature(line)
+		if err != nil {
+			panic(fmt.Sprintf("builtin boot signature %d: %v", i, err))
+		}
+		BootSignatures = append(BootSignatures, sig)
+	}
+}
+
+// ParseBootSignature parses a single "kind match name" signature line
+func ParseBootSignature(line string) (*BootSignature, error) {
+
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return nil, errors.New("Expected <kind> <match> <name>")
+	}
+
+	sig := &BootSignature{
+		Kind:  strings.ToLower(fields[0]),
+		Match: fields[1],
+		Name:  strings.Join(fields[2:], " "),
+	}
+
+	switch sig.Kind {
+	case BootSigBoot, BootSigDOS, BootSigProDOS:
+	default:
+		return nil, errors.New("Unknown signature kind: " + sig.Kind)
+	}
+
+	parts := strings.SplitN(sig.Match, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.New("Bad match: " + sig.Match)
+	}
+
+	var err error
+	switch strings.ToLower(parts[0]) {
+	case "sha256":
+		sig.sha256 = strings.ToLower(parts[1])
+	case "prefix":
+		sig.pattern, err = hex.DecodeString(parts[1])
+	case "bytes":
+		bp := strings.SplitN(parts[1], ":", 2)
+		if len(bp) != 2 {
+			return nil, errors.New("Expected bytes:<offset>:<hex>")
+		}
+		var offset int64
+		offset, err = strconv.ParseInt(bp[0], 0, 32)
+		if err == nil {
+			sig.offset = int(offset)
+			sig.pattern, err = hex.DecodeString(bp[1])
+		}
+	case "text":
+		sig.text = strings.ToUpper(parts[1])
+	default:
+		return nil, errors.New("Unknown match type: " + parts[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return sig, nil
+}
+
+// LoadBootSignatures reads user signatures from a file, ahead of the built
+// in ones.  A missing file is not an error.
+func LoadBootSignatures(filename string) error {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	user := make([]*BootSignature, 0)
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sig, err := ParseBootSignature(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		user = append(user, sig)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	BootSignatures = append(user, BootSignatures...)
+
+	return nil
+}
+
+// Matches tests a region of disk against the signature
+func (sig *BootSignature) Matches(data []byte, sum string) bool {
+	switch {
+	case sig.sha256 != "":
+		return sig.sha256 == sum
+	case sig.text != "":
+		return bytes.Contains(bytes.ToUpper(stripHighBit(data)), []byte(sig.text))
+	case sig.pattern != nil:
+		if sig.offset < 0 || sig.offset+len(sig.pattern) > len(data) {
+			return false
+		}
+		return bytes.Equal(data[sig.offset:sig.offset+len(sig.pattern)], sig.pattern)
+	}
+	return false
+}
+
+func matchBootSignature(kind string, data []byte) (string, string) {
+	sum := Checksum(data)
+	for _, sig := range BootSignatures {
+		if sig.Kind == kind && sig.Matches(data, sum) {
+			return sig.Name, sum
+		}
+	}
+	return "", sum
+}
+
+func stripHighBit(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, v := range data {
+		out[i] = v & 0x7f
+	}
+	return out
+}
+
+func isBlank(data []byte) bool {
+	for _, v := range data {
+		if v != data[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// BootFingerprint describes how (and whether) a disk boots
+type BootFingerprint struct {
+	BootSHA256     string // Sha of the boot sector
+	BootCode       string // Name of the matching boot signature
+	DOSImage       string // DOS variant found on tracks 0-2
+	DOSImageSHA256 string
+	ProDOSVersion  string // Kernel version from the PRODOS file
+	Bootable       bool
+}
+
+var prodosVersionRegex = regexp.MustCompile(`PRODOS\s+(8\s+)?V?[0-9]+\.[0-9]+(\.[0-9]+)?`)
+
+// AppleDOSReadDOSImage returns tracks 0-2 in DOS sector order
+func (dsk *DSKWrapper) AppleDOSReadDOSImage() ([]byte, error) {
+
+	if !dsk.Format.IsOneOf(DF_DOS_SECTORS_13, DF_DOS_SECTORS_16) {
+		return nil, errors.New("Not a DOS disk")
+	}
+
+	image := make([]byte, 0, DOS_IMAGE_TRACKS*dsk.Format.SPT()*STD_BYTES_PER_SECTOR)
+	for t := 0; t < DOS_IMAGE_TRACKS; t++ {
+		for s := 0; s < dsk.Format.SPT(); s++ {
+			if err := dsk.Seek(t, s); err != nil {
+				return nil, err
+			}
+			image = append(image, dsk.Read()...)
+		}
+	}
+
+	return image, nil
+}
+
+// DOSImage returns tracks 0-2 in DOS sector order with the greeting
+// program name blanked, so disks differing only by greeting still match.
+func (dsk *DSKWrapper) DOSImage() ([]byte, error) {
+
+	image, err := dsk.AppleDOSReadDOSImage()
+	if err != nil {
+		return nil, err
+	}
+
+	if dsk.Format.ID == DF_DOS_SECTORS_16 {
+		SetDOSImageGreeting(image, "")
+	}
+
+	return image, nil
+}
+
+// BootFingerprint identifies the boot code, DOS image and ProDOS kernel
+// on the disk.
+func (dsk *DSKWrapper) BootFingerprint() BootFingerprint {
+
+	var bf BootFingerprint
+
+	if len(dsk.Data) < STD_BYTES_PER_SECTOR {
+		return bf
+	}
+
+	// track 0, sector 0 is at the start of the image in every order
+	boot := dsk.Data[:STD_BYTES_PER_SECTOR]
+	bf.BootCode, bf.BootSHA256 = matchBootSignature(BootSigBoot, boot)
+	bf.Bootable = !isBlank(boot) && boot[0] != 0x00
+
+	switch {
+	case dsk.Format.IsOneOf(DF_DOS_SECTORS_13, DF_DOS_SECTORS_16):
+
+		image, err := dsk.DOSImage()
+		if err == nil && !isBlank(image) {
+			bf.DOSImage, bf.DOSImageSHA256 = matchBootSignature(BootSigDOS, image)
+			if bf.DOSImage == "" && bytes.Contains(stripHighBit(image), []byte("DISK FULL")) {
+				bf.DOSImage = "Apple DOS 3.x compatible"
+			}
+		}
+
+	case dsk.Format.IsOneOf(DF_PRODOS, DF_PRODOS_800KB, DF_PRODOS_400KB, DF_PRODOS_CUSTOM):
+
+		// ProDOS block 0 loader is useless without the kernel
+		bf.Bootable = false
+		_, files, err := dsk.PRODOSGetCatalog(2, "*")
+		if err != nil {
+			break
+		}
+		var data []byte
+		for _, fd := range files {
+			if fd.NameUnadorned() == "PRODOS" && fd.Type() == FileType_PD_SYS {
+				_, _, data, _ = dsk.PRODOSReadFileRaw(fd)
+				break
+			}
+		}
+		if len(data) == 0 {
+			break
+		}
+		bf.Bootable = true
+		name, _ := matchBootSignature(BootSigProDOS, data)
+		if name == "" {
+			name = prodosVersionRegex.FindString(string(bytes.ToUpper(stripHighBit(data))))
+		}
+		if name == "" {
+			name = "Unknown ProDOS kernel"
+		}
+		bf.ProDOSVersion = name
+
+	}
+
+	return bf
+}
@@ -0,0 +1,56 @@
+package disk
+
+import "testing"
+
+func TestParseBootSignature(t *testing.T) {
+
+	for _, line := range []string{
+		"boot sha256:abcd Some boot",
+		"dos bytes:0x100:a9ff DOS variant",
+		"prodos text:V2.4 ProDOS 8 V2.4",
+	} {
+		if _, err := ParseBootSignature(line); err != nil {
+			t.Fatalf("Failed to parse %q: %v", line, err)
+		}
+	}
+
+	for _, line := range []string{
+		"boot sha256:abcd",
+		"pascal text:X Pascal",
+		"dos prefix:zz Bad hex",
+		"dos magic:00 Bad match",
+	} {
+		if _, err := ParseBootSignature(line); err == nil {
+			t.Fatalf("Expected error parsing %q", line)
+		}
+	}
+
+}
+
+func TestBootFingerprintDOS(t *testing.T) {
+
+	dsk := &DSKWrapper{
+		Data:   make([]byte, STD_DISK_BYTES),
+		Format: GetDiskFormat(DF_DOS_SECTORS_16),
+		Layout: SectorOrderDOS33,
+	}
+
+	dsk.Data[0] = 0x01
+	dsk.Data[1] = 0xa5
+	copy(dsk.Data[0x400:], []byte("DIVERSI-DOS 2-C"))
+
+	bf := dsk.BootFingerprint()
+	if !bf.Bootable {
+		t.Fatalf("Expected disk to be bootable")
+	}
+	if bf.DOSImage != "DiversiDOS" {
+		t.Fatalf("Expected DiversiDOS, got %q", bf.DOSImage)
+	}
+
+	// greeting name must not affect the DOS image hash
+	copy(dsk.Data[(STD_SECTORS_PER_TRACK+9)*STD_BYTES_PER_SECTOR+DOS_GREETING_SECTOR_OFFSET:], []byte("STARTUP"))
+	if dsk.BootFingerprint().DOSImageSHA256 != bf.DOSImageSHA256 {
+		t.Fatalf("Greeting name changed the DOS image hash")
+	}
+
+}
@@ -0,0 +1,606 @@
+package disk
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+	Identification scoring...
+
+	Identify() stops at the first filesystem that looks plausible, which is
+	fast but gives no hint as to *why* an image was read a particular way.
+	IdentifyCandidates() instead tries every filesystem and sector order
+	that makes sense for the image size and scores each one on catalog
+	sanity, bitmap consistency and boot code, keeping the reasons so they
+	can be shown to the user.
+*/
+
+const (
+	IdentifyFSDOS    = "dos"
+	IdentifyFSProDOS = "prodos"
+	IdentifyFSPascal = "pascal"
+	IdentifyFSRDOS   = "rdos"
+)
+
+const (
+	IdentifyOrderDOS    = "do"
+	IdentifyOrderProDOS = "po"
+)
+
+var IdentifyFilesystems = []string{IdentifyFSDOS, IdentifyFSProDOS, IdentifyFSPascal, IdentifyFSRDOS}
+var IdentifyOrders = []string{IdentifyOrderDOS, IdentifyOrderProDOS}
+
+// IdentifyCandidate is one possible interpretation of a disk image
+type IdentifyCandidate struct {
+	FS      string
+	Order   string
+	Format  DiskFormat
+	Layout  SectorOrder
+	Score   int
+	Reasons []string
+}
+
+func (c *IdentifyCandidate) add(points int, format string, args ...interface{}) {
+	c.Score += points
+	c.Reasons = append(c.Reasons, fmt.Sprintf("%+4d  ", points)+fmt.Sprintf(format, args...))
+}
+
+func (c *IdentifyCandidate) String() string {
+	return fmt.Sprintf("%s (%s order)", c.Format.String(), strings.ToUpper(c.Order))
+}
+
+type identifyState struct {
+	format DiskFormat
+	layout SectorOrder
+	order  []int
+	volume int
+	rdos   RDOSFormat
+}
+
+func (dsk *DSKWrapper) saveIdentifyState() identifyState {
+	return identifyState{
+		format: dsk.Format,
+		layout: dsk.Layout,
+		order:  dsk.CurrentSectorOrder,
+		volume: dsk.DOSVolumeID,
+		rdos:   dsk.RDOSFormat,
+	}
+}
+
+func (dsk *DSKWrapper) restoreIdentifyState(s identifyState) {
+	dsk.Format = s.format
+	dsk.Layout = s.layout
+	dsk.CurrentSectorOrder = s.order
+	dsk.DOSVolumeID = s.volume
+	dsk.RDOSFormat = s.rdos
+}
+
+// applyInterpretation sets format, layout and sector order for a filesystem
+// and physical sector order, without touching the nibble buffer.
+func (dsk *DSKWrapper) applyInterpretation(fs, order string) error {
+
+	switch order {
+	case IdentifyOrderDOS, IdentifyOrderProDOS:
+	default:
+		return errors.New("Unknown sector order: " + order + " (expected do or po)")
+	}
+
+	switch len(dsk.Data) {
+	case STD_DISK_BYTES_OLD:
+		if order != IdentifyOrderDOS {
+			return errors.New("13 sector images are only stored in DOS order")
+		}
+	case PRODOS_800KB_DISK_BYTES:
+		if fs != IdentifyFSProDOS {
+			return errors.New("800Kb images can only be read as ProDOS")
+		}
+	case STD_DISK_BYTES:
+	default:
+		return errors.New("Cannot override format for an image of this size")
+	}
+
+	switch fs {
+	case IdentifyFSDOS:
+		if len(dsk.Data) == STD_DISK_BYTES_OLD {
+			dsk.Format = GetDiskFormat(DF_DOS_SECTORS_13)
+			dsk.Layout = SectorOrderDOS32
+			dsk.CurrentSectorOrder = DOS_32_SECTOR_ORDER
+			return nil
+		}
+		dsk.Format = GetDiskFormat(DF_DOS_SECTORS_16)
+		if order == IdentifyOrderProDOS {
+			// DOS logical sectors land in ProDOS block order
+			dsk.Layout = SectorOrderDiversiDOS
+			dsk.CurrentSectorOrder = PRODOS_SECTOR_ORDER
+		} else {
+			dsk.Layout = SectorOrderDOS33
+			dsk.CurrentSectorOrder = DOS_33_SECTOR_ORDER
+		}
+	case IdentifyFSProDOS, IdentifyFSPascal:
+		if len(dsk.Data) == STD_DISK_BYTES_OLD {
+			return errors.New("13 sector images cannot hold a " + fs + " volume")
+		}
+		switch {
+		case len(dsk.Data) == PRODOS_800KB_DISK_BYTES:
+			dsk.Format = GetDiskFormat(DF_PRODOS_800KB)
+		case fs == IdentifyFSPascal:
+			dsk.Format = GetDiskFormat(DF_PASCAL)
+		default:
+			dsk.Format = GetDiskFormat(DF_PRODOS)
+		}
+		if order == IdentifyOrderProDOS {
+			dsk.Layout = SectorOrderProDOSLinear
+			dsk.CurrentSectorOrder = PRODOS_SECTOR_ORDER
+		} else {
+			dsk.Layout = SectorOrderDOS33
+			dsk.CurrentSectorOrder = DOS_33_SECTOR_ORDER
+		}
+	case IdentifyFSRDOS:
+		isRDOS, version := dsk.IsRDOS()
+		if !isRDOS {
+			return errors.New("No RDOS signature found on track 0")
+		}
+		dsk.RDOSFormat = version
+		switch version {
+		case RDOS_3:
+			dsk.Format = GetDiskFormat(DF_RDOS_3)
+			dsk.Layout = SectorOrderDOS33Alt
+			dsk.CurrentSectorOrder = DOS_33_SECTOR_ORDER
+		case RDOS_32:
+			dsk.Format = GetDiskFormat(DF_RDOS_32)
+			dsk.Layout = SectorOrderDOS33Alt
+			dsk.CurrentSectorOrder = DOS_33_SECTOR_ORDER
+		case RDOS_33:
+			dsk.Format = GetDiskFormat(DF_RDOS_33)
+			dsk.Layout = SectorOrderProDOS
+			dsk.CurrentSectorOrder = PRODOS_SECTOR_ORDER
+		}
+	default:
+		return errors.New("Unknown filesystem: " + fs + " (expected " + strings.Join(IdentifyFilesystems, ", ") + ")")
+	}
+
+	return nil
+}
+
+// Interpretation returns the filesystem and sector order the image is
+// currently being read as, in the terms used by ForceInterpretation.
+func (dsk *DSKWrapper) Interpretation() (string, string) {
+
+	fs := ""
+	switch dsk.Format.ID {
+	case DF_DOS_SECTORS_13, DF_DOS_SECTORS_16:
+		fs = IdentifyFSDOS
+	case DF_PRODOS, DF_PRODOS_400KB, DF_PRODOS_800KB, DF_PRODOS_CUSTOM:
+		fs = IdentifyFSProDOS
+	case DF_PASCAL:
+		fs = IdentifyFSPascal
+	case DF_RDOS_3, DF_RDOS_32, DF_RDOS_33:
+		fs = IdentifyFSRDOS
+	}
+
+	order := IdentifyOrderDOS
+	switch dsk.Layout {
+	case SectorOrderProDOS, SectorOrderProDOSLinear, SectorOrderDiversiDOS:
+		order = IdentifyOrderProDOS
+	}
+
+	return fs, order
+}
+
+// ForceInterpretation overrides Identify(), reading the image as the given
+// filesystem (dos, prodos, pascal, rdos) stored in the given sector order
+// (do or po).  Either may be empty to keep the detected value.
+func (dsk *DSKWrapper) ForceInterpretation(fs, order string) error {
+
+	saved := dsk.saveIdentifyState()
+
+	curFS, curOrder := dsk.Interpretation()
+	if fs == "" {
+		fs = curFS
+	}
+	if order == "" {
+		order = curOrder
+	}
+	if fs == "" {
+		return errors.New("Disk format not recognized, a filesystem must be given")
+	}
+
+	if err := dsk.applyInterpretation(strings.ToLower(fs), strings.ToLower(order)); err != nil {
+		dsk.restoreIdentifyState(saved)
+		return err
+	}
+
+	if dsk.Format.ID == DF_DOS_SECTORS_16 || dsk.Format.ID == DF_DOS_SECTORS_13 {
+		if vtoc, e := dsk.AppleDOSGetVTOC(); e == nil {
+			dsk.DOSVolumeID = int(vtoc.GetVolumeID())
+		}
+	}
+
+	if len(dsk.Data) == PRODOS_800KB_DISK_BYTES {
+		dsk.SetNibbles(make([]byte, DISK_NIBBLE_LENGTH))
+	} else {
+		dsk.SetNibbles(dsk.Nibblize())
+	}
+
+	return nil
+}
+
+// IdentifyCandidates scores every filesystem and sector order that fits the
+// image size, best match first.  The disk's current interpretation is left
+// untouched.
+func (dsk *DSKWrapper) IdentifyCandidates() []*IdentifyCandidate {
+
+	saved := dsk.saveIdentifyState()
+	defer dsk.restoreIdentifyState(saved)
+
+	var fslist, orders []string
+
+	switch len(dsk.Data) {
+	case STD_DISK_BYTES:
+		fslist = []string{IdentifyFSDOS, IdentifyFSProDOS, IdentifyFSPascal}
+		orders = IdentifyOrders
+	case STD_DISK_BYTES_OLD:
+		fslist = []string{IdentifyFSDOS}
+		orders = []string{IdentifyOrderDOS}
+	case PRODOS_800KB_DISK_BYTES:
+		fslist = []string{IdentifyFSProDOS}
+		orders = []string{IdentifyOrderProDOS}
+	default:
+		return nil
+	}
+
+	var hint string
+	lowerFilename := strings.ToLower(dsk.Filename)
+	switch {
+	case strings.HasSuffix(lowerFilename, ".po"):
+		hint = IdentifyOrderProDOS
+	case strings.HasSuffix(lowerFilename, ".do"):
+		hint = IdentifyOrderDOS
+	}
+
+	var boot DiskFormat
+	var hasBoot bool
+	if len(dsk.Data) >= 32 {
+		boot, hasBoot = identity[hex.EncodeToString(dsk.Data[:32])]
+	}
+
+	out := make([]*IdentifyCandidate, 0)
+
+	for _, fs := range fslist {
+		for _, order := range orders {
+
+			if dsk.applyInterpretation(fs, order) != nil {
+				continue
+			}
+
+			c := &IdentifyCandidate{
+				FS:     fs,
+				Order:  order,
+				Format: dsk.Format,
+				Layout: dsk.Layout,
+			}
+
+			switch fs {
+			case IdentifyFSDOS:
+				dsk.scoreAppleDOS(c)
+				if hasBoot && boot.IsOneOf(DF_DOS_SECTORS_13, DF_DOS_SECTORS_16) {
+					c.add(15, "boot sector matches known %s boot code", boot.String())
+				}
+			case IdentifyFSProDOS:
+				dsk.scoreProDOS(c)
+				if hasBoot && boot.ID == DF_PRODOS {
+					c.add(15, "boot sector matches known ProDOS boot code")
+				}
+			case IdentifyFSPascal:
+				dsk.scorePascal(c)
+			}
+
+			if hint != "" && hint == order && len(orders) > 1 {
+				c.add(2, "filename extension suggests %s order", strings.ToUpper(hint))
+			}
+
+			out = append(out, c)
+		}
+	}
+
+	if isRDOS, _ := dsk.IsRDOS(); isRDOS && dsk.applyInterpretation(IdentifyFSRDOS, IdentifyOrderDOS) == nil {
+		c := &IdentifyCandidate{
+			FS:     IdentifyFSRDOS,
+			Order:  IdentifyOrderDOS,
+			Format: dsk.Format,
+			Layout: dsk.Layout,
+		}
+		c.add(60, "RDOS signature found on track 0, sector 1")
+		out = append(out, c)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Score > out[j].Score
+	})
+
+	return out
+}
+
+func (dsk *DSKWrapper) scoreAppleDOS(c *IdentifyCandidate) {
+
+	spt := dsk.Format.USPT()
+
+	vtoc, err := dsk.AppleDOSGetVTOC()
+	if err != nil {
+		c.add(-50, "VTOC unreadable: %v", err)
+		return
+	}
+
+	if vtoc.GetTracks() != STD_TRACKS_PER_DISK || vtoc.GetSectors() != spt {
+		c.add(-20, "VTOC geometry %d tracks, %d sectors is not %d/%d", vtoc.GetTracks(), vtoc.GetSectors(), STD_TRACKS_PER_DISK, spt)
+		return
+	}
+	c.add(20, "VTOC reports %d tracks, %d sectors", STD_TRACKS_PER_DISK, spt)
+
+	ct, cs := vtoc.GetCatalogStart()
+	if ct == 0 || ct >= STD_TRACKS_PER_DISK || cs >= spt {
+		c.add(-20, "VTOC catalog pointer T%d S%d is out of range", ct, cs)
+		return
+	}
+
+	// walk the catalog chain
+	seen := make(map[int]bool)
+	sectors, descending := 0, true
+	good, bad := 0, 0
+	var files []FileDescriptor
+
+	for ct != 0 {
+		if ct >= STD_TRACKS_PER_DISK || cs >= spt || seen[ct*spt+cs] {
+			c.add(-10, "catalog chain breaks at T%d S%d", ct, cs)
+			descending = false
+			break
+		}
+		seen[ct*spt+cs] = true
+
+		if dsk.Seek(ct, cs) != nil {
+			break
+		}
+		data := dsk.Read()
+		sectors++
+
+		for slot := 0; slot < 7; slot++ {
+			pos := 0x0b + 35*slot
+			if data[pos] == 0x00 || data[pos] == 0xff {
+				continue
+			}
+			fd := FileDescriptor{}
+			fd.SetData(data[pos:pos+35], ct, cs, pos)
+			tl, sl := fd.GetTrackSectorListStart()
+			if tl < STD_TRACKS_PER_DISK && sl < spt && fd.NameOK() && fd.Type().String() != "Unknown" {
+				good++
+				files = append(files, fd)
+			} else {
+				bad++
+			}
+		}
+
+		nt, ns := int(data[1]), int(data[2])
+		if nt != 0 && (nt != ct || ns != cs-1) {
+			descending = false
+		}
+		ct, cs = nt, ns
+	}
+
+	c.add(sectors, "%d catalog sectors chained", sectors)
+	if descending && sectors == spt-1 {
+		c.add(10, "catalog follows the standard descending layout on track %d", vtoc.Data[1])
+	}
+	if good > 0 {
+		c.add(capScore(2*good, 30), "%d valid catalog entries", good)
+	}
+	if bad > 0 {
+		c.add(-3*bad, "%d malformed catalog entries", bad)
+	}
+
+	// bitmap consistency: every sector a file claims should be in use
+	consistent, inconsistent := 0, 0
+	for _, fd := range files {
+		tslist, err := dsk.AppleDOSGetFileSectors(fd, 0)
+		ok := err == nil && len(tslist) > 0
+		for _, pair := range tslist {
+			if vtoc.IsTSFree(pair[0], pair[1]) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			consistent++
+		} else {
+			inconsistent++
+		}
+	}
+	if consistent > 0 {
+		c.add(capScore(2*consistent, 30), "%d files agree with the VTOC free sector bitmap", consistent)
+	}
+	if inconsistent > 0 {
+		c.add(-3*inconsistent, "%d files have sectors marked free or unreadable sector lists", inconsistent)
+	}
+
+}
+
+func (dsk *DSKWrapper) scoreProDOS(c *IdentifyCandidate) {
+
+	getBlock := dsk.PRODOSGetBlock
+	totalBlocks := PRODOS_BLOCKS_PER_DISK
+	if dsk.Format.ID == DF_PRODOS_800KB {
+		getBlock = dsk.PRODOS800GetBlock
+		totalBlocks = PRODOS_800KB_BLOCKS
+	}
+
+	key, err := getBlock(2)
+	if err != nil {
+		c.add(-50, "volume directory unreadable: %v", err)
+		return
+	}
+
+	vdh := &VDH{}
+	vdh.SetData(key[4:43], 2, 4)
+
+	if vdh.GetStorageType() != StorageType_Volume_Header {
+		c.add(-20, "block 2 is not a volume directory header (storage type $%x)", int(vdh.GetStorageType()))
+		return
+	}
+	c.add(20, "block 2 has a volume directory header")
+
+	if vdh.GetTotalBlocks() == totalBlocks {
+		c.add(20, "volume reports %d blocks", totalBlocks)
+	} else {
+		c.add(-10, "volume reports %d blocks, expected %d", vdh.GetTotalBlocks(), totalBlocks)
+	}
+
+	if vdh.GetEntryLength() == PRODOS_ENTRY_SIZE && vdh.GetEntriesPerBlock() == 0x0d {
+		c.add(5, "directory entry geometry is standard")
+	}
+
+	if prodosNameOK(key[5 : 5+vdh.GetNameLength()]) {
+		c.add(5, "volume name /%s is valid", vdh.GetVolumeName())
+	} else {
+		c.add(-5, "volume name is not a legal ProDOS name")
+	}
+
+	// walk the volume directory
+	var files []ProDOSFileDescriptor
+	good, bad, blocks := 0, 0, 0
+	seen := make(map[int]bool)
+	block, prev, data := 2, 0, key
+	for block != 0 && !seen[block] && block < totalBlocks {
+		seen[block] = true
+		if data == nil {
+			data, err = getBlock(block)
+			if err != nil {
+				break
+			}
+		}
+
+		if int(data[0])+256*int(data[1]) != prev {
+			c.add(-5, "directory block %d has a bad back pointer", block)
+			break
+		}
+		blocks++
+
+		for i := 0; i < 13; i++ {
+			if block == 2 && i == 0 {
+				continue // volume header
+			}
+			pos := 4 + i*PRODOS_ENTRY_SIZE
+			fd := ProDOSFileDescriptor{}
+			fd.SetData(append([]byte(nil), data[pos:pos+PRODOS_ENTRY_SIZE]...), block, pos)
+			switch fd.GetStorageType() {
+			case StorageType_Inactive:
+				continue
+			case StorageType_Seedling, StorageType_Sapling, StorageType_Tree, StorageType_SubDir_File, 0x5:
+				if fd.IndexBlock() < totalBlocks && prodosNameOK(fd.Data[1:1+fd.GetNameLength()]) {
+					good++
+					files = append(files, fd)
+					continue
+				}
+			}
+			bad++
+		}
+
+		prev = block
+		block = int(data[2]) + 256*int(data[3])
+		data = nil
+	}
+
+	c.add(blocks, "%d volume directory blocks chained", blocks)
+	if good > 0 {
+		c.add(capScore(2*good, 30), "%d valid directory entries", good)
+	}
+	if bad > 0 {
+		c.add(-3*bad, "%d malformed directory entries", bad)
+	}
+
+	// bitmap consistency
+	bp := vdh.GetBitmapPointer()
+	if bp < 3 || bp >= totalBlocks {
+		c.add(-10, "volume bitmap pointer %d is out of range", bp)
+		return
+	}
+	bitmap, err := getBlock(bp)
+	if err != nil {
+		return
+	}
+	vb := ProDOSVolumeBitmap{Data: bitmap}
+
+	if !vb.IsBlockFree(0) && !vb.IsBlockFree(1) && !vb.IsBlockFree(2) && !vb.IsBlockFree(bp) {
+		c.add(10, "volume bitmap marks boot, directory and bitmap blocks in use")
+	} else {
+		c.add(-10, "volume bitmap marks system blocks as free")
+	}
+
+	inconsistent := 0
+	for _, fd := range files {
+		if vb.IsBlockFree(fd.IndexBlock()) {
+			inconsistent++
+		}
+	}
+	if len(files) > inconsistent {
+		c.add(capScore(len(files)-inconsistent, 15), "%d files have their key block marked in use", len(files)-inconsistent)
+	}
+	if inconsistent > 0 {
+		c.add(-3*inconsistent, "%d files have their key block marked free", inconsistent)
+	}
+
+}
+
+func (dsk *DSKWrapper) scorePascal(c *IdentifyCandidate) {
+
+	isPAS, volName := dsk.IsPascal()
+	dsk.Format = c.Format
+	if !isPAS || volName == "" {
+		c.add(-20, "block 2 is not a Pascal volume header")
+		return
+	}
+	c.add(20, "Pascal volume %s: found in block 2", volName)
+
+	files, err := dsk.PascalGetCatalog("*")
+	if err != nil {
+		c.add(-10, "Pascal directory unreadable: %v", err)
+		return
+	}
+
+	good, bad := 0, 0
+	for _, f := range files {
+		if f.GetStartBlock() > PASCAL_VOLUME_BLOCK && f.GetNextBlock() > f.GetStartBlock() && f.GetNextBlock() <= PRODOS_BLOCKS_PER_DISK {
+			good++
+		} else {
+			bad++
+		}
+	}
+	if good > 0 {
+		c.add(capScore(2*good, 30), "%d valid directory entries", good)
+	}
+	if bad > 0 {
+		c.add(-3*bad, "%d malformed directory entries", bad)
+	}
+
+}
+
+func prodosNameOK(name []byte) bool {
+	if len(name) == 0 || name[0] < 'A' || name[0] > 'Z' {
+		return false
+	}
+	for _, ch := range name {
+		if !(ch >= 'A' && ch <= 'Z') && !(ch >= '0' && ch <= '9') && ch != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func capScore(v, max int) int {
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,94 @@
+package disk
+
+import "testing"
+
+func makeProDOSImage(t *testing.T, order string) *DSKWrapper {
+
+	dsk := &DSKWrapper{Data: make([]byte, STD_DISK_BYTES)}
+	if err := dsk.applyInterpretation(IdentifyFSProDOS, order); err != nil {
+		t.Fatalf("applyInterpretation failed: %v", err)
+	}
+
+	// volume directory, blocks 2-5
+	for b := 2; b <= 5; b++ {
+		block := make([]byte, 512)
+		if b > 2 {
+			block[0] = byte(b - 1)
+		}
+		if b < 5 {
+			block[2] = byte(b + 1)
+		}
+		if b == 2 {
+			block[4] = 0xf0 | 4
+			copy(block[5:], "TEST")
+			block[0x23] = PRODOS_ENTRY_SIZE
+			block[0x24] = 0x0d
+			block[0x25] = 1
+			block[0x27] = 6
+			block[0x29] = byte(PRODOS_BLOCKS_PER_DISK & 0xff)
+			block[0x2a] = byte(PRODOS_BLOCKS_PER_DISK >> 8)
+
+			entry := block[4+PRODOS_ENTRY_SIZE:]
+			entry[0] = 0x10 | 5
+			copy(entry[1:], "HELLO")
+			entry[16] = byte(FileType_PD_TXT)
+			entry[17] = 7
+		}
+		dsk.PRODOSWrite(b, block)
+	}
+
+	// volume bitmap: blocks 0-7 used, the rest free
+	bitmap := make([]byte, 512)
+	for i := 0; i < PRODOS_BLOCKS_PER_DISK/8; i++ {
+		bitmap[i] = 0xff
+	}
+	bitmap[0] = 0x00
+	dsk.PRODOSWrite(6, bitmap)
+
+	return dsk
+}
+
+func TestIdentifyCandidatesProDOSOrder(t *testing.T) {
+
+	for _, order := range IdentifyOrders {
+		dsk := makeProDOSImage(t, order)
+		dsk.Layout = SectorOrderDOS33
+
+		candidates := dsk.IdentifyCandidates()
+		if len(candidates) == 0 {
+			t.Fatalf("No candidates for %s image", order)
+		}
+
+		best := candidates[0]
+		if best.FS != IdentifyFSProDOS || best.Order != order {
+			t.Fatalf("Expected prodos/%s to score best, got %s/%s (%d)", order, best.FS, best.Order, best.Score)
+		}
+		if len(candidates) > 1 && candidates[1].Score >= best.Score {
+			t.Fatalf("Expected a clear winner for %s image, runner up scored %d vs %d", order, candidates[1].Score, best.Score)
+		}
+
+		if dsk.Layout != SectorOrderDOS33 {
+			t.Fatalf("IdentifyCandidates changed the disk layout")
+		}
+	}
+
+}
+
+func TestForceInterpretation(t *testing.T) {
+
+	dsk := makeProDOSImage(t, IdentifyOrderProDOS)
+
+	if err := dsk.ForceInterpretation("prodos", "xx"); err == nil {
+		t.Fatalf("Expected error for unknown order")
+	}
+
+	if err := dsk.ForceInterpretation("ProDOS", "PO"); err != nil {
+		t.Fatalf("ForceInterpretation failed: %v", err)
+	}
+
+	vdh, err := dsk.PRODOSGetVDH(2)
+	if err != nil || vdh.GetVolumeName() != "TEST" {
+		t.Fatalf("Expected volume TEST after forcing prodos/po")
+	}
+
+}
@@ -0,0 +1,245 @@
+package disk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+)
+
+/*
+	Logical checksums...
+
+	ChecksumDisk() hashes the image as stored, so the same disk kept as a
+	.dsk, a .po and a .2mg gives three different checksums.  The logical
+	checksums read the disk the way its filesystem does instead: ProDOS
+	and Pascal volumes block by block, DOS volumes track by track in DOS
+	sector order, so container and interleave make no difference.  For a
+	DOS disk the whole disk checksum is that of its .do image, for a
+	ProDOS disk that of its .po image.
+
+	A 140Kb image is read with the best scoring interpretation from
+	IdentifyCandidates(), which looks at both sector orders, rather than
+	whatever Identify() settled on.  Images of other sizes and unknown
+	formats are hashed as stored (less any 2MG header).
+*/
+
+// ChecksumLogical returns the checksum of the whole disk and of its used
+// sectors or blocks, both in logical order.  The active checksum is empty
+// if the filesystem is not known.
+func (d *DSKWrapper) ChecksumLogical() (string, string) {
+
+	saved := d.saveIdentifyState()
+	defer d.restoreIdentifyState(saved)
+
+	d.useBestInterpretation()
+
+	whole := sha256.New()
+	active := sha256.New()
+
+	var ok bool
+	switch d.Format.ID {
+	case DF_PRODOS, DF_PASCAL:
+		ok = d.checksumBlocks(whole, active)
+	case DF_DOS_SECTORS_13, DF_DOS_SECTORS_16, DF_RDOS_3, DF_RDOS_32, DF_RDOS_33:
+		ok = d.checksumSectors(whole, active)
+	}
+
+	if !ok {
+		return d.ChecksumDisk(), ""
+	}
+
+	if d.Format.IsOneOf(DF_RDOS_3, DF_RDOS_32, DF_RDOS_33) {
+		return hex.EncodeToString(whole.Sum(nil)), ""
+	}
+
+	return hex.EncodeToString(whole.Sum(nil)), hex.EncodeToString(active.Sum(nil))
+}
+
+// useBestInterpretation reads a 140Kb image with the best scoring
+// filesystem and sector order
+func (d *DSKWrapper) useBestInterpretation() {
+	if len(d.Data) == STD_DISK_BYTES {
+		if c := d.IdentifyCandidates(); len(c) > 0 && c[0].Score > 0 && c[0].FS != IdentifyFSRDOS {
+			d.applyInterpretation(c[0].FS, c[0].Order)
+		}
+	}
+}
+
+// LogicalUnits returns the disk read as ChecksumLogical reads it: blocks
+// for ProDOS and Pascal volumes, sectors track by track in DOS sector
+// order otherwise, with the number of sectors per track (0 for blocks).
+// Unknown formats are split into 256 byte sectors as stored.
+func (d *DSKWrapper) LogicalUnits() ([][]byte, int) {
+
+	saved := d.saveIdentifyState()
+	defer d.restoreIdentifyState(saved)
+
+	d.useBestInterpretation()
+
+	switch d.Format.ID {
+	case DF_PRODOS, DF_PRODOS_400KB, DF_PRODOS_800KB, DF_PRODOS_CUSTOM, DF_PASCAL:
+		if units, ok := d.logicalBlocks(); ok {
+			return units, 0
+		}
+	case DF_DOS_SECTORS_13, DF_DOS_SECTORS_16, DF_RDOS_3, DF_RDOS_32, DF_RDOS_33:
+		if units, ok := d.logicalSectors(); ok {
+			return units, d.Format.USPT()
+		}
+	}
+
+	var units [][]byte
+	for p := 0; p < len(d.Data); p += STD_BYTES_PER_SECTOR {
+		end := p + STD_BYTES_PER_SECTOR
+		if end > len(d.Data) {
+			end = len(d.Data)
+		}
+		units = append(units, append([]byte(nil), d.Data[p:end]...))
+	}
+
+	return units, STD_SECTORS_PER_TRACK
+}
+
+// WriteLogicalUnits writes units read with LogicalUnits (and perhaps
+// changed) back to the disk, each in the place it was read from
+func (d *DSKWrapper) WriteLogicalUnits(units [][]byte) error {
+
+	current, _ := d.LogicalUnits()
+	if len(units) != len(current) {
+		return fmt.Errorf("Expected %d sectors or blocks, got %d", len(current), len(units))
+	}
+	for i, u := range units {
+		if len(u) != len(current[i]) {
+			return fmt.Errorf("Sector or block %d is %d bytes, expected %d", i, len(u), len(current[i]))
+		}
+	}
+
+	saved := d.saveIdentifyState()
+	defer d.restoreIdentifyState(saved)
+
+	d.useBestInterpretation()
+
+	switch d.Format.ID {
+	case DF_PRODOS, DF_PRODOS_400KB, DF_PRODOS_800KB, DF_PRODOS_CUSTOM, DF_PASCAL:
+		if _, ok := d.logicalBlocks(); ok {
+			for b, data := range units {
+				if e := d.PRODOSWrite(b, data); e != nil {
+					return e
+				}
+			}
+			return nil
+		}
+	case DF_DOS_SECTORS_13, DF_DOS_SECTORS_16, DF_RDOS_3, DF_RDOS_32, DF_RDOS_33:
+		if _, ok := d.logicalSectors(); ok {
+			spt := d.Format.USPT()
+			for i, data := range units {
+				if e := d.Seek(i/spt, i%spt); e != nil {
+					return e
+				}
+				d.Write(data)
+			}
+			return nil
+		}
+	}
+
+	for i, data := range units {
+		copy(d.Data[i*STD_BYTES_PER_SECTOR:], data)
+	}
+
+	return nil
+}
+
+func (d *DSKWrapper) logicalBlocks() ([][]byte, bool) {
+	var units [][]byte
+	for b := 0; b < d.Format.BPD(); b++ {
+		data, e := d.PRODOSGetBlock(b)
+		if e != nil {
+			return nil, false
+		}
+		units = append(units, append([]byte(nil), data...))
+	}
+	return units, true
+}
+
+func (d *DSKWrapper) logicalSectors() ([][]byte, bool) {
+	var units [][]byte
+	for t := 0; t < d.Format.TPD(); t++ {
+		for s := 0; s < d.Format.USPT(); s++ {
+			if e := d.Seek(t, s); e != nil || d.SectorPointer+STD_BYTES_PER_SECTOR > len(d.Data) {
+				return nil, false
+			}
+			units = append(units, append([]byte(nil), d.Read()...))
+		}
+	}
+	return units, true
+}
+
+// checksumBlocks reads a ProDOS or Pascal volume in block order
+func (d *DSKWrapper) checksumBlocks(whole, active hash.Hash) bool {
+
+	var used func(b int) bool
+	if d.Format.ID == DF_PASCAL {
+		bitmap, e := d.PascalUsedBitmap()
+		if e != nil {
+			return false
+		}
+		used = func(b int) bool { return b < len(bitmap) && bitmap[b] }
+	} else {
+		vb, e := d.PRODOSGetVolumeBitmap()
+		if e != nil {
+			return false
+		}
+		used = func(b int) bool { return !vb.IsBlockFree(b) }
+	}
+
+	for b := 0; b < d.Format.BPD(); b++ {
+		data, e := d.PRODOSGetBlock(b)
+		if e != nil {
+			return false
+		}
+		whole.Write(data)
+		if used(b) {
+			active.Write(data)
+		}
+	}
+
+	return true
+}
+
+// checksumSectors reads a DOS or RDOS volume track by track in DOS sector
+// order.  Only DOS volumes have a bitmap to tell the used sectors.
+func (d *DSKWrapper) checksumSectors(whole, active hash.Hash) bool {
+
+	used := func(t, s int) bool { return false }
+	if d.Format.IsOneOf(DF_DOS_SECTORS_13, DF_DOS_SECTORS_16) {
+		vtoc, e := d.AppleDOSGetVTOC()
+		if e != nil {
+			return false
+		}
+		if vtoc.IsTSFree(17, 0) {
+			bitmap, e := d.AppleDOSUsedBitmap()
+			if e != nil {
+				return false
+			}
+			spt := d.Format.SPT()
+			used = func(t, s int) bool { return bitmap[t*spt+s] }
+		} else {
+			used = func(t, s int) bool { return !vtoc.IsTSFree(t, s) }
+		}
+	}
+
+	for t := 0; t < d.Format.TPD(); t++ {
+		for s := 0; s < d.Format.USPT(); s++ {
+			if e := d.Seek(t, s); e != nil || d.SectorPointer+STD_BYTES_PER_SECTOR > len(d.Data) {
+				return false
+			}
+			data := d.Read()
+			whole.Write(data)
+			if used(t, s) {
+				active.Write(data)
+			}
+		}
+	}
+
+	return true
+}
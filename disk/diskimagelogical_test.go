@@ -0,0 +1,183 @@
+package disk
+
+import "testing"
+
+// make2MG wraps a 140Kb image in a 2MG header, format 0 for DOS order or 1
+// for ProDOS order
+func make2MG(data []byte, format byte) []byte {
+
+	h := make([]byte, 0x40)
+	copy(h, "2IMG")
+	copy(h[0x04:], "DM8!")
+	h[0x08] = 0x40
+	h[0x0A] = 1
+	h[0x0C] = format
+	blocks := len(data) / 512
+	h[0x14], h[0x15] = byte(blocks), byte(blocks>>8)
+	h[0x18] = 0x40
+	h[0x1C], h[0x1D], h[0x1E] = byte(len(data)), byte(len(data)>>8), byte(len(data)>>16)
+
+	return append(h, data...)
+}
+
+func TestChecksumLogicalProDOS(t *testing.T) {
+
+	images := make(map[string][]byte)
+	for _, order := range IdentifyOrders {
+		dsk := makeProDOSImage(t, order)
+		block := make([]byte, 512)
+		for i := range block {
+			block[i] = byte(i * 7)
+		}
+		dsk.PRODOSWrite(7, block)
+		images[order] = dsk.Data
+	}
+
+	files := map[string][]byte{
+		"test.dsk":    images[IdentifyOrderDOS],
+		"test.po":     images[IdentifyOrderProDOS],
+		"test-do.2mg": make2MG(images[IdentifyOrderDOS], 0x00),
+		"test-po.2mg": make2MG(images[IdentifyOrderProDOS], 0x01),
+	}
+
+	want := Checksum(images[IdentifyOrderProDOS])
+	var wantActive string
+
+	for name, data := range files {
+		dsk, err := NewDSKWrapperBin(nil, append([]byte(nil), data...), name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if dsk.Format.ID != DF_PRODOS {
+			t.Fatalf("%s: expected a ProDOS volume, got %s", name, dsk.Format)
+		}
+		got, active := dsk.ChecksumLogical()
+		if got != want {
+			t.Fatalf("%s: logical checksum %s, expected %s", name, got, want)
+		}
+		if active == "" || (wantActive != "" && active != wantActive) {
+			t.Fatalf("%s: active checksum %q, expected %q", name, active, wantActive)
+		}
+		wantActive = active
+	}
+
+	if Checksum(images[IdentifyOrderDOS]) == Checksum(images[IdentifyOrderProDOS]) {
+		t.Fatalf("Expected the raw images to differ")
+	}
+
+}
+
+func TestChecksumLogicalDOS(t *testing.T) {
+
+	dsk := makeDOSImage()
+	for s := 0; s < 16; s++ {
+		dsk.Seek(3, s)
+		data := make([]byte, 256)
+		for i := range data {
+			data[i] = byte(s*16 + i)
+		}
+		dsk.Write(data)
+	}
+
+	want := Checksum(dsk.Data)
+
+	wrapped, err := NewDSKWrapperBin(nil, make2MG(append([]byte(nil), dsk.Data...), 0x00), "test.2mg")
+	if err != nil {
+		t.Fatalf("2mg: %v", err)
+	}
+	got, wantActive := wrapped.ChecksumLogical()
+	if got != want || wantActive == "" {
+		t.Fatalf("2mg: logical checksum %s, expected %s", got, want)
+	}
+
+	// the same disk in ProDOS order
+	po := make([]byte, STD_DISK_BYTES)
+	for tr := 0; tr < 35; tr++ {
+		for s := 0; s < 16; s++ {
+			dsk.Seek(tr, s)
+			data := dsk.Read()
+			off := (tr*16 + SectorMapperDiversiDOS(s)) * 256
+			copy(po[off:off+256], data)
+		}
+	}
+
+	podsk, err := NewDSKWrapperBin(nil, po, "test.po")
+	if err != nil {
+		t.Fatalf("po: %v", err)
+	}
+	if podsk.ChecksumDisk() == want {
+		t.Fatalf("Expected the raw images to differ")
+	}
+	if got, active := podsk.ChecksumLogical(); got != want || active != wantActive {
+		t.Fatalf("po: logical checksums %s/%s, expected %s/%s", got, active, want, wantActive)
+	}
+
+}
+
+func TestLogicalUnits(t *testing.T) {
+
+	dsk := makeProDOSImage(t, IdentifyOrderDOS)
+	block := make([]byte, 512)
+	for i := range block {
+		block[i] = byte(i * 3)
+	}
+	dsk.PRODOSWrite(9, block)
+
+	units, spt := dsk.LogicalUnits()
+	if spt != 0 || len(units) != 280 {
+		t.Fatalf("Expected 280 blocks, got %d units (%d per track)", len(units), spt)
+	}
+	if string(units[9]) != string(block) {
+		t.Fatalf("Expected block 9 as written")
+	}
+
+	dos := makeDOSImage()
+	units, spt = dos.LogicalUnits()
+	if spt != 16 || len(units) != 560 {
+		t.Fatalf("Expected 560 sectors, got %d units (%d per track)", len(units), spt)
+	}
+	dos.Seek(17, 0)
+	if string(units[17*16]) != string(dos.Read()) {
+		t.Fatalf("Expected T17S0 to be the VTOC")
+	}
+
+}
+
+func TestWriteLogicalUnits(t *testing.T) {
+
+	dsk := makeDOSImage()
+
+	// the same disk in ProDOS order
+	po := make([]byte, STD_DISK_BYTES)
+	for tr := 0; tr < 35; tr++ {
+		for s := 0; s < 16; s++ {
+			dsk.Seek(tr, s)
+			off := (tr*16 + SectorMapperDiversiDOS(s)) * 256
+			copy(po[off:off+256], dsk.Read())
+		}
+	}
+	podsk, err := NewDSKWrapperBin(nil, po, "test.po")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	units, _ := podsk.LogicalUnits()
+	for i := range units[3*16+5] {
+		units[3*16+5][i] = 0x5a
+	}
+	if err := podsk.WriteLogicalUnits(units); err != nil {
+		t.Fatal(err)
+	}
+
+	again, _ := podsk.LogicalUnits()
+	for i := range units {
+		if string(again[i]) != string(units[i]) {
+			t.Fatalf("Sector %d differs after writing back", i)
+		}
+	}
+
+	if err := podsk.WriteLogicalUnits(units[:10]); err == nil {
+		t.Fatalf("Expected too few sectors to be refused")
+	}
+
+}
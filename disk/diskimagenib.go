@@ -0,0 +1,575 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+	Nibble (6-and-2 / 5-and-3) encoder and decoder for 35 track 5.25" images...
+*/
+
+const DEFAULT_VOLUME_ID = 254
+
+// NibbleOptions controls how sector data is laid out on a track when a disk
+// is encoded as a .nib stream or a WOZ bitstream. Gap sizes are counted in
+// sync (0xFF) nibbles; zero values are replaced with sensible defaults.
+type NibbleOptions struct {
+	Volume    int  // volume number written into every address field
+	Gap1      int  // sync nibbles at the start of each track
+	Gap2      int  // sync nibbles between address and data fields
+	Gap3      int  // sync nibbles after each data field
+	BitTiming int  // WOZ optimal bit timing in 125ns units (32 = 4us)
+	Bitstream bool // true when the layout is for a WOZ bitstream (10 bit sync)
+}
+
+// NibbleOptions returns the default options for the disk, using the real DOS
+// volume number from the VTOC when one is known.
+func (d *DSKWrapper) NibbleOptions() NibbleOptions {
+
+	volume := DEFAULT_VOLUME_ID
+	if d.DOSVolumeID > 0 && d.DOSVolumeID < 256 {
+		volume = d.DOSVolumeID
+	}
+
+	return NibbleOptions{
+		Volume:    volume,
+		BitTiming: 32,
+	}
+
+}
+
+func (o NibbleOptions) withDefaults(spt int) NibbleOptions {
+
+	if o.Volume <= 0 || o.Volume > 255 {
+		o.Volume = DEFAULT_VOLUME_ID
+	}
+
+	if o.BitTiming <= 0 {
+		o.BitTiming = 32
+	}
+
+	if o.Gap2 <= 0 {
+		o.Gap2 = 6
+	}
+
+	// bitstream tracks must fit inside one revolution (~50000 bits at 4us),
+	// whereas .nib tracks are a fixed TRACK_NIBBLE_LENGTH bytes
+	switch {
+	case o.Bitstream && spt == STD_SECTORS_PER_TRACK_OLD:
+		if o.Gap1 <= 0 {
+			o.Gap1 = 64
+		}
+		if o.Gap3 <= 0 {
+			o.Gap3 = 24
+		}
+	case o.Bitstream:
+		if o.Gap1 <= 0 {
+			o.Gap1 = 64
+		}
+		if o.Gap3 <= 0 {
+			o.Gap3 = 12
+		}
+	case spt == STD_SECTORS_PER_TRACK_OLD:
+		if o.Gap1 <= 0 {
+			o.Gap1 = 48
+		}
+		if o.Gap3 <= 0 {
+			o.Gap3 = 64
+		}
+	default:
+		if o.Gap1 <= 0 {
+			o.Gap1 = 15
+		}
+		if o.Gap3 <= 0 {
+			o.Gap3 = 47
+		}
+	}
+
+	return o
+
+}
+
+// nibbleTrack collects the nibbles for a single track, remembering which of
+// them are self-sync bytes so they can be written as 10 bit cells in a WOZ.
+type nibbleTrack struct {
+	nibbles []byte
+	sync    []bool
+}
+
+func (t *nibbleTrack) writeSync(count int) {
+	for i := 0; i < count; i++ {
+		t.nibbles = append(t.nibbles, 0xff)
+		t.sync = append(t.sync, true)
+	}
+}
+
+func (t *nibbleTrack) write(data ...byte) {
+	for _, v := range data {
+		t.nibbles = append(t.nibbles, v)
+		t.sync = append(t.sync, false)
+	}
+}
+
+// dataLength is the number of nibbles up to the end of the last field,
+// leaving out the sync bytes after it.
+func (t *nibbleTrack) dataLength() int {
+	n := len(t.sync)
+	for n > 0 && t.sync[n-1] {
+		n--
+	}
+	return n
+}
+
+// Bytes returns the track as a fixed length nibble stream, padding with (or
+// trimming trailing) sync bytes.
+func (t *nibbleTrack) Bytes(length int) []byte {
+	out := make([]byte, length)
+	for i := range out {
+		if i < len(t.nibbles) {
+			out[i] = t.nibbles[i]
+		} else {
+			out[i] = 0xff
+		}
+	}
+	return out
+}
+
+// Bits returns the track as a packed MSB-first bitstream and its bit count.
+func (t *nibbleTrack) Bits() ([]byte, int) {
+
+	count := 0
+	for _, s := range t.sync {
+		if s {
+			count += 10
+		} else {
+			count += 8
+		}
+	}
+
+	out := make([]byte, (count+7)/8)
+	pos := 0
+
+	for i, v := range t.nibbles {
+		for b := 7; b >= 0; b-- {
+			if v&(1<<uint(b)) != 0 {
+				out[pos/8] |= 0x80 >> uint(pos%8)
+			}
+			pos++
+		}
+		if t.sync[i] {
+			pos += 2
+		}
+	}
+
+	return out, count
+
+}
+
+func (d *DSKWrapper) nibbleGeometry() (int, error) {
+	switch len(d.Data) {
+	case STD_DISK_BYTES:
+		return STD_SECTORS_PER_TRACK, nil
+	case STD_DISK_BYTES_OLD:
+		return STD_SECTORS_PER_TRACK_OLD, nil
+	}
+	return 0, errors.New("Nibble encoding needs a 35 track 13 or 16 sector image")
+}
+
+// physicalSector returns the image data for a physical sector on a track.
+func (d *DSKWrapper) physicalSector(track, sector, spt int) []byte {
+
+	order := d.CurrentSectorOrder
+	if spt == STD_SECTORS_PER_TRACK_OLD {
+		order = DOS_32_SECTOR_ORDER
+	} else if len(order) < spt {
+		order = DOS_33_SECTOR_ORDER
+	}
+
+	offset := ((track * spt) + order[sector]) * STD_BYTES_PER_SECTOR
+
+	return d.Data[offset : offset+STD_BYTES_PER_SECTOR]
+
+}
+
+// NibblizeTrack encodes one track of the disk using the given options.
+func (d *DSKWrapper) NibblizeTrack(track int, opts NibbleOptions) (*nibbleTrack, error) {
+
+	spt, err := d.nibbleGeometry()
+	if err != nil {
+		return nil, err
+	}
+
+	if track < 0 || track >= STD_TRACKS_PER_DISK {
+		return nil, fmt.Errorf("Invalid track %d", track)
+	}
+
+	opts = opts.withDefaults(spt)
+
+	t := &nibbleTrack{}
+	t.writeSync(opts.Gap1)
+
+	for sector := 0; sector < spt; sector++ {
+		data := d.physicalSector(track, sector, spt)
+		if spt == STD_SECTORS_PER_TRACK_OLD {
+			d.writeAddressField(t, []byte{0xd5, 0xaa, 0xb5}, opts.Volume, track, sector)
+			t.writeSync(opts.Gap2)
+			t.write(0xd5, 0xaa, 0xad)
+			t.write(encodeSector53(data)...)
+		} else {
+			d.writeAddressField(t, []byte{0xd5, 0xaa, 0x96}, opts.Volume, track, sector)
+			t.writeSync(opts.Gap2)
+			t.write(0xd5, 0xaa, 0xad)
+			t.write(encodeSector62(data)...)
+		}
+		t.write(0xde, 0xaa, 0xeb)
+		t.writeSync(opts.Gap3)
+	}
+
+	// a .nib track is a fixed length, so only the sync after the last
+	// sector may be cut short
+	if !opts.Bitstream {
+		if used := t.dataLength(); used > TRACK_NIBBLE_LENGTH {
+			return nil, fmt.Errorf("Track %d needs %d nibbles but a .nib track holds %d, use smaller gaps", track, used, TRACK_NIBBLE_LENGTH)
+		}
+	}
+
+	return t, nil
+
+}
+
+// NibblizeWithOptions returns the whole disk as a .nib image (35 tracks of
+// TRACK_NIBBLE_LENGTH bytes).
+func (d *DSKWrapper) NibblizeWithOptions(opts NibbleOptions) ([]byte, error) {
+
+	opts.Bitstream = false
+
+	out := make([]byte, 0, DISK_NIBBLE_LENGTH)
+
+	for track := 0; track < STD_TRACKS_PER_DISK; track++ {
+		t, err := d.NibblizeTrack(track, opts)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t.Bytes(TRACK_NIBBLE_LENGTH)...)
+	}
+
+	return out, nil
+
+}
+
+func (d *DSKWrapper) writeAddressField(t *nibbleTrack, prologue []byte, volume, track, sector int) {
+	t.write(prologue...)
+	t.write(d.getOddEven(volume)...)
+	t.write(d.getOddEven(track)...)
+	t.write(d.getOddEven(sector)...)
+	t.write(d.getOddEven((volume ^ track ^ sector) & 0xff)...)
+	t.write(0xde, 0xaa, 0xeb)
+}
+
+// encodeSector62 returns the 342 data nibbles plus checksum for a 16 sector
+// (6-and-2) data field.
+func encodeSector62(data []byte) []byte {
+
+	temp := make([]int, 342)
+	for i := 0; i < 256; i++ {
+		temp[i] = int((data[i] & 0x0ff) >> 2)
+	}
+	hi := 0x001
+	med := 0x0AB
+	low := 0x055
+
+	for i := 0; i < 0x56; i++ {
+		value := ((data[hi] & 1) << 5) |
+			((data[hi] & 2) << 3) |
+			((data[med] & 1) << 3) |
+			((data[med] & 2) << 1) |
+			((data[low] & 1) << 1) |
+			((data[low] & 2) >> 1)
+		temp[i+256] = int(value)
+		hi = (hi - 1) & 0x0ff
+		med = (med - 1) & 0x0ff
+		low = (low - 1) & 0x0ff
+	}
+
+	out := make([]byte, 0, 343)
+
+	last := 0
+	for i := len(temp) - 1; i > 255; i-- {
+		out = append(out, NIBBLE_62[temp[i]^last])
+		last = temp[i]
+	}
+	for i := 0; i < 256; i++ {
+		out = append(out, NIBBLE_62[temp[i]^last])
+		last = temp[i]
+	}
+	// Last data byte used as checksum
+	out = append(out, NIBBLE_62[last])
+
+	return out
+
+}
+
+// encodeSector53 returns the 410 data nibbles plus checksum for a 13 sector
+// (5-and-3) data field.
+func encodeSector53(data []byte) []byte {
+
+	top := make([]byte, 256)
+	threes := make([]byte, 154)
+
+	p := 0
+	for chunk := 0; chunk < 0x33; chunk++ {
+		b1, b2, b3, b4, b5 := data[p], data[p+1], data[p+2], data[p+3], data[p+4]
+		p += 5
+
+		top[chunk] = b1 >> 3
+		top[chunk+0x33] = b2 >> 3
+		top[chunk+0x66] = b3 >> 3
+		top[chunk+0x99] = b4 >> 3
+		top[chunk+0xcc] = b5 >> 3
+
+		threes[chunk] = (b1&0x07)<<2 | (b4&0x04)>>1 | (b5&0x04)>>2
+		threes[chunk+0x33] = (b2&0x07)<<2 | (b4 & 0x02) | (b5&0x02)>>1
+		threes[chunk+0x66] = (b3&0x07)<<2 | (b4&0x01)<<1 | (b5 & 0x01)
+	}
+	top[255] = data[255] >> 3
+	threes[153] = data[255] & 0x07
+
+	out := make([]byte, 0, 411)
+
+	var last byte
+	for i := 153; i >= 0; i-- {
+		out = append(out, NIBBLE_53[threes[i]^last])
+		last = threes[i]
+	}
+	for i := 0; i < 256; i++ {
+		out = append(out, NIBBLE_53[top[i]^last])
+		last = top[i]
+	}
+	out = append(out, NIBBLE_53[last])
+
+	return out
+
+}
+
+func reverseNibbleTable(table []byte) map[byte]byte {
+	out := make(map[byte]byte)
+	for i, v := range table {
+		out[v] = byte(i)
+	}
+	return out
+}
+
+var denib62 = reverseNibbleTable(NIBBLE_62)
+var denib53 = reverseNibbleTable(NIBBLE_53)
+
+func decodeSector62(nibbles []byte) ([]byte, error) {
+
+	if len(nibbles) < 343 {
+		return nil, errors.New("Short data field")
+	}
+
+	temp := make([]byte, 342)
+	var last byte
+	for i := 0; i < 342; i++ {
+		v, ok := denib62[nibbles[i]]
+		if !ok {
+			return nil, fmt.Errorf("Invalid nibble %.2x", nibbles[i])
+		}
+		last ^= v
+		temp[i] = last
+	}
+	if v, ok := denib62[nibbles[342]]; !ok || v != last {
+		return nil, errors.New("Data field checksum error")
+	}
+
+	// temp[0:86] holds the auxiliary bits in reverse, temp[86:] the high bits
+	aux := func(i int) byte {
+		return temp[85-i]
+	}
+
+	out := make([]byte, 256)
+	for j := 0; j < 256; j++ {
+		v := temp[86+j] << 2
+		switch {
+		case j <= 0x55:
+			a := aux(0x55 - j)
+			v |= (a>>1)&1 | (a&1)<<1
+		case j <= 0xab:
+			a := aux(0xab - j)
+			v |= (a>>3)&1 | ((a>>2)&1)<<1
+		default:
+			a := aux(257 - j)
+			v |= (a>>5)&1 | ((a>>4)&1)<<1
+		}
+		out[j] = v
+	}
+
+	return out, nil
+
+}
+
+func decodeSector53(nibbles []byte) ([]byte, error) {
+
+	if len(nibbles) < 411 {
+		return nil, errors.New("Short data field")
+	}
+
+	threes := make([]byte, 154)
+	top := make([]byte, 256)
+
+	var last byte
+	for i := 153; i >= 0; i-- {
+		v, ok := denib53[nibbles[153-i]]
+		if !ok {
+			return nil, fmt.Errorf("Invalid nibble %.2x", nibbles[153-i])
+		}
+		last ^= v
+		threes[i] = last
+	}
+	for i := 0; i < 256; i++ {
+		v, ok := denib53[nibbles[154+i]]
+		if !ok {
+			return nil, fmt.Errorf("Invalid nibble %.2x", nibbles[154+i])
+		}
+		last ^= v
+		top[i] = last
+	}
+	if v, ok := denib53[nibbles[410]]; !ok || v != last {
+		return nil, errors.New("Data field checksum error")
+	}
+
+	out := make([]byte, 256)
+	p := 0
+	for chunk := 0; chunk < 0x33; chunk++ {
+		t1, t2, t3 := threes[chunk], threes[chunk+0x33], threes[chunk+0x66]
+		out[p] = top[chunk]<<3 | (t1>>2)&7
+		out[p+1] = top[chunk+0x33]<<3 | (t2>>2)&7
+		out[p+2] = top[chunk+0x66]<<3 | (t3>>2)&7
+		out[p+3] = top[chunk+0x99]<<3 | ((t1>>1)&1)<<2 | ((t2>>1)&1)<<1 | (t3>>1)&1
+		out[p+4] = top[chunk+0xcc]<<3 | (t1&1)<<2 | (t2&1)<<1 | t3&1
+		p += 5
+	}
+	out[255] = top[255]<<3 | threes[153]&7
+
+	return out, nil
+
+}
+
+func decodeOddEven(a, b byte) int {
+	return int(((a << 1) | 1) & b)
+}
+
+// DenibblizeTrack decodes the sectors found in a single track of nibbles,
+// returning them indexed by physical sector along with the volume number.
+func DenibblizeTrack(nibbles []byte, spt int) ([][]byte, int, error) {
+
+	sectors := make([][]byte, spt)
+	volume := -1
+
+	// tracks are circular, so allow fields to wrap around the end
+	stream := append(append([]byte(nil), nibbles...), nibbles...)
+
+	addr := byte(0x96)
+	fieldLength := 343
+	if spt == STD_SECTORS_PER_TRACK_OLD {
+		addr = 0xb5
+		fieldLength = 411
+	}
+
+	for i := 0; i < len(nibbles); i++ {
+		if stream[i] != 0xd5 || stream[i+1] != 0xaa || stream[i+2] != addr {
+			continue
+		}
+		if i+11 >= len(stream) {
+			break
+		}
+		vol := decodeOddEven(stream[i+3], stream[i+4])
+		sector := decodeOddEven(stream[i+7], stream[i+8])
+		if sector < 0 || sector >= spt || sectors[sector] != nil {
+			continue
+		}
+		// data prologue should follow shortly after the address field
+		for j := i + 11; j < i+11+64 && j+3+fieldLength < len(stream); j++ {
+			if stream[j] == 0xd5 && stream[j+1] == 0xaa && stream[j+2] == 0xad {
+				var data []byte
+				var err error
+				if spt == STD_SECTORS_PER_TRACK_OLD {
+					data, err = decodeSector53(stream[j+3:])
+				} else {
+					data, err = decodeSector62(stream[j+3:])
+				}
+				if err == nil {
+					sectors[sector] = data
+					volume = vol
+				}
+				break
+			}
+		}
+	}
+
+	for s, data := range sectors {
+		if data == nil {
+			return sectors, volume, fmt.Errorf("Sector %d not found", s)
+		}
+	}
+
+	return sectors, volume, nil
+
+}
+
+// Denibblize converts a .nib image back into a DOS ordered sector image,
+// returning the image data and the volume number found in the address fields.
+func Denibblize(nibbles []byte) ([]byte, int, error) {
+
+	if len(nibbles) != DISK_NIBBLE_LENGTH {
+		return nil, -1, errors.New("Incorrect nibble image size")
+	}
+
+	tracks := make([][]byte, STD_TRACKS_PER_DISK)
+	for track := range tracks {
+		tracks[track] = nibbles[track*TRACK_NIBBLE_LENGTH : (track+1)*TRACK_NIBBLE_LENGTH]
+	}
+
+	return denibblizeTracks(tracks)
+
+}
+
+// denibblizeTracks decodes one nibble stream per track into a DOS ordered
+// sector image, working out 13 or 16 sectors from track 0.
+func denibblizeTracks(tracks [][]byte) ([]byte, int, error) {
+
+	if len(tracks) < STD_TRACKS_PER_DISK {
+		return nil, -1, errors.New("Too few tracks")
+	}
+
+	spt := STD_SECTORS_PER_TRACK
+	order := DOS_33_SECTOR_ORDER
+
+	if _, _, err := DenibblizeTrack(tracks[0], spt); err != nil {
+		if _, _, err13 := DenibblizeTrack(tracks[0], STD_SECTORS_PER_TRACK_OLD); err13 == nil {
+			spt = STD_SECTORS_PER_TRACK_OLD
+			order = DOS_32_SECTOR_ORDER
+		}
+	}
+
+	out := make([]byte, STD_TRACKS_PER_DISK*spt*STD_BYTES_PER_SECTOR)
+	volume := -1
+
+	for track := 0; track < STD_TRACKS_PER_DISK; track++ {
+		sectors, vol, err := DenibblizeTrack(tracks[track], spt)
+		if err != nil {
+			return nil, -1, fmt.Errorf("Track %d: %s", track, err.Error())
+		}
+		if volume == -1 {
+			volume = vol
+		}
+		for p, data := range sectors {
+			offset := ((track * spt) + order[p]) * STD_BYTES_PER_SECTOR
+			copy(out[offset:], data)
+		}
+	}
+
+	return out, volume, nil
+
+}
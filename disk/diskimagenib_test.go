@@ -0,0 +1,165 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math/rand"
+	"testing"
+)
+
+func randomImage(size int) []byte {
+	r := rand.New(rand.NewSource(int64(size)))
+	data := make([]byte, size)
+	r.Read(data)
+	return data
+}
+
+func TestNibbleRoundTrip16(t *testing.T) {
+
+	dsk := &DSKWrapper{
+		Data:               randomImage(STD_DISK_BYTES),
+		CurrentSectorOrder: DOS_33_SECTOR_ORDER,
+		DOSVolumeID:        17,
+	}
+
+	nib, err := dsk.NibblizeWithOptions(dsk.NibbleOptions())
+	if err != nil {
+		t.Fatalf("Nibblize failed: %v", err)
+	}
+
+	if len(nib) != DISK_NIBBLE_LENGTH {
+		t.Fatalf("Expected %d nibbles, got %d", DISK_NIBBLE_LENGTH, len(nib))
+	}
+
+	data, volume, err := Denibblize(nib)
+	if err != nil {
+		t.Fatalf("Denibblize failed: %v", err)
+	}
+
+	if volume != 17 {
+		t.Fatalf("Expected volume 17, got %d", volume)
+	}
+
+	if !bytes.Equal(data, dsk.Data) {
+		t.Fatalf("Sector data did not survive round trip")
+	}
+
+}
+
+func TestNibbleRoundTrip13(t *testing.T) {
+
+	dsk := &DSKWrapper{
+		Data: randomImage(STD_DISK_BYTES_OLD),
+	}
+
+	nib, err := dsk.NibblizeWithOptions(dsk.NibbleOptions())
+	if err != nil {
+		t.Fatalf("Nibblize failed: %v", err)
+	}
+
+	data, volume, err := Denibblize(nib)
+	if err != nil {
+		t.Fatalf("Denibblize failed: %v", err)
+	}
+
+	if volume != DEFAULT_VOLUME_ID {
+		t.Fatalf("Expected volume %d, got %d", DEFAULT_VOLUME_ID, volume)
+	}
+
+	if !bytes.Equal(data, dsk.Data) {
+		t.Fatalf("Sector data did not survive round trip")
+	}
+
+}
+
+func TestWOZHeader(t *testing.T) {
+
+	dsk := &DSKWrapper{
+		Data:               randomImage(STD_DISK_BYTES),
+		CurrentSectorOrder: DOS_33_SECTOR_ORDER,
+	}
+
+	woz, err := dsk.WOZ(dsk.NibbleOptions())
+	if err != nil {
+		t.Fatalf("WOZ failed: %v", err)
+	}
+
+	if !bytes.Equal(woz[:8], MAGIC_WOZ2) {
+		t.Fatalf("Bad magic")
+	}
+
+	if binary.LittleEndian.Uint32(woz[8:12]) != crc32.ChecksumIEEE(woz[12:]) {
+		t.Fatalf("Bad CRC")
+	}
+
+	if string(woz[248:252]) != "TRKS" {
+		t.Fatalf("TRKS chunk not where expected")
+	}
+
+	for track := 0; track < STD_TRACKS_PER_DISK; track++ {
+		entry := woz[256+track*8:]
+		start := int(binary.LittleEndian.Uint16(entry))
+		count := int(binary.LittleEndian.Uint32(entry[4:]))
+		if start < 3 || count == 0 || count > 51200 {
+			t.Fatalf("Track %d has bad TRK entry (block %d, %d bits)", track, start, count)
+		}
+	}
+
+}
+
+func TestWOZRoundTrip(t *testing.T) {
+
+	dsk := &DSKWrapper{
+		Data:               randomImage(STD_DISK_BYTES),
+		CurrentSectorOrder: DOS_33_SECTOR_ORDER,
+		DOSVolumeID:        42,
+	}
+
+	woz, err := dsk.WOZ(dsk.NibbleOptions())
+	if err != nil {
+		t.Fatalf("WOZ failed: %v", err)
+	}
+
+	data, volume, err := DeWOZ(woz)
+	if err != nil {
+		t.Fatalf("DeWOZ failed: %v", err)
+	}
+
+	if volume != 42 {
+		t.Fatalf("Expected volume 42, got %d", volume)
+	}
+
+	if !bytes.Equal(data, dsk.Data) {
+		t.Fatalf("Sector data did not survive round trip")
+	}
+
+}
+
+func TestNibbleTrackTooLong(t *testing.T) {
+
+	dsk := &DSKWrapper{
+		Data:               randomImage(STD_DISK_BYTES),
+		CurrentSectorOrder: DOS_33_SECTOR_ORDER,
+	}
+
+	// the default gaps only run over the track length with trailing sync
+	opts := dsk.NibbleOptions()
+	if _, err := dsk.NibblizeWithOptions(opts); err != nil {
+		t.Fatalf("Nibblize failed with the default gaps: %v", err)
+	}
+
+	for _, gaps := range [][3]int{{15, 6, 50}, {300, 6, 0}, {0, 40, 0}} {
+		opts.Gap1, opts.Gap2, opts.Gap3 = gaps[0], gaps[1], gaps[2]
+		if _, err := dsk.NibblizeWithOptions(opts); err == nil {
+			t.Errorf("Gaps %v: expected an error for a track longer than %d nibbles", gaps, TRACK_NIBBLE_LENGTH)
+		}
+	}
+
+	// the same gaps fit in a WOZ bitstream
+	opts.Bitstream = true
+	if _, err := dsk.NibblizeTrack(0, opts); err != nil {
+		t.Fatalf("Expected the bitstream track to be built: %v", err)
+	}
+
+}
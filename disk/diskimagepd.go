@@ -1009,13 +1009,9 @@ func (d *DSKWrapper) PRODOSGetCatalog(startblock int, pattern string) (*VDH, []P
 	var e error
 	var vtoc *VDH
 
-	fmt.Printf("FormatID = %s", d.Format.String())
-
 	if d.Format.ID == DF_PRODOS_800KB || d.Format.ID == DF_PRODOS_CUSTOM {
-		fmt.Println("HC VDH")
 		vtoc, e = d.PRODOS800GetVDH(startblock)
 	} else {
-		fmt.Println("LC VDH")
 		vtoc, e = d.PRODOSGetVDH(startblock)
 	}
 	if e != nil {
@@ -1037,8 +1033,6 @@ func (d *DSKWrapper) PRODOSGetCatalog(startblock int, pattern string) (*VDH, []P
 
 	nextblock := int(data[2]) + 256*int(data[3])
 
-	fmt.Printf("ActiveCount = %d\n", filecount)
-
 	entrypointer := 4 + PRODOS_ENTRY_SIZE
 
 	for activeentries < filecount {
@@ -1053,7 +1047,6 @@ func (d *DSKWrapper) PRODOSGetCatalog(startblock int, pattern string) (*VDH, []P
 
 				var skipname bool = false
 				if re != nil {
-					fmt.Printf("Checking [%s] against regex /%s/\n", fd.Name(), patterntmp)
 					skipname = !re.MatchString(fd.Name())
 				}
 
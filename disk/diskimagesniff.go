@@ -0,0 +1,153 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+	Content sniffing...
+
+	Decides whether a file is worth handing to NewDSKWrapperBin without
+	trusting its name: 2IMG and WOZ headers, nibble images, and the sizes
+	of sector images backed up by a look for a DOS VTOC, a ProDOS volume
+	directory header, a Pascal directory or boot code.
+*/
+
+const (
+	SniffKind2MG    = "2mg"
+	SniffKindWOZ    = "woz"
+	SniffKindNIB    = "nib"
+	SniffKindDOS    = "dos"
+	SniffKindProDOS = "prodos"
+	SniffKindPascal = "pascal"
+	SniffKindBoot   = "boot"
+)
+
+// offsets of block 2 in a 140K image, by file sector order
+const sniffVDHOffsetPO = 2 * 512
+const sniffVDHOffsetDO = 0x0b * STD_BYTES_PER_SECTOR
+
+// SniffImage looks at the content of a file and returns what kind of disk
+// image it appears to be, or an error saying why it is not one.
+func SniffImage(data []byte) (string, error) {
+
+	switch {
+	case len(data) == 0:
+		return "", errors.New("empty file")
+	case len(data) >= 64 && string(data[:4]) == "2IMG":
+		return SniffKind2MG, nil
+	case IsWOZ(data):
+		return SniffKindWOZ, nil
+	case len(data) == DISK_NIBBLE_LENGTH:
+		return SniffKindNIB, nil
+	}
+
+	switch len(data) {
+	case STD_DISK_BYTES, STD_DISK_BYTES + 64:
+		return sniffFloppy(data[:STD_DISK_BYTES], STD_SECTORS_PER_TRACK)
+	case STD_DISK_BYTES_OLD:
+		return sniffFloppy(data, STD_SECTORS_PER_TRACK_OLD)
+	}
+
+	if len(data)%512 != 0 && len(data)%512 != 64 {
+		return "", fmt.Errorf("unrecognised size %d bytes", len(data))
+	}
+	if len(data) < PRODOS_400KB_DISK_BYTES {
+		return "", fmt.Errorf("unrecognised size %d bytes", len(data))
+	}
+
+	// 3.5" and hard disk images are ProDOS ordered block images
+	if sniffVDH(data, sniffVDHOffsetPO) {
+		return SniffKindProDOS, nil
+	}
+
+	return "", fmt.Errorf("no ProDOS volume directory in %d byte block image", len(data))
+}
+
+// SniffHeader is a quick look at the first bytes and the size of a file
+// before reading the rest: it returns why the file cannot be a disk image,
+// or nil if SniffImage should look at all of it.
+func SniffHeader(header []byte, size int64) error {
+
+	switch {
+	case size == 0:
+		return errors.New("empty file")
+	case len(header) >= 4 && string(header[:4]) == "2IMG":
+		return nil
+	case IsWOZ(header):
+		return nil
+	}
+
+	switch size {
+	case DISK_NIBBLE_LENGTH, STD_DISK_BYTES, STD_DISK_BYTES + 64, STD_DISK_BYTES_OLD:
+		return nil
+	}
+
+	if (size%512 == 0 || size%512 == 64) && size >= PRODOS_400KB_DISK_BYTES {
+		return nil
+	}
+
+	return fmt.Errorf("unrecognised size %d bytes", size)
+}
+
+func sniffFloppy(data []byte, spt int) (string, error) {
+
+	if sniffVTOC(data, spt) {
+		return SniffKindDOS, nil
+	}
+
+	if spt == STD_SECTORS_PER_TRACK {
+		if sniffVDH(data, sniffVDHOffsetPO) || sniffVDH(data, sniffVDHOffsetDO) {
+			return SniffKindProDOS, nil
+		}
+		if sniffPascal(data, sniffVDHOffsetPO) || sniffPascal(data, sniffVDHOffsetDO) {
+			return SniffKindPascal, nil
+		}
+	}
+
+	// boot code without a recognisable filesystem, eg. games with their own loader
+	if !isBlank(data[:STD_BYTES_PER_SECTOR]) && data[0] != 0x00 {
+		return SniffKindBoot, nil
+	}
+
+	if isBlank(data) {
+		return "", errors.New("image is blank")
+	}
+
+	return "", errors.New("no VTOC, volume directory or boot code found")
+}
+
+// sniffVTOC checks for a DOS VTOC at track 17, sector 0, which is at the same
+// place in DOS and ProDOS ordered files.
+func sniffVTOC(data []byte, spt int) bool {
+
+	v := data[17*spt*STD_BYTES_PER_SECTOR:]
+
+	return v[0x01] < STD_TRACKS_PER_DISK &&
+		v[0x27] == 122 &&
+		v[0x34] >= STD_TRACKS_PER_DISK && v[0x34] <= 50 &&
+		int(v[0x35]) == spt &&
+		v[0x36] == 0x00 && v[0x37] == 0x01
+}
+
+func sniffVDH(data []byte, offset int) bool {
+
+	if offset+0x2b > len(data) {
+		return false
+	}
+	v := data[offset:]
+
+	return v[0x00] == 0 && v[0x01] == 0 &&
+		v[0x04]&0xf0 == 0xf0 && v[0x04]&0x0f != 0 &&
+		v[0x23] == 0x27 && v[0x24] == 0x0d
+}
+
+func sniffPascal(data []byte, offset int) bool {
+
+	v := data[offset:]
+
+	return v[0x00] == 0 && v[0x01] == 0 &&
+		v[0x02] == 6 && v[0x03] == 0 &&
+		v[0x06] > 0 && v[0x06] <= 7
+}
@@ -0,0 +1,72 @@
+package disk
+
+import "testing"
+
+func TestSniffImage(t *testing.T) {
+
+	dos := makeDOSImage()
+	prodos := makeProDOSImage(t, "do")
+
+	boot := make([]byte, STD_DISK_BYTES)
+	boot[0] = 0x01
+	boot[1] = 0xa5
+
+	tests := []struct {
+		name string
+		data []byte
+		kind string
+	}{
+		{"dos", dos.Data, SniffKindDOS},
+		{"prodos", prodos.Data, SniffKindProDOS},
+		{"boot", boot, SniffKindBoot},
+		{"nib", make([]byte, DISK_NIBBLE_LENGTH), SniffKindNIB},
+		{"blank", make([]byte, STD_DISK_BYTES), ""},
+		{"text", []byte("HELLO WORLD\n"), ""},
+	}
+
+	for _, test := range tests {
+		kind, err := SniffImage(test.data)
+		if kind != test.kind {
+			t.Errorf("%s: expected %q, got %q (%v)", test.name, test.kind, kind, err)
+		}
+		if kind == "" && err == nil {
+			t.Errorf("%s: expected a reason for rejecting", test.name)
+		}
+	}
+
+}
+
+func TestSniffHeader(t *testing.T) {
+
+	dos := makeDOSImage()
+	woz, err := dos.WOZ(dos.NibbleOptions())
+	if err != nil {
+		t.Fatalf("Unable to make a WOZ image: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header []byte
+		size   int64
+		ok     bool
+	}{
+		{"dsk", make([]byte, 64), STD_DISK_BYTES, true},
+		{"13 sector", make([]byte, 64), STD_DISK_BYTES_OLD, true},
+		{"nib", make([]byte, 64), DISK_NIBBLE_LENGTH, true},
+		{"2mg", append([]byte("2IMG"), make([]byte, 60)...), 1000, true},
+		{"woz", woz[:64], int64(len(woz)), true},
+		{"800k", make([]byte, 64), 819200, true},
+		{"hdv with header", make([]byte, 64), 32*1024*1024 + 64, true},
+		{"empty", nil, 0, false},
+		{"text", []byte("HELLO WORLD\n"), 12, false},
+		{"small blocks", make([]byte, 64), 512 * 100, false},
+	}
+
+	for _, test := range tests {
+		err := SniffHeader(test.header, test.size)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: expected ok=%v, got %v", test.name, test.ok, err)
+		}
+	}
+
+}
@@ -0,0 +1,315 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+	Installing boot code...
+
+	DOS 3.3 lives on tracks 0-2, which the VTOC normally reserves.  Disks
+	that had DOS stripped to gain space may have file sectors on those
+	tracks, so before the DOS image is written the tracks are reserved in
+	the VTOC and any file sectors found there are moved elsewhere.
+
+	ProDOS only needs its loader in blocks 0-1 and the PRODOS kernel plus a
+	.SYSTEM program in the volume directory.
+*/
+
+const DOS_IMAGE_BYTES = DOS_IMAGE_TRACKS * STD_SECTORS_PER_TRACK * STD_BYTES_PER_SECTOR
+const PRODOS_BOOT_BLOCKS = 2
+const PRODOS_SYSTEM_ADDRESS = 0x2000
+
+func dosGreetingOffset() int {
+	return (DOS_GREETING_TRACK*STD_SECTORS_PER_TRACK+DOS_GREETING_SECTOR)*STD_BYTES_PER_SECTOR + DOS_GREETING_SECTOR_OFFSET
+}
+
+// SetDOSImageGreeting stores the greeting program name in a DOS 3.3 image,
+// high bit set and padded with spaces as DOS expects.
+func SetDOSImageGreeting(image []byte, name string) error {
+
+	if len(image) != DOS_IMAGE_BYTES {
+		return errors.New("DOS image is the wrong size")
+	}
+
+	name = strings.ToUpper(name)
+	if len(name) > DOS_GREETING_LENGTH {
+		return fmt.Errorf("Greeting name longer than %d characters", DOS_GREETING_LENGTH)
+	}
+
+	offset := dosGreetingOffset()
+	for i := 0; i < DOS_GREETING_LENGTH; i++ {
+		ch := byte(' ')
+		if i < len(name) {
+			ch = name[i]
+		}
+		image[offset+i] = ch | 0x80
+	}
+
+	return nil
+}
+
+// DOSImageGreeting returns the greeting program name from a DOS 3.3 image
+func DOSImageGreeting(image []byte) string {
+
+	if len(image) != DOS_IMAGE_BYTES {
+		return ""
+	}
+
+	offset := dosGreetingOffset()
+	name := stripHighBit(image[offset : offset+DOS_GREETING_LENGTH])
+
+	return strings.TrimRight(string(name), " ")
+}
+
+type tsPointer struct {
+	t, s, offset int
+}
+
+// appleDOSFileSectorRefs maps every sector on tracks 0-2 that belongs to a
+// file (T/S lists and data) to the places that point at it.
+func (dsk *DSKWrapper) appleDOSFileSectorRefs() (map[[2]int][]tsPointer, error) {
+
+	refs := make(map[[2]int][]tsPointer)
+	spt := dsk.Format.SPT()
+
+	add := func(t, s int, from tsPointer) {
+		if t < DOS_IMAGE_TRACKS {
+			refs[[2]int{t, s}] = append(refs[[2]int{t, s}], from)
+		}
+	}
+
+	_, files, err := dsk.AppleDOSGetCatalog("")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fd := range files {
+
+		tl, sl := fd.GetTrackSectorListStart()
+		from := tsPointer{fd.trackid, fd.sectorid, fd.sectoroffset}
+		seen := make(map[int]bool)
+
+		for (tl != 0 || sl != 0) && tl < STD_TRACKS_PER_DISK && sl < spt && !seen[tl*spt+sl] {
+
+			seen[tl*spt+sl] = true
+			add(tl, sl, from)
+
+			if err := dsk.Seek(tl, sl); err != nil {
+				return nil, err
+			}
+			data := dsk.Read()
+
+			for ptr := 0x0c; ptr < STD_BYTES_PER_SECTOR; ptr += 2 {
+				t, s := int(data[ptr]), int(data[ptr+1])
+				if (t == 0 && s == 0) || t >= STD_TRACKS_PER_DISK || s >= spt {
+					continue
+				}
+				add(t, s, tsPointer{tl, sl, ptr})
+			}
+
+			from = tsPointer{tl, sl, 1}
+			tl, sl = int(data[1]), int(data[2])
+		}
+	}
+
+	return refs, nil
+}
+
+// AppleDOSInstallDOS writes a DOS 3.3 image to tracks 0-2, reserving them in
+// the VTOC and relocating any file sectors stored there.  If greeting is not
+// empty it replaces the greeting program name in the image.  Returns the
+// number of sectors relocated.
+func (dsk *DSKWrapper) AppleDOSInstallDOS(image []byte, greeting string) (int, error) {
+
+	if dsk.Format.ID != DF_DOS_SECTORS_16 {
+		return 0, errors.New("DOS 3.3 can only be installed on a 16 sector DOS disk")
+	}
+
+	if len(image) != DOS_IMAGE_BYTES {
+		return 0, fmt.Errorf("DOS image must be %d bytes", DOS_IMAGE_BYTES)
+	}
+
+	image = append([]byte(nil), image...)
+	if greeting != "" {
+		if err := SetDOSImageGreeting(image, greeting); err != nil {
+			return 0, err
+		}
+	}
+
+	refs, err := dsk.appleDOSFileSectorRefs()
+	if err != nil {
+		return 0, err
+	}
+
+	// work on a copy so a failure leaves the disk untouched
+	backup := append([]byte(nil), dsk.Data...)
+	moved, err := dsk.appleDOSInstallDOS(image, refs)
+	if err != nil {
+		copy(dsk.Data, backup)
+		return 0, err
+	}
+
+	return moved, nil
+}
+
+func (dsk *DSKWrapper) appleDOSInstallDOS(image []byte, refs map[[2]int][]tsPointer) (int, error) {
+
+	// reserve the DOS tracks so nothing is allocated there
+	vtoc, err := dsk.AppleDOSGetVTOC()
+	if err != nil {
+		return 0, err
+	}
+	for t := 0; t < DOS_IMAGE_TRACKS; t++ {
+		for s := 0; s < STD_SECTORS_PER_TRACK; s++ {
+			vtoc.SetTSFree(t, s, false)
+		}
+	}
+	if err := vtoc.Publish(dsk); err != nil {
+		return 0, err
+	}
+
+	// move file sectors out of the way
+	if len(refs) > 0 {
+
+		old := make([][2]int, 0, len(refs))
+		for k := range refs {
+			old = append(old, k)
+		}
+		sort.Slice(old, func(i, j int) bool {
+			return old[i][0]*STD_SECTORS_PER_TRACK+old[i][1] < old[j][0]*STD_SECTORS_PER_TRACK+old[j][1]
+		})
+
+		tsBlocks, dataBlocks, err := dsk.AppleDOSGetFreeSectors((len(old) - 1) * STD_BYTES_PER_SECTOR)
+		if err != nil {
+			return 0, fmt.Errorf("Cannot relocate %d file sectors off tracks 0-2: %v", len(old), err)
+		}
+		free := append(dataBlocks, tsBlocks...)
+
+		moves := make(map[[2]int][2]int)
+		for i, ts := range old {
+			moves[ts] = free[i]
+		}
+
+		for _, ts := range old {
+			dst := moves[ts]
+			if err := dsk.Seek(ts[0], ts[1]); err != nil {
+				return 0, err
+			}
+			data := append([]byte(nil), dsk.Read()...)
+			if err := dsk.Seek(dst[0], dst[1]); err != nil {
+				return 0, err
+			}
+			dsk.Write(data)
+			vtoc.SetTSFree(dst[0], dst[1], false)
+		}
+
+		// repoint references, which may themselves have moved
+		for _, ts := range old {
+			dst := moves[ts]
+			for _, ref := range refs[ts] {
+				loc := [2]int{ref.t, ref.s}
+				if m, ok := moves[loc]; ok {
+					loc = m
+				}
+				if err := dsk.Seek(loc[0], loc[1]); err != nil {
+					return 0, err
+				}
+				data := append([]byte(nil), dsk.Read()...)
+				data[ref.offset] = byte(dst[0])
+				data[ref.offset+1] = byte(dst[1])
+				dsk.Write(data)
+			}
+		}
+
+		if err := vtoc.Publish(dsk); err != nil {
+			return 0, err
+		}
+	}
+
+	for t := 0; t < DOS_IMAGE_TRACKS; t++ {
+		for s := 0; s < STD_SECTORS_PER_TRACK; s++ {
+			if err := dsk.Seek(t, s); err != nil {
+				return 0, err
+			}
+			offset := (t*STD_SECTORS_PER_TRACK + s) * STD_BYTES_PER_SECTOR
+			dsk.Write(image[offset : offset+STD_BYTES_PER_SECTOR])
+		}
+	}
+
+	return len(refs), nil
+}
+
+// PRODOSReadBootBlocks returns the loader in blocks 0-1
+func (dsk *DSKWrapper) PRODOSReadBootBlocks() ([]byte, error) {
+
+	boot := make([]byte, 0, PRODOS_BOOT_BLOCKS*512)
+	for b := 0; b < PRODOS_BOOT_BLOCKS; b++ {
+		var data []byte
+		var err error
+		if dsk.Format.ID == DF_PRODOS_800KB || dsk.Format.ID == DF_PRODOS_CUSTOM {
+			data, err = dsk.PRODOS800GetBlock(b)
+		} else {
+			data, err = dsk.PRODOSGetBlock(b)
+		}
+		if err != nil {
+			return nil, err
+		}
+		boot = append(boot, data...)
+	}
+
+	return boot, nil
+}
+
+// PRODOSInstallSystem writes the ProDOS loader to blocks 0-1 and copies
+// the PRODOS kernel and an optional .SYSTEM startup program to the volume
+// directory.
+func (dsk *DSKWrapper) PRODOSInstallSystem(boot []byte, prodos []byte, systemName string, system []byte) error {
+
+	if len(boot) != PRODOS_BOOT_BLOCKS*512 {
+		return fmt.Errorf("ProDOS boot code must be %d bytes", PRODOS_BOOT_BLOCKS*512)
+	}
+	if len(prodos) == 0 {
+		return errors.New("No PRODOS kernel to install")
+	}
+	if system != nil && !strings.HasSuffix(strings.ToUpper(systemName), ".SYSTEM") {
+		return errors.New("Startup program name must end in .SYSTEM")
+	}
+
+	for b := 0; b < PRODOS_BOOT_BLOCKS; b++ {
+		if err := dsk.PRODOSWrite(b, boot[b*512:(b+1)*512]); err != nil {
+			return err
+		}
+	}
+
+	// boot blocks must never be handed out to files
+	vb, err := dsk.PRODOSGetVolumeBitmap()
+	if dsk.Format.ID == DF_PRODOS_800KB || dsk.Format.ID == DF_PRODOS_CUSTOM {
+		vb, err = dsk.PRODOS800GetVolumeBitmap()
+	}
+	if err != nil {
+		return err
+	}
+	if vb.IsBlockFree(0) || vb.IsBlockFree(1) {
+		vb.SetBlockFree(0, false)
+		vb.SetBlockFree(1, false)
+		if err := dsk.PRODOSWrite(vb.blockid, vb.Data); err != nil {
+			return err
+		}
+	}
+
+	if err := dsk.PRODOSWriteFile("", "PRODOS", FileType_PD_SYS, prodos, 0x0000); err != nil {
+		return err
+	}
+
+	if system != nil {
+		if err := dsk.PRODOSWriteFile("", systemName, FileType_PD_SYS, system, PRODOS_SYSTEM_ADDRESS); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
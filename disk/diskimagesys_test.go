@@ -0,0 +1,117 @@
+package disk
+
+import (
+	"bytes"
+	"testing"
+)
+
+// makeDOSImage builds an empty DOS 3.3 volume with only the given tracks free
+func makeDOSImage(freeTracks ...int) *DSKWrapper {
+
+	dsk := &DSKWrapper{
+		Data:               make([]byte, STD_DISK_BYTES),
+		Format:             GetDiskFormat(DF_DOS_SECTORS_16),
+		Layout:             SectorOrderDOS33,
+		CurrentSectorOrder: DOS_33_SECTOR_ORDER,
+	}
+
+	vtoc := &VTOC{}
+	vtoc.t, vtoc.s = 17, 0
+	vtoc.Data[0x01], vtoc.Data[0x02] = 17, 15
+	vtoc.Data[0x03] = 3
+	vtoc.Data[0x06] = 254
+	vtoc.Data[0x27] = 122
+	vtoc.Data[0x34], vtoc.Data[0x35] = 35, 16
+	vtoc.Data[0x36] = 0x00
+	vtoc.Data[0x37] = 0x01
+	for _, t := range freeTracks {
+		for s := 0; s < 16; s++ {
+			vtoc.SetTSFree(t, s, true)
+		}
+	}
+	vtoc.Publish(dsk)
+
+	for s := 15; s > 0; s-- {
+		dsk.Seek(17, s)
+		data := make([]byte, 256)
+		if s > 1 {
+			data[1], data[2] = 17, byte(s-1)
+		}
+		dsk.Write(data)
+	}
+
+	return dsk
+}
+
+func TestAppleDOSInstallDOSRelocates(t *testing.T) {
+
+	dsk := makeDOSImage(2)
+
+	content := bytes.Repeat([]byte("DISKM8"), 500)
+	if err := dsk.AppleDOSWriteFile("HELLO", FileTypeTXT, content, 0); err != nil {
+		t.Fatalf("AppleDOSWriteFile failed: %v", err)
+	}
+
+	// free up somewhere for the file to go
+	vtoc, _ := dsk.AppleDOSGetVTOC()
+	for s := 0; s < 16; s++ {
+		vtoc.SetTSFree(30, s, true)
+	}
+	vtoc.Publish(dsk)
+
+	image := randomImage(DOS_IMAGE_BYTES)
+	image[0] = 0x01
+
+	moved, err := dsk.AppleDOSInstallDOS(image, "hello")
+	if err != nil {
+		t.Fatalf("AppleDOSInstallDOS failed: %v", err)
+	}
+	if moved == 0 {
+		t.Fatalf("Expected file sectors to be relocated")
+	}
+
+	installed, _ := dsk.AppleDOSReadDOSImage()
+	if DOSImageGreeting(installed) != "HELLO" {
+		t.Fatalf("Expected greeting HELLO, got %q", DOSImageGreeting(installed))
+	}
+	SetDOSImageGreeting(image, "HELLO")
+	if !bytes.Equal(installed, image) {
+		t.Fatalf("DOS image was not written to tracks 0-2")
+	}
+
+	fd, err := dsk.AppleDOSNamedCatalogEntry("HELLO")
+	if err != nil {
+		t.Fatalf("File lost: %v", err)
+	}
+	tslist, err := dsk.AppleDOSGetFileSectors(*fd, 0)
+	if err != nil {
+		t.Fatalf("AppleDOSGetFileSectors failed: %v", err)
+	}
+	vtoc, _ = dsk.AppleDOSGetVTOC()
+	for _, pair := range tslist {
+		if pair[0] < DOS_IMAGE_TRACKS || vtoc.IsTSFree(pair[0], pair[1]) {
+			t.Fatalf("File sector T%d S%d not relocated correctly", pair[0], pair[1])
+		}
+	}
+	data, err := dsk.AppleDOSReadFileSectors(*fd, -1)
+	if err != nil || !bytes.Contains(data, content) {
+		t.Fatalf("File content did not survive relocation")
+	}
+
+}
+
+func TestAppleDOSInstallDOSNoSpace(t *testing.T) {
+
+	dsk := makeDOSImage(2)
+	dsk.AppleDOSWriteFile("HELLO", FileTypeTXT, []byte("HELLO"), 0)
+	before := append([]byte(nil), dsk.Data...)
+
+	image := make([]byte, DOS_IMAGE_BYTES)
+	if _, err := dsk.AppleDOSInstallDOS(image, ""); err == nil {
+		t.Fatalf("Expected failure with no room to relocate")
+	}
+	if !bytes.Equal(before, dsk.Data) {
+		t.Fatalf("Failed install modified the disk")
+	}
+
+}
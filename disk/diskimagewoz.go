@@ -0,0 +1,239 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+	WOZ 2.0 writer, WOZ 1.0 and 2.0 reader...
+
+	Layout is header (12 bytes), INFO (60), TMAP (160) and TRKS, with the
+	track bitstreams starting at block 3 (offset 1536) as the spec requires.
+
+	Reading only handles 5.25" disks whose tracks decode to standard 13 or
+	16 sector address and data fields; copy protected images will not.
+*/
+
+const WOZ_BLOCK_SIZE = 512
+const WOZ_CREATOR = "DiskM8"
+
+const WOZ1_TRACK_SIZE = 6656
+const WOZ1_BITSTREAM_SIZE = 6646
+
+var MAGIC_WOZ1 = []byte{'W', 'O', 'Z', '1', 0xff, 0x0a, 0x0d, 0x0a}
+var MAGIC_WOZ2 = []byte{'W', 'O', 'Z', '2', 0xff, 0x0a, 0x0d, 0x0a}
+
+func wozChunk(id string, data []byte) []byte {
+	out := make([]byte, 8, 8+len(data))
+	copy(out[0:4], id)
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(data)))
+	return append(out, data...)
+}
+
+// WOZ returns the disk encoded as a WOZ 2.0 image.
+func (d *DSKWrapper) WOZ(opts NibbleOptions) ([]byte, error) {
+
+	spt, err := d.nibbleGeometry()
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Bitstream = true
+	opts = opts.withDefaults(spt)
+
+	// track bitstreams, each padded to a whole number of blocks
+	trk := make([]byte, 160*8)
+	bits := make([]byte, 0)
+	largest := 0
+	block := 3
+
+	for track := 0; track < STD_TRACKS_PER_DISK; track++ {
+		t, err := d.NibblizeTrack(track, opts)
+		if err != nil {
+			return nil, err
+		}
+		data, count := t.Bits()
+
+		blocks := (len(data) + WOZ_BLOCK_SIZE - 1) / WOZ_BLOCK_SIZE
+		padded := make([]byte, blocks*WOZ_BLOCK_SIZE)
+		copy(padded, data)
+		bits = append(bits, padded...)
+
+		binary.LittleEndian.PutUint16(trk[track*8:], uint16(block))
+		binary.LittleEndian.PutUint16(trk[track*8+2:], uint16(blocks))
+		binary.LittleEndian.PutUint32(trk[track*8+4:], uint32(count))
+
+		block += blocks
+		if blocks > largest {
+			largest = blocks
+		}
+	}
+
+	info := make([]byte, 60)
+	info[0] = 2 // INFO version
+	info[1] = 1 // 5.25"
+	if d.WriteProtected {
+		info[2] = 1
+	}
+	info[3] = 0 // not cross track synchronized
+	info[4] = 1 // cleaned (no MC3470 fake bits)
+	creator := []byte(WOZ_CREATOR)
+	for i := 0; i < 32; i++ {
+		if i < len(creator) {
+			info[5+i] = creator[i]
+		} else {
+			info[5+i] = ' '
+		}
+	}
+	info[37] = 1 // sides
+	if spt == STD_SECTORS_PER_TRACK_OLD {
+		info[38] = 2
+	} else {
+		info[38] = 1
+	}
+	info[39] = byte(opts.BitTiming)
+	binary.LittleEndian.PutUint16(info[44:], uint16(largest))
+
+	// whole tracks also answer for the adjacent quarter tracks
+	tmap := make([]byte, 160)
+	for i := range tmap {
+		tmap[i] = 0xff
+	}
+	for track := 0; track < STD_TRACKS_PER_DISK; track++ {
+		tmap[track*4] = byte(track)
+		if track > 0 {
+			tmap[track*4-1] = byte(track)
+		}
+		tmap[track*4+1] = byte(track)
+	}
+
+	body := make([]byte, 0, 1536+len(bits))
+	body = append(body, wozChunk("INFO", info)...)
+	body = append(body, wozChunk("TMAP", tmap)...)
+	body = append(body, wozChunk("TRKS", append(trk, bits...))...)
+
+	out := make([]byte, 12, 12+len(body))
+	copy(out, MAGIC_WOZ2)
+	binary.LittleEndian.PutUint32(out[8:12], crc32.ChecksumIEEE(body))
+
+	return append(out, body...), nil
+
+}
+
+// IsWOZ reports whether data starts with a WOZ 1.0 or 2.0 header
+func IsWOZ(data []byte) bool {
+	return len(data) >= 12 && (bytes.Equal(data[:8], MAGIC_WOZ1) || bytes.Equal(data[:8], MAGIC_WOZ2))
+}
+
+// WOZTracks returns the nibble stream for each whole track of a 5.25" WOZ
+// image.  Unformatted tracks are returned as nil.
+func WOZTracks(data []byte) ([][]byte, error) {
+
+	if !IsWOZ(data) {
+		return nil, errors.New("Not a WOZ image")
+	}
+	version := data[3] - '0'
+
+	chunks := make(map[string][]byte)
+	for offset := 12; offset+8 <= len(data); {
+		id := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		if offset+8+size > len(data) {
+			return nil, fmt.Errorf("WOZ chunk %s is truncated", id)
+		}
+		chunks[id] = data[offset+8 : offset+8+size]
+		offset += 8 + size
+	}
+
+	info, tmap, trks := chunks["INFO"], chunks["TMAP"], chunks["TRKS"]
+	if len(info) < 2 || len(tmap) < 160 || trks == nil {
+		return nil, errors.New("WOZ image is missing INFO, TMAP or TRKS")
+	}
+	if info[1] != 1 {
+		return nil, errors.New("Only 5.25\" WOZ images are supported")
+	}
+
+	tracks := make([][]byte, STD_TRACKS_PER_DISK)
+	for track := range tracks {
+
+		idx := int(tmap[track*4])
+		if idx == 0xff {
+			continue
+		}
+
+		var bits []byte
+		var count int
+
+		if version == 1 {
+			start := idx * WOZ1_TRACK_SIZE
+			if start+WOZ1_TRACK_SIZE > len(trks) {
+				return nil, fmt.Errorf("WOZ track %d is truncated", track)
+			}
+			t := trks[start : start+WOZ1_TRACK_SIZE]
+			bits = t[:WOZ1_BITSTREAM_SIZE]
+			count = int(binary.LittleEndian.Uint16(t[6648:]))
+		} else {
+			if idx*8+8 > len(trks) {
+				return nil, fmt.Errorf("WOZ track %d is truncated", track)
+			}
+			start := int(binary.LittleEndian.Uint16(trks[idx*8:])) * WOZ_BLOCK_SIZE
+			blocks := int(binary.LittleEndian.Uint16(trks[idx*8+2:]))
+			count = int(binary.LittleEndian.Uint32(trks[idx*8+4:]))
+			if start+blocks*WOZ_BLOCK_SIZE > len(data) {
+				return nil, fmt.Errorf("WOZ track %d is truncated", track)
+			}
+			bits = data[start : start+blocks*WOZ_BLOCK_SIZE]
+		}
+
+		if count > len(bits)*8 {
+			return nil, fmt.Errorf("WOZ track %d has a bad bit count", track)
+		}
+
+		tracks[track] = bitsToNibbles(bits, count)
+	}
+
+	return tracks, nil
+
+}
+
+// bitsToNibbles reads a track bitstream the way the disk controller does,
+// shifting bits in until the high bit is set.  The stream is read twice
+// round so nibbles spanning the index are not lost.
+func bitsToNibbles(bits []byte, count int) []byte {
+
+	out := make([]byte, 0, count/4)
+	var b byte
+
+	for i := 0; i < count*2; i++ {
+		pos := i % count
+		bit := (bits[pos/8] >> uint(7-pos%8)) & 1
+		if b == 0 && bit == 0 {
+			continue
+		}
+		b = b<<1 | bit
+		if b&0x80 != 0 {
+			out = append(out, b)
+			b = 0
+		}
+	}
+
+	return out
+
+}
+
+// DeWOZ converts a WOZ image into a DOS ordered sector image, returning the
+// image data and the volume number found in the address fields.
+func DeWOZ(data []byte) ([]byte, int, error) {
+
+	tracks, err := WOZTracks(data)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return denibblizeTracks(tracks)
+
+}
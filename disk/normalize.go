@@ -0,0 +1,81 @@
+package disk
+
+import "bytes"
+
+/*
+	Normalized file data...
+
+	A file's data is read to the length its filesystem gives, which often
+	takes in slack from the last sector: Applesoft programs saved with a
+	length past the end of the program, text files padded out with zeros
+	or old data.  NormalizeFileData trims that off, so the same program
+	or text gives the same data wherever it came from.  Binaries are
+	already read to their declared length and are left as they are.
+*/
+
+// NormalizeFileData trims a file's data to its content: BASIC programs to
+// the end of the program, text to the first 0x00.  The data is returned
+// as is if it cannot be made sense of.
+func NormalizeFileData(kind CatalogEntryType, data []byte) []byte {
+
+	var l int
+	switch kind {
+	case CETBasicApplesoft:
+		l = ApplesoftProgramLength(data)
+	case CETBasicInteger:
+		l = IntegerProgramLength(data)
+	case CETText:
+		l = bytes.IndexByte(data, 0x00)
+	default:
+		return data
+	}
+
+	if l <= 0 {
+		return data
+	}
+
+	return data[:l]
+}
+
+// ApplesoftProgramLength follows the lines of a tokenized Applesoft program
+// to the zero link that ends it, returning the length including the link,
+// or 0 if the program does not end.
+func ApplesoftProgramLength(data []byte) int {
+
+	p := 0
+	for p+2 <= len(data) {
+
+		if data[p] == 0 && data[p+1] == 0 {
+			return p + 2
+		}
+
+		// link and line number, then tokens to a 0x00
+		if p+4 > len(data) {
+			return 0
+		}
+		end := bytes.IndexByte(data[p+4:], 0x00)
+		if end < 0 {
+			return 0
+		}
+		p += 4 + end + 1
+	}
+
+	return 0
+}
+
+// IntegerProgramLength follows the lines of a tokenized Integer BASIC
+// program, returning the length of the whole lines found.
+func IntegerProgramLength(data []byte) int {
+
+	p := 0
+	for p < len(data) {
+		// length, line number, tokens and a 0x01 end of line
+		l := int(data[p])
+		if l < 4 || p+l > len(data) || data[p+l-1] != 0x01 {
+			break
+		}
+		p += l
+	}
+
+	return p
+}
@@ -0,0 +1,51 @@
+package disk
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNormalizeFileData(t *testing.T) {
+
+	slack := []byte{0xa0, 0x4c, 0x00, 0x08, 0xff, 0x01, 0x37}
+
+	as := ApplesoftTokenize([]string{"10 HOME", "20 PRINT \"HELLO\"", "30 GOTO 20"})
+	ib := IntegerTokenize([]string{"10 PRINT \"HELLO\"", "20 GOTO 10"})
+	txt := []byte("HELLO\rWORLD\r")
+
+	cases := []struct {
+		name string
+		kind CatalogEntryType
+		data []byte
+	}{
+		{"applesoft", CETBasicApplesoft, as},
+		{"integer", CETBasicInteger, ib},
+		{"text", CETText, txt},
+	}
+
+	for _, c := range cases {
+		if got := NormalizeFileData(c.kind, c.data); !bytes.Equal(got, c.data) {
+			t.Fatalf("%s: expected a clean file to be left alone, got %d of %d bytes", c.name, len(got), len(c.data))
+		}
+		padded := append(append(append([]byte(nil), c.data...), 0x00), slack...)
+		if c.kind == CETText {
+			padded = append(append([]byte(nil), c.data...), make([]byte, 200)...)
+			padded = append(padded, slack...)
+		}
+		if got := NormalizeFileData(c.kind, padded); !bytes.Equal(got, c.data) {
+			t.Fatalf("%s: expected slack to be trimmed, got %d bytes for %d", c.name, len(got), len(c.data))
+		}
+	}
+
+	bin := append([]byte{0x20, 0x58, 0xfc, 0x00}, slack...)
+	if got := NormalizeFileData(CETBinary, bin); !bytes.Equal(got, bin) {
+		t.Fatalf("Expected a binary to be left alone")
+	}
+
+	// a program that never ends is left as it is
+	broken := []byte{0x01, 0x08, 0x0a, 0x00, 0x97}
+	if got := NormalizeFileData(CETBasicApplesoft, broken); !bytes.Equal(got, broken) {
+		t.Fatalf("Expected an unterminated program to be left alone")
+	}
+
+}
@@ -0,0 +1,364 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+	Binary patches...
+
+	IPS and BPS are the patch formats most used for Apple II and other
+	retro images, so patches made here can be applied by other tools and
+	the other way round.
+
+	IPS is a list of records, each a 3 byte offset and the bytes to put
+	there (or a run of one byte).  It has no checksums and can only reach
+	the first 16Mb, which is plenty for a floppy.  A 3 byte length after
+	the "EOF" marker truncates the target, as most tools expect.
+
+	BPS (beat) describes the target as copies from the source or the
+	target and literal bytes, and carries the CRC32 of the source, the
+	target and itself along with free form metadata.  MakeBPS only uses
+	source reads and literals, which is all two images of one disk need;
+	ApplyBPS takes all four actions.
+*/
+
+const (
+	ipsMagic     = "PATCH"
+	ipsEOF       = "EOF"
+	ipsMaxOffset = 0xffffff
+	ipsMaxRecord = 0xffff
+	ipsEOFOffset = 0x454f46 // "EOF" read as an offset
+
+	bpsMagic = "BPS1"
+)
+
+const (
+	bpsSourceRead = iota
+	bpsTargetRead
+	bpsSourceCopy
+	bpsTargetCopy
+)
+
+// MakeIPS returns an IPS patch that turns source into target
+func MakeIPS(source, target []byte) ([]byte, error) {
+
+	if len(target) > ipsMaxOffset {
+		return nil, errors.New("Target is too large for an IPS patch")
+	}
+
+	out := bytes.NewBufferString(ipsMagic)
+
+	record := func(off int, data []byte) {
+		out.Write([]byte{byte(off >> 16), byte(off >> 8), byte(off)})
+		out.Write([]byte{byte(len(data) >> 8), byte(len(data))})
+		out.Write(data)
+	}
+
+	differs := func(i int) bool {
+		return i >= len(source) || source[i] != target[i]
+	}
+
+	for i := 0; i < len(target); {
+
+		if !differs(i) {
+			i++
+			continue
+		}
+
+		// an offset reading as "EOF" would end the patch early
+		start := i
+		if start == ipsEOFOffset {
+			start--
+		}
+
+		// gaps shorter than a record header are cheaper to carry along
+		end := i + 1
+		for end < len(target) && end-start < ipsMaxRecord {
+			if differs(end) {
+				end++
+				continue
+			}
+			gap := end
+			for gap < len(target) && gap-end < 5 && !differs(gap) {
+				gap++
+			}
+			if gap < len(target) && gap-end < 5 && gap-start < ipsMaxRecord {
+				end = gap
+				continue
+			}
+			break
+		}
+
+		record(start, target[start:end])
+		i = end
+	}
+
+	out.WriteString(ipsEOF)
+
+	if len(target) < len(source) {
+		l := len(target)
+		out.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l)})
+	}
+
+	return out.Bytes(), nil
+}
+
+// ApplyIPS applies an IPS patch to source, returning the target
+func ApplyIPS(source, patch []byte) ([]byte, error) {
+
+	if len(patch) < len(ipsMagic)+len(ipsEOF) || string(patch[:len(ipsMagic)]) != ipsMagic {
+		return nil, errors.New("Not an IPS patch")
+	}
+
+	target := append([]byte(nil), source...)
+	p := len(ipsMagic)
+
+	for {
+		if p+3 > len(patch) {
+			return nil, errors.New("IPS patch ends without EOF")
+		}
+		if string(patch[p:p+3]) == ipsEOF {
+			p += 3
+			break
+		}
+		if p+5 > len(patch) {
+			return nil, errors.New("IPS record is cut short")
+		}
+
+		off := int(patch[p])<<16 | int(patch[p+1])<<8 | int(patch[p+2])
+		size := int(patch[p+3])<<8 | int(patch[p+4])
+		p += 5
+
+		var data []byte
+		if size == 0 {
+			// a run of one byte
+			if p+3 > len(patch) {
+				return nil, errors.New("IPS run is cut short")
+			}
+			count := int(patch[p])<<8 | int(patch[p+1])
+			data = bytes.Repeat([]byte{patch[p+2]}, count)
+			p += 3
+		} else {
+			if p+size > len(patch) {
+				return nil, errors.New("IPS record is cut short")
+			}
+			data = patch[p : p+size]
+			p += size
+		}
+
+		for len(target) < off+len(data) {
+			target = append(target, 0)
+		}
+		copy(target[off:], data)
+	}
+
+	if p+3 <= len(patch) {
+		l := int(patch[p])<<16 | int(patch[p+1])<<8 | int(patch[p+2])
+		if l < len(target) {
+			target = target[:l]
+		}
+	}
+
+	return target, nil
+}
+
+func bpsEncodeNumber(out *bytes.Buffer, n uint64) {
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			out.WriteByte(b | 0x80)
+			return
+		}
+		out.WriteByte(b)
+		n--
+	}
+}
+
+func bpsDecodeNumber(data []byte, p *int) (uint64, error) {
+	var n uint64
+	shift := uint64(1)
+	for {
+		if *p >= len(data) {
+			return 0, errors.New("BPS patch is cut short")
+		}
+		b := data[*p]
+		*p++
+		n += uint64(b&0x7f) * shift
+		if b&0x80 != 0 {
+			return n, nil
+		}
+		shift <<= 7
+		n += shift
+	}
+}
+
+// MakeBPS returns a BPS patch that turns source into target, with metadata
+// stored in the patch
+func MakeBPS(source, target []byte, metadata string) []byte {
+
+	out := bytes.NewBufferString(bpsMagic)
+	bpsEncodeNumber(out, uint64(len(source)))
+	bpsEncodeNumber(out, uint64(len(target)))
+	bpsEncodeNumber(out, uint64(len(metadata)))
+	out.WriteString(metadata)
+
+	action := func(kind int, length int) {
+		bpsEncodeNumber(out, uint64(length-1)<<2|uint64(kind))
+	}
+
+	same := func(i int) bool {
+		return i < len(source) && source[i] == target[i]
+	}
+
+	for i := 0; i < len(target); {
+		start := i
+		if same(i) {
+			for i < len(target) && same(i) {
+				i++
+			}
+			action(bpsSourceRead, i-start)
+			continue
+		}
+		for i < len(target) && !same(i) {
+			i++
+		}
+		action(bpsTargetRead, i-start)
+		out.Write(target[start:i])
+	}
+
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(source))
+	out.Write(crc)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(target))
+	out.Write(crc)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(out.Bytes()))
+	out.Write(crc)
+
+	return out.Bytes()
+}
+
+// BPSMetadata returns the metadata stored in a BPS patch
+func BPSMetadata(patch []byte) (string, error) {
+	_, _, metadata, _, err := bpsHeader(patch)
+	return metadata, err
+}
+
+func bpsHeader(patch []byte) (uint64, uint64, string, int, error) {
+
+	if len(patch) < len(bpsMagic)+12 || string(patch[:len(bpsMagic)]) != bpsMagic {
+		return 0, 0, "", 0, errors.New("Not a BPS patch")
+	}
+
+	p := len(bpsMagic)
+	sourceSize, err := bpsDecodeNumber(patch, &p)
+	if err != nil {
+		return 0, 0, "", 0, err
+	}
+	targetSize, err := bpsDecodeNumber(patch, &p)
+	if err != nil {
+		return 0, 0, "", 0, err
+	}
+	metaSize, err := bpsDecodeNumber(patch, &p)
+	if err != nil {
+		return 0, 0, "", 0, err
+	}
+	if uint64(p)+metaSize > uint64(len(patch)-12) {
+		return 0, 0, "", 0, errors.New("BPS metadata is cut short")
+	}
+
+	return sourceSize, targetSize, string(patch[p : p+int(metaSize)]), p + int(metaSize), nil
+}
+
+// ApplyBPS applies a BPS patch to source after checking the CRC32 of the
+// patch and the source, returning the target once its CRC32 is checked
+func ApplyBPS(source, patch []byte) ([]byte, error) {
+
+	sourceSize, targetSize, _, p, err := bpsHeader(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	footer := len(patch) - 12
+	if crc32.ChecksumIEEE(patch[:footer+8]) != binary.LittleEndian.Uint32(patch[footer+8:]) {
+		return nil, errors.New("BPS patch is damaged (checksum mismatch)")
+	}
+	if uint64(len(source)) != sourceSize || crc32.ChecksumIEEE(source) != binary.LittleEndian.Uint32(patch[footer:]) {
+		return nil, errors.New("BPS patch is for a different source")
+	}
+
+	target := make([]byte, 0, targetSize)
+	var sourceRel, targetRel int64
+
+	relative := func(n uint64) int64 {
+		if n&1 != 0 {
+			return -int64(n >> 1)
+		}
+		return int64(n >> 1)
+	}
+
+	for p < footer {
+		n, err := bpsDecodeNumber(patch, &p)
+		if err != nil {
+			return nil, err
+		}
+		length := int(n>>2) + 1
+		if uint64(len(target)+length) > targetSize {
+			return nil, errors.New("BPS patch writes past the end of the target")
+		}
+
+		switch n & 3 {
+		case bpsSourceRead:
+			o := len(target)
+			if o+length > len(source) {
+				return nil, errors.New("BPS patch reads past the end of the source")
+			}
+			target = append(target, source[o:o+length]...)
+		case bpsTargetRead:
+			if p+length > footer {
+				return nil, errors.New("BPS patch is cut short")
+			}
+			target = append(target, patch[p:p+length]...)
+			p += length
+		case bpsSourceCopy:
+			d, err := bpsDecodeNumber(patch, &p)
+			if err != nil {
+				return nil, err
+			}
+			sourceRel += relative(d)
+			if sourceRel < 0 || sourceRel+int64(length) > int64(len(source)) {
+				return nil, errors.New("BPS patch copies from outside the source")
+			}
+			target = append(target, source[sourceRel:sourceRel+int64(length)]...)
+			sourceRel += int64(length)
+		case bpsTargetCopy:
+			d, err := bpsDecodeNumber(patch, &p)
+			if err != nil {
+				return nil, err
+			}
+			targetRel += relative(d)
+			if targetRel < 0 || targetRel >= int64(len(target)) {
+				return nil, errors.New("BPS patch copies from outside the target")
+			}
+			// may overlap what it writes, so a byte at a time
+			for i := 0; i < length; i++ {
+				target = append(target, target[targetRel])
+				targetRel++
+			}
+		}
+	}
+
+	if uint64(len(target)) != targetSize {
+		return nil, fmt.Errorf("BPS patch made %d bytes, expected %d", len(target), targetSize)
+	}
+	if crc32.ChecksumIEEE(target) != binary.LittleEndian.Uint32(patch[footer+4:]) {
+		return nil, errors.New("BPS patch made the wrong target (checksum mismatch)")
+	}
+
+	return target, nil
+}
@@ -0,0 +1,119 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+func patchTestData() ([]byte, []byte) {
+
+	source := make([]byte, 4096)
+	for i := range source {
+		source[i] = byte(i * 13)
+	}
+
+	target := append([]byte(nil), source...)
+	copy(target[100:], []byte("CRACKED BY"))
+	target[103] = source[103] // a gap inside a change
+	copy(target[2000:], bytes.Repeat([]byte{0xea}, 300))
+	target[4095] = 0x60
+
+	return source, target
+}
+
+func TestIPS(t *testing.T) {
+
+	source, target := patchTestData()
+
+	cases := map[string][]byte{
+		"changed": target,
+		"grown":   append(append([]byte(nil), target...), 1, 2, 3),
+		"shrunk":  target[:3000],
+		"same":    source,
+	}
+
+	for name, want := range cases {
+		patch, err := MakeIPS(source, want)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := ApplyIPS(source, patch)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: patched data differs", name)
+		}
+	}
+
+	// a run record, as other tools write
+	rle := []byte("PATCH\x00\x00\x10\x00\x00\x00\x04\xffEOF")
+	got, err := ApplyIPS(source, rle)
+	if err != nil || !bytes.Equal(got[16:20], []byte{0xff, 0xff, 0xff, 0xff}) || got[20] != source[20] {
+		t.Fatalf("Expected a run of 4 0xff at 16, got % x (%v)", got[12:24], err)
+	}
+
+	if _, err := ApplyIPS(source, []byte("PATCH\x00\x00\x10\x00\x05ab")); err == nil {
+		t.Fatalf("Expected a cut short patch to fail")
+	}
+
+}
+
+func TestBPS(t *testing.T) {
+
+	source, target := patchTestData()
+
+	patch := MakeBPS(source, target, "hello")
+	if len(patch) > 500 {
+		t.Fatalf("Expected a small patch, got %d bytes", len(patch))
+	}
+
+	got, err := ApplyBPS(source, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, target) {
+		t.Fatalf("Patched data differs")
+	}
+	if m, err := BPSMetadata(patch); err != nil || m != "hello" {
+		t.Fatalf("Expected metadata hello, got %q (%v)", m, err)
+	}
+
+	if _, err := ApplyBPS(target, patch); err == nil {
+		t.Fatalf("Expected the wrong source to be refused")
+	}
+	damaged := append([]byte(nil), patch...)
+	damaged[len(damaged)/2] ^= 0xff
+	if _, err := ApplyBPS(source, damaged); err == nil {
+		t.Fatalf("Expected a damaged patch to be refused")
+	}
+
+	// source and target copies, as other tools write: "ABCABCABC" from "ABC"
+	src := []byte("ABC")
+	want := []byte("CABCABCAB")
+	out := bytes.NewBufferString("BPS1")
+	bpsEncodeNumber(out, 3)
+	bpsEncodeNumber(out, 9)
+	bpsEncodeNumber(out, 0)
+	bpsEncodeNumber(out, 0<<2|bpsSourceCopy) // 1 byte from source 2
+	bpsEncodeNumber(out, 2<<1)
+	bpsEncodeNumber(out, 2<<2|bpsSourceCopy) // 3 bytes from source 0
+	bpsEncodeNumber(out, 3<<1|1)
+	bpsEncodeNumber(out, 4<<2|bpsTargetCopy) // 5 bytes from target 1
+	bpsEncodeNumber(out, 1<<1)
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(src))
+	out.Write(crc)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(want))
+	out.Write(crc)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(out.Bytes()))
+	out.Write(crc)
+
+	got, err = ApplyBPS(src, out.Bytes())
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("Expected %q, got %q (%v)", want, got, err)
+	}
+
+}
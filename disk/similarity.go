@@ -0,0 +1,337 @@
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+/*
+	File similarity...
+
+	Two measures of how alike two versions of a file are, from 0 (nothing
+	in common) to 1 (the same):
+
+	LineSimilarity compares text a line at a time, so a BASIC listing with
+	one line changed still scores close to 1.  DiffLines gives the changes
+	themselves.
+
+	FuzzyHash gives binaries a context triggered piecewise hash in the
+	style of ssdeep: a rolling hash over a small window cuts the data into
+	pieces where the content says so, and each piece adds one character to
+	the signature.  An edit only changes the characters for the pieces it
+	touches, so FuzzyHashSimilarity of two signatures stays high when most
+	of the data is unchanged, even if it has moved.
+*/
+
+// LineSimilarity returns 2 * common lines / total lines of two texts, with
+// the common lines found as their longest common subsequence.  Lines may
+// end in CR or LF, and blank lines are ignored.
+func LineSimilarity(a, b []byte) float64 {
+
+	la := splitLines(a)
+	lb := splitLines(b)
+
+	n, m := len(la), len(lb)
+	if n == 0 && m == 0 {
+		return 1
+	}
+	if n == 0 || m == 0 {
+		return 0
+	}
+
+	// number the distinct lines so the table compares ints
+	ids := make(map[string]int)
+	number := func(lines []string) []int {
+		out := make([]int, len(lines))
+		for i, l := range lines {
+			id, ok := ids[l]
+			if !ok {
+				id = len(ids)
+				ids[l] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+	x, y := number(la), number(lb)
+
+	prev := make([]int, m+1)
+	cur := make([]int, m+1)
+	for i := 1; i <= n; i++ {
+		for j := 1; j <= m; j++ {
+			switch {
+			case x[i-1] == y[j-1]:
+				cur[j] = prev[j-1] + 1
+			case prev[j] >= cur[j-1]:
+				cur[j] = prev[j]
+			default:
+				cur[j] = cur[j-1]
+			}
+		}
+		prev, cur = cur, prev
+	}
+
+	return 2 * float64(prev[m]) / float64(n+m)
+}
+
+// LineEdit is one line of a DiffLines script: ' ' for a line in both, '-'
+// for a line only in the first text and '+' for one only in the second
+type LineEdit struct {
+	Op   byte
+	Text string
+}
+
+// DiffLines returns the edits that turn lines a into lines b, keeping their
+// longest common subsequence.  Removals come before additions where both
+// are at the same place.
+func DiffLines(a, b []string) []LineEdit {
+
+	// lines the same at either end need no table
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	x := a[pre : len(a)-suf]
+	y := b[pre : len(b)-suf]
+	n, m := len(x), len(y)
+
+	// lcs[i][j] is the common length of x[i:] and y[j:]
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case x[i] == y[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	out := make([]LineEdit, 0, len(a)+len(b))
+	for _, l := range a[:pre] {
+		out = append(out, LineEdit{' ', l})
+	}
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && x[i] == y[j]:
+			out = append(out, LineEdit{' ', x[i]})
+			i++
+			j++
+		case j == m || (i < n && lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, LineEdit{'-', x[i]})
+			i++
+		default:
+			out = append(out, LineEdit{'+', y[j]})
+			j++
+		}
+	}
+	for _, l := range a[len(a)-suf:] {
+		out = append(out, LineEdit{' ', l})
+	}
+
+	return out
+}
+
+// LineCount returns the number of lines LineSimilarity compares in a text
+func LineCount(text []byte) int {
+	return len(splitLines(text))
+}
+
+func splitLines(text []byte) []string {
+	fields := bytes.FieldsFunc(text, func(r rune) bool { return r == '\r' || r == '\n' })
+	out := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if l := strings.TrimSpace(string(f)); l != "" {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+const (
+	fuzzyWindow    = 7
+	fuzzyMinBlock  = 3
+	fuzzySigLength = 64
+	fuzzyHashInit  = 0x28021967
+	fuzzyHashPrime = 0x01000193
+	fuzzyB64       = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+)
+
+type fuzzyRoller struct {
+	window     [fuzzyWindow]byte
+	h1, h2, h3 uint32
+	n          uint32
+}
+
+func (r *fuzzyRoller) roll(c byte) uint32 {
+	r.h2 -= r.h1
+	r.h2 += fuzzyWindow * uint32(c)
+	r.h1 += uint32(c)
+	r.h1 -= uint32(r.window[r.n%fuzzyWindow])
+	r.window[r.n%fuzzyWindow] = c
+	r.n++
+	r.h3 <<= 5
+	r.h3 ^= uint32(c)
+	return r.h1 + r.h2 + r.h3
+}
+
+// FuzzyHash returns a "blocksize:signature:signature" piecewise hash of
+// data, or "" if there is no data.
+func FuzzyHash(data []byte) string {
+
+	if len(data) == 0 {
+		return ""
+	}
+
+	bs := uint32(fuzzyMinBlock)
+	for int(bs)*fuzzySigLength < len(data) {
+		bs *= 2
+	}
+
+	for {
+		s1, s2 := fuzzySignatures(data, bs)
+		// too few pieces to say much, try again with smaller ones
+		if len(s1) < fuzzySigLength/2 && bs > fuzzyMinBlock {
+			bs /= 2
+			continue
+		}
+		return fmt.Sprintf("%d:%s:%s", bs, s1, s2)
+	}
+}
+
+// fuzzySignatures makes the signatures for blocksize bs and 2*bs in one pass
+func fuzzySignatures(data []byte, bs uint32) (string, string) {
+
+	var r fuzzyRoller
+	var s1, s2 []byte
+	h1, h2 := uint32(fuzzyHashInit), uint32(fuzzyHashInit)
+
+	for _, c := range data {
+		h1 = (h1 * fuzzyHashPrime) ^ uint32(c)
+		h2 = (h2 * fuzzyHashPrime) ^ uint32(c)
+		rh := r.roll(c)
+
+		if rh%bs == bs-1 && len(s1) < fuzzySigLength-1 {
+			s1 = append(s1, fuzzyB64[h1%64])
+			h1 = fuzzyHashInit
+		}
+		if rh%(2*bs) == 2*bs-1 && len(s2) < fuzzySigLength/2-1 {
+			s2 = append(s2, fuzzyB64[h2%64])
+			h2 = fuzzyHashInit
+		}
+	}
+
+	// the tail after the last piece
+	if h1 != fuzzyHashInit {
+		s1 = append(s1, fuzzyB64[h1%64])
+	}
+	if h2 != fuzzyHashInit {
+		s2 = append(s2, fuzzyB64[h2%64])
+	}
+
+	return string(s1), string(s2)
+}
+
+// FuzzyHashSimilarity compares two FuzzyHash values.  Hashes are only
+// comparable if their blocksizes are the same or one is twice the other,
+// otherwise the similarity is 0.
+func FuzzyHashSimilarity(a, b string) float64 {
+
+	if a == "" || b == "" {
+		return 0
+	}
+	if a == b {
+		return 1
+	}
+
+	var abs, bbs uint32
+	var a1, a2, b1, b2 string
+	if !parseFuzzyHash(a, &abs, &a1, &a2) || !parseFuzzyHash(b, &bbs, &b1, &b2) {
+		return 0
+	}
+
+	switch {
+	case abs == bbs:
+		s1 := signatureSimilarity(a1, b1)
+		if s2 := signatureSimilarity(a2, b2); s2 > s1 {
+			return s2
+		}
+		return s1
+	case abs == 2*bbs:
+		return signatureSimilarity(a1, b2)
+	case bbs == 2*abs:
+		return signatureSimilarity(a2, b1)
+	}
+
+	return 0
+}
+
+func parseFuzzyHash(h string, bs *uint32, s1, s2 *string) bool {
+	parts := strings.SplitN(h, ":", 3)
+	if len(parts) != 3 {
+		return false
+	}
+	if _, e := fmt.Sscanf(parts[0], "%d", bs); e != nil || *bs == 0 {
+		return false
+	}
+	*s1, *s2 = parts[1], parts[2]
+	return true
+}
+
+// signatureSimilarity is 1 less the edit distance over the longer length
+func signatureSimilarity(a, b string) float64 {
+
+	if a == "" || b == "" {
+		return 0
+	}
+	if a == b {
+		return 1
+	}
+
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	l := len(a)
+	if len(b) > l {
+		l = len(b)
+	}
+
+	return 1 - float64(prev[len(b)])/float64(l)
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,87 @@
+package disk
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestLineSimilarity(t *testing.T) {
+
+	a := []byte("10 HOME\n20 PRINT \"HELLO\"\n30 GOTO 20\n")
+	b := []byte("10 HOME\n20 PRINT \"WORLD\"\n30 GOTO 20\n")
+
+	if s := LineSimilarity(a, a); s != 1 {
+		t.Fatalf("Expected the same text to score 1, got %f", s)
+	}
+	if s := LineSimilarity(a, b); s < 0.66 || s > 0.67 {
+		t.Fatalf("Expected one changed line in three to score 2/3, got %f", s)
+	}
+	// line endings and blank lines make no difference
+	if s := LineSimilarity(a, []byte("10 HOME\r\r20 PRINT \"HELLO\"\r30 GOTO 20\r")); s != 1 {
+		t.Fatalf("Expected CR endings to score 1, got %f", s)
+	}
+	if s := LineSimilarity(a, []byte("HELLO WORLD\n")); s != 0 {
+		t.Fatalf("Expected different text to score 0, got %f", s)
+	}
+
+}
+
+func TestFuzzyHash(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+	a := make([]byte, 8192)
+	r.Read(a)
+
+	// a few bytes patched in the middle
+	b := append([]byte(nil), a...)
+	copy(b[4000:], []byte{0xea, 0xea, 0xea, 0x60})
+
+	// something else entirely
+	c := make([]byte, 8192)
+	r.Read(c)
+
+	ha, hb, hc := FuzzyHash(a), FuzzyHash(b), FuzzyHash(c)
+
+	if s := FuzzyHashSimilarity(ha, ha); s != 1 {
+		t.Fatalf("Expected the same data to score 1, got %f", s)
+	}
+	if s := FuzzyHashSimilarity(ha, hb); s < 0.9 {
+		t.Fatalf("Expected a patched copy to score highly, got %f (%s vs %s)", s, ha, hb)
+	}
+	if s := FuzzyHashSimilarity(ha, hc); s > 0.5 {
+		t.Fatalf("Expected different data to score low, got %f (%s vs %s)", s, ha, hc)
+	}
+
+	// data grown past the next blocksize is still comparable
+	d := append(append([]byte(nil), a...), a[:1024]...)
+	if s := FuzzyHashSimilarity(ha, FuzzyHash(d)); s < 0.5 {
+		t.Fatalf("Expected a grown copy to score above 0.5, got %f", s)
+	}
+
+	if FuzzyHash(nil) != "" || FuzzyHashSimilarity("", ha) != 0 {
+		t.Fatalf("Expected no hash for no data")
+	}
+
+}
+
+func TestDiffLines(t *testing.T) {
+
+	a := []string{"10 HOME", "20 PRINT \"HELLO\"", "30 GOTO 20"}
+	b := []string{"5 REM", "10 HOME", "20 PRINT \"WORLD\"", "30 GOTO 20"}
+
+	var got string
+	for _, e := range DiffLines(a, b) {
+		got += string(e.Op) + e.Text + "\n"
+	}
+	want := "+5 REM\n 10 HOME\n-20 PRINT \"HELLO\"\n+20 PRINT \"WORLD\"\n 30 GOTO 20\n"
+	if got != want {
+		t.Fatalf("Expected\n%s\ngot\n%s", want, got)
+	}
+
+	for _, e := range DiffLines(a, a) {
+		if e.Op != ' ' {
+			t.Fatalf("Expected no changes between the same lines")
+		}
+	}
+
+}
@@ -70,7 +70,7 @@ func analyzeDOS16(id int, dsk *disk.DSKWrapper, info *Disk) {
 				data := dsk.Read()
 				activeData = append(activeData, data...)
 
-				if *ingestMode&2 == 2 {
+				if info.IngestMode&2 == 2 {
 					sector.Data = data
 				}
 
@@ -83,7 +83,7 @@ func analyzeDOS16(id int, dsk *disk.DSKWrapper, info *Disk) {
 				}
 
 				data := dsk.Read()
-				if *ingestMode&2 == 2 {
+				if info.IngestMode&2 == 2 {
 					sector.Data = data
 				}
 				//activeData = append(activeData, data...)
@@ -140,8 +140,10 @@ func analyzeDOS16(id int, dsk *disk.DSKWrapper, info *Disk) {
 		if err == nil {
 			sum := sha256.Sum256(data)
 			file.SHA256 = hex.EncodeToString(sum[:])
+			file.NormalizedSHA256 = normalizedSHA256(appleDOSContent(fd.Type()), data)
+			file.FuzzyHash = disk.FuzzyHash(data)
 			file.Size = size
-			if *ingestMode&1 == 1 {
+			if info.IngestMode&1 == 1 {
 				if fd.Type() == disk.FileTypeAPP {
 					file.Text = disk.ApplesoftDetoks(data)
 					file.TypeCode = TypeMask_AppleDOS | TypeCode(fd.Type())
@@ -174,9 +176,9 @@ func analyzeDOS16(id int, dsk *disk.DSKWrapper, info *Disk) {
 
 	}
 
-	exists := exists(*baseName + "/" + info.GetFilename())
-
-	if !exists || *forceIngest {
+	if info.inMemory {
+		l.Log("Not writing, only needed in memory")
+	} else if !fingerprintExists(info.GetFilename()) || *forceIngest {
 		info.WriteToFile(*baseName + "/" + info.GetFilename())
 	} else {
 		l.Log("Not writing as it already exists")
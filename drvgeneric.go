@@ -55,7 +55,7 @@ func analyzeNONE(id int, dsk *disk.DSKWrapper, info *Disk) {
 				data := dsk.Read()
 				activeData = append(activeData, data...)
 
-				if *ingestMode&2 == 2 {
+				if info.IngestMode&2 == 2 {
 					sector.Data = data
 				}
 
@@ -73,9 +73,9 @@ func analyzeNONE(id int, dsk *disk.DSKWrapper, info *Disk) {
 	// Analyzing files
 	l.Log("Skipping Analysis of files")
 
-	exists := exists(*baseName + "/" + info.GetFilename())
-
-	if !exists || *forceIngest {
+	if info.inMemory {
+		l.Log("Not writing, only needed in memory")
+	} else if !fingerprintExists(info.GetFilename()) || *forceIngest {
 		info.WriteToFile(*baseName + "/" + info.GetFilename())
 	} else {
 		l.Log("Not writing as it already exists")
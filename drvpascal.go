@@ -71,7 +71,7 @@ func analyzePASCAL(id int, dsk *disk.DSKWrapper, info *Disk) {
 				SHA256: dsk.ChecksumSector(t, s2),
 			}
 
-			if *ingestMode&2 == 2 {
+			if info.IngestMode&2 == 2 {
 				sec1.Data = data[:256]
 				sec2.Data = data[256:]
 			}
@@ -98,7 +98,7 @@ func analyzePASCAL(id int, dsk *disk.DSKWrapper, info *Disk) {
 				SHA256: dsk.ChecksumSector(t, s2),
 			}
 
-			if *ingestMode&2 == 2 {
+			if info.IngestMode&2 == 2 {
 				sec1.Data = data[:256]
 				sec2.Data = data[256:]
 			}
@@ -143,8 +143,12 @@ func analyzePASCAL(id int, dsk *disk.DSKWrapper, info *Disk) {
 		if err == nil {
 			sum := sha256.Sum256(data)
 			file.SHA256 = hex.EncodeToString(sum[:])
+			// Pascal text is kept in zero padded pages, so there is no
+			// slack to trim
+			file.NormalizedSHA256 = file.SHA256
+			file.FuzzyHash = disk.FuzzyHash(data)
 			file.Size = len(data)
-			if *ingestMode&1 == 1 {
+			if info.IngestMode&1 == 1 {
 				// text ingestion
 				if fd.GetType() == disk.FileType_PAS_TEXT {
 					file.Text = disk.StripText(data)
@@ -163,9 +167,9 @@ func analyzePASCAL(id int, dsk *disk.DSKWrapper, info *Disk) {
 
 	}
 
-	exists := exists(*baseName + "/" + info.GetFilename())
-
-	if !exists || *forceIngest {
+	if info.inMemory {
+		l.Log("Not writing, only needed in memory")
+	} else if !fingerprintExists(info.GetFilename()) || *forceIngest {
 		info.WriteToFile(*baseName + "/" + info.GetFilename())
 	} else {
 		l.Log("Not writing as it already exists")
@@ -69,7 +69,7 @@ func analyzePRODOS16(id int, dsk *disk.DSKWrapper, info *Disk) {
 				SHA256: dsk.ChecksumSector(t, s2),
 			}
 
-			if *ingestMode&2 == 2 {
+			if info.IngestMode&2 == 2 {
 				sec1.Data = data[:256]
 				sec2.Data = data[256:]
 			}
@@ -96,7 +96,7 @@ func analyzePRODOS16(id int, dsk *disk.DSKWrapper, info *Disk) {
 				SHA256: dsk.ChecksumSector(t, s2),
 			}
 
-			if *ingestMode&2 == 2 {
+			if info.IngestMode&2 == 2 {
 				sec1.Data = data[:256]
 				sec2.Data = data[256:]
 			}
@@ -119,9 +119,9 @@ func analyzePRODOS16(id int, dsk *disk.DSKWrapper, info *Disk) {
 
 	prodosDir(id, 2, "", dsk, info)
 
-	exists := exists(*baseName + "/" + info.GetFilename())
-
-	if !exists || *forceIngest {
+	if info.inMemory {
+		l.Log("Not writing, only needed in memory")
+	} else if !fingerprintExists(info.GetFilename()) || *forceIngest {
 		e := info.WriteToFile(*baseName + "/" + info.GetFilename())
 		if e != nil {
 			l.Errorf("Error writing fingerprint: %v", e)
@@ -181,8 +181,10 @@ func prodosDir(id int, start int, path string, dsk *disk.DSKWrapper, info *Disk)
 			if err == nil {
 				sum := sha256.Sum256(data)
 				file.SHA256 = hex.EncodeToString(sum[:])
+				file.NormalizedSHA256 = normalizedSHA256(prodosContent(fd.Type(), fd.AuxType()), data)
+				file.FuzzyHash = disk.FuzzyHash(data)
 				file.Size = len(data)
-				if *ingestMode&1 == 1 {
+				if info.IngestMode&1 == 1 {
 					if fd.Type() == disk.FileType_PD_APP {
 						file.Text = disk.ApplesoftDetoks(data)
 						file.TypeCode = TypeMask_ProDOS | TypeCode(fd.Type())
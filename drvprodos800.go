@@ -60,7 +60,7 @@ func analyzePRODOS800(id int, dsk *disk.DSKWrapper, info *Disk) {
 				SHA256: dsk.ChecksumSector(t, s2),
 			}
 
-			if *ingestMode&2 == 2 {
+			if info.IngestMode&2 == 2 {
 				sec1.Data = data[:256]
 				sec2.Data = data[256:]
 			}
@@ -87,7 +87,7 @@ func analyzePRODOS800(id int, dsk *disk.DSKWrapper, info *Disk) {
 				SHA256: dsk.ChecksumSector(t, s2),
 			}
 
-			if *ingestMode&2 == 2 {
+			if info.IngestMode&2 == 2 {
 				sec1.Data = data[:256]
 				sec2.Data = data[256:]
 			}
@@ -111,9 +111,9 @@ func analyzePRODOS800(id int, dsk *disk.DSKWrapper, info *Disk) {
 	info.Files = make([]*DiskFile, 0)
 	prodosDir(id, 2, "", dsk, info)
 
-	exists := exists(*baseName + "/" + info.GetFilename())
-
-	if !exists || *forceIngest {
+	if info.inMemory {
+		l.Log("Not writing, only needed in memory")
+	} else if !fingerprintExists(info.GetFilename()) || *forceIngest {
 		info.WriteToFile(*baseName + "/" + info.GetFilename())
 	} else {
 		l.Log("Not writing as it already exists")
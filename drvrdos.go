@@ -49,7 +49,7 @@ func analyzeRDOS(id int, dsk *disk.DSKWrapper, info *Disk) {
 				data := dsk.Read()
 				activeData = append(activeData, data...)
 
-				if *ingestMode&2 == 2 {
+				if info.IngestMode&2 == 2 {
 					sector.Data = data
 				}
 
@@ -63,7 +63,7 @@ func analyzeRDOS(id int, dsk *disk.DSKWrapper, info *Disk) {
 				}
 
 				data := dsk.Read()
-				if *ingestMode&2 == 2 {
+				if info.IngestMode&2 == 2 {
 					sector.Data = data
 				}
 				//activeData = append(activeData, data...)
@@ -104,8 +104,10 @@ func analyzeRDOS(id int, dsk *disk.DSKWrapper, info *Disk) {
 		if err == nil {
 			sum := sha256.Sum256(data)
 			file.SHA256 = hex.EncodeToString(sum[:])
+			file.NormalizedSHA256 = normalizedSHA256(rdosContent(fd.Type()), data)
+			file.FuzzyHash = disk.FuzzyHash(data)
 			file.Size = len(data)
-			if *ingestMode&1 == 1 {
+			if info.IngestMode&1 == 1 {
 				if fd.Type() == disk.FileType_RDOS_AppleSoft {
 					file.Text = disk.ApplesoftDetoks(data)
 					file.TypeCode = TypeMask_RDOS | TypeCode(fd.Type())
@@ -129,9 +131,9 @@ func analyzeRDOS(id int, dsk *disk.DSKWrapper, info *Disk) {
 
 	}
 
-	exists := exists(*baseName + "/" + info.GetFilename())
-
-	if !exists || *forceIngest {
+	if info.inMemory {
+		l.Log("Not writing, only needed in memory")
+	} else if !fingerprintExists(info.GetFilename()) || *forceIngest {
 		info.WriteToFile(*baseName + "/" + info.GetFilename())
 	} else {
 		l.Log("Not writing as it already exists")
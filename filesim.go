@@ -0,0 +1,152 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/paleotronic/diskm8/disk"
+)
+
+/*
+	Modified files...
+
+	Files only match by checksum, so a program with one line changed would
+	show up as missing from one disk and extra on the other.  After the
+	exact matches are made, each missing file is compared with the extra
+	files of the same type: BASIC and text by their listings a line at a
+	time, anything else by the fuzzy hash made at ingest (see
+	disk/similarity.go).  Pairs at or
+	above -modified are reported as modified files rather than missing and
+	extra, and count towards the match by their similarity.
+*/
+
+// FileModification is a file that looks like an edited version of one on
+// another disk.  As with matched files, From is the extra file on the disk
+// compared with and To the missing file on the disk compared.
+type FileModification struct {
+	From       *DiskFile
+	To         *DiskFile
+	Similarity float64
+}
+
+// FileSimilarity returns how alike two files are, from 0 to 1
+func FileSimilarity(a, b *DiskFile) float64 {
+
+	if a.matchSHA256() == b.matchSHA256() {
+		return 1
+	}
+
+	if len(a.Text) > 0 && len(b.Text) > 0 {
+		return disk.LineSimilarity(a.Text, b.Text)
+	}
+
+	return disk.FuzzyHashSimilarity(a.fuzzyHash(), b.fuzzyHash())
+}
+
+// fuzzyHash is the piecewise hash made at ingest, worked out from the data
+// for fingerprints made before it was stored
+func (f *DiskFile) fuzzyHash() string {
+	if f.FuzzyHash == "" {
+		return disk.FuzzyHash(f.Data)
+	}
+	return f.FuzzyHash
+}
+
+// matchModifiedFiles pairs missing files with extra files that are similar
+// enough to be modified versions of them, returning the pairs and the files
+// left over.  The most similar pairs are taken first, and of those equally
+// similar the ones with the same name.
+func matchModifiedFiles(missing, extras []*DiskFile) ([]*FileModification, []*DiskFile, []*DiskFile) {
+
+	t := *modifiedThreshold
+	if t <= 0 || len(missing) == 0 || len(extras) == 0 {
+		return nil, missing, extras
+	}
+
+	type candidate struct {
+		mod      *FileModification
+		sameName bool
+	}
+	var candidates []candidate
+
+	for _, m := range missing {
+		for _, e := range extras {
+			if m.Ext != e.Ext || !mightBeSimilar(m, e, t) {
+				continue
+			}
+			if s := FileSimilarity(m, e); s >= t {
+				candidates = append(candidates, candidate{
+					mod:      &FileModification{From: e, To: m, Similarity: s},
+					sameName: m.Filename == e.Filename,
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].mod.Similarity != candidates[j].mod.Similarity {
+			return candidates[i].mod.Similarity > candidates[j].mod.Similarity
+		}
+		return candidates[i].sameName && !candidates[j].sameName
+	})
+
+	used := make(map[*DiskFile]bool)
+	var mods []*FileModification
+	for _, c := range candidates {
+		if used[c.mod.From] || used[c.mod.To] {
+			continue
+		}
+		used[c.mod.From] = true
+		used[c.mod.To] = true
+		mods = append(mods, c.mod)
+	}
+
+	var restMissing, restExtras []*DiskFile
+	for _, f := range missing {
+		if !used[f] {
+			restMissing = append(restMissing, f)
+		}
+	}
+	for _, f := range extras {
+		if !used[f] {
+			restExtras = append(restExtras, f)
+		}
+	}
+
+	return mods, restMissing, restExtras
+}
+
+// mightBeSimilar skips pairs too different in size to reach t: the line
+// ratio can be no more than 2 * shorter / total lines
+func mightBeSimilar(a, b *DiskFile, t float64) bool {
+
+	if len(a.Text) > 0 && len(b.Text) > 0 {
+		na, nb := disk.LineCount(a.Text), disk.LineCount(b.Text)
+		if na+nb == 0 {
+			return true
+		}
+		short := na
+		if nb < short {
+			short = nb
+		}
+		return 2*float64(short)/float64(na+nb) >= t
+	}
+
+	return len(a.Data) > 0 && len(b.Data) > 0 || a.FuzzyHash != "" && b.FuzzyHash != ""
+}
+
+// modifiedScore is the match score counting each modified file by its
+// similarity
+func modifiedScore(same, missing, extras int, mods []*FileModification) float64 {
+
+	total := float64(same + missing + extras + len(mods))
+	if total == 0 {
+		return 0
+	}
+
+	score := float64(same)
+	for _, m := range mods {
+		score += m.Similarity
+	}
+
+	return score / total
+}
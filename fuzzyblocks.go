@@ -9,7 +9,11 @@ import (
 
 const EMPTYSECTOR = "5341e6b2646979a70e57653007a1f310169421ec9bdd9f1a5648f75ade005af1"
 
-func GetAllDiskSectors(pattern string, pathfilter []string) map[string]DiskSectors {
+// sectorLoader loads sector data of the disks matching pattern, adding
+// their signatures to sigs unless it is nil
+type sectorLoader func(pattern string, pathfilter []string, sigs map[string]MinHash) map[string]DiskSectors
+
+func GetAllDiskSectors(pattern string, pathfilter []string, sigs map[string]MinHash) map[string]DiskSectors {
 
 	cache := make(map[string]DiskSectors)
 
@@ -35,14 +39,20 @@ func GetAllDiskSectors(pattern string, pathfilter []string) map[string]DiskSecto
 					for _, v := range chunk {
 						if v.SHA256 != EMPTYSECTOR {
 							tmp = append(tmp, v)
-						} else {
-							fmt.Printf("%s: throw away zero sector T%d,S%d\n", item.Filename, v.Track, v.Sector)
 						}
 					}
 
+					var sig MinHash
+					if sigs != nil {
+						sig = item.sectorMinHash()
+					}
+
 					// Load cache
 					s.Lock()
 					cache[item.FullPath] = tmp
+					if sigs != nil {
+						sigs[item.FullPath] = sig
+					}
 					s.Unlock()
 
 				}
@@ -72,7 +82,7 @@ func GetAllDiskSectors(pattern string, pathfilter []string) map[string]DiskSecto
 	return cache
 }
 
-func GetActiveDiskSectors(pattern string, pathfilter []string) map[string]DiskSectors {
+func GetActiveDiskSectors(pattern string, pathfilter []string, sigs map[string]MinHash) map[string]DiskSectors {
 
 	cache := make(map[string]DiskSectors)
 
@@ -92,9 +102,17 @@ func GetActiveDiskSectors(pattern string, pathfilter []string) map[string]DiskSe
 				item := &Disk{}
 				if err := item.ReadFromFile(m); err == nil {
 
+					var sig MinHash
+					if sigs != nil {
+						sig = item.activeMinHash()
+					}
+
 					// Load cache
 					s.Lock()
 					cache[item.FullPath] = item.ActiveSectors
+					if sigs != nil {
+						sigs[item.FullPath] = sig
+					}
 					s.Unlock()
 
 				}
@@ -232,9 +250,18 @@ func CompareSectors(d, b DiskSectors, r *SectorOverlapRecord, key string) float6
 }
 
 // Actual fuzzy file match report
-func CollectSectorOverlapsAboveThreshold(t float64, pathfilter []string, ff func(pattern string, pathfilter []string) map[string]DiskSectors) map[string]*SectorOverlapRecord {
+func CollectSectorOverlapsAboveThreshold(t float64, pathfilter []string, ff sectorLoader) map[string]*SectorOverlapRecord {
+
+	sigs := make(map[string]MinHash)
+	filerecords := ff("*_*_*_*.fgp", pathfilter, sigs)
 
-	filerecords := ff("*_*_*_*.fgp", pathfilter)
+	return collectSectorOverlapsAboveThreshold(t, filerecords, sigs)
+}
+
+func collectSectorOverlapsAboveThreshold(t float64, filerecords map[string]DiskSectors, sigs map[string]MinHash) map[string]*SectorOverlapRecord {
+
+	// only compare disks likely to be above the threshold
+	candidates := lshCandidates(sigs, sectorJaccardThreshold(t))
 
 	results := make(map[string]*SectorOverlapRecord)
 
@@ -259,7 +286,15 @@ func CollectSectorOverlapsAboveThreshold(t float64, pathfilter []string, ff func
 
 				d := filerecords[m]
 
-				for k, b := range filerecords {
+				others := filerecords
+				if candidates != nil {
+					others = make(map[string]DiskSectors, len(candidates[m]))
+					for _, k := range candidates[m] {
+						others[k] = filerecords[k]
+					}
+				}
+
+				for k, b := range others {
 					if k == m {
 						continue // dont compare ourselves
 					}
@@ -320,9 +355,11 @@ func CollectSectorOverlapsAboveThreshold(t float64, pathfilter []string, ff func
 }
 
 // Actual fuzzy file match report
-func CollectSectorSubsets(pathfilter []string, ff func(pattern string, pathfilter []string) map[string]DiskSectors) map[string]*SectorOverlapRecord {
+func CollectSectorSubsets(pathfilter []string, ff sectorLoader) map[string]*SectorOverlapRecord {
+	return collectSectorSubsets(ff("*_*_*_*.fgp", pathfilter, nil))
+}
 
-	filerecords := ff("*_*_*_*.fgp", pathfilter)
+func collectSectorSubsets(filerecords map[string]DiskSectors) map[string]*SectorOverlapRecord {
 
 	results := make(map[string]*SectorOverlapRecord)
 
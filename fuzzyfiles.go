@@ -22,10 +22,31 @@ const EXCLUDEHELLO = true
 
 func GetAllFiles(pattern string, pathfilter []string) map[string]DiskCatalog {
 
+	_, matches := existsPattern(*baseName, pathfilter, pattern)
+
+	return GetFilesFrom(matches)
+}
+
+// GetFilesFrom loads the catalogs of the given fingerprints
+func GetFilesFrom(matches []string) map[string]DiskCatalog {
+	return getFilesFrom(matches, nil)
+}
+
+// GetAllFilesWithMinHashes loads the catalogs and file signatures of every
+// disk matching pattern
+func GetAllFilesWithMinHashes(pattern string, pathfilter []string) (map[string]DiskCatalog, map[string]MinHash) {
+
+	_, matches := existsPattern(*baseName, pathfilter, pattern)
+
+	sigs := make(map[string]MinHash)
+	return getFilesFrom(matches, sigs), sigs
+}
+
+func getFilesFrom(matches []string, sigs map[string]MinHash) map[string]DiskCatalog {
+
 	cache := make(map[string]DiskCatalog)
 
-	exists, matches := existsPattern(*baseName, pathfilter, pattern)
-	if !exists {
+	if len(matches) == 0 {
 		return cache
 	}
 
@@ -44,13 +65,19 @@ func GetAllFiles(pattern string, pathfilter []string) map[string]DiskCatalog {
 						continue
 					}
 
+					var sig MinHash
+					if sigs != nil {
+						sig = item.fileMinHash()
+					}
+
 					// Load cache
 					s.Lock()
 					cache[item.FullPath] = item.Files
+					if sigs != nil {
+						sigs[item.FullPath] = sig
+					}
 					s.Unlock()
 
-				} else {
-					fmt.Println("FAIL")
 				}
 			}
 			wg.Done()
@@ -85,6 +112,8 @@ type FileOverlapRecord struct {
 	percent map[string]float64
 	missing map[string][]*DiskFile
 	extras  map[string][]*DiskFile
+	// modified is only kept, and files only paired up, if it is made
+	modified map[string][]*FileModification
 }
 
 func (f *FileOverlapRecord) Remove(key string) {
@@ -92,6 +121,7 @@ func (f *FileOverlapRecord) Remove(key string) {
 	delete(f.percent, key)
 	delete(f.missing, key)
 	delete(f.extras, key)
+	delete(f.modified, key)
 }
 
 func (f *FileOverlapRecord) IsSubsetOf(filename string) bool {
@@ -125,7 +155,18 @@ func (f *FileOverlapRecord) IsSupersetOf(filename string) bool {
 // Actual fuzzy file match report
 func CollectFilesOverlapsAboveThreshold(t float64, pathfilter []string) map[string]*FileOverlapRecord {
 
-	filerecords := GetAllFiles("*_*_*_*.fgp", pathfilter)
+	filerecords, sigs := GetAllFilesWithMinHashes("*_*_*_*.fgp", pathfilter)
+
+	return collectFilesOverlapsAboveThreshold(t, filerecords, sigs)
+}
+
+func collectFilesOverlapsAboveThreshold(t float64, filerecords map[string]DiskCatalog, sigs map[string]MinHash) map[string]*FileOverlapRecord {
+
+	// only compare disks likely to be above the threshold
+	candidates := lshCandidates(sigs, t)
+	if candidates != nil && *modifiedThreshold > 0 {
+		candidates = mergeCandidates(candidates, lshCandidates(fileNameMinHashes(filerecords), t))
+	}
 
 	results := make(map[string]*FileOverlapRecord)
 
@@ -142,15 +183,24 @@ func CollectFilesOverlapsAboveThreshold(t float64, pathfilter []string) map[stri
 			for m := range workchan {
 
 				v := &FileOverlapRecord{
-					files:   make(map[string]map[*DiskFile]*DiskFile),
-					percent: make(map[string]float64),
-					missing: make(map[string][]*DiskFile),
-					extras:  make(map[string][]*DiskFile),
+					files:    make(map[string]map[*DiskFile]*DiskFile),
+					percent:  make(map[string]float64),
+					missing:  make(map[string][]*DiskFile),
+					extras:   make(map[string][]*DiskFile),
+					modified: make(map[string][]*FileModification),
 				}
 
 				d := filerecords[m]
 
-				for k, b := range filerecords {
+				others := filerecords
+				if candidates != nil {
+					others = make(map[string]DiskCatalog, len(candidates[m]))
+					for _, k := range candidates[m] {
+						others[k] = filerecords[k]
+					}
+				}
+
+				for k, b := range others {
 					if k == m {
 						continue // dont compare ourselves
 					}
@@ -214,7 +264,7 @@ func GetCatalogMap(d DiskCatalog) map[string]*DiskFile {
 
 	out := make(map[string]*DiskFile)
 	for _, v := range d {
-		out[v.SHA256] = v
+		out[v.matchSHA256()] = v
 	}
 	return out
 
@@ -281,6 +331,15 @@ func CompareCatalogs(d, b DiskCatalog, r *FileOverlapRecord, key string) float64
 
 	}
 
+	if r.modified != nil {
+		if mods, missing, extras := matchModifiedFiles(r.missing[key], r.extras[key]); len(mods) > 0 {
+			r.modified[key] = mods
+			r.missing[key] = missing
+			r.extras[key] = extras
+			return modifiedScore(int(sameFiles), len(missing), len(extras), mods)
+		}
+	}
+
 	if (sameFiles + extraFiles + missingFiles) == 0 {
 		return 0
 	}
@@ -291,8 +350,10 @@ func CompareCatalogs(d, b DiskCatalog, r *FileOverlapRecord, key string) float64
 }
 
 func CollectFileSubsets(pathfilter []string) map[string]*FileOverlapRecord {
+	return collectFileSubsets(GetAllFiles("*_*_*_*.fgp", pathfilter))
+}
 
-	filerecords := GetAllFiles("*_*_*_*.fgp", pathfilter)
+func collectFileSubsets(filerecords map[string]DiskCatalog) map[string]*FileOverlapRecord {
 
 	results := make(map[string]*FileOverlapRecord)
 
@@ -397,10 +458,11 @@ func CollectFilesOverlapsCustom(keep func(d1, d2 string, v *FileOverlapRecord) b
 			for m := range workchan {
 
 				v := &FileOverlapRecord{
-					files:   make(map[string]map[*DiskFile]*DiskFile),
-					percent: make(map[string]float64),
-					missing: make(map[string][]*DiskFile),
-					extras:  make(map[string][]*DiskFile),
+					files:    make(map[string]map[*DiskFile]*DiskFile),
+					percent:  make(map[string]float64),
+					missing:  make(map[string][]*DiskFile),
+					extras:   make(map[string][]*DiskFile),
+					modified: make(map[string][]*FileModification),
 				}
 
 				d := filerecords[m]
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// editedCatalog is a disk with one file in common and n text files that
+// differ by one line in twenty from the same files on another version
+func editedCatalog(version, n int) DiskCatalog {
+
+	files := DiskCatalog{
+		&DiskFile{Filename: "HELLO.SYSTEM", Ext: "SYS", SHA256: "shared", Size: 1, Data: []byte{0x60}},
+	}
+
+	for i := 0; i < n; i++ {
+		lines := make([]string, 20)
+		for l := range lines {
+			lines[l] = fmt.Sprintf("%d PRINT \"FILE %d LINE %d\"", 10*(l+1), i, l)
+		}
+		lines[10] = fmt.Sprintf("110 PRINT \"VERSION %d\"", version)
+		text := []byte(strings.Join(lines, "\n"))
+		files = append(files, &DiskFile{
+			Filename: fmt.Sprintf("PROG%d", i),
+			Ext:      "TXT",
+			SHA256:   fmt.Sprintf("prog-%d-v%d", i, version),
+			Size:     len(text),
+			Text:     text,
+			Data:     text,
+		})
+	}
+
+	return files
+}
+
+func TestCollectFilesOverlapsModified(t *testing.T) {
+
+	defer func(m float64) { *modifiedThreshold = m }(*modifiedThreshold)
+	*modifiedThreshold = 0.5
+
+	filerecords := map[string]DiskCatalog{
+		"a": editedCatalog(1, 4),
+		"b": editedCatalog(2, 4),
+	}
+	sigs := map[string]MinHash{
+		"a": NewMinHash(fileMinHashElements(filerecords["a"], func(f *DiskFile) string { return f.SHA256 })),
+		"b": NewMinHash(fileMinHashElements(filerecords["b"], func(f *DiskFile) string { return f.SHA256 })),
+	}
+
+	// 1 file of 9 by checksum, but 0.96 counting the edited ones
+	const threshold = 0.9
+	for _, k := range lshCandidates(sigs, threshold)["a"] {
+		if k == "b" {
+			t.Fatalf("Expected the checksum signatures alone not to pair the disks")
+		}
+	}
+
+	results := collectFilesOverlapsAboveThreshold(threshold, filerecords, sigs)
+	r, ok := results["a"]
+	if !ok {
+		t.Fatalf("Expected a to match b above %.2f", threshold)
+	}
+	if p := r.percent["b"]; p < threshold {
+		t.Fatalf("Expected a score above %.2f, got %f", threshold, p)
+	}
+	if n := len(r.modified["b"]); n != 4 {
+		t.Fatalf("Expected 4 modified files, got %d", n)
+	}
+
+	*modifiedThreshold = 0
+	if results := collectFilesOverlapsAboveThreshold(threshold, filerecords, sigs); len(results) != 0 {
+		t.Fatalf("Expected no matches with -modified 0, got %d", len(results))
+	}
+
+}
+
+func TestFileSimilarityStoredHash(t *testing.T) {
+
+	a := &DiskFile{SHA256: "a", FuzzyHash: "3:abcdefgh:abcd"}
+	b := &DiskFile{SHA256: "b", FuzzyHash: "3:abcdefgx:abcd"}
+
+	// no data kept, so only the stored hashes can say how alike they are
+	if s := FileSimilarity(a, b); s < 0.8 {
+		t.Fatalf("Expected files with close hashes to be similar, got %f", s)
+	}
+	if !mightBeSimilar(a, b, 0.5) {
+		t.Fatalf("Expected files with stored hashes to be compared")
+	}
+
+}
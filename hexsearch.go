@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/paleotronic/diskm8/disk"
+)
+
+/*
+	Byte pattern search...
+
+	Patterns are hex bytes separated by spaces, eg. "A9 ?? 8D 00 C0":
+
+	  A9     the byte $A9
+	  ??     any byte
+	  A? ?9  a byte with one nibble fixed
+	  80/F0  a byte that is $80 once masked with $F0
+
+	Runs of hex without spaces ("A9008DC0") work too.  File data is searched
+	when the disk was ingested with it (-ingest-mode 1 or 3), sectors when
+	it was ingested with sector data (-ingest-mode 2 or 3).  Sectors of
+	block based disks are searched a block at a time, and sectors or blocks
+	next to each other in the image are searched as one, so a match can
+	run across the boundary.
+*/
+
+type hexByte struct {
+	value, mask byte
+}
+
+type HexPattern []hexByte
+
+func parseHexByte(s string) (hexByte, error) {
+
+	var hb hexByte
+
+	if i := strings.Index(s, "/"); i >= 0 {
+		v, err := strconv.ParseUint(s[:i], 16, 8)
+		if err != nil {
+			return hb, fmt.Errorf("Bad byte: %s", s)
+		}
+		m, err := strconv.ParseUint(s[i+1:], 16, 8)
+		if err != nil {
+			return hb, fmt.Errorf("Bad mask: %s", s)
+		}
+		return hexByte{value: byte(v) & byte(m), mask: byte(m)}, nil
+	}
+
+	if len(s) != 2 {
+		return hb, fmt.Errorf("Bad byte: %s", s)
+	}
+
+	for i, shift := range []uint{4, 0} {
+		ch := s[i]
+		if ch == '?' {
+			continue
+		}
+		n, err := strconv.ParseUint(string(ch), 16, 8)
+		if err != nil {
+			return hb, fmt.Errorf("Bad byte: %s", s)
+		}
+		hb.value |= byte(n) << shift
+		hb.mask |= 0xf << shift
+	}
+
+	return hb, nil
+}
+
+// ParseHexPattern parses a byte pattern such as "A9 ?? 8D 00 C0"
+func ParseHexPattern(s string) (HexPattern, error) {
+
+	var out HexPattern
+
+	for _, word := range strings.Fields(strings.Replace(s, ",", " ", -1)) {
+		word = strings.TrimPrefix(strings.TrimPrefix(word, "$"), "0x")
+		if strings.Contains(word, "/") {
+			hb, err := parseHexByte(word)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, hb)
+			continue
+		}
+		if len(word)%2 != 0 {
+			return nil, fmt.Errorf("Odd number of hex digits in %s", word)
+		}
+		for i := 0; i < len(word); i += 2 {
+			hb, err := parseHexByte(word[i : i+2])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, hb)
+		}
+	}
+
+	if len(out) == 0 {
+		return nil, errors.New("Empty pattern")
+	}
+
+	anchored := false
+	for _, hb := range out {
+		if hb.mask != 0 {
+			anchored = true
+		}
+	}
+	if !anchored {
+		return nil, errors.New("Pattern matches anything")
+	}
+
+	return out, nil
+}
+
+// Find returns the offset of every match in data
+func (p HexPattern) Find(data []byte) []int {
+
+	var out []int
+
+	// look for the first fully specified byte to skip ahead quickly
+	anchor := -1
+	for i, hb := range p {
+		if hb.mask == 0xff {
+			anchor = i
+			break
+		}
+	}
+
+	for start := 0; start+len(p) <= len(data); {
+
+		if anchor >= 0 {
+			i := bytes.IndexByte(data[start+anchor:len(data)-len(p)+anchor+1], p[anchor].value)
+			if i < 0 {
+				break
+			}
+			start += i
+		}
+
+		match := true
+		for j, hb := range p {
+			if data[start+j]&hb.mask != hb.value {
+				match = false
+				break
+			}
+		}
+		if match {
+			out = append(out, start)
+		}
+		start++
+	}
+
+	return out
+}
+
+type HexMatch struct {
+	DiskPath string
+	File     *DiskFile // nil for a sector match
+	Offset   int
+	Track    int
+	Sector   int
+	Block    int // -1 unless the disk is block based
+}
+
+// 140K ProDOS block sector pairs, by block within the track
+var prodosBlockSectors = [][2]int{{0x0, 0xe}, {0xd, 0xc}, {0xb, 0xa}, {0x9, 0x8}, {0x7, 0x6}, {0x5, 0x4}, {0x3, 0x2}, {0x1, 0xf}}
+
+// sectorBlock works out which block a pair of sectors came from
+func sectorBlock(d *Disk, s1, s2 *DiskSector) int {
+
+	if s1.Track != s2.Track {
+		return -1
+	}
+
+	for bo, pair := range prodosBlockSectors {
+		if pair[0] == s1.Sector && pair[1] == s2.Sector {
+			return s1.Track*8 + bo
+		}
+	}
+
+	if s2.Sector == s1.Sector+1 && s1.Sector%2 == 0 {
+		switch d.FormatID.ID {
+		case disk.DF_PRODOS, disk.DF_PASCAL:
+			return (s1.Track*16 + s1.Sector) / 2
+		case disk.DF_PRODOS_400KB, disk.DF_PRODOS_800KB:
+			return (s1.Track*40 + s1.Sector) / 2
+		}
+	}
+
+	return -1
+}
+
+// hexUnit is a sector, or a block of two, searched as one
+type hexUnit struct {
+	sectors []*DiskSector
+	block   int // -1 if not a block
+	pos     int // place on the disk, in sectors or blocks; -1 if unknown
+}
+
+// hexUnits puts the sectors of a disk in the order they sit in the image.
+// The sectors of a block come in pairs, as ingest stores them; a sector
+// that doesn't pair up with the next into a block is searched on its own.
+func (d *Disk) hexUnits() []*hexUnit {
+
+	var out []*hexUnit
+
+	for _, list := range []DiskSectors{d.ActiveSectors, d.InactiveSectors} {
+		for i := 0; i < len(list); i++ {
+			s := list[i]
+			if len(s.Data) == 0 {
+				continue
+			}
+			if d.Blocks > 0 {
+				if i+1 < len(list) && len(list[i+1].Data) > 0 {
+					if block := sectorBlock(d, s, list[i+1]); block >= 0 {
+						out = append(out, &hexUnit{sectors: []*DiskSector{s, list[i+1]}, block: block, pos: block})
+						i++
+						continue
+					}
+				}
+				out = append(out, &hexUnit{sectors: []*DiskSector{s}, block: -1, pos: -1})
+				continue
+			}
+			pos := -1
+			if d.Sectors > 0 {
+				pos = s.Track*d.Sectors + s.Sector
+			}
+			out = append(out, &hexUnit{sectors: []*DiskSector{s}, block: -1, pos: pos})
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool { return out[i].pos < out[j].pos })
+
+	return out
+}
+
+func (d *Disk) findHex(p HexPattern) []*HexMatch {
+
+	var out []*HexMatch
+
+	for _, f := range d.Files {
+		for _, offset := range p.Find(f.Data) {
+			out = append(out, &HexMatch{DiskPath: d.FullPath, File: f, Offset: offset, Block: -1})
+		}
+	}
+
+	// runs of sectors or blocks next to each other are searched together,
+	// so a match can run on from one into the next; it is reported where
+	// it starts
+	units := d.hexUnits()
+	for i := 0; i < len(units); {
+
+		j := i + 1
+		for j < len(units) && units[i].pos >= 0 && units[j].pos == units[j-1].pos+1 {
+			j++
+		}
+
+		var data []byte
+		var starts, unitStarts []int
+		var sectors []*DiskSector
+		var blocks []int
+		for _, u := range units[i:j] {
+			ustart := len(data)
+			for _, s := range u.sectors {
+				starts = append(starts, len(data))
+				unitStarts = append(unitStarts, ustart)
+				sectors = append(sectors, s)
+				blocks = append(blocks, u.block)
+				data = append(data, s.Data...)
+			}
+		}
+
+		for _, offset := range p.Find(data) {
+			// offsets are within the block, or the sector if not a block
+			n := sort.SearchInts(starts, offset+1) - 1
+			s := sectors[n]
+			out = append(out, &HexMatch{DiskPath: d.FullPath, Offset: offset - unitStarts[n], Track: s.Track, Sector: s.Sector, Block: blocks[n]})
+		}
+
+		i = j
+	}
+
+	return out
+}
+
+type hexCollector struct {
+	sync.Mutex
+	pattern HexPattern
+	matches []*HexMatch
+	files   bool // any disk had file data
+	sectors bool // any disk had sector data
+}
+
+func AggregateHexMatches(d *Disk, collector interface{}) {
+
+	c := collector.(*hexCollector)
+
+	found := d.findHex(c.pattern)
+
+	c.Lock()
+	c.matches = append(c.matches, found...)
+	for _, f := range d.Files {
+		if len(f.Data) > 0 {
+			c.files = true
+			break
+		}
+	}
+	for _, s := range d.ActiveSectors {
+		if len(s.Data) > 0 {
+			c.sectors = true
+			break
+		}
+	}
+	c.Unlock()
+}
+
+type jsonHexMatch struct {
+	Disk    string `json:"disk"`
+	File    string `json:"file"`
+	Offset  int    `json:"offset"`
+	Address int    `json:"address"`
+	Track   int    `json:"track"`
+	Sector  int    `json:"sector"`
+	Block   int    `json:"block"`
+}
+
+// JSON describes the match; file matches have track, sector and block
+// set to -1, sector matches have no file or address.
+func (m *HexMatch) JSON() *jsonHexMatch {
+
+	if m.File != nil {
+		return &jsonHexMatch{
+			Disk:    m.DiskPath,
+			File:    m.File.Filename,
+			Offset:  m.Offset,
+			Address: m.File.LoadAddress + m.Offset,
+			Track:   -1,
+			Sector:  -1,
+			Block:   -1,
+		}
+	}
+
+	return &jsonHexMatch{
+		Disk:    m.DiskPath,
+		Offset:  m.Offset,
+		Address: -1,
+		Track:   m.Track,
+		Sector:  m.Sector,
+		Block:   m.Block,
+	}
+}
+
+func (m *HexMatch) Where() string {
+
+	if m.File != nil {
+		s := fmt.Sprintf("file %s +$%04X", m.File.Filename, m.Offset)
+		if m.File.LoadAddress != 0 {
+			s += fmt.Sprintf(" (at $%04X)", m.File.LoadAddress+m.Offset)
+		}
+		return s
+	}
+
+	if m.Block >= 0 {
+		return fmt.Sprintf("block %d +$%03X (T%d,S%d)", m.Block, m.Offset, m.Track, m.Sector)
+	}
+
+	return fmt.Sprintf("T%d,S%d +$%02X", m.Track, m.Sector, m.Offset)
+}
+
+// findHexMatches searches every disk for the pattern
+func findHexMatches(p HexPattern, filter []string) *hexCollector {
+
+	c := &hexCollector{pattern: p}
+	Aggregate(AggregateHexMatches, c, filter)
+
+	sort.SliceStable(c.matches, func(i, j int) bool {
+		return c.matches[i].DiskPath < c.matches[j].DiskPath
+	})
+
+	return c
+}
+
+func jsonHexMatches(matches []*HexMatch) []*jsonHexMatch {
+	out := make([]*jsonHexMatch, 0, len(matches))
+	for _, m := range matches {
+		out = append(out, m.JSON())
+	}
+	return out
+}
+
+func searchForHex(pattern string, filter []string) {
+
+	p, err := ParseHexPattern(pattern)
+	if err != nil {
+		os.Stderr.WriteString("Bad pattern: " + err.Error() + "\n")
+		return
+	}
+
+	c := findHexMatches(p, filter)
+
+	if *jsonOut {
+		writeJSONReport("search-hex", jsonHexMatches(c.matches))
+	} else {
+		printHexMatches(pattern, c)
+	}
+
+	if *extract == "@" {
+		for _, m := range c.matches {
+			if m.File != nil {
+				ExtractFile(m.DiskPath, m.File, *adornedCP, false)
+			}
+		}
+	}
+	if *extract == "#" {
+		seen := make(map[string]bool)
+		for _, m := range c.matches {
+			if !seen[m.DiskPath] {
+				ExtractDisk(m.DiskPath)
+				seen[m.DiskPath] = true
+			}
+		}
+	}
+}
+
+func printHexMatches(pattern string, c *hexCollector) {
+
+	fmt.Println()
+	fmt.Println()
+
+	fmt.Printf("SEARCH RESULTS FOR BYTES '%s'\n", pattern)
+
+	fmt.Println()
+
+	last := ""
+	disks := 0
+	for _, m := range c.matches {
+		if m.DiskPath != last {
+			fmt.Printf("%32s:\n", m.DiskPath)
+			last = m.DiskPath
+			disks++
+		}
+		fmt.Printf("  %s\n", m.Where())
+	}
+
+	fmt.Printf("\n%d match(es) on %d disk(s)\n", len(c.matches), disks)
+	if !c.files {
+		fmt.Println("No file data was searched; ingest with -ingest-mode 1 or 3 to search files")
+	}
+	if !c.sectors {
+		fmt.Println("No sectors were searched; ingest with -ingest-mode 2 or 3 to search sectors")
+	}
+}
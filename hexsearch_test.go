@@ -0,0 +1,181 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/paleotronic/diskm8/disk"
+)
+
+func TestParseHexPattern(t *testing.T) {
+
+	tests := []struct {
+		pattern string
+		want    HexPattern
+	}{
+		{"A9 ?? 8D 00 C0", HexPattern{{0xa9, 0xff}, {0, 0}, {0x8d, 0xff}, {0, 0xff}, {0xc0, 0xff}}},
+		{"a9008dc0", HexPattern{{0xa9, 0xff}, {0, 0xff}, {0x8d, 0xff}, {0xc0, 0xff}}},
+		{"$A9,0x8D", HexPattern{{0xa9, 0xff}, {0x8d, 0xff}}},
+		{"A? ?9", HexPattern{{0xa0, 0xf0}, {0x09, 0x0f}}},
+		{"20??FD", HexPattern{{0x20, 0xff}, {0, 0}, {0xfd, 0xff}}},
+		{"80/F0", HexPattern{{0x80, 0xf0}}},
+		{"8F/F0 ??", HexPattern{{0x80, 0xf0}, {0, 0}}},
+		{"3/7F", HexPattern{{0x03, 0x7f}}},
+	}
+
+	for _, test := range tests {
+		p, err := ParseHexPattern(test.pattern)
+		if err != nil {
+			t.Errorf("%q: %v", test.pattern, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.pattern, test.want, p)
+		}
+	}
+
+}
+
+func TestParseHexPatternErrors(t *testing.T) {
+
+	for _, pattern := range []string{
+		"",
+		"??",
+		"?? ??",
+		"00/00",
+		"A",
+		"A9 123",
+		"ZZ",
+		"A9 G0",
+		"?G",
+		"80/FG",
+		"X0/F0",
+		"100/FF",
+	} {
+		if _, err := ParseHexPattern(pattern); err == nil {
+			t.Errorf("%q: expected an error", pattern)
+		}
+	}
+
+}
+
+func TestHexPatternFind(t *testing.T) {
+
+	data := []byte{0xa9, 0x01, 0x8d, 0x00, 0xc0, 0xa9, 0x02, 0x8d, 0x10, 0xc0, 0x8d}
+
+	tests := []struct {
+		pattern string
+		want    []int
+	}{
+		{"A9 ?? 8D", []int{0, 5}},
+		{"8D ?0 C0", []int{2, 7}},
+		{"?? 8D", []int{1, 6, 9}},
+		{"8D 00 C0", []int{2}},
+		{"C0 8D", []int{9}},
+		{"80/F0", []int{2, 7, 10}},
+		{"8D ??", []int{2, 7}},
+		{"A9 03", nil},
+	}
+
+	for _, test := range tests {
+		p, err := ParseHexPattern(test.pattern)
+		if err != nil {
+			t.Fatalf("%q: %v", test.pattern, err)
+		}
+		if got := p.Find(data); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.pattern, test.want, got)
+		}
+	}
+
+}
+
+// hexSector is a sector of zeroes with bytes put at the start or the end
+func hexSector(track, sector int, start, end []byte) *DiskSector {
+	data := make([]byte, 256)
+	copy(data, start)
+	copy(data[256-len(end):], end)
+	return &DiskSector{Track: track, Sector: sector, Data: data}
+}
+
+func hexMatches(d *Disk, pattern string) [][4]int {
+
+	p, err := ParseHexPattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+
+	var out [][4]int
+	for _, m := range d.findHex(p) {
+		out = append(out, [4]int{m.Track, m.Sector, m.Block, m.Offset})
+	}
+
+	return out
+}
+
+func TestFindHexSectors(t *testing.T) {
+
+	d := &Disk{
+		Tracks:  35,
+		Sectors: 16,
+		ActiveSectors: DiskSectors{
+			hexSector(0, 14, nil, []byte{0x20}),
+			hexSector(0, 15, nil, []byte{0xa9, 0x01}),
+			hexSector(2, 0, []byte{0xfd}, nil),
+		},
+		InactiveSectors: DiskSectors{
+			hexSector(1, 0, []byte{0x8d, 0x00}, nil),
+		},
+	}
+
+	tests := []struct {
+		pattern string
+		want    [][4]int
+	}{
+		// runs on from an active sector into an inactive one on the next track
+		{"A9 01 8D 00", [][4]int{{0, 15, -1, 254}}},
+		{"00 20 00", [][4]int{{0, 14, -1, 254}}},
+		// 1:0 and 2:0 are not next to each other
+		{"00 FD", nil},
+		{"FD", [][4]int{{2, 0, -1, 0}}},
+	}
+
+	for _, test := range tests {
+		if got := hexMatches(d, test.pattern); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.pattern, test.want, got)
+		}
+	}
+
+}
+
+func TestFindHexBlocks(t *testing.T) {
+
+	d := &Disk{
+		FormatID: disk.GetDiskFormat(disk.DF_PRODOS),
+		Blocks:   280,
+		ActiveSectors: DiskSectors{
+			// a sector on its own, then blocks 0 and 1
+			hexSector(5, 3, []byte{0x4c, 0x00}, nil),
+			hexSector(0, 0x0, nil, []byte{0xa9}),
+			hexSector(0, 0xe, []byte{0x01}, []byte{0x8d}),
+			hexSector(0, 0xd, []byte{0x00, 0xc0}, nil),
+			hexSector(0, 0xc, nil, nil),
+		},
+	}
+
+	tests := []struct {
+		pattern string
+		want    [][4]int
+	}{
+		{"A9 01", [][4]int{{0, 0x0, 0, 255}}},
+		{"8D 00 C0", [][4]int{{0, 0xe, 0, 511}}},
+		{"4C 00", [][4]int{{5, 3, -1, 0}}},
+		{"00 A9", [][4]int{{0, 0x0, 0, 254}}},
+	}
+
+	for _, test := range tests {
+		if got := hexMatches(d, test.pattern); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.pattern, test.want, got)
+		}
+	}
+
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+	Static HTML catalogue...
+
+	-html <dir> writes a set of pages built from the stored fingerprints,
+	which can be browsed straight off a file share:
+
+	  index.html          every disk, by name
+	  formats.html        every disk, grouped by format
+	  clusters.html       groups of duplicate disks
+	  disk/<id>.html      one page per disk
+	  cluster/<id>.html   one page per group of duplicates
+	  style.css
+
+	Disk pages are named after the disk ID (a hash of its path), so they
+	stay the same from one run to the next and links into the catalogue
+	keep working.
+*/
+
+// blocks shown on each line of the map of a block based disk
+const htmlMapWidth = 16
+
+type htmlCollector struct {
+	sync.Mutex
+	disks []*Disk
+}
+
+func AggregateHTMLDisks(d *Disk, collector interface{}) {
+	c := collector.(*htmlCollector)
+	c.Lock()
+	c.disks = append(c.disks, d)
+	c.Unlock()
+}
+
+type htmlMapRow struct {
+	Label string
+	Used  []bool
+}
+
+type htmlLink struct {
+	Name   string
+	Path   string
+	Page   string
+	Detail string
+}
+
+type htmlCluster struct {
+	Page   string
+	Kind   string
+	Active bool // disks share active sectors rather than being identical
+	SHA256 string
+	Disks  []htmlLink
+}
+
+type htmlListing struct {
+	Anchor string
+	Name   string
+	Text   string
+}
+
+type htmlDiskPage struct {
+	Disk      *Disk
+	Geometry  string
+	Used      int
+	Map       []htmlMapRow
+	Listings  []htmlListing
+	Anchors   map[*DiskFile]string
+	Identical []htmlLink
+	Active    []htmlLink
+	Similar   []htmlLink
+	Clusters  []*htmlCluster
+}
+
+type htmlFormatGroup struct {
+	Format string
+	Disks  []*Disk
+}
+
+type htmlCatalogue struct {
+	disks    []*Disk
+	pages    map[string]string // disk path -> page
+	whole    map[string]*htmlCluster
+	active   map[string]*htmlCluster
+	clusters []*htmlCluster
+	similar  map[string]*FileOverlapRecord
+}
+
+func htmlDiskName(d *Disk) string {
+	if d.Filename != "" {
+		return d.Filename
+	}
+	return filepath.Base(d.FullPath)
+}
+
+func (c *htmlCatalogue) link(path, detail string) htmlLink {
+	name := path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		name = path[i+1:]
+	}
+	return htmlLink{Name: name, Path: path, Page: c.pages[path], Detail: detail}
+}
+
+// geometry describes the layout of the disk
+func htmlGeometry(d *Disk) string {
+	switch {
+	case d.Blocks > 0:
+		return fmt.Sprintf("%d blocks", d.Blocks)
+	case d.Tracks > 0:
+		return fmt.Sprintf("%d tracks, %d sectors per track", d.Tracks, d.Sectors)
+	}
+	return "unknown"
+}
+
+// htmlBitmap lays out the used sector (or block) map a track, or a line
+// of blocks, per row.
+func htmlBitmap(d *Disk) ([]htmlMapRow, int) {
+
+	var rows []htmlMapRow
+	used := 0
+
+	for _, b := range d.Bitmap {
+		if b {
+			used++
+		}
+	}
+
+	if d.Blocks == 0 && d.Tracks > 0 && d.Sectors > 0 && len(d.Bitmap) == d.Tracks*d.Sectors {
+		for t := 0; t < d.Tracks; t++ {
+			rows = append(rows, htmlMapRow{
+				Label: fmt.Sprintf("T%02d", t),
+				Used:  d.Bitmap[t*d.Sectors : (t+1)*d.Sectors],
+			})
+		}
+		return rows, used
+	}
+
+	for b := 0; b < len(d.Bitmap); b += htmlMapWidth {
+		end := b + htmlMapWidth
+		if end > len(d.Bitmap) {
+			end = len(d.Bitmap)
+		}
+		rows = append(rows, htmlMapRow{Label: fmt.Sprintf("%04d", b), Used: d.Bitmap[b:end]})
+	}
+
+	return rows, used
+}
+
+func newHTMLCatalogue(disks []*Disk, similar map[string]*FileOverlapRecord) *htmlCatalogue {
+
+	c := &htmlCatalogue{
+		disks:   disks,
+		pages:   make(map[string]string),
+		whole:   make(map[string]*htmlCluster),
+		active:  make(map[string]*htmlCluster),
+		similar: similar,
+	}
+
+	sort.Slice(disks, func(i, j int) bool {
+		ni, nj := strings.ToLower(htmlDiskName(disks[i])), strings.ToLower(htmlDiskName(disks[j]))
+		if ni != nj {
+			return ni < nj
+		}
+		return disks[i].FullPath < disks[j].FullPath
+	})
+
+	for _, d := range disks {
+		c.pages[d.FullPath] = d.ID() + ".html"
+	}
+
+	wholeDisks := make(map[string][]*Disk)
+	activeDisks := make(map[string][]*Disk)
+	for _, d := range disks {
+		wholeDisks[d.canonicalSHA256()] = append(wholeDisks[d.canonicalSHA256()], d)
+		if as := d.canonicalSHA256Active(); as != "" {
+			activeDisks[as] = append(activeDisks[as], d)
+		}
+	}
+
+	addCluster := func(kind, prefix, sha string, list []*Disk) *htmlCluster {
+		cl := &htmlCluster{Page: prefix + "-" + sha[:16] + ".html", Kind: kind, Active: prefix == "a", SHA256: sha}
+		for _, d := range list {
+			detail := d.FormatID.String()
+			if cl.Active {
+				detail += ", SHA256 " + d.SHA256[:16]
+			}
+			cl.Disks = append(cl.Disks, c.link(d.FullPath, detail))
+		}
+		c.clusters = append(c.clusters, cl)
+		return cl
+	}
+
+	for sha, list := range wholeDisks {
+		if len(list) > 1 && len(sha) >= 16 {
+			c.whole[sha] = addCluster("Identical disks", "w", sha, list)
+		}
+	}
+
+	for sha, list := range activeDisks {
+		if len(list) < 2 || len(sha) < 16 {
+			continue
+		}
+		// as with -as-dupes, disks that are identical throughout are left
+		// to the whole disk clusters
+		shas := make(map[string]bool)
+		for _, d := range list {
+			shas[d.canonicalSHA256()] = true
+		}
+		if len(shas) > 1 {
+			c.active[sha] = addCluster("Same active sectors", "a", sha, list)
+		}
+	}
+
+	sort.Slice(c.clusters, func(i, j int) bool {
+		if c.clusters[i].Kind != c.clusters[j].Kind {
+			return c.clusters[i].Kind < c.clusters[j].Kind
+		}
+		return c.clusters[i].Disks[0].Name < c.clusters[j].Disks[0].Name
+	})
+
+	return c
+}
+
+func (c *htmlCatalogue) diskPage(d *Disk) *htmlDiskPage {
+
+	p := &htmlDiskPage{
+		Disk:     d,
+		Geometry: htmlGeometry(d),
+		Anchors:  make(map[*DiskFile]string),
+	}
+	p.Map, p.Used = htmlBitmap(d)
+
+	for i, f := range d.Files {
+		if len(f.Text) == 0 {
+			continue
+		}
+		anchor := fmt.Sprintf("f%d", i)
+		p.Anchors[f] = anchor
+		p.Listings = append(p.Listings, htmlListing{
+			Anchor: anchor,
+			Name:   f.Filename,
+			Text:   strings.Join(textLines(f.Text), "\n"),
+		})
+	}
+
+	identical := make(map[string]bool)
+	if cl, ok := c.whole[d.canonicalSHA256()]; ok {
+		p.Clusters = append(p.Clusters, cl)
+		for _, l := range cl.Disks {
+			if l.Path != d.FullPath {
+				p.Identical = append(p.Identical, l)
+				identical[l.Path] = true
+			}
+		}
+	}
+
+	if cl, ok := c.active[d.canonicalSHA256Active()]; ok {
+		p.Clusters = append(p.Clusters, cl)
+		for _, l := range cl.Disks {
+			if l.Path != d.FullPath {
+				p.Active = append(p.Active, l)
+			}
+		}
+	}
+
+	if v, ok := c.similar[d.FullPath]; ok {
+		for path, ratio := range v.percent {
+			if identical[path] {
+				continue
+			}
+			detail := fmt.Sprintf("%.2f%% (%d same, %d missing, %d extra, %d modified)", 100*ratio, len(v.files[path]), len(v.missing[path]), len(v.extras[path]), len(v.modified[path]))
+			p.Similar = append(p.Similar, c.link(path, detail))
+		}
+		sort.Slice(p.Similar, func(i, j int) bool {
+			ri, rj := v.percent[p.Similar[i].Path], v.percent[p.Similar[j].Path]
+			if ri != rj {
+				return ri > rj
+			}
+			return p.Similar[i].Path < p.Similar[j].Path
+		})
+	}
+
+	return p
+}
+
+func (c *htmlCatalogue) formatGroups() []*htmlFormatGroup {
+
+	groups := make(map[string]*htmlFormatGroup)
+	var out []*htmlFormatGroup
+
+	for _, d := range c.disks {
+		name := d.FormatID.String()
+		g, ok := groups[name]
+		if !ok {
+			g = &htmlFormatGroup{Format: name}
+			groups[name] = g
+			out = append(out, g)
+		}
+		g.Disks = append(g.Disks, d)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Format < out[j].Format })
+
+	return out
+}
+
+var htmlFuncs = template.FuncMap{
+	"name": htmlDiskName,
+	"addr": func(a int) string { return fmt.Sprintf("$%04X", a) },
+	"short": func(s string) string {
+		if len(s) > 16 {
+			return s[:16]
+		}
+		return s
+	},
+}
+
+var htmlTemplates = template.Must(template.New("html").Funcs(htmlFuncs).Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="{{.Root}}style.css">
+</head>
+<body>
+<nav><a href="{{.Root}}index.html">Disks by name</a> | <a href="{{.Root}}formats.html">Disks by format</a> | <a href="{{.Root}}clusters.html">Duplicates</a></nav>
+<h1>{{.Title}}</h1>
+{{end}}
+
+{{define "foot"}}</body>
+</html>
+{{end}}
+
+{{define "disks"}}<table>
+<tr><th>Disk</th><th>Format</th><th>Files</th><th>OS</th><th>Path</th></tr>
+{{range .Disks}}<tr><td><a href="disk/{{$.Page .}}">{{name .}}</a></td><td>{{.FormatID}}</td><td class="n">{{len .Files}}</td><td>{{.BootDescription}}</td><td>{{.FullPath}}</td></tr>
+{{end}}</table>
+{{end}}
+
+{{define "links"}}<ul>
+{{range .}}<li>{{if .Page}}<a href="{{.Page}}">{{.Name}}</a>{{else}}{{.Name}}{{end}} <span class="path">{{.Path}}</span>{{if .Detail}} {{.Detail}}{{end}}</li>
+{{end}}</ul>
+{{end}}
+
+{{define "index"}}{{template "head" .}}<p>{{len .Disks}} disk(s)</p>
+{{template "disks" .}}{{template "foot"}}{{end}}
+
+{{define "formats"}}{{template "head" .}}{{range .Groups}}<h2>{{.Format}}</h2>
+<p>{{len .Disks}} disk(s)</p>
+{{template "disks" $.Wrap .Disks}}{{end}}{{template "foot"}}{{end}}
+
+{{define "clusters"}}{{template "head" .}}{{if not .Clusters}}<p>No duplicate disks.</p>
+{{end}}{{range .Clusters}}<h2><a href="cluster/{{.Page}}">{{.Kind}}</a> <span class="sha">{{short .SHA256}}</span></h2>
+<ul>
+{{range .Disks}}<li><a href="disk/{{.Page}}">{{.Name}}</a> <span class="path">{{.Path}}</span></li>
+{{end}}</ul>
+{{end}}{{template "foot"}}{{end}}
+
+{{define "cluster"}}{{template "head" .}}{{with .Cluster}}<p>{{len .Disks}} disks with the SHA256{{if .Active}} of their active sectors{{end}} <span class="sha">{{.SHA256}}</span></p>
+<ul>
+{{range .Disks}}<li><a href="../disk/{{.Page}}">{{.Name}}</a> <span class="path">{{.Path}}</span> {{.Detail}}</li>
+{{end}}</ul>
+{{end}}{{template "foot"}}{{end}}
+
+{{define "disk"}}{{template "head" .}}{{with .DiskPage}}{{$p := .}}<table class="info">
+<tr><th>Path</th><td>{{.Disk.FullPath}}</td></tr>
+{{if .Disk.Archive}}<tr><th>Archive</th><td>{{.Disk.Archive}} ({{.Disk.ArchiveMember}})</td></tr>
+{{end}}<tr><th>Format</th><td>{{.Disk.FormatID}}</td></tr>
+<tr><th>Geometry</th><td>{{.Geometry}}</td></tr>
+<tr><th>In use</th><td>{{.Used}} of {{len .Disk.Bitmap}}</td></tr>
+<tr><th>OS</th><td>{{.Disk.BootDescription}}</td></tr>
+<tr><th>SHA256</th><td class="sha">{{.Disk.SHA256}}</td></tr>
+<tr><th>Active SHA256</th><td class="sha">{{.Disk.SHA256Active}}</td></tr>
+</table>
+
+<h2>Catalog</h2>
+{{if .Disk.Files}}<table>
+<tr><th>Name</th><th>Type</th><th>Kind</th><th>Size</th><th>Address</th><th>Locked</th><th>SHA256</th></tr>
+{{range .Disk.Files}}<tr><td>{{with index $p.Anchors .}}<a href="#{{.}}">{{end}}{{.Filename}}{{if index $p.Anchors .}}</a>{{end}}</td><td>{{.Ext}}</td><td>{{.Type}}</td><td class="n">{{.Size}}</td><td>{{addr .LoadAddress}}</td><td>{{if .Locked}}Y{{end}}</td><td class="sha">{{short .SHA256}}</td></tr>
+{{end}}</table>
+{{else}}<p>No files.</p>
+{{end}}
+
+{{if .Map}}<h2>Map</h2>
+<table class="map">
+{{range .Map}}<tr><th>{{.Label}}</th>{{range .Used}}<td class="{{if .}}u{{else}}f{{end}}"></td>{{end}}</tr>
+{{end}}</table>
+{{end}}
+
+<h2>Duplicates</h2>
+{{if .Identical}}<h3>Identical disks</h3>
+{{template "links" .Identical}}{{end}}{{if .Active}}<h3>Same active sectors</h3>
+{{template "links" .Active}}{{end}}{{if .Similar}}<h3>Similar disks</h3>
+{{template "links" .Similar}}{{end}}{{if .Clusters}}<p>{{range .Clusters}}<a href="../cluster/{{.Page}}">{{.Kind}}</a> {{end}}</p>
+{{end}}{{if not (or .Identical .Active .Similar)}}<p>None found.</p>
+{{end}}
+
+{{range .Listings}}<h2 id="{{.Anchor}}">{{.Name}}</h2>
+<pre>{{.Text}}</pre>
+{{end}}{{end}}{{template "foot"}}{{end}}
+`))
+
+const htmlStyle = `body { font-family: sans-serif; margin: 1em 2em; }
+nav { margin-bottom: 1em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 2px 8px; }
+tr:nth-child(even) td { background: #f0f0f0; }
+td.n { text-align: right; }
+.sha, .path { font-family: monospace; }
+.path { color: #666; }
+table.info th { width: 10em; }
+table.map td { width: 10px; height: 10px; padding: 0; border: 1px solid #fff; }
+table.map th { font-family: monospace; font-weight: normal; padding: 0 4px; }
+table.map td.u { background: #36c; }
+table.map td.f { background: #ddd; }
+pre { background: #f8f8f8; padding: 0.5em; overflow-x: auto; }
+`
+
+type htmlPage struct {
+	Title    string
+	Root     string
+	Disks    []*Disk
+	Groups   []*htmlFormatGroup
+	Clusters []*htmlCluster
+	Cluster  *htmlCluster
+	DiskPage *htmlDiskPage
+	pages    map[string]string
+}
+
+// Page is the page of a disk, used by the "disks" template
+func (p *htmlPage) Page(d *Disk) string {
+	return p.pages[d.FullPath]
+}
+
+// Wrap passes a list of disks to the "disks" template along with the
+// page lookup.
+func (p *htmlPage) Wrap(disks []*Disk) *htmlPage {
+	q := *p
+	q.Disks = disks
+	return &q
+}
+
+func writeHTMLFile(filename string, name string, data interface{}) error {
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := htmlTemplates.ExecuteTemplate(f, name, data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (c *htmlCatalogue) write(dir string) error {
+
+	for _, sub := range []string{"", "disk", "cluster"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "style.css"), []byte(htmlStyle), 0644); err != nil {
+		return err
+	}
+
+	page := func(title, root string) *htmlPage {
+		return &htmlPage{Title: title, Root: root, pages: c.pages}
+	}
+
+	p := page("Disks by name", "")
+	p.Disks = c.disks
+	if err := writeHTMLFile(filepath.Join(dir, "index.html"), "index", p); err != nil {
+		return err
+	}
+
+	p = page("Disks by format", "")
+	p.Groups = c.formatGroups()
+	if err := writeHTMLFile(filepath.Join(dir, "formats.html"), "formats", p); err != nil {
+		return err
+	}
+
+	p = page("Duplicates", "")
+	p.Clusters = c.clusters
+	if err := writeHTMLFile(filepath.Join(dir, "clusters.html"), "clusters", p); err != nil {
+		return err
+	}
+
+	for _, cl := range c.clusters {
+		p = page(cl.Kind, "../")
+		p.Cluster = cl
+		if err := writeHTMLFile(filepath.Join(dir, "cluster", cl.Page), "cluster", p); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range c.disks {
+		p = page(htmlDiskName(d), "../")
+		p.DiskPage = c.diskPage(d)
+		if err := writeHTMLFile(filepath.Join(dir, "disk", c.pages[d.FullPath]), "disk", p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func htmlCatalogueReport(dir string, filter []string) {
+
+	c := &htmlCollector{}
+	Aggregate(AggregateHTMLDisks, c, filter)
+
+	similar := CollectFilesOverlapsAboveThreshold(*similarity, filter)
+	os.Stderr.WriteString("\n")
+
+	cat := newHTMLCatalogue(c.disks, similar)
+	if err := cat.write(dir); err != nil {
+		os.Stderr.WriteString("Unable to write catalogue: " + err.Error() + "\n")
+		return
+	}
+
+	fmt.Printf("Wrote %d disk page(s) and %d duplicate cluster(s) to %s\n", len(cat.disks), len(cat.clusters), dir)
+}
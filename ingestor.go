@@ -3,12 +3,14 @@ package main
 import (
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"sync"
 	"time"
 
@@ -21,7 +23,54 @@ import (
 	"github.com/paleotronic/diskm8/panic"
 )
 
-var diskRegex = regexp.MustCompile("(?i)[.](po|do|dsk)$")
+// acceptedExtension reports whether a file has one of the -ingest-ext
+// extensions, and so is always read; its content decides whether it
+// actually is a disk.
+func acceptedExtension(name string) bool {
+
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+
+	for _, v := range strings.Split(*ingestExt, ",") {
+		v = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(v)), ".")
+		if v == "*" || (v == ext && v != "") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ingestCandidate reports whether a file should be read to see if it is a
+// disk: any with an -ingest-ext extension, and any other whose size and
+// first bytes could be a disk image.  Files turned away are only counted.
+func ingestCandidate(name string, size int64, header []byte) bool {
+
+	if acceptedExtension(name) {
+		return true
+	}
+
+	if err := disk.SniffHeader(header, size); err != nil {
+		ignore()
+		return false
+	}
+
+	return true
+}
+
+// fileHeader returns the first bytes of a file, enough for SniffHeader
+func fileHeader(filename string) []byte {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	header := make([]byte, 64)
+	n, _ := io.ReadFull(f, header)
+
+	return header[:n]
+}
 
 func processFile(path string, info os.FileInfo, err error) error {
 	if err != nil {
@@ -29,9 +78,63 @@ func processFile(path string, info os.FileInfo, err error) error {
 		return err
 	}
 
-	if diskRegex.MatchString(path) {
+	// size and time of a symbolic link come from the file it points to, as
+	// dedupe records them in the manifest
+	if info.Mode()&os.ModeSymlink != 0 {
+		if info, err = os.Stat(path); err != nil {
+			loggy.Get(0).Errorf(err.Error())
+			return nil
+		}
+	}
+
+	if info.IsDir() {
+		return nil
+	}
+
+	key := manifestKey(path)
+
+	if isArchive(path) {
+
+		if !*reingest && manifest.UnchangedArchive(key, info) {
+			for _, member := range manifest.Get(key).Members {
+				noteUnchanged(member)
+			}
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			loggy.Get(0).Errorf(err.Error())
+			return nil
+		}
+		defer f.Close()
+
+		members := make([]string, 0)
+		err = walkArchive(path, f, info.Size(), func(p string, data []byte) error {
+			incoming <- ingestItem{filename: p, data: data, modtime: info.ModTime().UnixNano()}
+			members = append(members, manifestKey(p))
+			fmt.Printf("\rIngested: %d volumes ...", processed)
+			return nil
+		})
+		if err != nil {
+			loggy.Get(0).Errorf("Error reading archive %s: %v", path, err)
+			return nil
+		}
+
+		// only counts as unchanged next time once every member is ingested
+		manifest.Put(key, &ManifestEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Members: members})
+
+		return nil
+	}
+
+	if ingestCandidate(path, info.Size(), fileHeader(path)) {
+
+		if !*reingest && manifest.Unchanged(key, info) {
+			noteUnchanged(key)
+			return nil
+		}
 
-		incoming <- path
+		incoming <- ingestItem{filename: path, modtime: info.ModTime().UnixNano()}
 
 		fmt.Printf("\rIngested: %d volumes ...", processed)
 
@@ -40,11 +143,58 @@ func processFile(path string, info os.FileInfo, err error) error {
 	return nil
 }
 
+// ingestItem is a disk image waiting to be analyzed; data is already
+// loaded for images read out of archives.
+type ingestItem struct {
+	filename string
+	data     []byte
+	modtime  int64
+}
+
+// ingest analyzes an image unless its content is the same as last time,
+// and records the outcome in the manifest.
+func ingest(id int, item ingestItem) {
+
+	data := item.data
+	if data == nil {
+		var err error
+		data, err = readDiskImage(item.filename)
+		if err != nil {
+			loggy.Get(id).Errorf("Disk read failed: %s", err)
+			return
+		}
+	}
+
+	key := manifestKey(item.filename)
+
+	same, sum := manifest.SameContent(key, data)
+	if same && !*reingest {
+		// touched but not changed
+		e := *manifest.Get(key)
+		e.ModTime = item.modtime
+		manifest.Put(key, &e)
+		noteUnchanged(key)
+		return
+	}
+
+	dsk, err := analyzeData(id, item.filename, data)
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+	}
+
+	manifest.Record(key, int64(len(data)), item.modtime, sum, dsk, reason)
+	manifest.Checkpoint()
+}
+
 const loaderWorkers = 8
 
-var incoming chan string
-var processed int
+var incoming chan ingestItem
+var processed int // disks fingerprinted, as counted by in()
 var errorcount int
+var unchanged int
+var ignored int
+var skipped map[string]string
 var indisk map[disk.DiskFormat]int
 var outdisk map[disk.DiskFormat]int
 var cm sync.Mutex
@@ -52,11 +202,13 @@ var cm sync.Mutex
 func init() {
 	indisk = make(map[disk.DiskFormat]int)
 	outdisk = make(map[disk.DiskFormat]int)
+	skipped = make(map[string]string)
 }
 
 func in(f disk.DiskFormat) {
 	cm.Lock()
 	indisk[f] = indisk[f] + 1
+	processed++
 	cm.Unlock()
 }
 
@@ -66,13 +218,46 @@ func out(f disk.DiskFormat) {
 	cm.Unlock()
 }
 
+// noteUnchanged counts an image skipped because it has not changed since it
+// was last ingested.
+func noteUnchanged(key string) {
+	cm.Lock()
+	unchanged++
+	cm.Unlock()
+	if e := manifest.Get(key); e != nil && e.Reason != "" {
+		skip(key, e.Reason)
+	}
+}
+
+// skip lists a file that looked like a disk image but could not be read
+// as one.
+func skip(filename string, reason string) {
+	cm.Lock()
+	skipped[filename] = reason
+	cm.Unlock()
+}
+
+// ignore counts a file that is not a disk image by its name, size or first
+// bytes.
+func ignore() {
+	cm.Lock()
+	ignored++
+	cm.Unlock()
+}
+
 func walk(dir string) {
 
 	start := time.Now()
 
-	incoming = make(chan string, 16)
+	incoming = make(chan ingestItem, 16)
 	indisk = make(map[disk.DiskFormat]int)
 	outdisk = make(map[disk.DiskFormat]int)
+	skipped = make(map[string]string)
+	processed, errorcount, unchanged, ignored = 0, 0, 0, 0
+
+	manifest = LoadManifest()
+	stop := saveManifestOnInterrupt()
+	defer stop()
 
 	var wg sync.WaitGroup
 	var s sync.Mutex
@@ -84,14 +269,13 @@ func walk(dir string) {
 			id := 1 + i
 			l := loggy.Get(id)
 
-			for filename := range incoming {
+			for item := range incoming {
+
+				filename := item.filename
 
 				panic.Do(
 					func() {
-						analyze(id, filename)
-						s.Lock()
-						processed++
-						s.Unlock()
+						ingest(id, item)
 					},
 					func(r interface{}) {
 						l.Errorf("Error processing volume: %s", filename)
@@ -114,6 +298,10 @@ func walk(dir string) {
 	close(incoming)
 	wg.Wait()
 
+	if err := manifest.Save(); err != nil {
+		os.Stderr.WriteString("Failed to save manifest: " + err.Error() + "\n")
+	}
+
 	fmt.Printf("\rIngested: %d volumes ...", processed)
 
 	fmt.Println()
@@ -139,9 +327,34 @@ func walk(dir string) {
 
 	fmt.Println()
 
-	average := duration / time.Duration(processed+errorcount)
+	if unchanged > 0 {
+		fmt.Printf("%d unchanged volume(s) skipped (use -reingest to force)\n", unchanged)
+		fmt.Println()
+	}
+
+	if ignored > 0 {
+		fmt.Printf("%d file(s) ignored, not disk images by name, size or header\n", ignored)
+		fmt.Println()
+	}
+
+	if len(skipped) > 0 {
+		names := make([]string, 0, len(skipped))
+		for k := range skipped {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		fmt.Printf("%d file(s) skipped, not readable as disk images:\n", len(names))
+		for _, name := range names {
+			fmt.Printf("  %s: %s\n", name, skipped[name])
+		}
+		fmt.Println()
+	}
+
+	if processed+errorcount > 0 {
+		average := duration / time.Duration(processed+errorcount)
 
-	fmt.Printf("%v average time spent per disk.\n", average)
+		fmt.Printf("%v average time spent per disk.\n", average)
+	}
 }
 
 func existsPatternOld(base string, pattern string) (bool, []string) {
@@ -185,7 +398,7 @@ func resolvePathfilters(base string, pathfilter []string, pattern string) []*reg
 
 		// path is okay and now absolute
 		info, e := os.Stat(p)
-		if e != nil {
+		if e != nil && !isArchivePath(p) {
 			continue
 		}
 
@@ -195,7 +408,10 @@ func resolvePathfilters(base string, pathfilter []string, pattern string) []*reg
 		}
 
 		var realpath string
-		if info.IsDir() {
+		if info != nil && !info.IsDir() && isArchive(p) {
+			// everything ingested from the archive
+			realpath = regexp.QuoteMeta(strings.Replace(base, "\\", "/", -1)+"/"+strings.Trim(p, "/")+archiveSeparator) + ".+"
+		} else if info != nil && info.IsDir() {
 			realpath = strings.Replace(base, "\\", "/", -1) + "/" + strings.Trim(p, "/") + "/" + tmp
 		} else {
 			// file
@@ -223,27 +439,66 @@ func existsPattern(base string, filters []string, pattern string) (bool, []strin
 	//os.Stderr.WriteString("Globby is: " + tmp + "\r\n")
 	fileRxp := regexp.MustCompile(tmp)
 
+	s, err := getStore()
+	if err != nil {
+		loggy.Get(0).Errorf(err.Error())
+		return false, nil
+	}
+
 	var out []string
-	var found bool
+	for _, key := range s.Keys() {
+		if fileRxp.MatchString(path.Base(key)) {
+			out = append(out, fingerprintPath(key))
+		}
+	}
 
-	processPatternPath := func(path string, info os.FileInfo, err error) error {
+	return filterPaths(base, filters, pattern, out)
+}
 
-		l := loggy.Get(0)
+// existsIndexed is like existsPattern, but takes the fingerprints from one
+// of the store indexes rather than matching every name.
+func existsIndexed(base string, filters []string, index string, value string) (bool, []string) {
 
-		if err != nil {
-			l.Errorf(err.Error())
-			return err
-		}
+	s, err := getStore()
+	if err != nil {
+		loggy.Get(0).Errorf(err.Error())
+		return false, nil
+	}
 
-		if fileRxp.MatchString(filepath.Base(path)) {
-			found = true
-			out = append(out, path)
+	var out []string
+	for _, key := range s.Lookup(index, value) {
+		if !strings.HasSuffix(key, ".fgp") {
+			// quarantined
+			continue
 		}
+		out = append(out, fingerprintPath(key))
+	}
 
-		return nil
+	return filterPaths(base, filters, "*_*_*_*.fgp", out)
+}
+
+// existsIndexedFunc is existsIndexed for every value accepted by match
+func existsIndexedFunc(base string, filters []string, index string, match func(value string) bool) (bool, []string) {
+
+	s, err := getStore()
+	if err != nil {
+		loggy.Get(0).Errorf(err.Error())
+		return false, nil
 	}
 
-	filepath.Walk(base, processPatternPath)
+	var out []string
+	for _, key := range s.LookupFunc(index, match) {
+		if !strings.HasSuffix(key, ".fgp") {
+			// quarantined
+			continue
+		}
+		out = append(out, fingerprintPath(key))
+	}
+
+	return filterPaths(base, filters, "*_*_*_*.fgp", out)
+}
+
+func filterPaths(base string, filters []string, pattern string, out []string) (bool, []string) {
 
 	fexp := resolvePathfilters(base, filters, pattern)
 
@@ -256,31 +511,54 @@ func existsPattern(base string, filters []string, pattern string) (bool, []strin
 			}
 
 			for _, rxp := range fexp {
-				//fmt.Printf("Match [%s]\n", p)
 				if rxp.MatchString(p) {
 					out2 = append(out2, p)
-					//fmt.Printf("Match regexp: %s\n", p)
 					break
 				}
 			}
 		}
-		//fmt.Printf("%d returns\n", len(out2))
 		return (len(out2) > 0), out2
 	}
 
-	//fmt.Printf("%d returns\n", len(out))
+	return (len(out) > 0), out
+}
+
+func analyze(id int, filename string) (*Disk, error) {
+
+	data, err := readDiskImage(filename)
+	if err != nil {
+		loggy.Get(id).Errorf("Disk read failed: %s", err)
+		return &Disk{Filename: path.Base(filename), FullPath: path.Clean(filename)}, err
+	}
+
+	return analyzeData(id, filename, data)
+}
 
-	return found, out
+// analyzeData fingerprints a disk image already in memory.  filename may be
+// an archive member path, which is kept as the disk's provenance.
+func analyzeData(id int, filename string, data []byte) (*Disk, error) {
+	return analyzeDataMode(id, filename, data, *ingestMode, false)
+}
+
+// analyzeInMemory fingerprints a disk image with the ingest mode given,
+// without storing the fingerprint
+func analyzeInMemory(filename string, mode int) (*Disk, error) {
+
+	data, err := readDiskImage(filename)
+	if err != nil {
+		return &Disk{Filename: path.Base(filename), FullPath: path.Clean(filename)}, err
+	}
 
+	return analyzeDataMode(0, filename, data, mode, true)
 }
 
-func analyze(id int, filename string) (*Disk, error) {
+func analyzeDataMode(id int, filename string, data []byte, mode int, inMemory bool) (*Disk, error) {
 
 	l := loggy.Get(id)
 
 	var err error
 	var dsk *disk.DSKWrapper
-	var dskInfo Disk = Disk{}
+	var dskInfo Disk = Disk{inMemory: inMemory}
 
 	dskInfo.Filename = path.Base(filename)
 
@@ -289,15 +567,28 @@ func analyze(id int, filename string) (*Disk, error) {
 	}
 
 	dskInfo.FullPath = path.Clean(filename)
+	dskInfo.Archive, dskInfo.ArchiveMember = splitArchivePath(dskInfo.FullPath)
+	if dskInfo.ArchiveMember == "" {
+		dskInfo.Archive = ""
+	}
 
 	l.Logf("Reading disk image from file source %s", filename)
 	//fmt.Printf("Processing %s\n", filename)
 	//fmt.Print(".")
 
-	dsk, err = disk.NewDSKWrapper(defNibbler, filename)
+	kind, err := disk.SniffImage(data)
+	if err != nil {
+		l.Logf("Not a disk image: %s", err)
+		skip(dskInfo.FullPath, err.Error())
+		return &dskInfo, err
+	}
+	l.Logf("Content looks like a %s image", kind)
+
+	dsk, err = disk.NewDSKWrapperBin(defNibbler, data, filename)
 
 	if err != nil {
 		l.Errorf("Disk read failed: %s", err)
+		skip(dskInfo.FullPath, err.Error())
 		return &dskInfo, err
 	}
 
@@ -315,6 +606,9 @@ func analyze(id int, filename string) (*Disk, error) {
 	dskInfo.SHA256 = dsk.ChecksumDisk()
 	l.Logf("SHA256 is %s", dskInfo.SHA256)
 
+	dskInfo.CanonicalSHA256, dskInfo.CanonicalSHA256Active = dsk.ChecksumLogical()
+	l.Logf("Canonical SHA256 is %s", dskInfo.CanonicalSHA256)
+
 	dskInfo.Format = dsk.Format.String()
 	dskInfo.FormatID = dsk.Format
 	l.Logf("Format is %s", dskInfo.Format)
@@ -326,9 +620,18 @@ func analyze(id int, filename string) (*Disk, error) {
 
 	// Check if it exists
 
+	bf := dsk.BootFingerprint()
+	dskInfo.BootSHA256 = bf.BootSHA256
+	dskInfo.BootCode = bf.BootCode
+	dskInfo.DOSImage = bf.DOSImage
+	dskInfo.DOSImageSHA256 = bf.DOSImageSHA256
+	dskInfo.ProDOSVersion = bf.ProDOSVersion
+	dskInfo.Bootable = bf.Bootable
+	l.Logf("Boot code is %s, bootable=%v", bf.BootCode, bf.Bootable)
+
 	in(dsk.Format)
 
-	dskInfo.IngestMode = *ingestMode
+	dskInfo.IngestMode = mode
 
 	switch dsk.Format.ID {
 	case disk.DF_DOS_SECTORS_16:
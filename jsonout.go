@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+)
+
+/*
+	JSON output...
+
+	With -json every report and search writes a single JSON document instead
+	of text, to -out or stdout:
+
+	  {"schema": 1, "report": "<name>", "results": ...}
+
+	The layout of each report is described in JSON.md.  Fields are only
+	ever added, so scripts written against schema 1 keep working; anything
+	that changes meaning gets a new schema number.  Lists are always present
+	(empty rather than missing) and sorted, so output can be diffed.
+*/
+
+const jsonSchema = 1
+
+type jsonDocument struct {
+	Schema  int         `json:"schema"`
+	Report  string      `json:"report"`
+	Results interface{} `json:"results"`
+}
+
+type jsonFile struct {
+	Disk    string `json:"disk,omitempty"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Kind    string `json:"kind"`
+	Size    int    `json:"size"`
+	Address int    `json:"address"`
+	Locked  bool   `json:"locked"`
+	SHA256  string `json:"sha256"`
+	NormSHA string `json:"normalized_sha256,omitempty"`
+}
+
+type jsonDisk struct {
+	Disk            string `json:"disk"`
+	Format          string `json:"format"`
+	Files           int    `json:"files"`
+	Bootable        bool   `json:"bootable"`
+	BootCode        string `json:"boot_code"`
+	DOS             string `json:"dos"`
+	ProDOS          string `json:"prodos"`
+	SHA256          string `json:"sha256"`
+	ActiveSHA256    string `json:"active_sha256"`
+	Canonical       string `json:"canonical_sha256,omitempty"`
+	CanonicalActive string `json:"canonical_active_sha256,omitempty"`
+}
+
+type jsonFilePair struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type jsonModifiedFile struct {
+	From       string  `json:"from"`
+	To         string  `json:"to"`
+	Similarity float64 `json:"similarity"`
+}
+
+// jsonDiskMatch is one disk compared with another by files
+type jsonDiskMatch struct {
+	Disk     string             `json:"disk"`
+	Match    float64            `json:"match"`
+	Matched  []jsonFilePair     `json:"matched"`
+	Missing  []string           `json:"missing"`
+	Extra    []string           `json:"extra"`
+	Modified []jsonModifiedFile `json:"modified"`
+}
+
+// jsonSectorMatch is one disk compared with another by sectors
+type jsonSectorMatch struct {
+	Disk    string  `json:"disk"`
+	Match   float64 `json:"match"`
+	Same    int     `json:"same"`
+	Missing int     `json:"missing"`
+	Extra   int     `json:"extra"`
+}
+
+type jsonFileOverlap struct {
+	Disk    string          `json:"disk"`
+	Matches []jsonDiskMatch `json:"matches"`
+}
+
+type jsonSectorOverlap struct {
+	Disk    string            `json:"disk"`
+	Matches []jsonSectorMatch `json:"matches"`
+}
+
+func newJSONFile(disk string, f *DiskFile) *jsonFile {
+	return &jsonFile{
+		Disk:    disk,
+		Name:    f.Filename,
+		Type:    f.Ext,
+		Kind:    f.Type,
+		Size:    f.Size,
+		Address: f.LoadAddress,
+		Locked:  f.Locked,
+		SHA256:  f.SHA256,
+		NormSHA: f.NormalizedSHA256,
+	}
+}
+
+func newJSONDisk(d *Disk) *jsonDisk {
+	return &jsonDisk{
+		Disk:            d.FullPath,
+		Format:          d.FormatID.String(),
+		Files:           len(d.Files),
+		Bootable:        d.Bootable,
+		BootCode:        d.BootCode,
+		DOS:             d.DOSImage,
+		ProDOS:          d.ProDOSVersion,
+		SHA256:          d.SHA256,
+		ActiveSHA256:    d.SHA256Active,
+		Canonical:       d.CanonicalSHA256,
+		CanonicalActive: d.CanonicalSHA256Active,
+	}
+}
+
+func jsonFilePairs(m map[*DiskFile]*DiskFile) []jsonFilePair {
+	out := make([]jsonFilePair, 0, len(m))
+	for f1, f2 := range m {
+		out = append(out, jsonFilePair{From: f1.Filename, To: f2.Filename})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].From != out[j].From {
+			return out[i].From < out[j].From
+		}
+		return out[i].To < out[j].To
+	})
+	return out
+}
+
+func jsonModifiedFiles(list []*FileModification) []jsonModifiedFile {
+	out := make([]jsonModifiedFile, 0, len(list))
+	for _, m := range list {
+		out = append(out, jsonModifiedFile{From: m.From.Filename, To: m.To.Filename, Similarity: m.Similarity})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].From != out[j].From {
+			return out[i].From < out[j].From
+		}
+		return out[i].To < out[j].To
+	})
+	return out
+}
+
+func jsonFilenames(list []*DiskFile) []string {
+	out := make([]string, 0, len(list))
+	for _, f := range list {
+		out = append(out, f.Filename)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// jsonDiskMatches turns the matches for a single disk into a sorted list,
+// best match first.
+func jsonDiskMatches(matches []*Disk) []jsonDiskMatch {
+	out := make([]jsonDiskMatch, 0, len(matches))
+	for _, d := range matches {
+		out = append(out, jsonDiskMatch{
+			Disk:     d.FullPath,
+			Match:    d.MatchFactor,
+			Matched:  jsonFilePairs(d.MatchFiles),
+			Missing:  jsonFilenames(d.MissingFiles),
+			Extra:    jsonFilenames(d.ExtraFiles),
+			Modified: jsonModifiedFiles(d.ModifiedFiles),
+		})
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Match != out[j].Match {
+			return out[i].Match > out[j].Match
+		}
+		return out[i].Disk < out[j].Disk
+	})
+	return out
+}
+
+func jsonFileOverlaps(matches map[string]*FileOverlapRecord) []jsonFileOverlap {
+
+	out := make([]jsonFileOverlap, 0, len(matches))
+	for disk1, v := range matches {
+		o := jsonFileOverlap{Disk: disk1, Matches: make([]jsonDiskMatch, 0, len(v.percent))}
+		for disk2, ratio := range v.percent {
+			o.Matches = append(o.Matches, jsonDiskMatch{
+				Disk:     disk2,
+				Match:    ratio,
+				Matched:  jsonFilePairs(v.files[disk2]),
+				Missing:  jsonFilenames(v.missing[disk2]),
+				Extra:    jsonFilenames(v.extras[disk2]),
+				Modified: jsonModifiedFiles(v.modified[disk2]),
+			})
+		}
+		sort.Slice(o.Matches, func(i, j int) bool { return o.Matches[i].Disk < o.Matches[j].Disk })
+		out = append(out, o)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Disk < out[j].Disk })
+
+	return out
+}
+
+func jsonSectorOverlaps(matches map[string]*SectorOverlapRecord) []jsonSectorOverlap {
+
+	out := make([]jsonSectorOverlap, 0, len(matches))
+	for disk1, v := range matches {
+		o := jsonSectorOverlap{Disk: disk1, Matches: make([]jsonSectorMatch, 0, len(v.percent))}
+		for disk2, ratio := range v.percent {
+			o.Matches = append(o.Matches, jsonSectorMatch{
+				Disk:    disk2,
+				Match:   ratio,
+				Same:    len(v.same[disk2]),
+				Missing: len(v.missing[disk2]),
+				Extra:   len(v.extras[disk2]),
+			})
+		}
+		sort.Slice(o.Matches, func(i, j int) bool { return o.Matches[i].Disk < o.Matches[j].Disk })
+		out = append(out, o)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Disk < out[j].Disk })
+
+	return out
+}
+
+func writeJSON(w io.Writer, report string, results interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&jsonDocument{Schema: jsonSchema, Report: report, Results: results})
+}
+
+// writeJSONReport writes a report to the -out file, or stdout
+func writeJSONReport(report string, results interface{}) {
+
+	var w io.Writer = os.Stdout
+	if *reportFile != "" {
+		f, err := os.Create(*reportFile)
+		if err != nil {
+			os.Stderr.WriteString("Unable to create output file: " + err.Error() + "\n")
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := writeJSON(w, report, results); err != nil {
+		os.Stderr.WriteString("Error writing results: " + err.Error() + "\n")
+	}
+}
+
+type jsonDupeFile struct {
+	Disk string `json:"disk"`
+	Name string `json:"name"`
+}
+
+type jsonFileDupes struct {
+	SHA256 string         `json:"sha256"`
+	Files  []jsonDupeFile `json:"files"`
+}
+
+type jsonWholeDupes struct {
+	SHA256     string   `json:"sha256"`
+	Canonical  string   `json:"canonical_sha256"`
+	Original   string   `json:"original"`
+	Duplicates []string `json:"duplicates"`
+}
+
+type jsonDupeDisk struct {
+	Disk   string `json:"disk"`
+	SHA256 string `json:"sha256"`
+}
+
+type jsonActiveDupes struct {
+	ActiveSHA256 string         `json:"active_sha256"`
+	Original     jsonDupeDisk   `json:"original"`
+	Duplicates   []jsonDupeDisk `json:"duplicates"`
+}
+
+func (dfc *DuplicateFileCollection) JSON() []jsonFileDupes {
+	out := make([]jsonFileDupes, 0)
+	for sha256, list := range dfc.data {
+		if len(list) < 2 {
+			continue
+		}
+		g := jsonFileDupes{SHA256: sha256}
+		for _, v := range list {
+			g.Files = append(g.Files, jsonDupeFile{Disk: v.Fullpath, Name: v.Filename})
+		}
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SHA256 < out[j].SHA256 })
+	return out
+}
+
+func (dfc *DuplicateWholeDiskCollection) JSON() []jsonWholeDupes {
+	out := make([]jsonWholeDupes, 0)
+	for sha256, list := range dfc.data {
+		if len(list) < 2 {
+			continue
+		}
+		g := jsonWholeDupes{SHA256: list[0].GSHA, Canonical: sha256, Original: list[0].Fullpath, Duplicates: make([]string, 0, len(list)-1)}
+		for _, v := range list[1:] {
+			g.Duplicates = append(g.Duplicates, v.Fullpath)
+		}
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Canonical < out[j].Canonical })
+	return out
+}
+
+func (dfc *DuplicateActiveSectorDiskCollection) JSON() []jsonActiveDupes {
+	out := make([]jsonActiveDupes, 0)
+	for sha256, list := range dfc.data {
+		if len(list) < 2 {
+			continue
+		}
+		// same as the text report, which leaves identical disks to -whole-dupes
+		m := make(map[string]bool)
+		for _, v := range list {
+			m[v.CSHA] = true
+		}
+		if len(m) == 1 {
+			continue
+		}
+		g := jsonActiveDupes{
+			ActiveSHA256: sha256,
+			Original:     jsonDupeDisk{Disk: list[0].Fullpath, SHA256: list[0].GSHA},
+			Duplicates:   make([]jsonDupeDisk, 0, len(list)-1),
+		}
+		for _, v := range list[1:] {
+			g.Duplicates = append(g.Duplicates, jsonDupeDisk{Disk: v.Fullpath, SHA256: v.GSHA})
+		}
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ActiveSHA256 < out[j].ActiveSHA256 })
+	return out
+}
+
+type jsonDiskReport struct {
+	Disk      string          `json:"disk"`
+	File      string          `json:"file,omitempty"`
+	Threshold float64         `json:"threshold,omitempty"`
+	Matches   []jsonDiskMatch `json:"matches"`
+}
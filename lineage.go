@@ -0,0 +1,502 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/paleotronic/diskm8/disk"
+)
+
+/*
+	Disk lineage...
+
+	The subset and partial reports relate disks a pair at a time.  -lineage
+	joins those pairs up into families: disks are linked when one's files
+	or active sectors are a subset of another's, or when they are above
+	-similarity alike by files or active sectors, and each group of linked
+	disks is a cluster.
+
+	Within a cluster a subset is taken to be an earlier version of the disk
+	it is a subset of.  Otherwise disks are put in order by the latest
+	modification date of their files where both are ProDOS disks with
+	dates set, then by how many files and active sectors they have.  The
+	suggested best member is the most complete disk that isn't a subset of
+	another in the cluster.
+
+	A subset only links disks if it covers at least lineageMinSubset of the
+	larger disk, so a disk holding one common utility doesn't pull every
+	disk with that utility into one cluster.
+*/
+
+const lineageMinSubset = 0.5
+
+const (
+	LinkFileSubset    = "file-subset"
+	LinkSectorSubset  = "sector-subset"
+	LinkFileSimilar   = "file-similar"
+	LinkSectorSimilar = "sector-similar"
+)
+
+type LineageMember struct {
+	Disk          string
+	Files         int
+	ActiveSectors int
+	Modified      time.Time // latest ProDOS modification date, zero if unknown
+	Order         int       // 1 is the earliest
+	Best          bool
+}
+
+// LineageLink joins two disks.  Links with a subset kind point from the
+// subset to the disk containing it; other links are undirected.
+type LineageLink struct {
+	From, To string
+	Kinds    []string
+	Match    float64
+	Directed bool
+}
+
+type LineageCluster struct {
+	Members []*LineageMember // in version order
+	Links   []*LineageLink
+	Best    *LineageMember
+}
+
+type lineageCollector struct {
+	files   map[string]DiskCatalog
+	sectors map[string]DiskSectors
+	fsigs   map[string]MinHash
+	ssigs   map[string]MinHash
+	members map[string]*LineageMember
+}
+
+func isProDOSFormat(id disk.DiskFormatID) bool {
+	switch id {
+	case disk.DF_PRODOS, disk.DF_PRODOS_400KB, disk.DF_PRODOS_800KB, disk.DF_PRODOS_CUSTOM:
+		return true
+	}
+	return false
+}
+
+// prodosDated is false for the empty date stamp of a file saved without a
+// clock, which reads back as 30 November 1999
+func prodosDated(t time.Time) bool {
+	if t.IsZero() || t.Year() < 1980 || t.After(time.Now()) {
+		return false
+	}
+	return !(t.Year() == 1999 && t.Month() == time.November && t.Day() == 30 && t.Hour() == 0 && t.Minute() == 0)
+}
+
+func AggregateLineage(d *Disk, collector interface{}) {
+
+	c := collector.(*lineageCollector)
+
+	m := &LineageMember{
+		Disk:          d.FullPath,
+		Files:         len(fileMinHashElements(d.Files, (*DiskFile).matchSHA256)),
+		ActiveSectors: len(d.ActiveSectors),
+	}
+
+	if isProDOSFormat(d.FormatID.ID) {
+		for _, f := range d.Files {
+			if prodosDated(f.Modified) && f.Modified.After(m.Modified) {
+				m.Modified = f.Modified
+			}
+		}
+	}
+
+	c.members[d.FullPath] = m
+	if len(d.Files) > 0 {
+		c.files[d.FullPath] = d.Files
+		c.fsigs[d.FullPath] = d.fileMinHash()
+	}
+	c.sectors[d.FullPath] = d.ActiveSectors
+	c.ssigs[d.FullPath] = d.activeMinHash()
+}
+
+type lineageGraph struct {
+	links  map[[2]string]*LineageLink
+	parent map[string]string
+}
+
+func (g *lineageGraph) find(a string) string {
+	for g.parent[a] != a {
+		g.parent[a] = g.parent[g.parent[a]]
+		a = g.parent[a]
+	}
+	return a
+}
+
+func (g *lineageGraph) link(from, to, kind string, match float64, directed bool) {
+
+	l, ok := g.links[[2]string{from, to}]
+	if !ok {
+		// an undirected link joins one going the other way
+		if r, found := g.links[[2]string{to, from}]; found && (!directed || !r.Directed) {
+			l, ok = r, true
+		}
+	}
+	if !ok {
+		l = &LineageLink{From: from, To: to}
+		g.links[[2]string{from, to}] = l
+	}
+
+	l.Kinds = append(l.Kinds, kind)
+	if match > l.Match {
+		l.Match = match
+	}
+	if directed && !l.Directed {
+		l.From, l.To, l.Directed = from, to, true
+	}
+
+	if ra, rb := g.find(from), g.find(to); ra != rb {
+		g.parent[ra] = rb
+	}
+}
+
+// versionBefore guesses whether a is an earlier version than b
+func versionBefore(a, b *LineageMember) bool {
+	if !a.Modified.IsZero() && !b.Modified.IsZero() && !a.Modified.Equal(b.Modified) {
+		return a.Modified.Before(b.Modified)
+	}
+	if a.Files != b.Files {
+		return a.Files < b.Files
+	}
+	if a.ActiveSectors != b.ActiveSectors {
+		return a.ActiveSectors < b.ActiveSectors
+	}
+	return a.Disk < b.Disk
+}
+
+// orderCluster numbers the members so subsets come before the disks
+// containing them, choosing by versionBefore where links don't decide
+func orderCluster(c *LineageCluster) {
+
+	sort.Slice(c.Members, func(i, j int) bool { return c.Members[i].Disk < c.Members[j].Disk })
+
+	before := make(map[string]int)
+	for _, l := range c.Links {
+		if l.Directed {
+			before[l.To]++
+		}
+	}
+
+	done := make(map[string]bool)
+	ordered := make([]*LineageMember, 0, len(c.Members))
+
+	for len(ordered) < len(c.Members) {
+		var next *LineageMember
+		for _, m := range c.Members {
+			if !done[m.Disk] && before[m.Disk] == 0 && (next == nil || versionBefore(m, next)) {
+				next = m
+			}
+		}
+		if next == nil {
+			// links go round in a circle, so go by the members alone
+			for _, m := range c.Members {
+				if !done[m.Disk] && (next == nil || versionBefore(m, next)) {
+					next = m
+				}
+			}
+		}
+		done[next.Disk] = true
+		next.Order = len(ordered) + 1
+		ordered = append(ordered, next)
+		for _, l := range c.Links {
+			if l.Directed && l.From == next.Disk {
+				before[l.To]--
+			}
+		}
+	}
+
+	c.Members = ordered
+}
+
+// pickBest suggests the most complete member: one that isn't a subset of
+// another, with the most files and active sectors, and the latest version
+// if that doesn't settle it
+func pickBest(c *LineageCluster) {
+
+	subset := make(map[string]bool)
+	for _, l := range c.Links {
+		if l.Directed {
+			subset[l.From] = true
+		}
+	}
+
+	better := func(a, b *LineageMember) bool {
+		if subset[a.Disk] != subset[b.Disk] {
+			return !subset[a.Disk]
+		}
+		if a.Files != b.Files {
+			return a.Files > b.Files
+		}
+		if a.ActiveSectors != b.ActiveSectors {
+			return a.ActiveSectors > b.ActiveSectors
+		}
+		return a.Order > b.Order
+	}
+
+	for _, m := range c.Members {
+		if c.Best == nil || better(m, c.Best) {
+			c.Best = m
+		}
+	}
+	c.Best.Best = true
+}
+
+// CollectLineage groups the disks into clusters of related versions,
+// biggest first
+func CollectLineage(t float64, pathfilter []string) []*LineageCluster {
+
+	c := &lineageCollector{
+		files:   make(map[string]DiskCatalog),
+		sectors: make(map[string]DiskSectors),
+		fsigs:   make(map[string]MinHash),
+		ssigs:   make(map[string]MinHash),
+		members: make(map[string]*LineageMember),
+	}
+	Aggregate(AggregateLineage, c, pathfilter)
+
+	g := &lineageGraph{
+		links:  make(map[[2]string]*LineageLink),
+		parent: make(map[string]string),
+	}
+	for k := range c.members {
+		g.parent[k] = k
+	}
+
+	for m, v := range collectFileSubsets(c.files) {
+		for k, match := range v.percent {
+			if match >= lineageMinSubset {
+				g.link(m, k, LinkFileSubset, match, true)
+			}
+		}
+	}
+
+	for m, v := range collectSectorSubsets(c.sectors) {
+		for k, match := range v.percent {
+			if match >= lineageMinSubset {
+				g.link(m, k, LinkSectorSubset, match, true)
+			}
+		}
+	}
+
+	for m, v := range collectFilesOverlapsAboveThreshold(t, c.files, c.fsigs) {
+		for k, match := range v.percent {
+			if m < k {
+				g.link(m, k, LinkFileSimilar, match, false)
+			}
+		}
+	}
+
+	for m, v := range collectSectorOverlapsAboveThreshold(t, c.sectors, c.ssigs) {
+		for k, match := range v.percent {
+			if m < k {
+				g.link(m, k, LinkSectorSimilar, match, false)
+			}
+		}
+	}
+
+	clusters := make(map[string]*LineageCluster)
+	for _, l := range g.links {
+		root := g.find(l.From)
+		cl, ok := clusters[root]
+		if !ok {
+			cl = &LineageCluster{}
+			clusters[root] = cl
+		}
+		sort.Strings(l.Kinds)
+		cl.Links = append(cl.Links, l)
+	}
+
+	for k, m := range c.members {
+		if cl, ok := clusters[g.find(k)]; ok {
+			cl.Members = append(cl.Members, m)
+		}
+	}
+
+	out := make([]*LineageCluster, 0, len(clusters))
+	for _, cl := range clusters {
+		orderCluster(cl)
+		pickBest(cl)
+		sort.Slice(cl.Links, func(i, j int) bool {
+			if cl.Links[i].From != cl.Links[j].From {
+				return cl.Links[i].From < cl.Links[j].From
+			}
+			return cl.Links[i].To < cl.Links[j].To
+		})
+		out = append(out, cl)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if len(out[i].Members) != len(out[j].Members) {
+			return len(out[i].Members) > len(out[j].Members)
+		}
+		return out[i].Best.Disk < out[j].Best.Disk
+	})
+
+	return out
+}
+
+func (m *LineageMember) dateString() string {
+	if m.Modified.IsZero() {
+		return ""
+	}
+	return m.Modified.Format("2006-01-02")
+}
+
+func (l *LineageLink) describe() string {
+	return fmt.Sprintf("%s %.0f%%", strings.Join(l.Kinds, ", "), l.Match*100)
+}
+
+type jsonLineageMember struct {
+	Disk          string `json:"disk"`
+	Order         int    `json:"order"`
+	Files         int    `json:"files"`
+	ActiveSectors int    `json:"active_sectors"`
+	Modified      string `json:"modified"`
+	Best          bool   `json:"best"`
+}
+
+type jsonLineageLink struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Kinds    []string `json:"kinds"`
+	Match    float64  `json:"match"`
+	Directed bool     `json:"directed"`
+}
+
+type jsonLineageCluster struct {
+	Cluster int                 `json:"cluster"`
+	Best    string              `json:"best"`
+	Members []jsonLineageMember `json:"members"`
+	Links   []jsonLineageLink   `json:"links"`
+}
+
+func jsonLineage(clusters []*LineageCluster) []jsonLineageCluster {
+
+	out := make([]jsonLineageCluster, 0, len(clusters))
+	for i, c := range clusters {
+		jc := jsonLineageCluster{
+			Cluster: i + 1,
+			Best:    c.Best.Disk,
+			Members: make([]jsonLineageMember, 0, len(c.Members)),
+			Links:   make([]jsonLineageLink, 0, len(c.Links)),
+		}
+		for _, m := range c.Members {
+			jc.Members = append(jc.Members, jsonLineageMember{
+				Disk:          m.Disk,
+				Order:         m.Order,
+				Files:         m.Files,
+				ActiveSectors: m.ActiveSectors,
+				Modified:      m.dateString(),
+				Best:          m.Best,
+			})
+		}
+		for _, l := range c.Links {
+			jc.Links = append(jc.Links, jsonLineageLink{From: l.From, To: l.To, Kinds: l.Kinds, Match: l.Match, Directed: l.Directed})
+		}
+		out = append(out, jc)
+	}
+
+	return out
+}
+
+func dotQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// writeLineageDOT writes the clusters as a GraphViz graph, one subgraph
+// per cluster with its members left to right in version order
+func writeLineageDOT(w io.Writer, clusters []*LineageCluster) {
+
+	fmt.Fprintln(w, "digraph lineage {")
+	fmt.Fprintln(w, "\trankdir=LR;")
+	fmt.Fprintln(w, "\tnode [shape=box, fontsize=10];")
+	fmt.Fprintln(w, "\tedge [fontsize=9];")
+
+	for i, c := range clusters {
+		fmt.Fprintf(w, "\n\tsubgraph cluster_%d {\n", i+1)
+		fmt.Fprintf(w, "\t\tlabel=%s;\n", dotQuote(fmt.Sprintf("Cluster %d", i+1)))
+		for _, m := range c.Members {
+			label := fmt.Sprintf("%d. %s\n%d files, %d active sectors", m.Order, path.Base(m.Disk), m.Files, m.ActiveSectors)
+			if d := m.dateString(); d != "" {
+				label += "\n" + d
+			}
+			style := ""
+			if m.Best {
+				style = ", style=bold, color=blue"
+			}
+			fmt.Fprintf(w, "\t\t%s [label=%s, tooltip=%s%s];\n", dotQuote(m.Disk), dotQuote(label), dotQuote(m.Disk), style)
+		}
+		for _, l := range c.Links {
+			style := ""
+			if !l.Directed {
+				style = ", dir=none, style=dashed"
+			}
+			fmt.Fprintf(w, "\t\t%s -> %s [label=%s%s];\n", dotQuote(l.From), dotQuote(l.To), dotQuote(l.describe()), style)
+		}
+		fmt.Fprintln(w, "\t}")
+	}
+
+	fmt.Fprintln(w, "}")
+}
+
+func lineageReport(t float64, filter []string) {
+
+	clusters := CollectLineage(t, filter)
+
+	if *jsonOut {
+		writeJSONReport("lineage", jsonLineage(clusters))
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	if *reportFile != "" {
+		f, err := os.Create(*reportFile)
+		if err != nil {
+			os.Stderr.WriteString("Unable to create output file: " + err.Error() + "\n")
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *dotOut {
+		writeLineageDOT(w, clusters)
+		return
+	}
+
+	fmt.Fprintf(w, "DISK LINEAGE REPORT\n\n")
+	fmt.Fprintf(w, "%d clusters found\n\n", len(clusters))
+
+	for i, c := range clusters {
+		fmt.Fprintf(w, "Cluster %d: %d disks, best is %s\n\n", i+1, len(c.Members), c.Best.Disk)
+		for _, m := range c.Members {
+			mark := " "
+			if m.Best {
+				mark = "*"
+			}
+			fmt.Fprintf(w, "  %s %2d. %s (%d files, %d active sectors", mark, m.Order, m.Disk, m.Files, m.ActiveSectors)
+			if d := m.dateString(); d != "" {
+				fmt.Fprintf(w, ", modified %s", d)
+			}
+			fmt.Fprintln(w, ")")
+		}
+		fmt.Fprintln(w)
+		for _, l := range c.Links {
+			arrow := "<->"
+			if l.Directed {
+				arrow = "-->"
+			}
+			fmt.Fprintf(w, "     %s %s %s (%s)\n", l.From, arrow, l.To, l.describe())
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -54,6 +54,7 @@ func init() {
 
 var dskName = flag.String("ingest", "", "Disk file or path to ingest")
 var dskInfo = flag.String("query", "", "Disk file to query or analyze")
+var nearest = flag.Int("nearest", 0, "Report the N disks most similar to -query by files and by active sectors")
 var baseName = flag.String("datastore", binpath()+"/fingerprints", "Database of disk fingerprints for checking")
 var verbose = flag.Bool("verbose", false, "Log to stderr")
 var fileDupes = flag.Bool("file-dupes", false, "Run file dupe report")
@@ -61,10 +62,14 @@ var wholeDupes = flag.Bool("whole-dupes", false, "Run whole disk dupe report")
 var activeDupes = flag.Bool("as-dupes", false, "Run active sectors only disk dupe report")
 var asPartial = flag.Bool("as-partial", false, "Run partial active sector match against single disk (-disk required)")
 var similarity = flag.Float64("similarity", 0.90, "Object match threshold for -*-partial reports")
+var exhaustive = flag.Bool("exhaustive", false, "Compare every pair of disks in -all-*-partial reports, not just likely matches")
 var minSame = flag.Int("min-same", 0, "Minimum same # files for -all-file-partial")
 var maxDiff = flag.Int("max-diff", 0, "Maximum different # files for -all-file-partial")
 var filePartial = flag.Bool("file-partial", false, "Run partial file match against single disk (-disk required)")
+var modifiedThreshold = flag.Float64("modified", 0.5, "Minimum similarity for a missing and an extra file to count as one file modified in -*-file-partial and -nearest reports (0 to turn off)")
 var fileMatch = flag.String("file", "", "Search for other disks containing file")
+var fileHash = flag.String("file-hash", FileHashRaw, "Checksum file reports match files on: raw, or normalized to ignore slack bytes and padding")
+var diffDisks = flag.Bool("diff", false, "Compare the two disk images given after the flags by files, file content and sectors")
 var dir = flag.Bool("dir", false, "Directory specified disk (needs -disk)")
 var dirFormat = flag.String("dir-format", "{filename} {type} {size:kb} Checksum: {sha256}", "Format of dir")
 var preCache = flag.Bool("c", true, "Cache data to memory for quicker processing")
@@ -76,12 +81,27 @@ var activeSectorSubset = flag.Bool("active-sector-subset", false, "Run subset (a
 var allSectorSubset = flag.Bool("all-sector-subset", false, "Run subset (non-zero) sector match against all disks")
 var filterPath = flag.Bool("select", false, "Select files for analysis or search based on file/dir/mask")
 var csvOut = flag.Bool("csv", false, "Output data to CSV format")
+var jsonOut = flag.Bool("json", false, "Output reports and searches as JSON (see JSON.md)")
 var reportFile = flag.String("out", "", "Output file (empty for stdout)")
+var htmlDir = flag.String("html", "", "Write a static HTML catalogue of the collection to a directory")
+var serveAddr = flag.String("serve", "", "Serve a JSON API over the datastore on an address, eg. :8080")
+var serveWrite = flag.Bool("serve-write", false, "Allow -serve requests that change the datastore")
+var lineage = flag.Bool("lineage", false, "Run disk lineage report, grouping disks that look like versions of the same software")
+var dotOut = flag.Bool("dot", false, "Output -lineage as a GraphViz DOT graph")
 var catDupes = flag.Bool("cat-dupes", false, "Run duplicate catalog report")
 var searchFilename = flag.String("search-filename", "", "Search database for file with name")
 var searchSHA = flag.String("search-sha", "", "Search database for file with checksum")
-var searchTEXT = flag.String("search-text", "", "Search database for file containing text")
+var searchTEXT = flag.String("search-text", "", "Search database for files whose text or BASIC listing matches a query")
+var findQuery = flag.String("find", "", "Search catalog with a query, eg. 'type:BIN addr:$2000 size>8000 name:~^HGR'")
+var searchHex = flag.String("search-hex", "", "Search file data and sectors for bytes, eg. \"A9 ?? 8D 00 C0\"")
+var searchOS = flag.String("search-os", "", "Search database for disks by boot code, DOS variant or ProDOS version")
+var bootSignatures = flag.String("signatures", binpath()+"/signatures.txt", "File of extra boot, DOS and ProDOS signatures")
 var forceIngest = flag.Bool("force", false, "Force re-ingest disks that already exist")
+var ingestExt = flag.String("ingest-ext", "2mg,2img,do,dsk,hdv,img,nib,po,woz", "Comma separated file extensions always read when ingesting (others only if their size or header fits a disk image), or * to read every file")
+var reingest = flag.Bool("reingest", false, "Ingest every image, even those unchanged since the last ingest")
+var patchCmd = flag.String("patch", "", "Create or apply a disk patch, eg. \"create a.dsk b.dsk out.bps\" or \"apply out.bps [a.dsk] new.dsk\"")
+var prune = flag.Bool("prune", false, "Remove fingerprints whose source image no longer exists")
+var importFgp = flag.Bool("import-fgp", false, "Import .fgp fingerprint files from an older datastore")
 var ingestMode = flag.Int("ingest-mode", 1, "Ingest mode:\n\t0=Fingerprints only\n\t1=Fingerprints + text\n\t2=Fingerprints + sector data\n\t3=All")
 var extract = flag.String("extract", "", "Extract files/disks matched in searches ('#'=extract disk, '@'=extract files)")
 var adornedCP = flag.Bool("adorned", true, "Extract files named similar to CP")
@@ -94,7 +114,16 @@ var filePut = flag.String("file-put", "", "File to put on disk (-with-disk)")
 var fileDelete = flag.String("file-delete", "", "File to delete (-with-disk)")
 var fileMkdir = flag.String("dir-create", "", "Directory to create (-with-disk)")
 var fileCatalog = flag.Bool("catalog", false, "List disk contents (-with-disk)")
-var quarantine = flag.Bool("quarantine", false, "Run -as-dupes and -whole-disk in quarantine mode")
+var fileConvert = flag.String("convert", "", "Convert disk to .nib or .woz image, eg. \"out.woz volume=254\" (-with-disk)")
+var fileSys = flag.String("sys", "", "Install boot code from a reference disk or DOS image, eg. \"master.dsk greeting=HELLO\" (-with-disk)")
+var fileIdentify = flag.Bool("identify", false, "Score possible filesystems and sector orders (-with-disk)")
+var forceFS = flag.String("fs", "", "Force filesystem when mounting: dos, prodos, pascal, rdos (-with-disk)")
+var forceOrder = flag.String("order", "", "Force sector order when mounting: do, po (-with-disk)")
+var quarantine = flag.Bool("quarantine", false, "Run -as-dupes, -whole-dupes or -all-file-subset in quarantine mode")
+var dedupe = flag.String("dedupe", "", "Replace -whole-dupes copies with links to the one kept: hard or symlink")
+var keepPolicy = flag.String("keep", "", "Choose the disk -quarantine or -dedupe keeps, eg. \"prefix:/collection,newest\" (see USAGE.md; default asks)")
+var dryRun = flag.Bool("dry-run", false, "Show what -quarantine, -quarantine-restore or -dedupe would change without changing anything")
+var quarantineRestore = flag.String("quarantine-restore", "", "Undo a quarantine run from its journal")
 
 func main() {
 
@@ -117,12 +146,27 @@ func main() {
 	//l.SILENT = !*logToFile
 	loggy.ECHO = *verbose
 
+	if *fileHash != FileHashRaw && *fileHash != FileHashNormalized {
+		os.Stderr.WriteString("-file-hash must be raw or normalized\n")
+		os.Exit(1)
+	}
+
+	if err := disk.LoadBootSignatures(*bootSignatures); err != nil {
+		os.Stderr.WriteString("Error loading signatures: " + err.Error() + "\n")
+	}
+
 	if *withDisk != "" {
-		dsk, err := disk.NewDSKWrapper(defNibbler, *withDisk)
+		dsk, err := loadDisk(*withDisk)
 		if err != nil {
 			os.Stderr.WriteString(err.Error())
 			os.Exit(2)
 		}
+		if *forceFS != "" || *forceOrder != "" {
+			if err := dsk.ForceInterpretation(*forceFS, *forceOrder); err != nil {
+				os.Stderr.WriteString(err.Error() + "\n")
+				os.Exit(2)
+			}
+		}
 		commandVolumes[0] = dsk
 		commandTarget = 0
 
@@ -141,6 +185,12 @@ func main() {
 			shellProcess("delete " + *fileDelete)
 		case *fileCatalog:
 			shellProcess("cat ")
+		case *fileConvert != "":
+			shellProcess("convert " + *fileConvert)
+		case *fileIdentify:
+			shellProcess("identify")
+		case *fileSys != "":
+			shellProcess("sys " + *fileSys)
 		default:
 			os.Stderr.WriteString("Additional flag required")
 			os.Exit(3)
@@ -191,7 +241,7 @@ func main() {
 		var err error
 		if len(filterpath) > 0 {
 			fmt.Printf("Trying to load %s\n", filterpath[0])
-			dsk, err = disk.NewDSKWrapper(defNibbler, filterpath[0])
+			dsk, err = loadDisk(filterpath[0])
 			if err != nil {
 				fmt.Println("Error: " + err.Error())
 				os.Exit(1)
@@ -201,6 +251,24 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *patchCmd != "" {
+		if shellProcess("patch "+*patchCmd) != 0 {
+			os.Exit(2)
+		}
+		return
+	}
+
+	if *diffDisks {
+		if len(flag.Args()) != 2 {
+			os.Stderr.WriteString("-diff needs two disk images, eg. -diff a.dsk b.dsk\n")
+			os.Exit(1)
+		}
+		if diffImages(flag.Arg(0), flag.Arg(1)) != 0 {
+			os.Exit(2)
+		}
+		return
+	}
+
 	defer func() {
 
 		if fileExtractCounter > 0 {
@@ -209,86 +277,148 @@ func main() {
 
 	}()
 
+	if *serveAddr != "" {
+		if err := serveAPI(*serveAddr, *serveWrite); err != nil {
+			os.Stderr.WriteString("Unable to serve: " + err.Error() + "\n")
+			os.Exit(2)
+		}
+		return
+	}
+
+	if *importFgp {
+		withDatastoreLock(true, importFingerprintFiles)
+		return
+	}
+
+	if *prune {
+		withDatastoreLock(true, func() { pruneDatastore(filterpath) })
+		return
+	}
+
+	if *findQuery != "" {
+		withDatastoreLock(false, func() { searchForQuery(*findQuery, filterpath) })
+		return
+	}
+
 	if *searchFilename != "" {
-		searchForFilename(*searchFilename, filterpath)
+		withDatastoreLock(false, func() { searchForFilename(*searchFilename, filterpath) })
+		return
+	}
+
+	if *searchHex != "" {
+		withDatastoreLock(false, func() { searchForHex(*searchHex, filterpath) })
 		return
 	}
 
 	if *searchSHA != "" {
-		searchForSHA256(*searchSHA, filterpath)
+		withDatastoreLock(false, func() { searchForSHA256(*searchSHA, filterpath) })
 		return
 	}
 
 	if *searchTEXT != "" {
-		searchForTEXT(*searchTEXT, filterpath)
+		withDatastoreLock(false, func() { searchForTEXT(*searchTEXT, filterpath) })
+		return
+	}
+
+	if *searchOS != "" {
+		withDatastoreLock(false, func() { searchForOS(*searchOS, filterpath) })
 		return
 	}
 
 	if *dir {
-		directory(filterpath, *dirFormat)
+		withDatastoreLock(false, func() { directory(filterpath, *dirFormat) })
+		return
+	}
+
+	if *htmlDir != "" {
+		withDatastoreLock(false, func() { htmlCatalogueReport(*htmlDir, filterpath) })
+		return
+	}
+
+	if *quarantineRestore != "" {
+		r := -1
+		withDatastoreLock(true, func() { r = restoreQuarantine(*quarantineRestore, *dryRun) })
+		if r != 0 {
+			os.Exit(2)
+		}
 		return
 	}
 
 	if *allFileSubset {
-		allFilesSubsetReport(filterpath)
+		if *quarantine {
+			withDatastoreLock(true, func() { quarantineDisks(QuarantineFileSubsets, filterpath, *keepPolicy, *dryRun) })
+		} else {
+			withDatastoreLock(false, func() { allFilesSubsetReport(filterpath) })
+		}
 		os.Exit(0)
 	}
 
 	if *activeSectorSubset {
-		activeSectorsSubsetReport(filterpath)
+		withDatastoreLock(false, func() { activeSectorsSubsetReport(filterpath) })
 		os.Exit(0)
 	}
 
 	if *allSectorSubset {
-		allSectorsSubsetReport(filterpath)
+		withDatastoreLock(false, func() { allSectorsSubsetReport(filterpath) })
+		os.Exit(0)
+	}
+
+	if *lineage {
+		withDatastoreLock(false, func() { lineageReport(*similarity, filterpath) })
 		os.Exit(0)
 	}
 
 	if *catDupes {
-		allFilesPartialReport(1.0, filterpath, "DUPLICATE CATALOG REPORT")
+		withDatastoreLock(false, func() { allFilesPartialReport(1.0, filterpath, "DUPLICATE CATALOG REPORT") })
 		os.Exit(0)
 	}
 
 	if *allFilePartial {
 		if *minSame == 0 && *maxDiff == 0 {
-			allFilesPartialReport(*similarity, filterpath, "")
+			withDatastoreLock(false, func() { allFilesPartialReport(*similarity, filterpath, "") })
 		} else if *minSame > 0 {
-			allFilesCustomReport(keeperAtLeastNSame, filterpath, fmt.Sprintf("AT LEAST %d FILES MATCH", *minSame))
+			withDatastoreLock(false, func() {
+				allFilesCustomReport(keeperAtLeastNSame, filterpath, fmt.Sprintf("AT LEAST %d FILES MATCH", *minSame))
+			})
 		} else if *maxDiff > 0 {
-			allFilesCustomReport(keeperMaximumNDiff, filterpath, fmt.Sprintf("NO MORE THAN %d FILES DIFFER", *maxDiff))
+			withDatastoreLock(false, func() {
+				allFilesCustomReport(keeperMaximumNDiff, filterpath, fmt.Sprintf("NO MORE THAN %d FILES DIFFER", *maxDiff))
+			})
 		}
 		os.Exit(0)
 	}
 
 	if *allSectorPartial {
-		allSectorsPartialReport(*similarity, filterpath)
+		withDatastoreLock(false, func() { allSectorsPartialReport(*similarity, filterpath) })
 		os.Exit(0)
 	}
 
 	if *activeSectorPartial {
-		activeSectorsPartialReport(*similarity, filterpath)
+		withDatastoreLock(false, func() { activeSectorsPartialReport(*similarity, filterpath) })
 		os.Exit(0)
 	}
 
 	if *fileDupes {
-		fileDupeReport(filterpath)
+		withDatastoreLock(false, func() { fileDupeReport(filterpath) })
 		os.Exit(0)
 	}
 
 	if *wholeDupes {
-		if *quarantine {
-			quarantineWholeDisks(filterpath)
+		if *dedupe != "" {
+			withDatastoreLock(true, func() { dedupeWholeDisks(filterpath, *dedupe, *keepPolicy, *dryRun) })
+		} else if *quarantine {
+			withDatastoreLock(true, func() { quarantineDisks(QuarantineWholeDupes, filterpath, *keepPolicy, *dryRun) })
 		} else {
-			wholeDupeReport(filterpath)
+			withDatastoreLock(false, func() { wholeDupeReport(filterpath) })
 		}
 		os.Exit(0)
 	}
 
 	if *activeDupes {
 		if *quarantine {
-			quarantineActiveDisks(filterpath)
+			withDatastoreLock(true, func() { quarantineDisks(QuarantineActiveDupes, filterpath, *keepPolicy, *dryRun) })
 		} else {
-			activeDupeReport(filterpath)
+			withDatastoreLock(false, func() { activeDupeReport(filterpath) })
 		}
 		os.Exit(0)
 	}
@@ -299,13 +429,26 @@ func main() {
 		os.MkdirAll(*baseName, 0755)
 	}
 
-	if *dskName == "" && *dskInfo == "" {
+	if *dskInfo != "" {
+		if *nearest <= 0 {
+			os.Stderr.WriteString("-query needs -nearest <n>\n")
+			os.Exit(2)
+		}
+		r := -1
+		withDatastoreLock(false, func() { r = queryNearest(*dskInfo, *nearest, filterpath) })
+		if r != 0 {
+			os.Exit(2)
+		}
+		return
+	}
+
+	if *dskName == "" {
 
 		var dsk *disk.DSKWrapper
 		var err error
 		if len(filterpath) > 0 {
 			fmt.Printf("Trying to load %s\n", filterpath[0])
-			dsk, err = disk.NewDSKWrapper(defNibbler, filterpath[0])
+			dsk, err = loadDisk(filterpath[0])
 			if err != nil {
 				fmt.Println("Error: " + err.Error())
 				os.Exit(1)
@@ -321,7 +464,14 @@ func main() {
 		loggy.Get(0).Errorf("Error stating file: %s", err.Error())
 		os.Exit(2)
 	}
-	if info.IsDir() {
+	dl, err := lockDatastore(true)
+	if err != nil {
+		os.Stderr.WriteString("Unable to lock datastore: " + err.Error() + "\n")
+		os.Exit(2)
+	}
+	defer dl.Unlock()
+
+	if info.IsDir() || isArchive(*dskName) {
 		walk(*dskName)
 	} else {
 		indisk = make(map[disk.DiskFormat]int)
@@ -335,6 +485,8 @@ func main() {
 					asPartialReport(dsk, *similarity, *reportFile, filterpath)
 				} else if e == nil && *filePartial {
 					filePartialReport(dsk, *similarity, *reportFile, filterpath)
+				} else if e == nil && *nearest > 0 {
+					nearestReport(dsk, *nearest, filterpath)
 				} else if e == nil && *fileMatch != "" {
 					fileMatchReport(dsk, *fileMatch, filterpath)
 				} else if e == nil && *dir {
@@ -348,5 +500,6 @@ func main() {
 				loggy.Get(0).Errorf(string(debug.Stack()))
 			},
 		)
+		reportCorruptFingerprints(os.Stderr)
 	}
 }
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/paleotronic/diskm8/loggy"
+)
+
+/*
+	Ingest manifest...
+
+	Remembers the size, modification time and SHA256 of every image that
+	has been ingested, along with the fingerprint it produced, so a later
+	ingest can skip images that have not changed.  The manifest is saved
+	every few seconds while ingesting, so an interrupted run picks up where
+	it left off.
+
+	Archives are remembered by size and modification time with the list of
+	disk images inside them.
+*/
+
+const manifestFile = "manifest.gob"
+const manifestCheckpoint = 30 * time.Second
+
+type ManifestEntry struct {
+	Size        int64
+	ModTime     int64
+	SHA256      string   // Sha of the image file as read
+	Fingerprint string   // Fingerprint file, relative to the datastore
+	Reason      string   // Why the file is not a disk, if it is not
+	Members     []string // Disk images inside an archive
+}
+
+type Manifest struct {
+	sync.Mutex
+	Entries map[string]*ManifestEntry
+	changed bool
+	saved   time.Time
+}
+
+var manifest *Manifest
+
+func manifestKey(p string) string {
+	if abspath, e := filepath.Abs(p); e == nil {
+		p = abspath
+	}
+	return path.Clean(p)
+}
+
+func fileSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadManifest reads the manifest from the datastore, starting a new one
+// if there is none.
+func LoadManifest() *Manifest {
+
+	m := &Manifest{Entries: make(map[string]*ManifestEntry), saved: time.Now()}
+
+	f, err := os.Open(filepath.Join(*baseName, manifestFile))
+	if err != nil {
+		return m
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(&m.Entries); err != nil {
+		os.Stderr.WriteString("Ingest manifest is unreadable, starting a new one: " + err.Error() + "\n")
+		m.Entries = make(map[string]*ManifestEntry)
+	}
+
+	return m
+}
+
+// Save writes the manifest atomically if it has changed
+func (m *Manifest) Save() error {
+
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.changed {
+		return nil
+	}
+
+	filename := filepath.Join(*baseName, manifestFile)
+	_ = os.MkdirAll(*baseName, 0755)
+
+	f, err := ioutil.TempFile(*baseName, manifestFile+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpname := f.Name()
+
+	err = gob.NewEncoder(f).Encode(m.Entries)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	m.changed = false
+	m.saved = time.Now()
+
+	return nil
+}
+
+// Checkpoint saves the manifest if it has not been saved for a while
+func (m *Manifest) Checkpoint() {
+
+	m.Lock()
+	due := m.changed && time.Since(m.saved) > manifestCheckpoint
+	m.Unlock()
+
+	if due {
+		if err := m.Save(); err != nil {
+			loggy.Get(0).Errorf("Failed to save manifest: %v", err)
+		}
+	}
+}
+
+func (m *Manifest) Get(key string) *ManifestEntry {
+	m.Lock()
+	defer m.Unlock()
+	return m.Entries[key]
+}
+
+func (m *Manifest) Put(key string, e *ManifestEntry) {
+	m.Lock()
+	m.Entries[key] = e
+	m.changed = true
+	m.Unlock()
+}
+
+func (m *Manifest) Delete(key string) {
+	m.Lock()
+	delete(m.Entries, key)
+	m.changed = true
+	m.Unlock()
+}
+
+// Unchanged reports whether a file matches its manifest entry by size and
+// modification time, and its fingerprint is still in the datastore.
+func (m *Manifest) Unchanged(key string, info os.FileInfo) bool {
+
+	e := m.Get(key)
+	if e == nil || e.Size != info.Size() || e.ModTime != info.ModTime().UnixNano() {
+		return false
+	}
+
+	return m.complete(e)
+}
+
+// UnchangedArchive is like Unchanged, but also needs every disk image in the
+// archive to have been ingested.
+func (m *Manifest) UnchangedArchive(key string, info os.FileInfo) bool {
+
+	e := m.Get(key)
+	if e == nil || e.Size != info.Size() || e.ModTime != info.ModTime().UnixNano() {
+		return false
+	}
+
+	for _, member := range e.Members {
+		me := m.Get(member)
+		if me == nil || !m.complete(me) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *Manifest) complete(e *ManifestEntry) bool {
+	if e.Reason != "" {
+		return true
+	}
+	return e.Fingerprint != "" && fingerprintExists(e.Fingerprint)
+}
+
+// SameContent reports whether data matches the manifest entry, so only the
+// modification time needs updating.
+func (m *Manifest) SameContent(key string, data []byte) (bool, string) {
+
+	sum := fileSHA256(data)
+
+	e := m.Get(key)
+	if e == nil || e.SHA256 != sum || !m.complete(e) {
+		return false, sum
+	}
+
+	return true, sum
+}
+
+// Record notes the result of ingesting an image, removing the fingerprint
+// it had before if that has changed.
+func (m *Manifest) Record(key string, size, modtime int64, sum string, d *Disk, reason string) {
+
+	e := &ManifestEntry{
+		Size:    size,
+		ModTime: modtime,
+		SHA256:  sum,
+		Reason:  reason,
+	}
+	if d != nil && reason == "" {
+		e.Fingerprint = d.GetFilename()
+	}
+
+	if old := m.Get(key); old != nil && old.Fingerprint != "" && old.Fingerprint != e.Fingerprint {
+		if err := writeStore(func(s *Store) error { return s.Delete(old.Fingerprint) }); err != nil {
+			loggy.Get(0).Errorf("Failed to remove old fingerprint %s: %v", old.Fingerprint, err)
+		}
+	}
+
+	m.Put(key, e)
+}
+
+// saveManifestOnInterrupt makes sure an interrupted ingest can resume.  The
+// returned function stops watching.
+func saveManifestOnInterrupt() func() {
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-c:
+			os.Stderr.WriteString("\nInterrupted, saving ingest progress...\n")
+			if err := manifest.Save(); err != nil {
+				os.Stderr.WriteString("Failed to save manifest: " + err.Error() + "\n")
+			}
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
+// sourceExists checks that the image a fingerprint came from is still
+// there, looking inside archives when needed.
+func sourceExists(p string, listings map[string]map[string]bool) bool {
+
+	archive, member := splitArchivePath(p)
+	if member == "" {
+		return exists(p)
+	}
+
+	members, ok := listings[archive]
+	if !ok {
+		members = listArchive(archive)
+		listings[archive] = members
+	}
+	if members == nil {
+		// archive is unreadable rather than gone
+		return exists(archive)
+	}
+
+	return members[p]
+}
+
+// listArchive returns the paths of everything inside an archive, including
+// nested archives, or nil if it cannot be read.
+func listArchive(archive string) map[string]bool {
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+
+	members := make(map[string]bool)
+
+	var list func(name string, r io.Reader, size int64) error
+	list = func(name string, r io.Reader, size int64) error {
+		return archiveMembers(name, r, size, func(member string, mr io.Reader, msize int64) error {
+			p := name + archiveSeparator + member
+			members[p] = true
+			if isArchive(member) {
+				list(p, mr, msize)
+			}
+			return nil
+		})
+	}
+
+	if err := list(archive, f, info.Size()); err != nil {
+		return nil
+	}
+
+	return members
+}
+
+// pruneDatastore removes fingerprints whose source image has gone, or which
+// were replaced when the image changed.
+func pruneDatastore(filter []string) {
+
+	manifest = LoadManifest()
+
+	byFingerprint := make(map[string]string)
+	for k, e := range manifest.Entries {
+		if e.Fingerprint != "" {
+			byFingerprint[e.Fingerprint] = k
+		}
+	}
+
+	// manifest entries for images that have gone
+	listings := make(map[string]map[string]bool)
+	for k := range manifest.Entries {
+		if !sourceExists(k, listings) {
+			manifest.Delete(k)
+		}
+	}
+
+	s, err := getStore()
+	if err != nil {
+		os.Stderr.WriteString("Failed to open datastore: " + err.Error() + "\n")
+		return
+	}
+
+	count := 0
+	_, matches := existsPattern(*baseName, filter, "*_*_*_*.fgp")
+	for _, m := range matches {
+
+		rel := fingerprintKey(m)
+
+		source, ok := byFingerprint[rel]
+		if !ok {
+			source = s.Source(rel)
+		}
+
+		reason := ""
+		if !sourceExists(source, listings) {
+			reason = "source image is gone"
+		} else if e := manifest.Get(manifestKey(source)); e != nil && e.Fingerprint != "" && e.Fingerprint != rel {
+			reason = "image has been re-ingested"
+		}
+		if reason == "" {
+			continue
+		}
+
+		if err := s.Delete(rel); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("Failed to remove %s: %v\n", m, err))
+			continue
+		}
+		fmt.Printf("Pruned %s (%s: %s)\n", m, reason, source)
+		count++
+	}
+
+	if err := manifest.Save(); err != nil {
+		os.Stderr.WriteString("Failed to save manifest: " + err.Error() + "\n")
+	}
+
+	fmt.Printf("%d stale fingerprint(s) removed\n", count)
+}
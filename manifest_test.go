@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// ingestLibrary ingests dir holding the lock, as -ingest does, returning
+// how many disks were fingerprinted
+func ingestLibrary(dir string) int {
+	withDatastoreLock(true, func() { walk(dir) })
+	return processed
+}
+
+func writeImage(t *testing.T, path string, data []byte, modtime time.Time) {
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func storeKeys(t *testing.T) []string {
+
+	s, err := getStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := s.Keys()
+	sort.Strings(keys)
+
+	return keys
+}
+
+func TestIngestUnchanged(t *testing.T) {
+
+	dir := tempDatastore(t)
+	lib := filepath.Join(dir, "library")
+	os.MkdirAll(lib, 0755)
+
+	then := time.Now().Add(-time.Hour)
+	a, b := filepath.Join(lib, "a.dsk"), filepath.Join(lib, "b.dsk")
+	writeImage(t, a, bootImage(1), then)
+	writeImage(t, b, bootImage(2), then)
+
+	if n := ingestLibrary(lib); n != 2 {
+		t.Fatalf("Expected both images to be fingerprinted, got %d", n)
+	}
+	if n := ingestLibrary(lib); n != 0 || unchanged != 2 {
+		t.Fatalf("Expected nothing to be fingerprinted again, got %d (%d unchanged)", n, unchanged)
+	}
+
+	// touched, so read again but found to be the same
+	touched := then.Add(time.Minute)
+	os.Chtimes(b, touched, touched)
+	if n := ingestLibrary(lib); n != 0 || unchanged != 2 {
+		t.Fatalf("Expected the touched image to be unchanged, got %d (%d unchanged)", n, unchanged)
+	}
+	if e := LoadManifest().Get(manifestKey(b)); e == nil || e.ModTime != touched.UnixNano() {
+		t.Fatalf("Expected the manifest to have the new time of %s, got %+v", b, e)
+	}
+	if keys := storeKeys(t); len(keys) != 2 {
+		t.Fatalf("Expected the fingerprints to be kept, got %v", keys)
+	}
+
+	// changed, so fingerprinted again in place of the old one
+	old := LoadManifest().Get(manifestKey(b)).Fingerprint
+	writeImage(t, b, bootImage(3), touched.Add(time.Minute))
+	if n := ingestLibrary(lib); n != 1 {
+		t.Fatalf("Expected only the changed image to be fingerprinted, got %d", n)
+	}
+	e := LoadManifest().Get(manifestKey(b))
+	keys := storeKeys(t)
+	if e == nil || e.Fingerprint == old || len(keys) != 2 || !fingerprintExists(e.Fingerprint) || fingerprintExists(old) {
+		t.Fatalf("Expected a new fingerprint for the changed image, got %v", keys)
+	}
+
+}
+
+func TestPruneDatastore(t *testing.T) {
+
+	dir := tempDatastore(t)
+	lib := filepath.Join(dir, "library")
+	os.MkdirAll(lib, 0755)
+
+	then := time.Now().Add(-time.Hour)
+	a, b := filepath.Join(lib, "a.dsk"), filepath.Join(lib, "b.dsk")
+	writeImage(t, a, bootImage(1), then)
+	writeImage(t, b, bootImage(2), then)
+	ingestLibrary(lib)
+
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+
+	pruneDatastore(nil)
+
+	m := LoadManifest()
+	if m.Get(manifestKey(a)) != nil {
+		t.Fatalf("Expected the manifest entry of %s to be pruned", a)
+	}
+	e := m.Get(manifestKey(b))
+	if e == nil {
+		t.Fatalf("Expected the manifest entry of %s to be kept", b)
+	}
+
+	if keys := storeKeys(t); len(keys) != 1 || keys[0] != e.Fingerprint {
+		t.Fatalf("Expected only %s to be left, got %v", e.Fingerprint, keys)
+	}
+
+}
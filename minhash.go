@@ -0,0 +1,255 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+)
+
+/*
+	MinHash and locality sensitive hashing...
+
+	The -*-partial reports score a pair of disks by how many files (by
+	SHA256) or sectors (by position and SHA256) they share, out of all the
+	files or sectors on either.  Comparing every disk with every other gets
+	slow on big collections, so each disk carries a MinHash signature of
+	its files, its active sectors and all of its sectors, made when the
+	fingerprint is written.  Two signatures agree in about the same
+	proportion of places as the sets they came from overlap (the Jaccard
+	index), so cutting them into bands and bucketing disks by band finds
+	the pairs likely to be above the threshold.  Only those pairs are
+	compared exactly.
+
+	Rows per band are chosen for the threshold so a pair right at it is
+	still found at least lshRecall of the time; pairs further above it are
+	all but certain to be found.  -exhaustive compares every pair instead.
+*/
+
+const minHashSize = 128
+
+// chance of finding a pair that is exactly at the threshold
+const lshRecall = 0.99
+
+type MinHash []uint32
+
+var minHashSeeds = func() []uint64 {
+	seeds := make([]uint64, minHashSize)
+	x := uint64(0x6469736b6d38) // "diskm8"
+	for i := range seeds {
+		x += 0x9e3779b97f4a7c15
+		seeds[i] = mix64(x)
+	}
+	return seeds
+}()
+
+// mix64 is the splitmix64 finalizer
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// NewMinHash makes the signature of a set of strings, nil if it is empty
+func NewMinHash(elements []string) MinHash {
+
+	if len(elements) == 0 {
+		return nil
+	}
+
+	sig := make(MinHash, minHashSize)
+	for i := range sig {
+		sig[i] = math.MaxUint32
+	}
+
+	for _, e := range elements {
+		h := fnv.New64a()
+		h.Write([]byte(e))
+		v := h.Sum64()
+		for i, seed := range minHashSeeds {
+			if m := uint32(mix64(v^seed) >> 32); m < sig[i] {
+				sig[i] = m
+			}
+		}
+	}
+
+	return sig
+}
+
+// fileMinHashElements are the files CompareCatalogs counts, by the checksum
+// sha gives
+func fileMinHashElements(files DiskCatalog, sha func(f *DiskFile) string) []string {
+	out := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.Size == 0 && EXCLUDEZEROBYTE {
+			continue
+		}
+		if f.Filename == "hello" && EXCLUDEHELLO {
+			continue
+		}
+		out = append(out, sha(f))
+	}
+	return out
+}
+
+// fileNameMinHashes are signatures of the files on each disk by name and
+// type.  A modified file counts towards CompareCatalogs by its similarity
+// but differs by checksum, so disks whose files were edited can score
+// above the threshold with few checksums in common.  Unless files were
+// renamed as well their names still overlap at least as much as the
+// score, so these find the pairs the checksum signatures miss.
+func fileNameMinHashes(filerecords map[string]DiskCatalog) map[string]MinHash {
+	sigs := make(map[string]MinHash, len(filerecords))
+	for key, files := range filerecords {
+		sigs[key] = NewMinHash(fileMinHashElements(files, func(f *DiskFile) string { return f.Ext + ":" + f.Filename }))
+	}
+	return sigs
+}
+
+// mergeCandidates adds the candidates in b to those in a
+func mergeCandidates(a, b map[string][]string) map[string][]string {
+	for key, others := range b {
+		seen := make(map[string]bool, len(a[key]))
+		for _, k := range a[key] {
+			seen[k] = true
+		}
+		for _, k := range others {
+			if !seen[k] {
+				a[key] = append(a[key], k)
+			}
+		}
+	}
+	return a
+}
+
+// sectorMinHashElements are the sectors as CompareSectors matches them,
+// by position and content
+func sectorMinHashElements(sectors DiskSectors) []string {
+	out := make([]string, 0, len(sectors))
+	for _, s := range sectors {
+		out = append(out, strconv.Itoa(s.Track)+","+strconv.Itoa(s.Sector)+":"+s.SHA256)
+	}
+	return out
+}
+
+// nonEmptySectors are the sectors the all sector reports look at
+func nonEmptySectors(d *Disk) DiskSectors {
+	out := make(DiskSectors, 0, len(d.ActiveSectors)+len(d.InactiveSectors))
+	for _, s := range append(append(DiskSectors{}, d.ActiveSectors...), d.InactiveSectors...) {
+		if s.SHA256 != EMPTYSECTOR {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (d *Disk) updateMinHashes() {
+	d.FileMinHash = NewMinHash(fileMinHashElements(d.Files, func(f *DiskFile) string { return f.SHA256 }))
+	d.ActiveMinHash = NewMinHash(sectorMinHashElements(d.ActiveSectors))
+	d.SectorMinHash = NewMinHash(sectorMinHashElements(nonEmptySectors(d)))
+}
+
+// signatures made before they were stored are worked out when needed, as
+// are file signatures on normalized hashes
+
+func (d *Disk) fileMinHash() MinHash {
+	if d.FileMinHash == nil || *fileHash == FileHashNormalized {
+		return NewMinHash(fileMinHashElements(d.Files, (*DiskFile).matchSHA256))
+	}
+	return d.FileMinHash
+}
+
+func (d *Disk) activeMinHash() MinHash {
+	if d.ActiveMinHash == nil {
+		return NewMinHash(sectorMinHashElements(d.ActiveSectors))
+	}
+	return d.ActiveMinHash
+}
+
+func (d *Disk) sectorMinHash() MinHash {
+	if d.SectorMinHash == nil {
+		return NewMinHash(sectorMinHashElements(nonEmptySectors(d)))
+	}
+	return d.SectorMinHash
+}
+
+// lshRows picks the rows per band for a Jaccard threshold: the most rows
+// (so the fewest false candidates) that still find a pair at the
+// threshold lshRecall of the time.
+func lshRows(t float64) int {
+	best := 1
+	for r := 1; r <= minHashSize; r++ {
+		b := minHashSize / r
+		if 1-math.Pow(1-math.Pow(t, float64(r)), float64(b)) >= lshRecall {
+			best = r
+		}
+	}
+	return best
+}
+
+// lshCandidates returns for each disk the other disks that share a band
+// with it, the only pairs that need comparing for Jaccard threshold t.  It
+// returns nil if every pair needs comparing.
+func lshCandidates(sigs map[string]MinHash, t float64) map[string][]string {
+
+	if *exhaustive || t <= 0 {
+		return nil
+	}
+
+	rows := lshRows(t)
+	bands := minHashSize / rows
+
+	pairs := make(map[string]map[string]bool)
+	add := func(a, b string) {
+		if pairs[a] == nil {
+			pairs[a] = make(map[string]bool)
+		}
+		pairs[a][b] = true
+	}
+
+	buf := make([]byte, 4*rows)
+	for band := 0; band < bands; band++ {
+
+		buckets := make(map[uint64][]string)
+		for key, sig := range sigs {
+			if len(sig) != minHashSize {
+				continue
+			}
+			for i, v := range sig[band*rows : (band+1)*rows] {
+				buf[4*i], buf[4*i+1], buf[4*i+2], buf[4*i+3] = byte(v), byte(v>>8), byte(v>>16), byte(v>>24)
+			}
+			h := fnv.New64a()
+			h.Write(buf)
+			bucket := h.Sum64()
+			buckets[bucket] = append(buckets[bucket], key)
+		}
+
+		for _, list := range buckets {
+			for i, a := range list {
+				for _, b := range list[i+1:] {
+					add(a, b)
+					add(b, a)
+				}
+			}
+		}
+	}
+
+	out := make(map[string][]string, len(sigs))
+	for key := range sigs {
+		for other := range pairs[key] {
+			out[key] = append(out[key], other)
+		}
+	}
+
+	return out
+}
+
+// sectorJaccardThreshold is the lowest Jaccard index of two sector sets
+// that CompareSectors can score at t or above.  A sector at the same place
+// on both disks with different contents counts once against the score but
+// twice against the Jaccard index.
+func sectorJaccardThreshold(t float64) float64 {
+	return t / (2 - t)
+}
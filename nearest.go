@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+
+	"github.com/paleotronic/diskm8/disk"
+	"github.com/paleotronic/diskm8/loggy"
+	"github.com/paleotronic/diskm8/panic"
+)
+
+/*
+	Nearest neighbours...
+
+	Rather than every disk above a threshold, -nearest N -query <disk> (or
+	similar in the shell) gives the N disks closest to one disk, once ranked
+	by the files they share and once by the active sectors they share.  Each
+	hit lists which files matched, which are missing from it and which it
+	has extra, as in -file-partial.  Disks sharing nothing are left out.
+*/
+
+const defaultNearest = 10
+
+type Neighbour struct {
+	Disk        *Disk
+	FileMatch   float64
+	SectorMatch float64 // active sectors
+	Matched     map[*DiskFile]*DiskFile
+	Missing     []*DiskFile
+	Extra       []*DiskFile
+	Modified    []*FileModification
+}
+
+type nearestCollector struct {
+	disk       *Disk
+	neighbours []*Neighbour
+}
+
+func AggregateNearest(d *Disk, collector interface{}) {
+
+	c := collector.(*nearestCollector)
+
+	if d.FullPath == c.disk.FullPath {
+		return
+	}
+
+	fr := &FileOverlapRecord{
+		files:    make(map[string]map[*DiskFile]*DiskFile),
+		percent:  make(map[string]float64),
+		missing:  make(map[string][]*DiskFile),
+		extras:   make(map[string][]*DiskFile),
+		modified: make(map[string][]*FileModification),
+	}
+	sr := &SectorOverlapRecord{
+		same:    make(map[string]map[*DiskSector]*DiskSector),
+		percent: make(map[string]float64),
+		missing: make(map[string][]*DiskSector),
+		extras:  make(map[string][]*DiskSector),
+	}
+
+	n := &Neighbour{
+		Disk:        d,
+		FileMatch:   CompareCatalogs(c.disk.Files, d.Files, fr, d.FullPath),
+		SectorMatch: CompareSectors(c.disk.ActiveSectors, d.ActiveSectors, sr, d.FullPath),
+		Matched:     fr.files[d.FullPath],
+		Missing:     fr.missing[d.FullPath],
+		Extra:       fr.extras[d.FullPath],
+		Modified:    fr.modified[d.FullPath],
+	}
+
+	if n.FileMatch > 0 || n.SectorMatch > 0 {
+		c.neighbours = append(c.neighbours, n)
+	}
+}
+
+// topNeighbours sorts by score, best first, and keeps those above zero
+func topNeighbours(list []*Neighbour, count int, score func(n *Neighbour) float64) []*Neighbour {
+
+	out := make([]*Neighbour, 0, count)
+	for _, n := range list {
+		if score(n) > 0 {
+			out = append(out, n)
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if score(out[i]) != score(out[j]) {
+			return score(out[i]) > score(out[j])
+		}
+		return out[i].Disk.FullPath < out[j].Disk.FullPath
+	})
+
+	if len(out) > count {
+		out = out[:count]
+	}
+
+	return out
+}
+
+// NearestDisks returns the count disks closest to d by files and by active
+// sectors
+func NearestDisks(d *Disk, count int, filter []string) (byFiles, bySectors []*Neighbour) {
+
+	c := &nearestCollector{disk: d}
+	Aggregate(AggregateNearest, c, filter)
+
+	byFiles = topNeighbours(c.neighbours, count, func(n *Neighbour) float64 { return n.FileMatch })
+	bySectors = topNeighbours(c.neighbours, count, func(n *Neighbour) float64 { return n.SectorMatch })
+
+	return byFiles, bySectors
+}
+
+type jsonNeighbour struct {
+	Disk        string             `json:"disk"`
+	FileMatch   float64            `json:"file_match"`
+	SectorMatch float64            `json:"active_sector_match"`
+	Matched     []jsonFilePair     `json:"matched"`
+	Missing     []string           `json:"missing"`
+	Extra       []string           `json:"extra"`
+	Modified    []jsonModifiedFile `json:"modified"`
+}
+
+type jsonNearest struct {
+	Disk      string          `json:"disk"`
+	ByFiles   []jsonNeighbour `json:"by_files"`
+	BySectors []jsonNeighbour `json:"by_active_sectors"`
+}
+
+func jsonNeighbours(list []*Neighbour) []jsonNeighbour {
+	out := make([]jsonNeighbour, 0, len(list))
+	for _, n := range list {
+		out = append(out, jsonNeighbour{
+			Disk:        n.Disk.FullPath,
+			FileMatch:   n.FileMatch,
+			SectorMatch: n.SectorMatch,
+			Matched:     jsonFilePairs(n.Matched),
+			Missing:     jsonFilenames(n.Missing),
+			Extra:       jsonFilenames(n.Extra),
+			Modified:    jsonModifiedFiles(n.Modified),
+		})
+	}
+	return out
+}
+
+func nearestReport(d *Disk, count int, filter []string) {
+
+	byFiles, bySectors := NearestDisks(d, count, filter)
+
+	if *jsonOut {
+		writeJSONReport("nearest", &jsonNearest{Disk: d.FullPath, ByFiles: jsonNeighbours(byFiles), BySectors: jsonNeighbours(bySectors)})
+		return
+	}
+
+	var w *os.File
+	var err error
+
+	if *reportFile != "" {
+		w, err = os.Create(*reportFile)
+		if err != nil {
+			os.Stderr.WriteString("Unable to create report: " + err.Error() + "\n")
+			return
+		}
+		defer w.Close()
+	} else {
+		w = os.Stdout
+	}
+
+	w.WriteString(fmt.Sprintf("NEAREST %d DISKS TO %s\n\n", count, d.FullPath))
+
+	w.WriteString(fmt.Sprintf("BY FILES (%d found)\n\n", len(byFiles)))
+	for i, n := range byFiles {
+		writeNeighbour(w, i+1, n.FileMatch, n)
+	}
+
+	w.WriteString(fmt.Sprintf("BY ACTIVE SECTORS (%d found)\n\n", len(bySectors)))
+	for i, n := range bySectors {
+		writeNeighbour(w, i+1, n.SectorMatch, n)
+	}
+}
+
+func writeNeighbour(w *os.File, rank int, score float64, n *Neighbour) {
+
+	w.WriteString(fmt.Sprintf("%2d) %6.2f%%\t%s (files %.2f%%, active sectors %.2f%%, %d missing, %d extras, %d modified)\n",
+		rank, score*100, n.Disk.FullPath, n.FileMatch*100, n.SectorMatch*100, len(n.Missing), len(n.Extra), len(n.Modified)))
+
+	for _, p := range jsonFilePairs(n.Matched) {
+		w.WriteString(fmt.Sprintf("\t == %s -> %s\n", p.From, p.To))
+	}
+	for _, f := range jsonFilenames(n.Missing) {
+		w.WriteString(fmt.Sprintf("\t -- %s\n", f))
+	}
+	for _, f := range jsonFilenames(n.Extra) {
+		w.WriteString(fmt.Sprintf("\t ++ %s\n", f))
+	}
+	for _, m := range jsonModifiedFiles(n.Modified) {
+		w.WriteString(fmt.Sprintf("\t ~~ %s -> %s (%.2f%%)\n", m.From, m.To, m.Similarity*100))
+	}
+	w.WriteString("\n")
+}
+
+// queryNearest fingerprints a disk image in memory, leaving the datastore
+// as it is, and reports its nearest neighbours.  Needs the datastore
+// locked for reading.
+func queryNearest(filename string, count int, filter []string) int {
+
+	if abspath, err := filepath.Abs(filename); err == nil {
+		filename = abspath
+	}
+
+	indisk = make(map[disk.DiskFormat]int)
+	outdisk = make(map[disk.DiskFormat]int)
+
+	r := -1
+
+	panic.Do(
+		func() {
+			d, err := analyzeInMemory(filename, *ingestMode)
+			if err != nil {
+				os.Stderr.WriteString("Error processing disk " + filename + ": " + err.Error() + "\n")
+				return
+			}
+			nearestReport(d, count, filter)
+			r = 0
+		},
+		func(e interface{}) {
+			loggy.Get(0).Errorf("Error processing volume: %s", filename)
+			loggy.Get(0).Errorf(string(debug.Stack()))
+		},
+	)
+
+	return r
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func nearestDisk(path string, files []string, sectors []string) *Disk {
+
+	name := filepath.Base(path)
+	d := &Disk{FullPath: path, Filename: name, SHA256: "sha-" + name, SHA256Active: "active-" + name}
+	for _, sha := range files {
+		d.Files = append(d.Files, &DiskFile{Filename: "F" + sha, Ext: "BIN", SHA256: sha, Size: 256})
+	}
+	for i, sha := range sectors {
+		d.ActiveSectors = append(d.ActiveSectors, &DiskSector{Track: 17, Sector: i, SHA256: sha})
+	}
+
+	return d
+}
+
+func TestNearestReport(t *testing.T) {
+
+	dir := tempDatastore(t)
+
+	for _, d := range []*Disk{
+		nearestDisk("/disks/close.dsk", []string{"a", "b", "c", "d"}, []string{"s0", "s1", "zz", "zz"}),
+		nearestDisk("/disks/half.dsk", []string{"a", "b"}, []string{"s0", "s1", "s2", "s3"}),
+		nearestDisk("/disks/little.dsk", []string{"a", "x", "y"}, nil),
+		nearestDisk("/disks/nothing.dsk", []string{"x"}, []string{"zz"}),
+		// the query disk itself, if it was ingested, is left out
+		nearestDisk("/disks/query.dsk", []string{"a", "b", "c", "d"}, []string{"s0", "s1", "s2", "s3"}),
+	} {
+		if err := d.WriteToFile(*baseName + "/" + d.GetFilename()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := nearestDisk("/disks/query.dsk", []string{"a", "b", "c", "d"}, []string{"s0", "s1", "s2", "s3"})
+
+	oldJSON, oldReport := *jsonOut, *reportFile
+	defer func() { *jsonOut, *reportFile = oldJSON, oldReport }()
+	*jsonOut = true
+	*reportFile = filepath.Join(dir, "nearest.json")
+
+	tests := []struct {
+		count     int
+		byFiles   []string
+		bySectors []string
+	}{
+		{10, []string{"/disks/close.dsk", "/disks/half.dsk", "/disks/little.dsk"}, []string{"/disks/half.dsk", "/disks/close.dsk"}},
+		{2, []string{"/disks/close.dsk", "/disks/half.dsk"}, []string{"/disks/half.dsk", "/disks/close.dsk"}},
+		{1, []string{"/disks/close.dsk"}, []string{"/disks/half.dsk"}},
+	}
+
+	for _, test := range tests {
+
+		nearestReport(query, test.count, nil)
+
+		data, err := ioutil.ReadFile(*reportFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var report jsonNearest
+		if err := json.Unmarshal(data, &jsonDocument{Results: &report}); err != nil {
+			t.Fatal(err)
+		}
+
+		var byFiles, bySectors []string
+		for _, n := range report.ByFiles {
+			byFiles = append(byFiles, n.Disk)
+		}
+		for _, n := range report.BySectors {
+			bySectors = append(bySectors, n.Disk)
+		}
+		if !reflect.DeepEqual(byFiles, test.byFiles) {
+			t.Errorf("%d by files: expected %v, got %v", test.count, test.byFiles, byFiles)
+		}
+		if !reflect.DeepEqual(bySectors, test.bySectors) {
+			t.Errorf("%d by sectors: expected %v, got %v", test.count, test.bySectors, bySectors)
+		}
+
+		if len(report.ByFiles) > 0 {
+			if n := report.ByFiles[0]; n.FileMatch != 1 || len(n.Missing) != 0 || len(n.Extra) != 0 {
+				t.Errorf("Expected close.dsk to have every file, got %+v", n)
+			}
+		}
+	}
+
+}
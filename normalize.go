@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/paleotronic/diskm8/disk"
+)
+
+/*
+	Normalized file hashes...
+
+	Each file keeps two checksums: SHA256 of the data as read, and
+	NormalizedSHA256 of the data with the slack from the last sector
+	trimmed (see disk/normalize.go), so the same program saved twice
+	matches even if the bytes past its end differ.  -file-hash picks the
+	one the file dupe, partial and subset reports match on.  Fingerprints
+	made before normalized hashes were kept match on the raw one.
+*/
+
+const (
+	FileHashRaw        = "raw"
+	FileHashNormalized = "normalized"
+)
+
+// matchSHA256 is the checksum files are matched on, as chosen by -file-hash
+func (f *DiskFile) matchSHA256() string {
+	if *fileHash == FileHashNormalized && f.NormalizedSHA256 != "" {
+		return f.NormalizedSHA256
+	}
+	return f.SHA256
+}
+
+func normalizedSHA256(kind disk.CatalogEntryType, data []byte) string {
+	return disk.Checksum(disk.NormalizeFileData(kind, data))
+}
+
+func appleDOSContent(t disk.FileType) disk.CatalogEntryType {
+	switch t {
+	case disk.FileTypeAPP:
+		return disk.CETBasicApplesoft
+	case disk.FileTypeINT:
+		return disk.CETBasicInteger
+	case disk.FileTypeTXT:
+		return disk.CETText
+	case disk.FileTypeBIN:
+		return disk.CETBinary
+	}
+	return disk.CETUnknown
+}
+
+// prodosContent only trims sequential text files, as random access ones
+// (with a record length) are padded with zeros between records
+func prodosContent(t disk.ProDOSFileType, aux int) disk.CatalogEntryType {
+	switch t {
+	case disk.FileType_PD_APP:
+		return disk.CETBasicApplesoft
+	case disk.FileType_PD_INT:
+		return disk.CETBasicInteger
+	case disk.FileType_PD_TXT:
+		if aux == 0 {
+			return disk.CETText
+		}
+	case disk.FileType_PD_BIN:
+		return disk.CETBinary
+	}
+	return disk.CETUnknown
+}
+
+func rdosContent(t disk.RDOSFileType) disk.CatalogEntryType {
+	switch t {
+	case disk.FileType_RDOS_AppleSoft:
+		return disk.CETBasicApplesoft
+	case disk.FileType_RDOS_Text:
+		return disk.CETText
+	case disk.FileType_RDOS_Binary:
+		return disk.CETBinary
+	}
+	return disk.CETUnknown
+}
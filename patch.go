@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/paleotronic/diskm8/disk"
+)
+
+/*
+	Disk patches...
+
+	patch create a.dsk b.dsk out.ips|out.bps stores only what differs
+	between two versions of a disk.  Both disks are read in logical order
+	(see disk/diskimagelogical.go), so the patch is the same whichever
+	image format or sector order either was kept in, and the source it
+	applies to is the disk with the canonical SHA256 of a.dsk.
+
+	BPS patches carry that checksum (and the target's) in their metadata.
+	IPS has nowhere to keep it, so every patch made is also recorded in
+	patches.gob in the datastore, by the SHA256 of the patch file.  patch
+	apply checks the base disk against the recorded checksum before
+	applying, and the result after; without a base it uses the disk the
+	patch was made from, or a disk in the datastore with the same
+	canonical checksum.
+
+	Patches made by other tools need the base given.  BPS ones are still
+	checked by the CRC32 of the source they carry; IPS ones are applied
+	with a warning, as there is nothing to check the base against.
+
+	The patched disk is written in the base's sector order, so a .po base
+	gives a .po result.
+*/
+
+const patchesFile = "patches.gob"
+
+const (
+	PatchIPS = "ips"
+	PatchBPS = "bps"
+)
+
+type PatchRecord struct {
+	Patch        string // where the patch was written
+	Format       string
+	Source       string // disk the patch was made from
+	SourceSHA256 string // canonical SHA256 of the source
+	Target       string
+	TargetSHA256 string
+	Created      time.Time
+}
+
+type patchMetadata struct {
+	SourceSHA256 string `json:"source_sha256"`
+	TargetSHA256 string `json:"target_sha256"`
+	Source       string `json:"source,omitempty"`
+	Target       string `json:"target,omitempty"`
+}
+
+func loadPatchRecords() map[string]*PatchRecord {
+
+	records := make(map[string]*PatchRecord)
+
+	f, err := os.Open(filepath.Join(*baseName, patchesFile))
+	if err != nil {
+		return records
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(&records); err != nil {
+		os.Stderr.WriteString("Patch records are unreadable: " + err.Error() + "\n")
+		return make(map[string]*PatchRecord)
+	}
+
+	return records
+}
+
+// savePatchRecords writes the patch records atomically
+func savePatchRecords(records map[string]*PatchRecord) error {
+
+	filename := filepath.Join(*baseName, patchesFile)
+	_ = os.MkdirAll(*baseName, 0755)
+
+	f, err := ioutil.TempFile(*baseName, patchesFile+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpname := f.Name()
+
+	err = gob.NewEncoder(f).Encode(records)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+	}
+
+	return err
+}
+
+func patchFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".ips":
+		return PatchIPS
+	case ".bps":
+		return PatchBPS
+	}
+	return ""
+}
+
+// logicalImage reads a disk in logical order as one run of bytes, returning
+// the sectors per track (0 for blocks) and the size of each sector or block
+func logicalImage(dsk *disk.DSKWrapper) ([]byte, int, int) {
+
+	units, spt := dsk.LogicalUnits()
+
+	var size int
+	var out bytes.Buffer
+	for _, u := range units {
+		if len(u) > size {
+			size = len(u)
+		}
+		out.Write(u)
+	}
+
+	return out.Bytes(), spt, size
+}
+
+// findCanonicalDisk returns a disk in the datastore with the canonical
+// SHA256 given, or "" if there is none
+func findCanonicalDisk(sha string) string {
+
+	var found string
+	Aggregate(func(d *Disk, collector interface{}) {
+		if found == "" && d.canonicalSHA256() == sha {
+			found = d.FullPath
+		}
+	}, nil, nil)
+
+	return found
+}
+
+// createPatch writes a patch turning disk pathA into disk pathB.  Needs the
+// datastore locked for writing.
+func createPatch(pathA, pathB, out string) int {
+
+	format := patchFormat(out)
+	if format == "" {
+		os.Stderr.WriteString("Patch file must end in .ips or .bps: " + out + "\n")
+		return -1
+	}
+
+	a, err := loadDisk(pathA)
+	if err != nil {
+		os.Stderr.WriteString("Unable to read " + pathA + ": " + err.Error() + "\n")
+		return -1
+	}
+	b, err := loadDisk(pathB)
+	if err != nil {
+		os.Stderr.WriteString("Unable to read " + pathB + ": " + err.Error() + "\n")
+		return -1
+	}
+
+	source, sptA, _ := logicalImage(a)
+	target, sptB, _ := logicalImage(b)
+	if sptA != sptB {
+		os.Stderr.WriteString(fmt.Sprintf("Cannot patch between disks laid out differently: %s has %s, %s has %s\n", pathA, unitKind(sptA), pathB, unitKind(sptB)))
+		return -1
+	}
+
+	pathA, _ = filepath.Abs(pathA)
+	pathB, _ = filepath.Abs(pathB)
+	meta := patchMetadata{
+		SourceSHA256: disk.Checksum(source),
+		TargetSHA256: disk.Checksum(target),
+		Source:       pathA,
+		Target:       pathB,
+	}
+
+	var patch []byte
+	switch format {
+	case PatchIPS:
+		patch, err = disk.MakeIPS(source, target)
+		if err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			return -1
+		}
+	case PatchBPS:
+		m, _ := json.Marshal(&meta)
+		patch = disk.MakeBPS(source, target, string(m))
+	}
+
+	if err := ioutil.WriteFile(out, patch, 0644); err != nil {
+		os.Stderr.WriteString("Unable to write patch: " + err.Error() + "\n")
+		return -1
+	}
+
+	out, _ = filepath.Abs(out)
+	records := loadPatchRecords()
+	records[fileSHA256(patch)] = &PatchRecord{
+		Patch:        out,
+		Format:       format,
+		Source:       meta.Source,
+		SourceSHA256: meta.SourceSHA256,
+		Target:       meta.Target,
+		TargetSHA256: meta.TargetSHA256,
+		Created:      time.Now(),
+	}
+	if err := savePatchRecords(records); err != nil {
+		os.Stderr.WriteString("Unable to record patch in the datastore: " + err.Error() + "\n")
+		return -1
+	}
+
+	fmt.Printf("Wrote %s (%d bytes) from %s to %s\n", out, len(patch), pathA, pathB)
+	fmt.Printf("Source SHA256 %s\n", meta.SourceSHA256)
+	if findCanonicalDisk(meta.SourceSHA256) == "" {
+		os.Stderr.WriteString("The source disk is not in the datastore; ingest it so patch apply can find it\n")
+	}
+
+	return 0
+}
+
+// patchedImage returns the bytes to write for a patched disk: its data,
+// inside the 2MG header of the base image if it had one
+func patchedImage(raw []byte, dsk *disk.DSKWrapper) []byte {
+
+	if len(raw) >= 64 && string(raw[:4]) == "2IMG" {
+		var h disk.Header2MG
+		h.SetData(raw[:64])
+		start := h.GetDiskDataStart()
+		if start+len(dsk.Data) <= len(raw) {
+			out := append([]byte(nil), raw...)
+			copy(out[start:], dsk.Data)
+			return out
+		}
+	}
+
+	return dsk.Data
+}
+
+// applyPatch applies a patch to the disk at base (found from the patch
+// records if empty) and writes the result to out
+func applyPatch(patchfile, base, out string) int {
+
+	patch, err := ioutil.ReadFile(patchfile)
+	if err != nil {
+		os.Stderr.WriteString("Unable to read patch: " + err.Error() + "\n")
+		return -1
+	}
+
+	format := patchFormat(patchfile)
+	switch {
+	case bytes.HasPrefix(patch, []byte("PATCH")):
+		format = PatchIPS
+	case bytes.HasPrefix(patch, []byte("BPS1")):
+		format = PatchBPS
+	}
+
+	var meta patchMetadata
+	if r, ok := loadPatchRecords()[fileSHA256(patch)]; ok {
+		meta = patchMetadata{SourceSHA256: r.SourceSHA256, TargetSHA256: r.TargetSHA256, Source: r.Source, Target: r.Target}
+	} else if format == PatchBPS {
+		if m, err := disk.BPSMetadata(patch); err == nil {
+			json.Unmarshal([]byte(m), &meta)
+		}
+	}
+
+	// patches from other tools: BPS still has the CRC32 of its source,
+	// which ApplyBPS checks, but IPS has nothing to check against
+	if meta.SourceSHA256 == "" {
+		if base == "" {
+			os.Stderr.WriteString("No source checksum is known for " + patchfile + " (not made by patch create), give the disk to apply it to\n")
+			return -1
+		}
+		if format == PatchIPS {
+			os.Stderr.WriteString("Warning: " + patchfile + " was not made by patch create, so " + base + " cannot be checked against it\n")
+		}
+	}
+
+	if base == "" {
+		if _, err := os.Stat(meta.Source); meta.Source != "" && err == nil {
+			base = meta.Source
+		} else if base = findCanonicalDisk(meta.SourceSHA256); base == "" {
+			os.Stderr.WriteString("Cannot find the source disk " + meta.SourceSHA256 + ", give it to apply the patch to\n")
+			return -1
+		}
+	}
+
+	dsk, err := loadDisk(base)
+	if err != nil {
+		os.Stderr.WriteString("Unable to read " + base + ": " + err.Error() + "\n")
+		return -1
+	}
+	if dsk.SourceFormat != "" {
+		os.Stderr.WriteString("Cannot write a patched " + dsk.SourceFormat + " image, convert the base to a sector image first: " + base + "\n")
+		return -1
+	}
+
+	source, _, size := logicalImage(dsk)
+	if sum := disk.Checksum(source); meta.SourceSHA256 != "" && sum != meta.SourceSHA256 {
+		os.Stderr.WriteString(fmt.Sprintf("%s is not the source of this patch: SHA256 %s, expected %s\n", base, sum, meta.SourceSHA256))
+		return -1
+	}
+
+	var target []byte
+	switch format {
+	case PatchIPS:
+		target, err = disk.ApplyIPS(source, patch)
+	case PatchBPS:
+		target, err = disk.ApplyBPS(source, patch)
+	default:
+		err = fmt.Errorf("Not an IPS or BPS patch: %s", patchfile)
+	}
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return -1
+	}
+
+	if meta.TargetSHA256 != "" && disk.Checksum(target) != meta.TargetSHA256 {
+		os.Stderr.WriteString("Patched disk has the wrong SHA256: " + disk.Checksum(target) + ", expected " + meta.TargetSHA256 + "\n")
+		return -1
+	}
+	if len(target) != len(source) {
+		os.Stderr.WriteString(fmt.Sprintf("Patched disk is %d bytes, the base %d; changing the size of a disk is not supported\n", len(target), len(source)))
+		return -1
+	}
+
+	units := make([][]byte, 0, len(target)/size)
+	for p := 0; p < len(target); p += size {
+		end := p + size
+		if end > len(target) {
+			end = len(target)
+		}
+		units = append(units, target[p:end])
+	}
+	if err := dsk.WriteLogicalUnits(units); err != nil {
+		os.Stderr.WriteString("Unable to write patched disk: " + err.Error() + "\n")
+		return -1
+	}
+
+	raw, err := readDiskImage(base)
+	if err != nil {
+		os.Stderr.WriteString("Unable to read " + base + ": " + err.Error() + "\n")
+		return -1
+	}
+
+	if err := ioutil.WriteFile(out, patchedImage(raw, dsk), 0644); err != nil {
+		os.Stderr.WriteString("Unable to write patched disk: " + err.Error() + "\n")
+		return -1
+	}
+
+	fmt.Printf("Wrote %s from %s\n", out, base)
+
+	return 0
+}
+
+func shellPatch(args []string) int {
+
+	r := -1
+	switch {
+	case args[0] == "create" && len(args) == 4:
+		withDatastoreLock(true, func() { r = createPatch(args[1], args[2], args[3]) })
+	case args[0] == "apply" && len(args) == 3:
+		withDatastoreLock(false, func() { r = applyPatch(args[1], "", args[2]) })
+	case args[0] == "apply" && len(args) == 4:
+		withDatastoreLock(false, func() { r = applyPatch(args[1], args[2], args[3]) })
+	default:
+		os.Stderr.WriteString("patch create <source> <target> <patch.ips|patch.bps>, or patch apply <patch> [<base>] <disk>\n")
+	}
+
+	return r
+}
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Quarantine...
+
+	Quarantine moves the duplicates in each group of disks out of the
+	collection into the quarantine folder, keeping one, and marks their
+	fingerprints as quarantined so reports and searches skip them.  Groups
+	are whole disk dupes, active sector dupes, or file subsets: a disk and
+	the disks whose files are all on it.  Only disks whose files are all on
+	the one kept are moved out of a subset group.
+
+	Without -keep the disk to keep is asked for on stdin.  -keep chooses it
+	with a comma separated list of rules, each deciding between disks the
+	ones before it found equal, with the path as a last resort:
+
+	  prefix:<path>  disks under path
+	  shortest       the shortest file name
+	  longest        the longest file name
+	  oldest         the oldest image file
+	  newest         the newest image file
+	  ext:<ext>      images with the extension
+	  complete       the most files, then the most sectors with data
+
+	Every move is written to a journal before it happens, one JSON object
+	to a line, and quarantine restore puts back everything a journal lists.
+	-dry-run shows what would move without touching anything.
+*/
+
+const (
+	QuarantineWholeDupes  = "whole-dupes"
+	QuarantineActiveDupes = "as-dupes"
+	QuarantineFileSubsets = "file-subsets"
+)
+
+type quarantineCandidate struct {
+	disk    *Disk
+	modTime time.Time // zero if the image can't be found
+}
+
+func (c *quarantineCandidate) path() string {
+	return c.disk.FullPath
+}
+
+// a keepRule is below zero if a is the better disk to keep, above if b is
+type keepRule func(a, b *quarantineCandidate) int
+
+func boolRule(f func(c *quarantineCandidate) bool) keepRule {
+	return func(a, b *quarantineCandidate) int {
+		switch fa, fb := f(a), f(b); {
+		case fa && !fb:
+			return -1
+		case fb && !fa:
+			return 1
+		}
+		return 0
+	}
+}
+
+func intRule(f func(c *quarantineCandidate) int) keepRule {
+	return func(a, b *quarantineCandidate) int {
+		return f(a) - f(b)
+	}
+}
+
+func timeRule(newest bool) keepRule {
+	return func(a, b *quarantineCandidate) int {
+		switch {
+		case a.modTime.Equal(b.modTime):
+			return 0
+		case b.modTime.IsZero():
+			return -1
+		case a.modTime.IsZero():
+			return 1
+		case a.modTime.Before(b.modTime) != newest:
+			return -1
+		}
+		return 1
+	}
+}
+
+func dataSectors(d *Disk) int {
+	return len(nonEmptySectors(d))
+}
+
+// ParseKeepPolicy parses a -keep policy such as "prefix:/good,newest"
+func ParseKeepPolicy(s string) ([]keepRule, error) {
+
+	var rules []keepRule
+
+	for _, word := range strings.Split(s, ",") {
+
+		word = strings.TrimSpace(word)
+		name, arg := word, ""
+		if i := strings.Index(word, ":"); i >= 0 {
+			name, arg = word[:i], word[i+1:]
+		}
+
+		switch strings.ToLower(name) {
+		case "prefix":
+			if arg == "" {
+				return nil, errors.New("prefix needs a path, eg. prefix:/collection")
+			}
+			if abs, err := filepath.Abs(arg); err == nil {
+				arg = abs
+			}
+			prefix := filepath.Clean(arg)
+			rules = append(rules, boolRule(func(c *quarantineCandidate) bool {
+				return c.path() == prefix || strings.HasPrefix(c.path(), prefix+string(filepath.Separator))
+			}))
+		case "shortest":
+			rules = append(rules, intRule(func(c *quarantineCandidate) int { return len(filepath.Base(c.path())) }))
+		case "longest":
+			rules = append(rules, intRule(func(c *quarantineCandidate) int { return -len(filepath.Base(c.path())) }))
+		case "oldest":
+			rules = append(rules, timeRule(false))
+		case "newest":
+			rules = append(rules, timeRule(true))
+		case "ext":
+			ext := strings.TrimPrefix(arg, ".")
+			if ext == "" {
+				return nil, errors.New("ext needs an extension, eg. ext:po")
+			}
+			rules = append(rules, boolRule(func(c *quarantineCandidate) bool {
+				return strings.EqualFold(strings.TrimPrefix(filepath.Ext(c.path()), "."), ext)
+			}))
+		case "complete":
+			rules = append(rules, intRule(func(c *quarantineCandidate) int {
+				return -len(fileMinHashElements(c.disk.Files, (*DiskFile).matchSHA256))
+			}))
+			rules = append(rules, intRule(func(c *quarantineCandidate) int { return -dataSectors(c.disk) }))
+		default:
+			return nil, fmt.Errorf("Unknown keep rule: %s", word)
+		}
+	}
+
+	if len(rules) == 0 {
+		return nil, errors.New("Empty keep policy")
+	}
+
+	return rules, nil
+}
+
+// chooseKeeper returns the member the rules would keep
+func chooseKeeper(members []*quarantineCandidate, rules []keepRule) int {
+
+	best := 0
+	for i := 1; i < len(members); i++ {
+		a, b := members[i], members[best]
+		r := 0
+		for _, rule := range rules {
+			if r = rule(a, b); r != 0 {
+				break
+			}
+		}
+		if r < 0 || (r == 0 && a.path() < b.path()) {
+			best = i
+		}
+	}
+
+	return best
+}
+
+type quarantineGroup struct {
+	members []*quarantineCandidate // sorted by path
+	// contains is nil if every member can be moved out in favour of any
+	// other, otherwise whether keeper holds everything member does
+	contains func(member, keeper string) bool
+}
+
+type quarantineCollector struct {
+	disks map[string]*quarantineCandidate
+}
+
+func AggregateQuarantine(d *Disk, collector interface{}) {
+
+	c := collector.(*quarantineCollector)
+
+	// moving a link would reclaim nothing
+	if isLinkedCopy(d) {
+		return
+	}
+
+	qc := &quarantineCandidate{disk: d}
+	if info, err := os.Stat(d.FullPath); err == nil {
+		qc.modTime = info.ModTime()
+	}
+
+	c.disks[d.FullPath] = qc
+}
+
+func groupBy(disks map[string]*quarantineCandidate, key func(d *Disk) string) []*quarantineGroup {
+
+	byKey := make(map[string]*quarantineGroup)
+	for _, c := range disks {
+		k := key(c.disk)
+		if k == "" {
+			continue
+		}
+		g, ok := byKey[k]
+		if !ok {
+			g = &quarantineGroup{}
+			byKey[k] = g
+		}
+		g.members = append(g.members, c)
+	}
+
+	var out []*quarantineGroup
+	for _, g := range byKey {
+		if len(g.members) > 1 {
+			out = append(out, g)
+		}
+	}
+
+	return out
+}
+
+// subsetGroups joins each disk with the disks whose files are a subset of
+// its own
+func subsetGroups(disks map[string]*quarantineCandidate) []*quarantineGroup {
+
+	catalogs := make(map[string]DiskCatalog)
+	for k, c := range disks {
+		if len(c.disk.Files) > 0 {
+			catalogs[k] = c.disk.Files
+		}
+	}
+	subsets := collectFileSubsets(catalogs)
+
+	g := &lineageGraph{
+		links:  make(map[[2]string]*LineageLink),
+		parent: make(map[string]string),
+	}
+	for k := range catalogs {
+		g.parent[k] = k
+	}
+	for m, v := range subsets {
+		for k, match := range v.percent {
+			g.link(m, k, LinkFileSubset, match, true)
+		}
+	}
+
+	contains := func(member, keeper string) bool {
+		v, ok := subsets[member]
+		if !ok {
+			return false
+		}
+		_, ok = v.percent[keeper]
+		return ok
+	}
+
+	byRoot := make(map[string]*quarantineGroup)
+	for k := range catalogs {
+		root := g.find(k)
+		grp, ok := byRoot[root]
+		if !ok {
+			grp = &quarantineGroup{contains: contains}
+			byRoot[root] = grp
+		}
+		grp.members = append(grp.members, disks[k])
+	}
+
+	var out []*quarantineGroup
+	for _, grp := range byRoot {
+		if len(grp.members) > 1 {
+			out = append(out, grp)
+		}
+	}
+
+	return out
+}
+
+func quarantineGroups(kind string, filter []string) ([]*quarantineGroup, error) {
+
+	c := &quarantineCollector{disks: make(map[string]*quarantineCandidate)}
+	Aggregate(AggregateQuarantine, c, filter)
+
+	var groups []*quarantineGroup
+
+	switch kind {
+	case QuarantineWholeDupes:
+		groups = groupBy(c.disks, func(d *Disk) string { return d.canonicalSHA256() })
+	case QuarantineActiveDupes:
+		groups = groupBy(c.disks, func(d *Disk) string { return d.canonicalSHA256Active() })
+	case QuarantineFileSubsets:
+		groups = subsetGroups(c.disks)
+	default:
+		return nil, fmt.Errorf("Unknown quarantine scan: %s", kind)
+	}
+
+	for _, g := range groups {
+		sort.Slice(g.members, func(i, j int) bool { return g.members[i].path() < g.members[j].path() })
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].members[0].path() < groups[j].members[0].path() })
+
+	return groups, nil
+}
+
+// QuarantineEntry is one line of a quarantine journal
+type QuarantineEntry struct {
+	Time        time.Time `json:"time"`
+	Scan        string    `json:"scan"`
+	Kept        string    `json:"kept"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+type quarantineJournal struct {
+	filename string
+	f        *os.File
+	enc      *json.Encoder
+	count    int
+}
+
+func quarantineFolder() string {
+	return binpath() + "/quarantine"
+}
+
+func quarantinePath(fullpath string) string {
+	p := strings.Replace(fullpath, ":", "", -1)
+	p = strings.Replace(p, "\\", "/", -1)
+	return quarantineFolder() + "/" + strings.TrimPrefix(p, "/")
+}
+
+// record appends an entry, creating the journal with the first one
+func (j *quarantineJournal) record(e *QuarantineEntry) error {
+
+	if j.f == nil {
+		j.filename = quarantineFolder() + "/journal-" + fts() + ".jsonl"
+		os.MkdirAll(filepath.Dir(j.filename), 0755)
+		f, err := os.OpenFile(j.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		j.f = f
+		j.enc = json.NewEncoder(f)
+	}
+
+	if err := j.enc.Encode(e); err != nil {
+		return err
+	}
+	j.count++
+
+	return j.f.Sync()
+}
+
+func (j *quarantineJournal) Close() {
+	if j.f != nil {
+		j.f.Close()
+	}
+}
+
+// askKeeper prompts for the member to keep, -1 to skip the group
+func askKeeper(reader *bufio.Reader, g *quarantineGroup) (idx int, quit bool) {
+
+	for {
+		fmt.Println("Which one to keep?")
+		fmt.Println("(0) Skip this...")
+		for i, v := range g.members {
+			fmt.Printf("(%d) %s\n", i+1, v.path())
+		}
+		fmt.Println()
+		fmt.Printf("Option (0-%d, q): ", len(g.members))
+		text, err := reader.ReadString('\n')
+
+		text = strings.ToLower(strings.Trim(text, "\r\n"))
+
+		if text == "q" || (err != nil && text == "") {
+			return -1, true
+		}
+
+		if text == "0" {
+			return -1, false
+		}
+
+		if n, err := strconv.Atoi(text); err == nil && n >= 1 && n <= len(g.members) {
+			return n - 1, false
+		}
+	}
+}
+
+// quarantineDisks runs a quarantine scan.  keep is a -keep policy, or
+// empty to ask which disk to keep in each group.
+func quarantineDisks(kind string, filter []string, keep string, dryRun bool) int {
+
+	var rules []keepRule
+	if keep != "" {
+		var err error
+		if rules, err = ParseKeepPolicy(keep); err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			return -1
+		}
+	}
+
+	groups, err := quarantineGroups(kind, filter)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return -1
+	}
+
+	journal := &quarantineJournal{}
+	defer journal.Close()
+
+	reader := bufio.NewReader(os.Stdin)
+	moves, moved := 0, 0
+
+	for _, g := range groups {
+
+		var idx int
+		if rules != nil {
+			idx = chooseKeeper(g.members, rules)
+		} else {
+			var quit bool
+			if idx, quit = askKeeper(reader, g); quit {
+				break
+			} else if idx < 0 {
+				continue
+			}
+		}
+
+		keeper := g.members[idx]
+		fmt.Printf("Keeping %s\n", keeper.path())
+
+		for _, v := range g.members {
+
+			if v == keeper {
+				continue
+			}
+			if g.contains != nil && !g.contains(v.path(), keeper.path()) {
+				fmt.Printf("  Leaving %s (has files the kept disk doesn't)\n", v.path())
+				continue
+			}
+			if v.disk.Archive != "" {
+				fmt.Printf("  Leaving %s (inside an archive)\n", v.path())
+				continue
+			}
+
+			bpath := quarantinePath(v.path())
+			moves++
+
+			if dryRun {
+				fmt.Printf("  Would move %s -> %s\n", v.path(), bpath)
+				continue
+			}
+
+			// journalled first, so a disk is never moved without a record;
+			// restore passes over entries whose move didn't happen
+			e := &QuarantineEntry{
+				Time:        time.Now(),
+				Scan:        kind,
+				Kept:        keeper.path(),
+				From:        v.path(),
+				To:          bpath,
+				Fingerprint: v.disk.source,
+			}
+			if err := journal.record(e); err != nil {
+				os.Stderr.WriteString("Error writing journal: " + err.Error() + "\n")
+				return -1
+			}
+
+			fmt.Printf("  Moving %s -> %s\n", v.path(), bpath)
+			if err := moveFile(v.path(), bpath); err != nil {
+				os.Stderr.WriteString("Error moving " + v.path() + ": " + err.Error() + "\n")
+				return -1
+			}
+			moved++
+
+			if err := moveFingerprint(v.disk.source, v.disk.source+".q"); err != nil {
+				os.Stderr.WriteString("Error quarantining fingerprint: " + err.Error() + "\n")
+				return -1
+			}
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("\n%d disk(s) would be moved\n", moves)
+	} else if journal.count > 0 {
+		fmt.Printf("\n%d disk(s) moved; journal written to %s\n", moved, journal.filename)
+		fmt.Printf("Undo with: diskm8 -quarantine-restore %s\n", journal.filename)
+	} else {
+		fmt.Printf("\nNothing moved\n")
+	}
+
+	return 0
+}
+
+func readQuarantineJournal(filename string) ([]*QuarantineEntry, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []*QuarantineEntry
+	dec := json.NewDecoder(f)
+	for {
+		e := &QuarantineEntry{}
+		if err := dec.Decode(e); err == io.EOF {
+			break
+		} else if err != nil {
+			return out, fmt.Errorf("Bad journal entry %d: %v", len(out)+1, err)
+		}
+		out = append(out, e)
+	}
+
+	return out, nil
+}
+
+// restoreQuarantine undoes a quarantine run from its journal, last move
+// first.  Disks whose original path is taken again are left quarantined.
+// Once everything is back the journal is renamed so it isn't replayed.
+func restoreQuarantine(filename string, dryRun bool) int {
+
+	entries, err := readQuarantineJournal(filename)
+	if err != nil {
+		os.Stderr.WriteString("Error reading journal: " + err.Error() + "\n")
+		return -1
+	}
+
+	restored, failed := 0, 0
+
+	for i := len(entries) - 1; i >= 0; i-- {
+
+		e := entries[i]
+
+		_, errFrom := os.Stat(e.From)
+		_, errTo := os.Stat(e.To)
+		switch {
+		case errFrom == nil && errTo != nil:
+			// journalled, but stopped before the move
+			fmt.Printf("Not moved %s\n", e.From)
+			continue
+		case errFrom == nil:
+			fmt.Printf("Leaving %s (%s exists)\n", e.To, e.From)
+			failed++
+			continue
+		case errTo != nil:
+			fmt.Printf("Missing %s\n", e.To)
+			failed++
+			continue
+		}
+
+		if dryRun {
+			fmt.Printf("Would restore %s -> %s\n", e.To, e.From)
+			restored++
+			continue
+		}
+
+		fmt.Printf("Restoring %s -> %s\n", e.To, e.From)
+		if err := moveFile(e.To, e.From); err != nil {
+			os.Stderr.WriteString("Error restoring " + e.From + ": " + err.Error() + "\n")
+			failed++
+			continue
+		}
+		if fingerprintExists(fingerprintKey(e.Fingerprint)) {
+			// stopped before the fingerprint was quarantined
+		} else if err := moveFingerprint(e.Fingerprint+".q", e.Fingerprint); err != nil {
+			os.Stderr.WriteString("Fingerprint of " + e.From + " not restored (" + err.Error() + "); ingest it again\n")
+		}
+		restored++
+	}
+
+	if dryRun {
+		fmt.Printf("\n%d disk(s) would be restored, %d can't be\n", restored, failed)
+		return 0
+	}
+
+	fmt.Printf("\n%d disk(s) restored, %d left\n", restored, failed)
+
+	if failed > 0 {
+		return -1
+	}
+
+	if err := os.Rename(filename, filename+".restored"); err != nil {
+		os.Stderr.WriteString("Unable to rename journal: " + err.Error() + "\n")
+	}
+
+	return 0
+}
+
+// moveFile renames source to dest, copying it if they are on different
+// filesystems
+func moveFile(source, dest string) error {
+
+	source = strings.Replace(source, "\\", "/", -1)
+	dest = strings.Replace(dest, "\\", "/", -1)
+
+	if _, err := os.Stat(dest); err == nil {
+		return errors.New(dest + " already exists")
+	}
+
+	// make sure dest dir actually exists
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(source, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	info, err := in.Stat()
+	if err != nil {
+		in.Close()
+		return err
+	}
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		in.Close()
+		return err
+	}
+	_, err = io.Copy(out, in)
+	in.Close()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return err
+	}
+	os.Chtimes(dest, info.ModTime(), info.ModTime())
+
+	if err := os.Remove(source); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/paleotronic/diskm8/loggy"
+)
+
+// tempDatastore points the datastore and the DiskM8 folder at a temporary
+// directory for the length of a test
+func tempDatastore(t *testing.T) string {
+
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	loggy.LogFolder = filepath.Join(dir, "logs") + "/"
+
+	old := *baseName
+	*baseName = filepath.Join(dir, "fingerprints")
+
+	t.Cleanup(func() {
+		if store != nil {
+			store.Close()
+			store = nil
+		}
+		*baseName = old
+		cache = NewCache(CC_All, "")
+	})
+
+	return dir
+}
+
+// ingestedDisk writes a disk image and its fingerprint, returning the
+// fingerprint filename
+func ingestedDisk(t *testing.T, path string, sha string) string {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(sha), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := Disk{FullPath: path, Filename: filepath.Base(path), SHA256: sha, SHA256Active: sha, CanonicalSHA256: sha}
+	fingerprint := *baseName + "/" + d.GetFilename()
+	if err := d.WriteToFile(fingerprint); err != nil {
+		t.Fatal(err)
+	}
+
+	return fingerprint
+}
+
+func TestParseKeepPolicy(t *testing.T) {
+
+	tests := []struct {
+		policy string
+		rules  int
+		ok     bool
+	}{
+		{"shortest", 1, true},
+		{"prefix:/collection/clean, newest", 2, true},
+		{"ext:.po,oldest,longest", 3, true},
+		{"complete", 2, true},
+		{"SHORTEST", 1, true},
+		{"", 0, false},
+		{"prefix", 0, false},
+		{"ext:", 0, false},
+		{"biggest", 0, false},
+	}
+
+	for _, test := range tests {
+		rules, err := ParseKeepPolicy(test.policy)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: expected ok=%v, got %v", test.policy, test.ok, err)
+			continue
+		}
+		if len(rules) != test.rules {
+			t.Errorf("%q: expected %d rules, got %d", test.policy, test.rules, len(rules))
+		}
+	}
+
+}
+
+func TestChooseKeeper(t *testing.T) {
+
+	now := time.Now()
+	candidate := func(path string, age time.Duration, files int) *quarantineCandidate {
+		d := &Disk{FullPath: path}
+		for i := 0; i < files; i++ {
+			d.Files = append(d.Files, &DiskFile{Filename: "F", SHA256: string(rune('a' + i)), Size: 1})
+		}
+		c := &quarantineCandidate{disk: d}
+		if age >= 0 {
+			c.modTime = now.Add(-age)
+		}
+		return c
+	}
+
+	members := []*quarantineCandidate{
+		candidate("/dupes/games/choplifter copy.dsk", time.Hour, 3),
+		candidate("/clean/choplifter.po", 2*time.Hour, 2),
+		candidate("/dupes/chop.dsk", -1, 1),
+		candidate("/dupes/choplifter.dsk", time.Minute, 3),
+	}
+
+	tests := []struct {
+		policy string
+		keep   string
+	}{
+		{"shortest", "/dupes/chop.dsk"},
+		{"longest", "/dupes/games/choplifter copy.dsk"},
+		{"newest", "/dupes/choplifter.dsk"},
+		{"oldest", "/clean/choplifter.po"},
+		{"prefix:/clean", "/clean/choplifter.po"},
+		{"ext:dsk,oldest", "/dupes/games/choplifter copy.dsk"},
+		{"complete", "/dupes/choplifter.dsk"},
+		{"prefix:/nowhere", "/clean/choplifter.po"},
+	}
+
+	for _, test := range tests {
+		rules, err := ParseKeepPolicy(test.policy)
+		if err != nil {
+			t.Fatalf("%q: %v", test.policy, err)
+		}
+		if keep := members[chooseKeeper(members, rules)].path(); keep != test.keep {
+			t.Errorf("%q: expected to keep %s, got %s", test.policy, test.keep, keep)
+		}
+	}
+
+}
+
+func TestQuarantineRestore(t *testing.T) {
+
+	dir := tempDatastore(t)
+
+	keep := filepath.Join(dir, "library", "a.dsk")
+	dupe := filepath.Join(dir, "library", "games", "a copy.dsk")
+	ingestedDisk(t, keep, "same")
+	fingerprint := ingestedDisk(t, dupe, "same")
+	ingestedDisk(t, filepath.Join(dir, "library", "b.dsk"), "other")
+
+	if r := quarantineDisks(QuarantineWholeDupes, nil, "shortest", false); r != 0 {
+		t.Fatalf("Quarantine failed: %d", r)
+	}
+
+	if _, err := os.Stat(dupe); err == nil {
+		t.Fatalf("Expected %s to be moved out", dupe)
+	}
+	if _, err := os.Stat(quarantinePath(dupe)); err != nil {
+		t.Fatalf("Expected %s in quarantine: %v", dupe, err)
+	}
+	if fingerprintExists(fingerprintKey(fingerprint)) || !fingerprintExists(fingerprintKey(fingerprint+".q")) {
+		t.Fatalf("Expected the fingerprint of %s to be quarantined", dupe)
+	}
+
+	journals, _ := filepath.Glob(filepath.Join(quarantineFolder(), "journal-*.jsonl"))
+	if len(journals) != 1 {
+		t.Fatalf("Expected one journal, got %v", journals)
+	}
+	entries, err := readQuarantineJournal(journals[0])
+	if err != nil || len(entries) != 1 || entries[0].From != dupe || entries[0].Kept != keep {
+		t.Fatalf("Expected one journal entry moving %s, got %v (%v)", dupe, entries, err)
+	}
+
+	if r := restoreQuarantine(journals[0], false); r != 0 {
+		t.Fatalf("Restore failed: %d", r)
+	}
+
+	if data, err := ioutil.ReadFile(dupe); err != nil || string(data) != "same" {
+		t.Fatalf("Expected %s to be restored: %v", dupe, err)
+	}
+	if !fingerprintExists(fingerprintKey(fingerprint)) || fingerprintExists(fingerprintKey(fingerprint+".q")) {
+		t.Fatalf("Expected the fingerprint of %s to be restored", dupe)
+	}
+	if _, err := os.Stat(journals[0] + ".restored"); err != nil {
+		t.Fatalf("Expected the journal to be renamed once restored: %v", err)
+	}
+
+}
+
+func TestQuarantineRestoreUnmoved(t *testing.T) {
+
+	dir := tempDatastore(t)
+
+	// journalled, then stopped before the move
+	image := filepath.Join(dir, "library", "a.dsk")
+	fingerprint := ingestedDisk(t, image, "same")
+
+	journal := filepath.Join(dir, "journal.jsonl")
+	e := QuarantineEntry{Time: time.Now(), Scan: QuarantineWholeDupes, From: image, To: quarantinePath(image), Fingerprint: fingerprint}
+	data, _ := json.Marshal(&e)
+	if err := ioutil.WriteFile(journal, append(data, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := restoreQuarantine(journal, false); r != 0 {
+		t.Fatalf("Expected nothing to restore, got %d", r)
+	}
+	if _, err := os.Stat(image); err != nil {
+		t.Fatalf("Expected %s to be left alone: %v", image, err)
+	}
+	if !fingerprintExists(fingerprintKey(fingerprint)) {
+		t.Fatalf("Expected the fingerprint to be left alone")
+	}
+
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+/*
+	Catalog queries...
+
+	A query is a list of terms which must all match, eg.
+
+	  type:BIN addr:$2000 size>8000 name:~"^HGR" format:prodos locked:yes
+
+	Terms are field, operator and value:
+
+	  :   matches; text fields contain the value, others equal it
+	  :~  matches the regular expression
+	  =   equals (!= does not)
+	  > >= < <=  compare numbers
+
+	Values with spaces go in double quotes.  A term on its own is looked for
+	in the filename, -term or NOT term excludes matches, and OR joins lists
+	of terms.  Text matching is not case sensitive, and neither are OR, AND
+	and NOT; use name:or to look for one of them in a filename.
+
+	If every term is about the disk the results are disks, otherwise they
+	are files along with the disk they are on.
+*/
+
+type queryField struct {
+	disk    bool // a property of the disk rather than the file
+	numeric bool
+	boolean bool
+	substr  bool // ':' looks for the value inside the field
+	value   func(d *Disk, f *DiskFile) string
+}
+
+var queryFields = map[string]*queryField{
+	"name":   {substr: true, value: func(d *Disk, f *DiskFile) string { return f.Filename }},
+	"type":   {value: func(d *Disk, f *DiskFile) string { return f.Ext }},
+	"kind":   {substr: true, value: func(d *Disk, f *DiskFile) string { return f.Type }},
+	"addr":   {numeric: true, value: func(d *Disk, f *DiskFile) string { return strconv.Itoa(f.LoadAddress) }},
+	"size":   {numeric: true, value: func(d *Disk, f *DiskFile) string { return strconv.Itoa(f.Size) }},
+	"locked": {boolean: true, value: func(d *Disk, f *DiskFile) string { return strconv.FormatBool(f.Locked) }},
+	"sha":    {value: func(d *Disk, f *DiskFile) string { return f.SHA256 }},
+	"text":   {substr: true, value: func(d *Disk, f *DiskFile) string { return string(f.Text) }},
+
+	"disk":     {disk: true, substr: true, value: func(d *Disk, f *DiskFile) string { return d.FullPath }},
+	"format":   {disk: true, substr: true, value: func(d *Disk, f *DiskFile) string { return d.FormatID.String() }},
+	"files":    {disk: true, numeric: true, value: func(d *Disk, f *DiskFile) string { return strconv.Itoa(len(d.Files)) }},
+	"bootable": {disk: true, boolean: true, value: func(d *Disk, f *DiskFile) string { return strconv.FormatBool(d.Bootable) }},
+	"os": {disk: true, substr: true, value: func(d *Disk, f *DiskFile) string {
+		return strings.Join([]string{d.BootCode, d.DOSImage, d.ProDOSVersion}, " ")
+	}},
+	"disksha": {disk: true, value: func(d *Disk, f *DiskFile) string { return d.SHA256 }},
+}
+
+type queryTerm struct {
+	field  *queryField
+	name   string
+	op     string
+	value  string
+	number int
+	rxp    *regexp.Regexp
+	negate bool
+}
+
+type Query struct {
+	groups [][]*queryTerm
+	disks  bool // every term is about the disk
+}
+
+var queryFieldRxp = regexp.MustCompile(`^[A-Za-z]+(:|=|!=|<|>)`)
+
+var queryOps = []string{":~", ">=", "<=", "!=", ":", "=", ">", "<"}
+
+// parseNumber accepts decimal, $hex and 0x hex, with an optional k suffix
+func parseNumber(s string) (int, error) {
+
+	mult := 1
+	if strings.HasSuffix(strings.ToLower(s), "k") {
+		mult = 1024
+		s = s[:len(s)-1]
+	}
+
+	var n int64
+	var err error
+	switch {
+	case strings.HasPrefix(s, "$"):
+		n, err = strconv.ParseInt(s[1:], 16, 32)
+	case strings.HasPrefix(strings.ToLower(s), "0x"):
+		n, err = strconv.ParseInt(s[2:], 16, 32)
+	default:
+		n, err = strconv.ParseInt(s, 10, 32)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Not a number: %s", s)
+	}
+
+	return int(n) * mult, nil
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "y", "yes", "true", "1":
+		return true, nil
+	case "n", "no", "false", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("Not yes or no: %s", s)
+}
+
+// splitQuery breaks a query into words, keeping double quoted values
+// together and unquoting them.
+func splitQuery(q string) ([]string, error) {
+
+	var out []string
+	var chunk strings.Builder
+	inqq, started := false, false
+
+	for i := 0; i < len(q); i++ {
+		ch := q[i]
+		switch {
+		case ch == '\\' && inqq && i+1 < len(q):
+			i++
+			chunk.WriteByte(q[i])
+		case ch == '"':
+			inqq = !inqq
+			started = true
+		case (ch == ' ' || ch == '\t') && !inqq:
+			if started {
+				out = append(out, chunk.String())
+				chunk.Reset()
+				started = false
+			}
+		default:
+			chunk.WriteByte(ch)
+			started = true
+		}
+	}
+	if inqq {
+		return nil, errors.New("Unterminated quote in query")
+	}
+	if started {
+		out = append(out, chunk.String())
+	}
+
+	return out, nil
+}
+
+func parseQueryTerm(word string) (*queryTerm, error) {
+
+	t := &queryTerm{name: "name", op: ":", value: word}
+	found := false
+
+	for _, op := range queryOps {
+		i := strings.Index(word, op)
+		if i <= 0 {
+			continue
+		}
+		name := strings.ToLower(word[:i])
+		if _, ok := queryFields[name]; !ok {
+			continue
+		}
+		t.name, t.op, t.value = name, op, word[i+len(op):]
+		found = true
+		break
+	}
+	if !found && queryFieldRxp.MatchString(word) {
+		return nil, fmt.Errorf("Unknown field in %s", word)
+	}
+	t.field = queryFields[t.name]
+
+	switch {
+	case t.op == ":~":
+		rxp, err := regexp.Compile("(?i)" + t.value)
+		if err != nil {
+			return nil, err
+		}
+		t.rxp = rxp
+	case t.field.numeric:
+		n, err := parseNumber(t.value)
+		if err != nil {
+			return nil, err
+		}
+		t.number = n
+	case t.field.boolean:
+		b, err := parseBool(t.value)
+		if err != nil {
+			return nil, err
+		}
+		t.value = strconv.FormatBool(b)
+	}
+
+	if t.op == ">" || t.op == ">=" || t.op == "<" || t.op == "<=" {
+		if !t.field.numeric {
+			return nil, fmt.Errorf("%s is not a number and cannot use %s", t.name, t.op)
+		}
+	}
+
+	return t, nil
+}
+
+// ParseQuery parses a catalog query
+func ParseQuery(q string) (*Query, error) {
+
+	words, err := splitQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	query := &Query{disks: true}
+	var group []*queryTerm
+	negate := false
+
+	for _, word := range words {
+		switch strings.ToUpper(word) {
+		case "OR":
+			if len(group) > 0 {
+				query.groups = append(query.groups, group)
+			}
+			group = nil
+			continue
+		case "AND":
+			continue
+		case "NOT":
+			negate = true
+			continue
+		}
+
+		if strings.HasPrefix(word, "-") && len(word) > 1 {
+			negate = true
+			word = word[1:]
+		}
+
+		t, err := parseQueryTerm(word)
+		if err != nil {
+			return nil, err
+		}
+		t.negate = negate
+		negate = false
+
+		if !t.field.disk {
+			query.disks = false
+		}
+		group = append(group, t)
+	}
+	if len(group) > 0 {
+		query.groups = append(query.groups, group)
+	}
+
+	if len(query.groups) == 0 {
+		return nil, errors.New("Nothing to search for")
+	}
+
+	return query, nil
+}
+
+func (t *queryTerm) match(d *Disk, f *DiskFile) bool {
+
+	v := t.field.value(d, f)
+
+	var ok bool
+	switch t.op {
+	case ":~":
+		ok = t.rxp.MatchString(v)
+	case ":":
+		if t.field.numeric {
+			n, _ := strconv.Atoi(v)
+			ok = n == t.number
+		} else if t.field.substr {
+			ok = strings.Contains(strings.ToLower(v), strings.ToLower(t.value))
+		} else {
+			ok = strings.EqualFold(v, t.value)
+		}
+	case "=", "!=":
+		if t.field.numeric {
+			n, _ := strconv.Atoi(v)
+			ok = n == t.number
+		} else {
+			ok = strings.EqualFold(v, t.value)
+		}
+		if t.op == "!=" {
+			ok = !ok
+		}
+	default:
+		n, _ := strconv.Atoi(v)
+		switch t.op {
+		case ">":
+			ok = n > t.number
+		case ">=":
+			ok = n >= t.number
+		case "<":
+			ok = n < t.number
+		case "<=":
+			ok = n <= t.number
+		}
+	}
+
+	return ok != t.negate
+}
+
+// Match reports whether the disk, or the file on it, matches the query.  f
+// is nil when matching disks.
+func (q *Query) Match(d *Disk, f *DiskFile) bool {
+
+	for _, group := range q.groups {
+		ok := true
+		for _, t := range group {
+			if f == nil && !t.field.disk {
+				continue
+			}
+			if !t.match(d, f) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+type queryCollector struct {
+	sync.Mutex
+	query   *Query
+	results []*SearchResultItem
+}
+
+func AggregateQueryMatches(d *Disk, collector interface{}) {
+
+	c := collector.(*queryCollector)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.query.disks {
+		if c.query.Match(d, nil) {
+			c.results = append(c.results, &SearchResultItem{Context: SRC_DISK, DiskPath: d.FullPath, Disk: d})
+		}
+		return
+	}
+
+	if !c.query.Match(d, nil) {
+		return
+	}
+	for _, f := range d.Files {
+		if c.query.Match(d, f) {
+			c.results = append(c.results, &SearchResultItem{Context: SRC_FILE, DiskPath: d.FullPath, Disk: d, File: f})
+		}
+	}
+}
+
+// searchQuery runs a catalog query over the datastore
+func searchQuery(q *Query, filter []string) []*SearchResultItem {
+
+	c := &queryCollector{query: q}
+	Aggregate(AggregateQueryMatches, c, filter)
+
+	sort.Slice(c.results, func(i, j int) bool {
+		a, b := c.results[i], c.results[j]
+		if a.DiskPath != b.DiskPath {
+			return a.DiskPath < b.DiskPath
+		}
+		if a.File == nil || b.File == nil {
+			return false
+		}
+		return a.File.Filename < b.File.Filename
+	})
+
+	return c.results
+}
+
+var queryFileColumns = []string{"DISK", "FORMAT", "NAME", "TYPE", "SIZE", "ADDR", "LOCKED", "SHA256"}
+var queryDiskColumns = []string{"DISK", "FORMAT", "FILES", "BOOTABLE", "OS", "SHA256"}
+
+func (r *SearchResultItem) columns() []string {
+
+	d := r.Disk
+	if r.Context == SRC_DISK {
+		return []string{
+			r.DiskPath,
+			d.FormatID.String(),
+			strconv.Itoa(len(d.Files)),
+			yesNo(d.Bootable),
+			strings.TrimSpace(strings.Join([]string{d.BootCode, d.DOSImage, d.ProDOSVersion}, " ")),
+			d.SHA256,
+		}
+	}
+
+	f := r.File
+	return []string{
+		r.DiskPath,
+		d.FormatID.String(),
+		f.Filename,
+		f.Ext,
+		strconv.Itoa(f.Size),
+		fmt.Sprintf("$%04X", f.LoadAddress),
+		yesNo(f.Locked),
+		f.SHA256,
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "Y"
+	}
+	return "N"
+}
+
+func (r *SearchResultItem) jsonValue() interface{} {
+	if r.Context == SRC_DISK {
+		return newJSONDisk(r.Disk)
+	}
+	return newJSONFile(r.DiskPath, r.File)
+}
+
+func jsonQueryResults(results []*SearchResultItem) []interface{} {
+	out := make([]interface{}, len(results))
+	for i, r := range results {
+		out[i] = r.jsonValue()
+	}
+	return out
+}
+
+// writeQueryResults writes results as a table, CSV or JSON
+func writeQueryResults(w io.Writer, results []*SearchResultItem, disks bool, format string) error {
+
+	header := queryFileColumns
+	if disks {
+		header = queryDiskColumns
+	}
+
+	switch format {
+	case "json":
+		return writeJSON(w, "find", jsonQueryResults(results))
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(header)
+		for _, r := range results {
+			cw.Write(r.columns())
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, r := range results {
+		fmt.Fprintln(tw, strings.Join(r.columns(), "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n%d match(es)\n", len(results))
+
+	return nil
+}
+
+func searchForQuery(query string, filter []string) {
+
+	q, err := ParseQuery(query)
+	if err != nil {
+		os.Stderr.WriteString("Bad query: " + err.Error() + "\n")
+		return
+	}
+
+	results := searchQuery(q, filter)
+
+	format := "table"
+	switch {
+	case *jsonOut:
+		format = "json"
+	case *csvOut:
+		format = "csv"
+	}
+
+	var w io.Writer = os.Stdout
+	if *reportFile != "" {
+		f, err := os.Create(*reportFile)
+		if err != nil {
+			os.Stderr.WriteString("Unable to create output file: " + err.Error() + "\n")
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := writeQueryResults(w, results, q.disks, format); err != nil {
+		os.Stderr.WriteString("Error writing results: " + err.Error() + "\n")
+		return
+	}
+
+	for _, r := range results {
+		if *extract == "@" && r.File != nil {
+			ExtractFile(r.DiskPath, r.File, *adornedCP, false)
+		} else if *extract == "#" {
+			ExtractDisk(r.DiskPath)
+		}
+	}
+
+	if *reportFile != "" {
+		fmt.Println("\nWrote " + *reportFile + "\n")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import "testing"
+
+func TestParseQuery(t *testing.T) {
+
+	type term struct {
+		name, op, value string
+		number          int
+		negate          bool
+	}
+
+	tests := []struct {
+		query  string
+		groups [][]term
+		disks  bool
+	}{
+		{"HELLO", [][]term{{{"name", ":", "HELLO", 0, false}}}, false},
+		{"type:BIN addr:$2000", [][]term{{{"type", ":", "BIN", 0, false}, {"addr", ":", "$2000", 0x2000, false}}}, false},
+		{"size>=8000", [][]term{{{"size", ">=", "8000", 8000, false}}}, false},
+		{"size<=0x100", [][]term{{{"size", "<=", "0x100", 0x100, false}}}, false},
+		{"size>8k", [][]term{{{"size", ">", "8k", 8192, false}}}, false},
+		{"size<2", [][]term{{{"size", "<", "2", 2, false}}}, false},
+		{"type=bin", [][]term{{{"type", "=", "bin", 0, false}}}, false},
+		{"type!=TXT", [][]term{{{"type", "!=", "TXT", 0, false}}}, false},
+		{"name:~^HGR", [][]term{{{"name", ":~", "^HGR", 0, false}}}, false},
+		{"TEXT:a=b", [][]term{{{"text", ":", "a=b", 0, false}}}, false},
+		{`name:"HELLO WORLD"`, [][]term{{{"name", ":", "HELLO WORLD", 0, false}}}, false},
+		{`text:"say \"hi\""`, [][]term{{{"text", ":", `say "hi"`, 0, false}}}, false},
+		{"locked:yes", [][]term{{{"locked", ":", "true", 0, false}}}, false},
+		{"-type:BIN", [][]term{{{"type", ":", "BIN", 0, true}}}, false},
+		{"NOT type:BIN AND size>1", [][]term{{{"type", ":", "BIN", 0, true}, {"size", ">", "1", 1, false}}}, false},
+		{"type:BIN OR type:INT", [][]term{{{"type", ":", "BIN", 0, false}}, {{"type", ":", "INT", 0, false}}}, false},
+		{"not type:BIN and size>1 or name:or", [][]term{{{"type", ":", "BIN", 0, true}, {"size", ">", "1", 1, false}}, {{"name", ":", "or", 0, false}}}, false},
+		{"format:prodos bootable:no files>10", [][]term{{{"format", ":", "prodos", 0, false}, {"bootable", ":", "false", 0, false}, {"files", ">", "10", 10, false}}}, true},
+	}
+
+	for _, test := range tests {
+
+		q, err := ParseQuery(test.query)
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if q.disks != test.disks {
+			t.Errorf("%s: expected disks=%v", test.query, test.disks)
+		}
+		if len(q.groups) != len(test.groups) {
+			t.Errorf("%s: expected %d groups, got %d", test.query, len(test.groups), len(q.groups))
+			continue
+		}
+		for i, group := range test.groups {
+			if len(q.groups[i]) != len(group) {
+				t.Errorf("%s: expected %d terms in group %d, got %d", test.query, len(group), i, len(q.groups[i]))
+				continue
+			}
+			for j, want := range group {
+				got := q.groups[i][j]
+				if got.name != want.name || got.op != want.op || got.value != want.value || got.number != want.number || got.negate != want.negate {
+					t.Errorf("%s: expected %+v, got {%s %s %s %d %v}", test.query, want, got.name, got.op, got.value, got.number, got.negate)
+				}
+			}
+		}
+	}
+
+}
+
+func TestParseQueryErrors(t *testing.T) {
+
+	for _, query := range []string{
+		"",
+		"OR",
+		`name:"HELLO`,
+		"colour:red",
+		"size>big",
+		"addr:$zz",
+		"name>3",
+		"type<=BIN",
+		"name:~(",
+		"locked:maybe",
+	} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+
+}
+
+func TestQueryMatch(t *testing.T) {
+
+	d := &Disk{FullPath: "/games/choplifter.dsk", Bootable: true}
+	hgr := &DiskFile{Filename: "HGR.LOADER", Ext: "BIN", LoadAddress: 0x2000, Size: 8192, Locked: true}
+	hello := &DiskFile{Filename: "HELLO", Ext: "BAS", Size: 200, Text: []byte("10 PRINT \"HELLO WORLD\"")}
+	d.Files = DiskCatalog{hgr, hello}
+
+	tests := []struct {
+		query string
+		file  *DiskFile
+		match bool
+	}{
+		{"hgr", hgr, true},
+		{"hgr", hello, false},
+		{"type:bin addr:$2000 size>=8k locked:yes", hgr, true},
+		{"size>8k", hgr, false},
+		{"size<8193", hgr, true},
+		{"type!=BIN", hgr, false},
+		{"name:~^hgr\\.", hgr, true},
+		{`text:"hello world"`, hello, true},
+		{"-type:BIN", hello, true},
+		{"type:TXT OR type:BAS", hello, true},
+		{"disk:choplifter bootable:yes", nil, true},
+		{"disk:choplifter bootable:no", nil, false},
+	}
+
+	for _, test := range tests {
+		q, err := ParseQuery(test.query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		if m := q.Match(d, test.file); m != test.match {
+			t.Errorf("%s: expected match=%v", test.query, test.match)
+		}
+	}
+
+}
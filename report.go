@@ -10,6 +10,7 @@ type DuplicateSource struct {
 	Fullpath    string
 	Filename    string
 	GSHA        string
+	CSHA        string // canonical sha of the whole disk
 	fingerprint string
 }
 
@@ -43,7 +44,7 @@ func (dfc *DuplicateFileCollection) Add(checksum string, fullpath string, filena
 
 }
 
-func (dfc *DuplicateWholeDiskCollection) Add(checksum string, fullpath string, fgp string) {
+func (dfc *DuplicateWholeDiskCollection) Add(checksum string, gchecksum string, fullpath string, fgp string) {
 
 	if dfc.data == nil {
 		dfc.data = make(map[string][]DuplicateSource)
@@ -54,13 +55,13 @@ func (dfc *DuplicateWholeDiskCollection) Add(checksum string, fullpath string, f
 		list = make([]DuplicateSource, 0)
 	}
 
-	list = append(list, DuplicateSource{Fullpath: fullpath, fingerprint: fgp})
+	list = append(list, DuplicateSource{Fullpath: fullpath, GSHA: gchecksum, fingerprint: fgp})
 
 	dfc.data[checksum] = list
 
 }
 
-func (dfc *DuplicateActiveSectorDiskCollection) Add(checksum string, achecksum string, fullpath string, fgp string) {
+func (dfc *DuplicateActiveSectorDiskCollection) Add(checksum string, cchecksum string, achecksum string, fullpath string, fgp string) {
 
 	if dfc.data == nil {
 		dfc.data = make(map[string][]DuplicateSource)
@@ -71,7 +72,7 @@ func (dfc *DuplicateActiveSectorDiskCollection) Add(checksum string, achecksum s
 		list = make([]DuplicateSource, 0)
 	}
 
-	list = append(list, DuplicateSource{Fullpath: fullpath, GSHA: checksum, fingerprint: fgp})
+	list = append(list, DuplicateSource{Fullpath: fullpath, GSHA: checksum, CSHA: cchecksum, fingerprint: fgp})
 
 	dfc.data[achecksum] = list
 
@@ -111,21 +112,47 @@ func AggregateDuplicateFiles(d *Disk, collection interface{}) {
 
 	for _, f := range d.Files {
 
-		collection.(*DuplicateFileCollection).Add(f.SHA256, d.FullPath, f.Filename, d.source)
+		collection.(*DuplicateFileCollection).Add(f.matchSHA256(), d.FullPath, f.Filename, d.source)
 
 	}
 
 }
 
+// canonicalSHA256 is the sha disks are matched on as whole disks, the same
+// for a disk in any image format.  Fingerprints made before canonical shas
+// were kept fall back to the sha of the image.
+func (d *Disk) canonicalSHA256() string {
+	if d.CanonicalSHA256 == "" {
+		return d.SHA256
+	}
+	return d.CanonicalSHA256
+}
+
+// canonicalSHA256Active is the sha disks are matched on by active sectors
+func (d *Disk) canonicalSHA256Active() string {
+	if d.CanonicalSHA256Active == "" {
+		return d.SHA256Active
+	}
+	return d.CanonicalSHA256Active
+}
+
 func AggregateDuplicateWholeDisks(d *Disk, collection interface{}) {
 
-	collection.(*DuplicateWholeDiskCollection).Add(d.SHA256, d.FullPath, d.source)
+	if isLinkedCopy(d) {
+		return
+	}
+
+	collection.(*DuplicateWholeDiskCollection).Add(d.canonicalSHA256(), d.SHA256, d.FullPath, d.source)
 
 }
 
 func AggregateDuplicateActiveSectorDisks(d *Disk, collection interface{}) {
 
-	collection.(*DuplicateActiveSectorDiskCollection).Add(d.SHA256, d.SHA256Active, d.FullPath, d.source)
+	if isLinkedCopy(d) {
+		return
+	}
+
+	collection.(*DuplicateActiveSectorDiskCollection).Add(d.SHA256, d.canonicalSHA256(), d.canonicalSHA256Active(), d.FullPath, d.source)
 
 }
 
@@ -147,7 +174,7 @@ func (dfc *DuplicateWholeDiskCollection) Report(filename string) {
 		w = os.Stdout
 	}
 
-	for sha256, list := range dfc.data {
+	for _, list := range dfc.data {
 
 		if len(list) > 1 {
 
@@ -159,7 +186,11 @@ func (dfc *DuplicateWholeDiskCollection) Report(filename string) {
 			w.WriteString("\n")
 			w.WriteString(fmt.Sprintf("Volume %s has %d duplicate(s):\n", original.Fullpath, len(dupes)))
 			for _, v := range dupes {
-				w.WriteString(fmt.Sprintf(" %s (sha256: %s)\n", v.Fullpath, sha256))
+				note := ""
+				if v.GSHA != original.GSHA {
+					note = ", another image format"
+				}
+				w.WriteString(fmt.Sprintf(" %s (sha256: %s%s)\n", v.Fullpath, v.GSHA, note))
 				extras++
 			}
 
@@ -199,7 +230,7 @@ func (dfc *DuplicateActiveSectorDiskCollection) Report(filename string) {
 
 			m := make(map[string]int)
 			for _, v := range list {
-				m[v.GSHA] = 1
+				m[v.CSHA] = 1
 			}
 
 			if len(m) == 1 {
@@ -242,6 +273,11 @@ func (dfc *DuplicateActiveSectorDiskCollection) Report(filename string) {
 func asPartialReport(d *Disk, t float64, filename string, pathfilter []string) {
 	matches := d.GetPartialMatchesWithThreshold(t, pathfilter)
 
+	if *jsonOut {
+		writeJSONReport("as-partial", &jsonDiskReport{Disk: d.FullPath, Threshold: t, Matches: jsonDiskMatches(matches)})
+		return
+	}
+
 	var w *os.File
 	var err error
 
@@ -274,6 +310,11 @@ func asPartialReport(d *Disk, t float64, filename string, pathfilter []string) {
 func filePartialReport(d *Disk, t float64, filename string, pathfilter []string) {
 	matches := d.GetPartialFileMatchesWithThreshold(t, pathfilter)
 
+	if *jsonOut {
+		writeJSONReport("file-partial", &jsonDiskReport{Disk: d.FullPath, Threshold: t, Matches: jsonDiskMatches(matches)})
+		return
+	}
+
 	var w *os.File
 	var err error
 
@@ -296,7 +337,7 @@ func filePartialReport(d *Disk, t float64, filename string, pathfilter []string)
 	for i := len(matches) - 1; i >= 0; i-- {
 		v := matches[i]
 
-		w.WriteString(fmt.Sprintf("%.2f%%\t%s (%d missing, %d extras)\n", v.MatchFactor*100, v.FullPath, len(v.MissingFiles), len(v.ExtraFiles)))
+		w.WriteString(fmt.Sprintf("%.2f%%\t%s (%d missing, %d extras, %d modified)\n", v.MatchFactor*100, v.FullPath, len(v.MissingFiles), len(v.ExtraFiles), len(v.ModifiedFiles)))
 		for f1, f2 := range v.MatchFiles {
 			w.WriteString(fmt.Sprintf("\t == %s -> %s\n", f1.Filename, f2.Filename))
 		}
@@ -306,6 +347,9 @@ func filePartialReport(d *Disk, t float64, filename string, pathfilter []string)
 		for _, f := range v.ExtraFiles {
 			w.WriteString(fmt.Sprintf("\t ++ %s\n", f.Filename))
 		}
+		for _, m := range v.ModifiedFiles {
+			w.WriteString(fmt.Sprintf("\t ~~ %s -> %s (%.2f%%)\n", m.From.Filename, m.To.Filename, m.Similarity*100))
+		}
 		w.WriteString("")
 
 	}
@@ -317,11 +361,16 @@ func fileMatchReport(d *Disk, filename string, pathfilter []string) {
 
 	matches := d.GetFileMatches(filename, pathfilter)
 
+	if *jsonOut {
+		writeJSONReport("file", &jsonDiskReport{Disk: d.FullPath, File: filename, Matches: jsonDiskMatches(matches)})
+		return
+	}
+
 	var w *os.File
 	var err error
 
-	if filename != "" {
-		w, err = os.Create(filename)
+	if *reportFile != "" {
+		w, err = os.Create(*reportFile)
 		if err != nil {
 			return
 		}
@@ -351,6 +400,11 @@ func fileDupeReport(filter []string) {
 	dfc := &DuplicateFileCollection{}
 	Aggregate(AggregateDuplicateFiles, dfc, filter)
 
+	if *jsonOut {
+		writeJSONReport("file-dupes", dfc.JSON())
+		return
+	}
+
 	fmt.Println("DUPLICATE FILE REPORT")
 	fmt.Println()
 
@@ -363,6 +417,11 @@ func wholeDupeReport(filter []string) {
 	dfc := &DuplicateWholeDiskCollection{}
 	Aggregate(AggregateDuplicateWholeDisks, dfc, filter)
 
+	if *jsonOut {
+		writeJSONReport("whole-dupes", dfc.JSON())
+		return
+	}
+
 	fmt.Println("DUPLICATE WHOLE DISK REPORT")
 	fmt.Println()
 
@@ -375,6 +434,11 @@ func activeDupeReport(filter []string) {
 	dfc := &DuplicateActiveSectorDiskCollection{}
 	Aggregate(AggregateDuplicateActiveSectorDisks, dfc, filter)
 
+	if *jsonOut {
+		writeJSONReport("as-dupes", dfc.JSON())
+		return
+	}
+
 	fmt.Println("DUPLICATE ACTIVE SECTORS DISK REPORT")
 	fmt.Println()
 
@@ -386,6 +450,15 @@ func allFilesPartialReport(t float64, filter []string, oheading string) {
 
 	matches := CollectFilesOverlapsAboveThreshold(t, filter)
 
+	if *jsonOut {
+		report := "all-file-partial"
+		if oheading != "" {
+			report = "cat-dupes"
+		}
+		writeJSONReport(report, jsonFileOverlaps(matches))
+		return
+	}
+
 	if *csvOut {
 		dumpFileOverlapCSV(matches, *reportFile)
 		return
@@ -414,6 +487,9 @@ func allFilesPartialReport(t float64, filter []string, oheading string) {
 			for _, f := range matchdata.extras[k] {
 				fmt.Printf("     ++ %s\n", f.Filename)
 			}
+			for _, m := range matchdata.modified[k] {
+				fmt.Printf("     ~~ %s -> %s (%.2f%%)\n", m.From.Filename, m.To.Filename, m.Similarity*100)
+			}
 			fmt.Println()
 		}
 
@@ -428,6 +504,11 @@ func allSectorsPartialReport(t float64, filter []string) {
 
 	matches := CollectSectorOverlapsAboveThreshold(t, filter, GetAllDiskSectors)
 
+	if *jsonOut {
+		writeJSONReport("all-sector-partial", jsonSectorOverlaps(matches))
+		return
+	}
+
 	if *csvOut {
 		dumpSectorOverlapCSV(matches, *reportFile)
 		return
@@ -460,6 +541,11 @@ func activeSectorsPartialReport(t float64, filter []string) {
 
 	matches := CollectSectorOverlapsAboveThreshold(t, filter, GetActiveDiskSectors)
 
+	if *jsonOut {
+		writeJSONReport("active-sector-partial", jsonSectorOverlaps(matches))
+		return
+	}
+
 	if *csvOut {
 		dumpSectorOverlapCSV(matches, *reportFile)
 		return
@@ -492,6 +578,11 @@ func allFilesSubsetReport(filter []string) {
 
 	matches := CollectFileSubsets(filter)
 
+	if *jsonOut {
+		writeJSONReport("all-file-subset", jsonFileOverlaps(matches))
+		return
+	}
+
 	if *csvOut {
 		dumpFileOverlapCSV(matches, *reportFile)
 		return
@@ -530,6 +621,11 @@ func activeSectorsSubsetReport(filter []string) {
 
 	matches := CollectSectorSubsets(filter, GetActiveDiskSectors)
 
+	if *jsonOut {
+		writeJSONReport("active-sector-subset", jsonSectorOverlaps(matches))
+		return
+	}
+
 	if *csvOut {
 		dumpSectorOverlapCSV(matches, *reportFile)
 		return
@@ -561,6 +657,11 @@ func allSectorsSubsetReport(filter []string) {
 
 	matches := CollectSectorSubsets(filter, GetAllDiskSectors)
 
+	if *jsonOut {
+		writeJSONReport("all-sector-subset", jsonSectorOverlaps(matches))
+		return
+	}
+
 	if *csvOut {
 		dumpSectorOverlapCSV(matches, *reportFile)
 		return
@@ -615,6 +716,9 @@ func dumpFileOverlapCSV(matches map[string]*FileOverlapRecord, filename string)
 			for _, f2 := range matchdata.extras[disk2] {
 				w.WriteString(fmt.Sprintf(`%.2f,"%s","%s","%s","%s",%s`, match, disk1, "", disk2, f2.Filename, "N") + "\n")
 			}
+			for _, m := range matchdata.modified[disk2] {
+				w.WriteString(fmt.Sprintf(`%.2f,"%s","%s","%s","%s",%s`, match, disk1, m.To.Filename, disk2, m.From.Filename, "M") + "\n")
+			}
 		}
 	}
 
@@ -660,7 +764,7 @@ func keeperAtLeastNSame(d1, d2 string, v *FileOverlapRecord) bool {
 
 func keeperMaximumNDiff(d1, d2 string, v *FileOverlapRecord) bool {
 
-	return len(v.files[d2]) > 0 && (len(v.missing[d2])+len(v.extras[d2])) <= *maxDiff
+	return len(v.files[d2]) > 0 && (len(v.missing[d2])+len(v.extras[d2])+len(v.modified[d2])) <= *maxDiff
 
 }
 
@@ -668,6 +772,11 @@ func allFilesCustomReport(keep func(d1, d2 string, v *FileOverlapRecord) bool, f
 
 	matches := CollectFilesOverlapsCustom(keep, filter)
 
+	if *jsonOut {
+		writeJSONReport("all-file-partial", jsonFileOverlaps(matches))
+		return
+	}
+
 	if *csvOut {
 		dumpFileOverlapCSV(matches, *reportFile)
 		return
@@ -692,6 +801,9 @@ func allFilesCustomReport(keep func(d1, d2 string, v *FileOverlapRecord) bool, f
 			for _, f := range matchdata.extras[k] {
 				fmt.Printf("     ++ %s\n", f.Filename)
 			}
+			for _, m := range matchdata.modified[k] {
+				fmt.Printf("     ~~ %s -> %s (%.2f%%)\n", m.From.Filename, m.To.Filename, m.Similarity*100)
+			}
 			fmt.Println()
 		}
 
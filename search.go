@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -17,95 +18,288 @@ const (
 )
 
 type SearchResultItem struct {
+	Context  SearchResultContext
 	DiskPath string
+	Disk     *Disk
 	File     *DiskFile
 }
 
-func searchForFilename(filename string, filter []string) {
+// matchingFiles picks the files accepted by match, sorted by disk and name
+func matchingFiles(fd map[string]DiskCatalog, match func(f *DiskFile) bool) []*SearchResultItem {
 
-	fd := GetAllFiles("*_*_*_*.fgp", filter)
+	var out []*SearchResultItem
+	for diskname, list := range fd {
+		for _, f := range list {
+			if match(f) {
+				out = append(out, &SearchResultItem{Context: SRC_FILE, DiskPath: diskname, File: f})
+			}
+		}
+	}
 
-	fmt.Printf("Filter: %s\n", filter)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].DiskPath != out[j].DiskPath {
+			return out[i].DiskPath < out[j].DiskPath
+		}
+		return out[i].File.Filename < out[j].File.Filename
+	})
 
-	fmt.Println()
-	fmt.Println()
+	return out
+}
 
-	fmt.Printf("SEARCH RESULTS FOR '%s'\n", filename)
+func jsonFileResults(results []*SearchResultItem) []*jsonFile {
+	out := make([]*jsonFile, 0, len(results))
+	for _, r := range results {
+		out = append(out, newJSONFile(r.DiskPath, r.File))
+	}
+	return out
+}
 
-	fmt.Println()
+func printFileResults(report string, heading string, results []*SearchResultItem) {
 
-	for diskname, list := range fd {
-		//fmt.Printf("Checking: %s\n", diskname)
-		for _, f := range list {
-			if strings.Contains(strings.ToLower(f.Filename), strings.ToLower(filename)) {
-				fmt.Printf("%32s:\n  %s (%s, %d bytes, sha: %s)\n\n", diskname, f.Filename, f.Type, f.Size, f.SHA256)
-				if *extract == "@" {
-					ExtractFile(diskname, f, *adornedCP, false)
-				} else if *extract == "#" {
-					ExtractDisk(diskname)
-				}
-			}
+	if *jsonOut {
+		writeJSONReport(report, jsonFileResults(results))
+	} else {
+		fmt.Println()
+		fmt.Println()
+
+		fmt.Println(heading)
+
+		fmt.Println()
+
+		for _, r := range results {
+			f := r.File
+			fmt.Printf("%32s:\n  %s (%s, %d bytes, sha: %s)\n\n", r.DiskPath, f.Filename, f.Type, f.Size, f.SHA256)
 		}
 	}
 
+	for _, r := range results {
+		if *extract == "@" {
+			ExtractFile(r.DiskPath, r.File, *adornedCP, false)
+		} else if *extract == "#" {
+			ExtractDisk(r.DiskPath)
+		}
+	}
+}
+
+// findFilename returns the files whose name contains filename
+func findFilename(filename string, filter []string) []*SearchResultItem {
+
+	_, matches := existsIndexedFunc(*baseName, filter, IndexFilename, func(name string) bool {
+		return strings.Contains(strings.ToLower(name), strings.ToLower(filename))
+	})
+	fd := GetFilesFrom(matches)
+
+	return matchingFiles(fd, func(f *DiskFile) bool {
+		return strings.Contains(strings.ToLower(f.Filename), strings.ToLower(filename))
+	})
+}
+
+func searchForFilename(filename string, filter []string) {
+
+	if !*jsonOut {
+		fmt.Printf("Filter: %s\n", filter)
+	}
+
+	results := findFilename(filename, filter)
+
+	printFileResults("search-filename", fmt.Sprintf("SEARCH RESULTS FOR '%s'", filename), results)
+}
+
+// findSHA256 returns the files with the checksum sha
+func findSHA256(sha string, filter []string) []*SearchResultItem {
+
+	_, matches := existsIndexed(*baseName, filter, IndexFileSHA, sha)
+	fd := GetFilesFrom(matches)
+
+	return matchingFiles(fd, func(f *DiskFile) bool {
+		return f.SHA256 == sha
+	})
 }
 
 func searchForSHA256(sha string, filter []string) {
 
-	fd := GetAllFiles("*_*_*_*.fgp", filter)
+	results := findSHA256(sha, filter)
+
+	printFileResults("search-sha", fmt.Sprintf("SEARCH RESULTS FOR SHA256 '%s'", sha), results)
+}
+
+type jsonTextLine struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+type jsonTextResult struct {
+	jsonFile
+	Score int            `json:"score"`
+	Lines []jsonTextLine `json:"lines"`
+}
+
+func jsonTextResults(results []*textResult) []*jsonTextResult {
+	out := make([]*jsonTextResult, 0, len(results))
+	for _, r := range results {
+		jr := &jsonTextResult{jsonFile: *newJSONFile(r.DiskPath, r.File), Score: r.Score, Lines: []jsonTextLine{}}
+		lines := textLines(r.File.Text)
+		for _, n := range r.Lines {
+			jr.Lines = append(jr.Lines, jsonTextLine{Line: n + 1, Text: lines[n]})
+		}
+		out = append(out, jr)
+	}
+	return out
+}
+
+func searchForTEXT(text string, filter []string) {
+
+	results, err := searchText(text, filter)
+	if err != nil {
+		os.Stderr.WriteString("Bad search: " + err.Error() + "\n")
+		return
+	}
+
+	if *jsonOut {
+		writeJSONReport("search-text", jsonTextResults(results))
+		for _, r := range results {
+			if *extract == "@" {
+				ExtractFile(r.DiskPath, r.File, *adornedCP, false)
+			} else if *extract == "#" {
+				ExtractDisk(r.DiskPath)
+			}
+		}
+		return
+	}
 
 	fmt.Println()
 	fmt.Println()
 
-	fmt.Printf("SEARCH RESULTS FOR SHA256 '%s'\n", sha)
+	fmt.Printf("SEARCH RESULTS FOR TEXT CONTENT '%s'\n", text)
 
 	fmt.Println()
 
-	for diskname, list := range fd {
-		for _, f := range list {
-			if f.SHA256 == sha {
-				fmt.Printf("%32s:\n  %s (%s, %d bytes, sha: %s)\n\n", diskname, f.Filename, f.Type, f.Size, f.SHA256)
-				if *extract == "@" {
-					ExtractFile(diskname, f, *adornedCP, false)
-				} else if *extract == "#" {
-					ExtractDisk(diskname)
-				}
-			}
+	for _, r := range results {
+		f := r.File
+		fmt.Printf("%32s:\n  %s (%s, %d bytes, sha: %s, score %d)\n", r.DiskPath, f.Filename, f.Type, f.Size, f.SHA256, r.Score)
+		printTextContext(r)
+		fmt.Println()
+		if *extract == "@" {
+			ExtractFile(r.DiskPath, f, *adornedCP, false)
+		} else if *extract == "#" {
+			ExtractDisk(r.DiskPath)
 		}
 	}
 
 }
 
-func searchForTEXT(text string, filter []string) {
+type osSearch struct {
+	term    string
+	matches []*Disk
+}
 
-	fd := GetAllFiles("*_*_*_*.fgp", filter)
+func AggregateOSMatches(d *Disk, collection interface{}) {
+
+	c := collection.(*osSearch)
+
+	switch c.term {
+	case "bootable":
+		if d.Bootable {
+			c.matches = append(c.matches, d)
+		}
+		return
+	case "unbootable", "not bootable":
+		if !d.Bootable {
+			c.matches = append(c.matches, d)
+		}
+		return
+	}
+
+	for _, v := range []string{d.BootCode, d.BootSHA256, d.DOSImage, d.DOSImageSHA256, d.ProDOSVersion} {
+		if v != "" && strings.Contains(strings.ToLower(v), c.term) {
+			c.matches = append(c.matches, d)
+			return
+		}
+	}
+
+}
+
+// findOS returns the disks whose boot code, DOS or ProDOS matches text
+func findOS(text string, filter []string) []*Disk {
+
+	c := &osSearch{term: strings.ToLower(text)}
+
+	Aggregate(AggregateOSMatches, c, filter)
+
+	return c.matches
+}
+
+func jsonDisks(disks []*Disk) []*jsonDisk {
+	out := make([]*jsonDisk, 0, len(disks))
+	for _, d := range disks {
+		out = append(out, newJSONDisk(d))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Disk < out[j].Disk })
+	return out
+}
+
+func searchForOS(text string, filter []string) {
+
+	matches := findOS(text, filter)
+
+	if *jsonOut {
+		writeJSONReport("search-os", jsonDisks(matches))
+		if *extract == "#" {
+			for _, d := range matches {
+				ExtractDisk(d.FullPath)
+			}
+		}
+		return
+	}
 
 	fmt.Println()
 	fmt.Println()
 
-	fmt.Printf("SEARCH RESULTS FOR TEXT CONTENT '%s'\n", text)
+	fmt.Printf("SEARCH RESULTS FOR BOOT/OS '%s'\n", text)
 
 	fmt.Println()
 
-	for diskname, list := range fd {
-		for _, f := range list {
-			if strings.Contains(strings.ToLower(string(f.Text)), strings.ToLower(text)) {
-				fmt.Printf("%32s:\n  %s (%s, %d bytes, sha: %s)\n\n", diskname, f.Filename, f.Type, f.Size, f.SHA256)
-				if *extract == "@" {
-					ExtractFile(diskname, f, *adornedCP, false)
-				} else if *extract == "#" {
-					ExtractDisk(diskname)
-				}
-			}
+	for _, d := range matches {
+		fmt.Printf("%32s:\n  %s\n\n", d.FullPath, d.BootDescription())
+		if *extract == "#" {
+			ExtractDisk(d.FullPath)
 		}
 	}
 
 }
 
+type jsonCatalog struct {
+	Disk  string      `json:"disk"`
+	Files []*jsonFile `json:"files"`
+}
+
 func directory(filter []string, format string) {
 
 	fd := GetAllFiles("*_*_*_*.fgp", filter)
 
+	if *jsonOut {
+		out := make([]*jsonCatalog, 0, len(fd))
+		for diskname, list := range fd {
+			c := &jsonCatalog{Disk: diskname, Files: make([]*jsonFile, 0, len(list))}
+			for _, file := range list {
+				c.Files = append(c.Files, newJSONFile("", file))
+			}
+			out = append(out, c)
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Disk < out[j].Disk })
+		writeJSONReport("dir", out)
+		for diskname, list := range fd {
+			for _, file := range list {
+				if *extract == "@" {
+					ExtractFile(diskname, file, *adornedCP, false)
+				} else if *extract == "#" {
+					ExtractDisk(diskname)
+				}
+			}
+		}
+		return
+	}
+
 	fmt.Println()
 	fmt.Println()
 
@@ -197,7 +391,7 @@ func ExtractFile(diskname string, fd *DiskFile, adorned bool, local bool) error
 func ExtractDisk(diskname string) error {
 	path := binpath() + "/extract" + diskname
 	os.MkdirAll(path, 0755)
-	data, err := ioutil.ReadFile(diskname)
+	data, err := readDiskImage(diskname)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/paleotronic/diskm8/disk"
+)
+
+/*
+	HTTP API...
+
+	-serve <addr> answers queries over the datastore as JSON:
+
+	  GET  /api/disks                    every disk, ?offset= and ?limit= to page
+	  GET  /api/disks/{id}               a disk and its catalog
+	  GET  /api/disks/{id}/files/{name}  a file, ?format=text for the listing
+	  GET  /api/disks/{id}/similar       disks sharing files, ?by=sectors to
+	                                     compare active sectors instead
+	  GET  /api/disks/{id}/matches       disks with the file ?name=
+	  GET  /api/search/{type}?q=         filename, sha, text, hex, os or query
+	  GET  /api/reports/{name}           any of the -json reports, eg. file-dupes
+	  POST /api/ingest?path=             ingest a path on the server
+
+	Every request accepts ?path= (repeated as needed) to select disks, as
+	with -select, and ?similarity= for the similarity reports.  Replies use
+	the -json envelope (see JSON.md); errors are {"error": "..."}.
+
+	The server is read only unless started with -serve-write.  Requests are
+	handled one at a time holding the datastore lock, so ingests from other
+	processes go in between them.  Disks are kept in the metadata cache
+	across requests until the datastore changes.
+*/
+
+type apiServer struct {
+	sync.Mutex
+	end int64             // store offset the cache was filled at
+	ids map[string]string // disk id -> fingerprint
+}
+
+type apiDisk struct {
+	ID string `json:"id"`
+	*jsonDisk
+}
+
+type apiDiskDetail struct {
+	apiDisk
+	Tracks  int         `json:"tracks"`
+	Sectors int         `json:"sectors"`
+	Blocks  int         `json:"blocks"`
+	Catalog []*jsonFile `json:"catalog"`
+}
+
+type apiErrorReply struct {
+	Error string `json:"error"`
+}
+
+func newAPIDisk(d *Disk) apiDisk {
+	return apiDisk{ID: d.ID(), jsonDisk: newJSONDisk(d)}
+}
+
+func apiReply(w http.ResponseWriter, report string, results interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := writeJSON(w, report, results); err != nil {
+		os.Stderr.WriteString("Error writing reply: " + err.Error() + "\n")
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&apiErrorReply{Error: msg})
+}
+
+// apiFilter is the list of ?path= selections, like the arguments to -select
+func apiFilter(r *http.Request) []string {
+	return r.URL.Query()["path"]
+}
+
+func apiSimilarity(r *http.Request) (float64, error) {
+	v := r.URL.Query().Get("similarity")
+	if v == "" {
+		return *similarity, nil
+	}
+	t, err := strconv.ParseFloat(v, 64)
+	if err != nil || t < 0 || t > 1 {
+		return 0, errors.New("similarity must be between 0 and 1")
+	}
+	return t, nil
+}
+
+func apiInt(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Bad %s: %s", name, v)
+	}
+	return n, nil
+}
+
+// refresh empties the cache if the datastore changed since the last request
+func (a *apiServer) refresh() error {
+
+	s, err := getStore()
+	if err != nil {
+		return err
+	}
+
+	s.RLock()
+	end := s.end
+	s.RUnlock()
+
+	if end != a.end {
+		cache = NewCache(CC_All, "")
+		a.ids = nil
+		a.end = end
+	}
+
+	return nil
+}
+
+// handle wraps a handler so it runs alone, holding the datastore lock
+func (a *apiServer) handle(exclusive bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		a.Lock()
+		defer a.Unlock()
+
+		dl, err := lockDatastore(exclusive)
+		if err != nil {
+			apiError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		defer dl.Unlock()
+
+		if err := a.refresh(); err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		h(w, r)
+
+		reportCorruptFingerprints(os.Stderr)
+	}
+}
+
+type apiDiskCollector struct {
+	disks []*Disk
+}
+
+func AggregateAPIDisks(d *Disk, collector interface{}) {
+	c := collector.(*apiDiskCollector)
+	c.disks = append(c.disks, d)
+}
+
+func (a *apiServer) disk(id string) (*Disk, error) {
+
+	if a.ids == nil {
+		c := &apiDiskCollector{}
+		Aggregate(AggregateAPIDisks, c, nil)
+		a.ids = make(map[string]string)
+		for _, d := range c.disks {
+			a.ids[d.ID()] = d.source
+		}
+	}
+
+	fgp, ok := a.ids[id]
+	if !ok {
+		return nil, errors.New("No such disk")
+	}
+
+	return cache.Get(fgp)
+}
+
+func (a *apiServer) listDisks(w http.ResponseWriter, r *http.Request) {
+
+	offset, err := apiInt(r, "offset", 0)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, err := apiInt(r, "limit", 0)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c := &apiDiskCollector{}
+	Aggregate(AggregateAPIDisks, c, apiFilter(r))
+
+	sort.Slice(c.disks, func(i, j int) bool { return c.disks[i].FullPath < c.disks[j].FullPath })
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(c.disks)))
+
+	list := c.disks
+	if offset > len(list) {
+		offset = len(list)
+	}
+	list = list[offset:]
+	if limit > 0 && limit < len(list) {
+		list = list[:limit]
+	}
+
+	out := make([]apiDisk, 0, len(list))
+	for _, d := range list {
+		out = append(out, newAPIDisk(d))
+	}
+
+	apiReply(w, "disks", out)
+}
+
+func (a *apiServer) getDisk(w http.ResponseWriter, r *http.Request) {
+
+	d, err := a.disk(r.PathValue("id"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	out := &apiDiskDetail{
+		apiDisk: newAPIDisk(d),
+		Tracks:  d.Tracks,
+		Sectors: d.Sectors,
+		Blocks:  d.Blocks,
+		Catalog: make([]*jsonFile, 0, len(d.Files)),
+	}
+	for _, f := range d.Files {
+		out.Catalog = append(out.Catalog, newJSONFile("", f))
+	}
+
+	apiReply(w, "disk", out)
+}
+
+func (a *apiServer) getFile(w http.ResponseWriter, r *http.Request) {
+
+	d, err := a.disk(r.PathValue("id"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	name := r.PathValue("name")
+	var file *DiskFile
+	for _, f := range d.Files {
+		if strings.EqualFold(f.Filename, name) {
+			file = f
+			break
+		}
+	}
+	if file == nil {
+		apiError(w, http.StatusNotFound, "No such file")
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "raw":
+		if len(file.Data) == 0 && file.Size > 0 {
+			apiError(w, http.StatusNotFound, "File data was not stored when the disk was ingested")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(file.GetNameAdorned())))
+		w.Write(file.Data)
+	case "text":
+		if len(file.Text) == 0 {
+			apiError(w, http.StatusNotFound, "File has no text or listing")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(strings.Join(textLines(file.Text), "\n") + "\n"))
+	default:
+		apiError(w, http.StatusBadRequest, "format must be raw or text")
+	}
+}
+
+func (a *apiServer) similarDisks(w http.ResponseWriter, r *http.Request) {
+
+	d, err := a.disk(r.PathValue("id"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	t, err := apiSimilarity(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch r.URL.Query().Get("by") {
+	case "", "files":
+		matches := d.GetPartialFileMatchesWithThreshold(t, apiFilter(r))
+		apiReply(w, "file-partial", &jsonDiskReport{Disk: d.FullPath, Threshold: t, Matches: jsonDiskMatches(matches)})
+	case "sectors":
+		matches := d.GetPartialMatchesWithThreshold(t, apiFilter(r))
+		apiReply(w, "as-partial", &jsonDiskReport{Disk: d.FullPath, Threshold: t, Matches: jsonDiskMatches(matches)})
+	default:
+		apiError(w, http.StatusBadRequest, "by must be files or sectors")
+	}
+}
+
+func (a *apiServer) fileMatches(w http.ResponseWriter, r *http.Request) {
+
+	d, err := a.disk(r.PathValue("id"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		apiError(w, http.StatusBadRequest, "name is needed")
+		return
+	}
+
+	matches := d.GetFileMatches(name, apiFilter(r))
+	apiReply(w, "file", &jsonDiskReport{Disk: d.FullPath, File: name, Matches: jsonDiskMatches(matches)})
+}
+
+func (a *apiServer) search(w http.ResponseWriter, r *http.Request) {
+
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		apiError(w, http.StatusBadRequest, "q is needed")
+		return
+	}
+	filter := apiFilter(r)
+
+	switch r.PathValue("type") {
+	case "filename":
+		apiReply(w, "search-filename", jsonFileResults(findFilename(q, filter)))
+	case "sha":
+		apiReply(w, "search-sha", jsonFileResults(findSHA256(q, filter)))
+	case "text":
+		results, err := searchText(q, filter)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		apiReply(w, "search-text", jsonTextResults(results))
+	case "hex":
+		p, err := ParseHexPattern(q)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		apiReply(w, "search-hex", jsonHexMatches(findHexMatches(p, filter).matches))
+	case "os":
+		apiReply(w, "search-os", jsonDisks(findOS(q, filter)))
+	case "query":
+		query, err := ParseQuery(q)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		apiReply(w, "find", jsonQueryResults(searchQuery(query, filter)))
+	default:
+		apiError(w, http.StatusNotFound, "No such search")
+	}
+}
+
+// apiReports produce the results of the -json reports by name
+var apiReports = map[string]func(t float64, filter []string) interface{}{
+	"file-dupes": func(t float64, filter []string) interface{} {
+		dfc := &DuplicateFileCollection{}
+		Aggregate(AggregateDuplicateFiles, dfc, filter)
+		return dfc.JSON()
+	},
+	"whole-dupes": func(t float64, filter []string) interface{} {
+		dfc := &DuplicateWholeDiskCollection{}
+		Aggregate(AggregateDuplicateWholeDisks, dfc, filter)
+		return dfc.JSON()
+	},
+	"as-dupes": func(t float64, filter []string) interface{} {
+		dfc := &DuplicateActiveSectorDiskCollection{}
+		Aggregate(AggregateDuplicateActiveSectorDisks, dfc, filter)
+		return dfc.JSON()
+	},
+	"cat-dupes": func(t float64, filter []string) interface{} {
+		return jsonFileOverlaps(CollectFilesOverlapsAboveThreshold(1.0, filter))
+	},
+	"all-file-partial": func(t float64, filter []string) interface{} {
+		return jsonFileOverlaps(CollectFilesOverlapsAboveThreshold(t, filter))
+	},
+	"all-sector-partial": func(t float64, filter []string) interface{} {
+		return jsonSectorOverlaps(CollectSectorOverlapsAboveThreshold(t, filter, GetAllDiskSectors))
+	},
+	"active-sector-partial": func(t float64, filter []string) interface{} {
+		return jsonSectorOverlaps(CollectSectorOverlapsAboveThreshold(t, filter, GetActiveDiskSectors))
+	},
+	"all-file-subset": func(t float64, filter []string) interface{} {
+		return jsonFileOverlaps(CollectFileSubsets(filter))
+	},
+	"active-sector-subset": func(t float64, filter []string) interface{} {
+		return jsonSectorOverlaps(CollectSectorSubsets(filter, GetActiveDiskSectors))
+	},
+	"all-sector-subset": func(t float64, filter []string) interface{} {
+		return jsonSectorOverlaps(CollectSectorSubsets(filter, GetAllDiskSectors))
+	},
+	"lineage": func(t float64, filter []string) interface{} {
+		return jsonLineage(CollectLineage(t, filter))
+	},
+}
+
+func (a *apiServer) report(w http.ResponseWriter, r *http.Request) {
+
+	name := r.PathValue("name")
+	f, ok := apiReports[name]
+	if !ok {
+		apiError(w, http.StatusNotFound, "No such report")
+		return
+	}
+
+	t, err := apiSimilarity(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	apiReply(w, name, f(t, apiFilter(r)))
+}
+
+func (a *apiServer) ingest(w http.ResponseWriter, r *http.Request) {
+
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		apiError(w, http.StatusBadRequest, "path is needed")
+		return
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if info.IsDir() || isArchive(p) {
+		walk(p)
+	} else {
+		indisk = make(map[disk.DiskFormat]int)
+		outdisk = make(map[disk.DiskFormat]int)
+		if _, err := analyze(0, p); err != nil {
+			apiError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+
+	apiReply(w, "ingest", map[string]string{"path": p})
+}
+
+func (a *apiServer) readOnly(w http.ResponseWriter, r *http.Request) {
+	apiError(w, http.StatusForbidden, "Server is read only, start it with -serve-write to allow changes")
+}
+
+// newAPIHandler routes the API, with ingest refused unless write is set
+func newAPIHandler(write bool) http.Handler {
+
+	a := &apiServer{end: -1}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/disks", a.handle(false, a.listDisks))
+	mux.HandleFunc("GET /api/disks/{id}", a.handle(false, a.getDisk))
+	mux.HandleFunc("GET /api/disks/{id}/files/{name...}", a.handle(false, a.getFile))
+	mux.HandleFunc("GET /api/disks/{id}/similar", a.handle(false, a.similarDisks))
+	mux.HandleFunc("GET /api/disks/{id}/matches", a.handle(false, a.fileMatches))
+	mux.HandleFunc("GET /api/search/{type}", a.handle(false, a.search))
+	mux.HandleFunc("GET /api/reports/{name}", a.handle(false, a.report))
+	if write {
+		mux.HandleFunc("POST /api/ingest", a.handle(true, a.ingest))
+	} else {
+		mux.HandleFunc("POST /api/ingest", a.readOnly)
+	}
+
+	return mux
+}
+
+func serveAPI(addr string, write bool) error {
+
+	mode := "read only"
+	if write {
+		mode = "read/write"
+	}
+	os.Stderr.WriteString(fmt.Sprintf("Serving API on %s (%s)\n", addr, mode))
+
+	return http.ListenAndServe(addr, newAPIHandler(write))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// apiDisks stores fingerprints for a couple of disks with files
+func apiDisks(t *testing.T, dir string) []*Disk {
+
+	var out []*Disk
+	for _, name := range []string{"b.dsk", "a.dsk"} {
+		d := &Disk{
+			FullPath:     filepath.Join(dir, "library", name),
+			Filename:     name,
+			SHA256:       "sha-" + name,
+			SHA256Active: "active-" + name,
+			Files: DiskCatalog{
+				{Filename: "HELLO", Type: "Applesoft", Ext: "BAS", SHA256: "hello-" + name, Size: 5, Data: []byte("HELLO"), Text: []byte("10 PRINT \"HELLO\"")},
+				{Filename: "HGR", Type: "Binary", Ext: "BIN", SHA256: "hgr-" + name, Size: 2, LoadAddress: 0x2000},
+			},
+		}
+		if err := d.WriteToFile(*baseName + "/" + d.GetFilename()); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, d)
+	}
+
+	return out
+}
+
+// apiListedDisk is the part of a disk reply the tests look at
+type apiListedDisk struct {
+	ID      string      `json:"id"`
+	Disk    string      `json:"disk"`
+	Catalog []*jsonFile `json:"catalog"`
+}
+
+func apiGet(t *testing.T, h http.Handler, method, url string, status int, results interface{}) *httptest.ResponseRecorder {
+
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	if w.Code != status {
+		t.Fatalf("%s %s: expected status %d, got %d: %s", method, url, status, w.Code, w.Body.String())
+	}
+
+	if results != nil {
+		doc := &jsonDocument{Results: results}
+		if err := json.Unmarshal(w.Body.Bytes(), doc); err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+
+	return w
+}
+
+func TestAPIReadOnly(t *testing.T) {
+
+	dir := tempDatastore(t)
+	apiDisks(t, dir)
+
+	var reply apiErrorReply
+	w := apiGet(t, newAPIHandler(false), "POST", "/api/ingest?path="+dir, http.StatusForbidden, nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || reply.Error == "" {
+		t.Fatalf("Expected an error reply, got %s", w.Body.String())
+	}
+
+	s, _ := getStore()
+	if len(s.Keys()) != 2 {
+		t.Fatalf("Expected the datastore to be left alone, has %d disks", len(s.Keys()))
+	}
+
+}
+
+func TestAPIDisks(t *testing.T) {
+
+	dir := tempDatastore(t)
+	disks := apiDisks(t, dir)
+	h := newAPIHandler(false)
+
+	var list []apiListedDisk
+	w := apiGet(t, h, "GET", "/api/disks", http.StatusOK, &list)
+	if len(list) != 2 || list[0].Disk != disks[1].FullPath || list[1].Disk != disks[0].FullPath {
+		t.Fatalf("Expected both disks sorted by path, got %s", w.Body.String())
+	}
+	if w.Header().Get("X-Total-Count") != "2" {
+		t.Fatalf("Expected a total count of 2, got %q", w.Header().Get("X-Total-Count"))
+	}
+
+	list = nil
+	apiGet(t, h, "GET", "/api/disks?offset=1&limit=1", http.StatusOK, &list)
+	if len(list) != 1 || list[0].Disk != disks[0].FullPath {
+		t.Fatalf("Expected the second disk, got %v", list)
+	}
+	apiGet(t, h, "GET", "/api/disks?limit=-1", http.StatusBadRequest, nil)
+
+	var detail apiListedDisk
+	apiGet(t, h, "GET", "/api/disks/"+disks[1].ID(), http.StatusOK, &detail)
+	if detail.ID != disks[1].ID() || len(detail.Catalog) != 2 || detail.Catalog[0].Name != "HELLO" || detail.Catalog[1].Address != 0x2000 {
+		t.Fatalf("Expected the catalog of %s, got %+v", disks[1].FullPath, detail)
+	}
+	apiGet(t, h, "GET", "/api/disks/nosuchdisk", http.StatusNotFound, nil)
+
+}
+
+func TestAPIFiles(t *testing.T) {
+
+	dir := tempDatastore(t)
+	disks := apiDisks(t, dir)
+	h := newAPIHandler(false)
+	base := "/api/disks/" + disks[0].ID() + "/files/"
+
+	if w := apiGet(t, h, "GET", base+"hello", http.StatusOK, nil); w.Body.String() != "HELLO" {
+		t.Fatalf("Expected the file data, got %q", w.Body.String())
+	}
+	if w := apiGet(t, h, "GET", base+"HELLO?format=text", http.StatusOK, nil); w.Body.String() != "10 PRINT \"HELLO\"\n" {
+		t.Fatalf("Expected the listing, got %q", w.Body.String())
+	}
+
+	// HGR was stored without its data or any text
+	apiGet(t, h, "GET", base+"HGR", http.StatusNotFound, nil)
+	apiGet(t, h, "GET", base+"HGR?format=text", http.StatusNotFound, nil)
+	apiGet(t, h, "GET", base+"HELLO?format=pdf", http.StatusBadRequest, nil)
+	apiGet(t, h, "GET", base+"MISSING", http.StatusNotFound, nil)
+
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"io/ioutil"
 	"runtime/debug"
@@ -60,6 +59,7 @@ func smartSplit(line string) (string, []string) {
 	var out []string
 
 	var inqq bool
+	var inword bool // in quotes that started part way through a word
 	var lastEscape bool
 	var chunk string
 
@@ -72,8 +72,28 @@ func smartSplit(line string) (string, []string) {
 
 	for _, ch := range line {
 		switch {
+		case inword:
+			// kept as typed for the command to unquote, eg. name:~"^HGR"
+			chunk += string(ch)
+			if ch == '"' && !lastEscape {
+				inword = false
+			}
+			lastEscape = ch == '\\' && !lastEscape
+		case inqq && lastEscape:
+			// \" and \\ inside quotes, other backslashes are left alone
+			if ch != '"' && ch != '\\' {
+				chunk += "\\"
+			}
+			chunk += string(ch)
+			lastEscape = false
+		case inqq && ch == '\\':
+			lastEscape = true
+		case ch == '"' && !inqq && chunk != "":
+			chunk += string(ch)
+			inword = true
 		case ch == '"':
 			inqq = !inqq
+			lastEscape = false
 			add()
 		case ch == ' ':
 			if inqq || lastEscape {
@@ -252,14 +272,15 @@ func init() {
 			Name:        "mount",
 			Description: "Mount a disk image",
 			MinArgs:     1,
-			MaxArgs:     1,
+			MaxArgs:     5,
 			Code:        shellMount,
 			NeedsMount:  false,
 			Context:     sccLocal,
 			Text: []string{
-				"mount <diskfile>",
+				"mount [-fs dos|prodos|pascal|rdos] [-order do|po] <diskfile>",
 				"",
-				"Mounts disk and switches to the new slot",
+				"Mounts disk and switches to the new slot.  -fs and -order override",
+				"the detected filesystem and sector order (see identify).",
 			},
 		},
 		"setvolume": &shellCommand{
@@ -355,6 +376,25 @@ func init() {
 			NeedsMount:  false,
 			Context:     sccNone,
 		},
+		"patch": &shellCommand{
+			Name:        "patch",
+			Description: "Create or apply an IPS or BPS patch between disks",
+			MinArgs:     3,
+			MaxArgs:     4,
+			Code:        shellPatch,
+			NeedsMount:  false,
+			Context:     sccLocal,
+			Text: []string{
+				"patch create <source disk> <target disk> <patch.ips|patch.bps>",
+				"patch apply <patch> [<base disk>] <new disk>",
+				"",
+				"Patches are made between the disks' sectors (or blocks) in logical",
+				"order, so any image format of the source will do.  apply checks the",
+				"base disk's canonical SHA256 before patching and the result after.",
+				"Without a base disk, the disk the patch was made from is used, or one",
+				"in the datastore with the same checksum.  (-patch at command line)",
+			},
+		},
 		"prefix": &shellCommand{
 			Name:        "prefix",
 			Description: "Change volume path",
@@ -523,6 +563,23 @@ func init() {
 				"Select slot as default for commands",
 			},
 		},
+		"diff": &shellCommand{
+			Name:        "diff",
+			Description: "Compare two mounted disks",
+			MinArgs:     2,
+			MaxArgs:     2,
+			Code:        shellDiff,
+			NeedsMount:  false,
+			Context:     sccNone,
+			Text: []string{
+				"diff <slot> <slot>",
+				"",
+				"Lists the files only on each disk and the files with the same name but",
+				"different content, with a unified diff of BASIC and text listings or a",
+				"hex diff of other files, then maps the sectors (or blocks) that differ.",
+				"Same as -diff <disk> <disk> at the command line.",
+			},
+		},
 		"copy": &shellCommand{
 			Name:        "copy",
 			Description: "Copy files from one volume to another",
@@ -569,6 +626,60 @@ func init() {
 				"Rename a file on a disk.",
 			},
 		},
+		"sys": &shellCommand{
+			Name:        "sys",
+			Description: "Install DOS 3.3 or ProDOS boot code on the disk",
+			MinArgs:     0,
+			MaxArgs:     3,
+			Code:        shellSys,
+			NeedsMount:  true,
+			Context:     sccLocal,
+			Text: []string{
+				"sys [<reference disk|DOS image>] [greeting=<name>] [system=<name|file>]",
+				"",
+				"DOS 3.3: writes tracks 0-2 from a reference disk or a raw 12288 byte",
+				"DOS image (default: this disk's own DOS) and sets the greeting program.",
+				"File sectors on tracks 0-2 are moved elsewhere first.",
+				"",
+				"ProDOS: writes boot blocks 0-1 and copies PRODOS from the reference",
+				"disk, plus the .SYSTEM startup program named by system= (from the",
+				"reference disk or a local file, default: the first one found).",
+			},
+		},
+		"identify": &shellCommand{
+			Name:        "identify",
+			Description: "Score possible filesystems and sector orders",
+			MinArgs:     0,
+			MaxArgs:     1,
+			Code:        shellIdentify,
+			NeedsMount:  false,
+			Context:     sccLocal,
+			Text: []string{
+				"identify [<diskfile>]",
+				"",
+				"Tries every filesystem and sector order that fits the image (or the",
+				"current disk) and explains how each one scored on catalog sanity,",
+				"bitmap consistency and boot code.  Use mount -fs/-order to pick one.",
+			},
+		},
+		"convert": &shellCommand{
+			Name:        "convert",
+			Description: "Export disk as a nibble (.nib) or WOZ image",
+			MinArgs:     1,
+			MaxArgs:     -1,
+			Code:        shellConvert,
+			NeedsMount:  true,
+			Context:     sccLocal,
+			Text: []string{
+				"convert <target file> [volume=<n>] [timing=<n>] [gap1=<n>] [gap2=<n>] [gap3=<n>]",
+				"",
+				"Write current disk as a .nib or WOZ 2.0 (.woz) image, chosen by extension.",
+				"Volume defaults to the DOS volume in the VTOC (or 254). Timing is the WOZ",
+				"optimal bit timing in 125ns units (32 = 4us). Gaps are sync nibble counts;",
+				"each .nib track must still fit in 6656 nibbles.",
+				"Only 35 track, 13 or 16 sector images can be converted.",
+			},
+		},
 		"report": &shellCommand{
 			Name:        "report",
 			Description: "Run a report",
@@ -583,6 +694,7 @@ func init() {
 				"Reports:",
 				"as-dupes       Active sector dupes report (-as-dupes at command line)",
 				"file-dupes     File dupes report (-file-dupes at command line)",
+				"lineage        Disk lineage report (-lineage at command line)",
 				"whole-dupes    Whole disk dupes report (-whole-dupes at command line)",
 			},
 		},
@@ -601,6 +713,45 @@ func init() {
 				"filename       Search by filename",
 				"text           Search for files containing tex",
 				"hash           Search for files with hash",
+				"hex            Search file data and sectors for bytes, eg. search hex \"A9 ?? 8D 00 C0\"",
+				"os             Search for disks by boot code, DOS variant or ProDOS version",
+				"query          Search with a query, eg. search query \"type:BIN size>8000\"",
+				"               or search query name:~\"^HGR\" (\\\" for a quote inside quotes)",
+			},
+		},
+		"similar": &shellCommand{
+			Name:        "similar",
+			Description: "List the disks most like the current disk",
+			MinArgs:     0,
+			MaxArgs:     999,
+			Code:        shellSimilar,
+			NeedsMount:  true,
+			Context:     sccLocal,
+			Text: []string{
+				"similar [<n>] [<path>]",
+				"",
+				"Ranks the disks in the datastore by how many files and how many",
+				"active sectors they share with the current disk, and lists the top",
+				"n (default 10) of each with the files matched (==), missing (--) and",
+				"extra (++).  Same as -nearest <n> -query <disk> at the command line.",
+				"The disk is ingested first if it is new.",
+			},
+		},
+		"dedupe": &shellCommand{
+			Name:        "dedupe",
+			Description: "Replace whole disk dupes with links to one copy",
+			MinArgs:     0,
+			MaxArgs:     999,
+			Code:        shellDedupe,
+			NeedsMount:  false,
+			Context:     sccDiskFile,
+			Text: []string{
+				"dedupe [hard|symlink] [keep=<policy>] [dry-run] [<path>]",
+				"",
+				"Replaces every copy in each group of whole disk dupes, except the one",
+				"kept, with a hard link (default) or symbolic link to it, after checking",
+				"the files are identical byte for byte (-whole-dupes -dedupe at command",
+				"line).  keep= chooses the copy to keep as for quarantine.",
 			},
 		},
 		"quarantine": &shellCommand{
@@ -612,12 +763,18 @@ func init() {
 			NeedsMount:  false,
 			Context:     sccDiskFile,
 			Text: []string{
-				"quarantine <name> [<path>]",
+				"quarantine <name> [keep=<policy>] [dry-run] [<path>]",
+				"quarantine restore <journal> [dry-run]",
 				"",
 				"Scans:",
 				"as-dupes       Active sector dupes report (-as-dupes at command line)",
-				"file-dupes     File dupes report (-file-dupes at command line)",
 				"whole-dupes    Whole disk dupes report (-whole-dupes at command line)",
+				"file-subsets   Disks whose files are all on another (-all-file-subset)",
+				"",
+				"Without keep= (or -keep) asks which disk to keep in each group.  Policies",
+				"are comma separated rules: prefix:<path>, shortest, longest, oldest,",
+				"newest, ext:<ext>, complete.  Moves are journalled in the quarantine",
+				"folder; restore <journal> puts them back.",
 			},
 		},
 	}
@@ -733,23 +890,56 @@ func shellPath(args []string) int {
 }
 
 func shellMount(args []string) int {
-	if len(args) != 1 {
+
+	var fs, order, filename string
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "-fs", "-order":
+			if i+1 >= len(args) {
+				os.Stderr.WriteString(args[i] + " expects a value\n")
+				return -1
+			}
+			if strings.ToLower(args[i]) == "-fs" {
+				fs = args[i+1]
+			} else {
+				order = args[i+1]
+			}
+			i++
+		default:
+			filename = args[i]
+		}
+	}
+
+	if filename == "" {
 		fmt.Println("mount expects a diskfile")
 		return -1
 	}
 
-	dsk, err := disk.NewDSKWrapper(defNibbler, args[0])
+	dsk, err := loadDisk(filename)
 	if err != nil {
 		os.Stderr.WriteString("Error:" + err.Error() + "\n")
 		return -1
 	}
 
+	if fs != "" || order != "" {
+		err = dsk.ForceInterpretation(fs, order)
+		if err != nil {
+			os.Stderr.WriteString("Error:" + err.Error() + "\n")
+			return -1
+		}
+	}
+
 	slotid, err := mountDsk(dsk)
 	if err != nil {
 		os.Stderr.WriteString("Error:" + err.Error() + "\n")
 		return -1
 	}
 
+	if fs != "" || order != "" {
+		// remounting an already mounted disk should pick up the override
+		commandVolumes[slotid] = dsk
+	}
+
 	commandTarget = slotid
 	os.Stderr.WriteString(fmt.Sprintf("mount disk in slot %d\n", slotid))
 
@@ -815,6 +1005,19 @@ func shellInfo(args []string) int {
 	fmt.Printf("Sector Order: %s\n", commandVolumes[commandTarget].Layout.String())
 	fmt.Printf("Size        : %d bytes\n", len(commandVolumes[commandTarget].Data))
 
+	bf := commandVolumes[commandTarget].BootFingerprint()
+	fmt.Printf("Boot sector : %s\n", bf.BootSHA256)
+	if bf.BootCode != "" {
+		fmt.Printf("Boot code   : %s\n", bf.BootCode)
+	}
+	if bf.DOSImage != "" {
+		fmt.Printf("DOS image   : %s (%s)\n", bf.DOSImage, bf.DOSImageSHA256)
+	}
+	if bf.ProDOSVersion != "" {
+		fmt.Printf("ProDOS      : %s\n", bf.ProDOSVersion)
+	}
+	fmt.Printf("Bootable    : %v\n", bf.Bootable)
+
 	return 0
 }
 
@@ -1018,6 +1221,16 @@ func backupFile(path string) error {
 
 func saveDisk(dsk *disk.DSKWrapper, path string) error {
 
+	if isArchivePath(path) {
+		os.Stderr.WriteString("Cannot write back into an archive: " + path + "\n")
+		return errors.New("Disk is inside an archive")
+	}
+
+	if dsk.SourceFormat != "" {
+		os.Stderr.WriteString("Cannot write back to a " + dsk.SourceFormat + " image, use convert to save a copy: " + path + "\n")
+		return errors.New("Disk was decoded from a nibble image")
+	}
+
 	backupFile(path)
 
 	f, e := os.Create(path)
@@ -1291,7 +1504,14 @@ func shellIngest(args []string) int {
 		loggy.Get(0).Errorf("Error stating file: %s", err.Error())
 		os.Exit(2)
 	}
-	if info.IsDir() {
+	dl, err := lockDatastore(true)
+	if err != nil {
+		os.Stderr.WriteString("Unable to lock datastore: " + err.Error() + "\n")
+		return -1
+	}
+	defer dl.Unlock()
+
+	if info.IsDir() || isArchive(dskName) {
 		walk(dskName)
 	} else {
 		indisk = make(map[disk.DiskFormat]int)
@@ -1618,246 +1838,451 @@ func shellRename(args []string) int {
 	return 0
 }
 
-func globDisk(slotid int, pattern string) ([]*DiskFile, error) {
+func prodosRootFiles(dsk *disk.DSKWrapper) map[string]disk.ProDOSFileDescriptor {
 
-	var files []*DiskFile
+	out := make(map[string]disk.ProDOSFileDescriptor)
 
-	if commandVolumes[slotid] == nil {
-		return []*DiskFile(nil), fmt.Errorf("Invalid slotid %d", slotid)
+	_, files, err := dsk.PRODOSGetCatalog(2, "*")
+	if err != nil {
+		return out
 	}
 
-	fullpath, _ := filepath.Abs(commandVolumes[slotid].Filename)
-
-	dsk, err := analyze(0, fullpath)
-	if err != nil {
-		return []*DiskFile(nil), fmt.Errorf("Problem reading volume")
+	for _, fd := range files {
+		out[strings.ToUpper(fd.NameUnadorned())] = fd
 	}
 
-	r := strings.Replace(pattern, ".", "[.]", -1)
-	r = strings.Replace(r, "?", ".", -1)
-	r = strings.Replace(r, "*", ".*", -1)
-	r = "(?i)^" + r + "$"
+	return out
+}
 
-	rePattern := regexp.MustCompile(r)
+func shellSys(args []string) int {
 
-	for _, f := range dsk.Files {
-		if rePattern.MatchString(f.Filename) {
-			files = append(files, f)
+	dsk := commandVolumes[commandTarget]
+	fullpath, _ := filepath.Abs(dsk.Filename)
+
+	var source, greeting, system string
+	for _, a := range args {
+		parts := strings.SplitN(a, "=", 2)
+		if len(parts) == 1 {
+			source = a
+			continue
+		}
+		switch strings.ToLower(parts[0]) {
+		case "greeting":
+			greeting = parts[1]
+		case "system":
+			system = parts[1]
+		default:
+			os.Stderr.WriteString("Unknown option: " + parts[0] + "\n")
+			return -1
 		}
 	}
 
-	return files, nil
+	var ref *disk.DSKWrapper
+	var image []byte
+	if source != "" {
+		data, err := ioutil.ReadFile(source)
+		if err != nil {
+			os.Stderr.WriteString("Error:" + err.Error() + "\n")
+			return -1
+		}
+		if len(data) == disk.DOS_IMAGE_BYTES {
+			image = data
+		} else {
+			ref, err = disk.NewDSKWrapperBin(defNibbler, data, source)
+			if err != nil {
+				os.Stderr.WriteString("Error:" + err.Error() + "\n")
+				return -1
+			}
+		}
+	}
 
-}
+	switch {
+	case dsk.Format.ID == disk.DF_DOS_SECTORS_16:
 
-func shellReport(args []string) int {
+		var err error
+		switch {
+		case image != nil:
+		case ref != nil:
+			if ref.Format.ID != disk.DF_DOS_SECTORS_16 {
+				os.Stderr.WriteString("Reference disk is not a DOS 3.3 disk\n")
+				return -1
+			}
+			image, err = ref.AppleDOSReadDOSImage()
+		default:
+			image, err = dsk.AppleDOSReadDOSImage()
+		}
+		if err != nil {
+			os.Stderr.WriteString("Error:" + err.Error() + "\n")
+			return -1
+		}
+		if image[0] != 0x01 {
+			os.Stderr.WriteString("Source does not contain a DOS 3.3 boot image\n")
+			return -1
+		}
 
-	switch args[0] {
-	case "as-dupes":
-		activeDupeReport(args[1:])
-	case "file-dupes":
-		fileDupeReport(args[1:])
-	case "whole-dupes":
-		wholeDupeReport(args[1:])
-	}
+		moved, err := dsk.AppleDOSInstallDOS(image, greeting)
+		if err != nil {
+			os.Stderr.WriteString("Error:" + err.Error() + "\n")
+			return -1
+		}
+		if moved > 0 {
+			fmt.Printf("Moved %d file sectors off tracks 0-2\n", moved)
+		}
 
-	return -1
+		if greeting == "" {
+			greeting = disk.DOSImageGreeting(image)
+		}
+		fmt.Printf("Installed DOS 3.3, greeting program is %s\n", strings.ToUpper(greeting))
+		if _, err := dsk.AppleDOSNamedCatalogEntry(greeting); err != nil {
+			os.Stderr.WriteString("WARNING: greeting program " + strings.ToUpper(greeting) + " is not on this disk\n")
+		}
 
-}
+	case formatIn(dsk.Format.ID, []disk.DiskFormatID{disk.DF_PRODOS, disk.DF_PRODOS_800KB, disk.DF_PRODOS_400KB, disk.DF_PRODOS_CUSTOM}):
 
-func shellSearch(args []string) int {
+		if ref == nil || !formatIn(ref.Format.ID, []disk.DiskFormatID{disk.DF_PRODOS, disk.DF_PRODOS_800KB, disk.DF_PRODOS_400KB, disk.DF_PRODOS_CUSTOM}) {
+			os.Stderr.WriteString("sys needs a bootable ProDOS reference disk\n")
+			return -1
+		}
+		if greeting != "" {
+			os.Stderr.WriteString("greeting= only applies to DOS 3.3 disks\n")
+			return -1
+		}
 
-	switch args[0] {
-	case "text":
-		//activeDupeReport(args[1:])
-		searchForTEXT(args[1], args[2:])
-	case "filename":
-		//fileDupeReport(args[1:])
-		searchForFilename(args[1], args[2:])
-	case "hash":
-		searchForSHA256(args[1], args[2:])
+		boot, err := ref.PRODOSReadBootBlocks()
+		if err != nil {
+			os.Stderr.WriteString("Error:" + err.Error() + "\n")
+			return -1
+		}
+
+		files := prodosRootFiles(ref)
+		fd, ok := files["PRODOS"]
+		if !ok {
+			os.Stderr.WriteString("Reference disk has no PRODOS file\n")
+			return -1
+		}
+		_, _, prodos, err := ref.PRODOSReadFileRaw(fd)
+		if err != nil {
+			os.Stderr.WriteString("Error:" + err.Error() + "\n")
+			return -1
+		}
+
+		var sysdata []byte
+		if system == "" {
+			names := make([]string, 0)
+			for name := range files {
+				if strings.HasSuffix(name, ".SYSTEM") {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			if len(names) > 0 {
+				system = names[0]
+			}
+		}
+		if system != "" {
+			if fd, ok := files[strings.ToUpper(system)]; ok {
+				_, _, sysdata, err = ref.PRODOSReadFileRaw(fd)
+			} else {
+				sysdata, err = ioutil.ReadFile(system)
+				system = filepath.Base(system)
+			}
+			if err != nil {
+				os.Stderr.WriteString("Error:" + err.Error() + "\n")
+				return -1
+			}
+		}
+
+		err = dsk.PRODOSInstallSystem(boot, prodos, strings.ToUpper(system), sysdata)
+		if err != nil {
+			os.Stderr.WriteString("Error:" + err.Error() + "\n")
+			return -1
+		}
+
+		if system != "" {
+			fmt.Printf("Installed ProDOS boot blocks, PRODOS and %s\n", strings.ToUpper(system))
+		} else {
+			fmt.Println("Installed ProDOS boot blocks and PRODOS (no .SYSTEM program)")
+		}
+
+	default:
+		os.Stderr.WriteString("sys not supported on " + dsk.Format.String() + "\n")
+		return -1
 	}
 
-	return -1
+	saveDisk(dsk, fullpath)
 
+	return 0
 }
 
-func shellQuarantine(args []string) int {
+func shellIdentify(args []string) int {
 
-	switch args[0] {
-	case "as-dupes":
-		quarantineActiveDisks(args[1:])
-	case "whole-dupes":
-		quarantineWholeDisks(args[1:])
+	var dsk *disk.DSKWrapper
+	if len(args) > 0 {
+		var err error
+		dsk, err = loadDisk(args[0])
+		if err != nil {
+			os.Stderr.WriteString("Error:" + err.Error() + "\n")
+			return -1
+		}
+	} else if commandTarget != -1 && commandVolumes[commandTarget] != nil {
+		dsk = commandVolumes[commandTarget]
+	} else {
+		os.Stderr.WriteString("identify needs a diskfile or a mounted disk\n")
+		return -1
 	}
 
-	return -1
+	fs, order := dsk.Interpretation()
+	fmt.Printf("Disk path   : %s\n", dsk.Filename)
+	fmt.Printf("Detected as : %s (%s order)\n", dsk.Format.String(), strings.ToUpper(order))
 
+	candidates := dsk.IdentifyCandidates()
+	if len(candidates) == 0 {
+		fmt.Println("No alternative interpretations for an image of this size")
+		return 0
+	}
+
+	for i, c := range candidates {
+		fmt.Println()
+		marker := ""
+		if c.FS == fs && c.Order == order {
+			marker = "  <- current"
+		}
+		fmt.Printf("%d. %-40s score %4d%s\n", i+1, c.String(), c.Score, marker)
+		for _, r := range c.Reasons {
+			fmt.Printf("      %s\n", r)
+		}
+	}
+
+	best := candidates[0]
+	if best.FS != fs || best.Order != order {
+		fmt.Println()
+		fmt.Printf("Best match differs from detection, try: mount -fs %s -order %s %s\n", best.FS, best.Order, dsk.Filename)
+	}
+
+	return 0
 }
 
-func moveFile(source, dest string) error {
+func shellConvert(args []string) int {
 
-	source = strings.Replace(source, "\\", "/", -1)
-	dest = strings.Replace(dest, "\\", "/", -1)
+	dsk := commandVolumes[commandTarget]
+	target := args[0]
 
-	fmt.Printf("Reading source file: %s\n", source)
-	data, err := ioutil.ReadFile(source)
-	if err != nil {
-		return err
+	opts := dsk.NibbleOptions()
+
+	for _, a := range args[1:] {
+		parts := strings.SplitN(strings.ToLower(a), "=", 2)
+		if len(parts) != 2 {
+			os.Stderr.WriteString("Invalid option: " + a + "\n")
+			return -1
+		}
+		tmp, err := strconv.ParseInt(parts[1], 0, 32)
+		if err != nil || tmp < 0 {
+			os.Stderr.WriteString("Invalid value for " + parts[0] + ": " + parts[1] + "\n")
+			return -1
+		}
+		switch parts[0] {
+		case "volume":
+			if tmp < 1 || tmp > 255 {
+				os.Stderr.WriteString("Volume must be between 1 and 255\n")
+				return -1
+			}
+			opts.Volume = int(tmp)
+		case "timing":
+			opts.BitTiming = int(tmp)
+		case "gap1":
+			opts.Gap1 = int(tmp)
+		case "gap2":
+			opts.Gap2 = int(tmp)
+		case "gap3":
+			opts.Gap3 = int(tmp)
+		default:
+			os.Stderr.WriteString("Unknown option: " + parts[0] + "\n")
+			return -1
+		}
 	}
 
-	// make sure dest dir actually exists
-	os.MkdirAll(filepath.Dir(dest), 0755)
+	var data []byte
+	var err error
 
-	fmt.Printf("Creating dest file: %s\n", dest)
-	f, err := os.Create(dest)
-	if err != nil {
-		return err
+	switch strings.ToLower(filepath.Ext(target)) {
+	case ".nib":
+		data, err = dsk.NibblizeWithOptions(opts)
+	case ".woz":
+		data, err = dsk.WOZ(opts)
+	default:
+		os.Stderr.WriteString("Unsupported target format (use .nib or .woz)\n")
+		return -1
 	}
-	f.Write(data)
-	f.Close()
 
-	err = os.Remove(source)
 	if err != nil {
-		return err
+		os.Stderr.WriteString("Conversion failed: " + err.Error() + "\n")
+		return -1
 	}
 
-	if _, err := os.Stat(source); err == nil {
-		fmt.Println(source + " not deleted!!")
-		return errors.New(source + " not deleted!!")
+	err = ioutil.WriteFile(target, data, 0644)
+	if err != nil {
+		os.Stderr.WriteString("Failed to write " + target + ": " + err.Error() + "\n")
+		return -1
 	}
 
-	return nil
+	fmt.Printf("Wrote %s (%d bytes, volume %d)\n", target, len(data), opts.Volume)
+
+	return 0
 }
 
-func quarantineActiveDisks(filter []string) {
-	dfc := &DuplicateActiveSectorDiskCollection{}
-	Aggregate(AggregateDuplicateActiveSectorDisks, dfc, filter)
+func globDisk(slotid int, pattern string) ([]*DiskFile, error) {
 
-	reader := bufio.NewReader(os.Stdin)
+	var files []*DiskFile
 
-	for _, list := range dfc.data {
+	if commandVolumes[slotid] == nil {
+		return []*DiskFile(nil), fmt.Errorf("Invalid slotid %d", slotid)
+	}
 
-		if len(list) == 1 {
-			continue
-		}
+	fullpath, _ := filepath.Abs(commandVolumes[slotid].Filename)
 
-	prompt:
+	dsk, err := analyze(0, fullpath)
+	if err != nil {
+		return []*DiskFile(nil), fmt.Errorf("Problem reading volume")
+	}
 
-		fmt.Println("Which one to keep?")
-		fmt.Println("(0) Skip this...")
-		for i, v := range list {
-			fmt.Printf("(%d) %s\n", i+1, v.Fullpath)
-		}
-		fmt.Println()
-		fmt.Printf("Option (0-%d, q): ", len(list))
-		text, _ := reader.ReadString('\n')
+	r := strings.Replace(pattern, ".", "[.]", -1)
+	r = strings.Replace(r, "?", ".", -1)
+	r = strings.Replace(r, "*", ".*", -1)
+	r = "(?i)^" + r + "$"
 
-		text = strings.ToLower(strings.Trim(text, "\r\n"))
+	rePattern := regexp.MustCompile(r)
 
-		if text == "q" {
-			return
+	for _, f := range dsk.Files {
+		if rePattern.MatchString(f.Filename) {
+			files = append(files, f)
 		}
+	}
 
-		if text == "0" {
-			continue
-		}
+	return files, nil
 
-		tmp, _ := strconv.ParseInt(text, 10, 32)
-		idx := int(tmp) - 1
+}
 
-		if idx < 0 || idx > len(list) {
-			goto prompt
-		}
+func shellReport(args []string) int {
 
-		for i, v := range list {
-			if i == idx {
-				continue
-			}
-			path := v.Fullpath
-			path = strings.Replace(path, ":", "", -1)
-			path = strings.Replace(path, "\\", "/", -1)
+	switch args[0] {
+	case "as-dupes":
+		withDatastoreLock(false, func() { activeDupeReport(args[1:]) })
+	case "file-dupes":
+		withDatastoreLock(false, func() { fileDupeReport(args[1:]) })
+	case "whole-dupes":
+		withDatastoreLock(false, func() { wholeDupeReport(args[1:]) })
+	case "lineage":
+		withDatastoreLock(false, func() { lineageReport(*similarity, args[1:]) })
+	}
 
-			bpath := binpath() + "/quarantine/" + path
-			err := moveFile(v.Fullpath, bpath)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
+	return -1
 
-			err = moveFile(v.fingerprint, v.fingerprint+".q")
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
+}
 
-		}
+func shellSearch(args []string) int {
 
+	switch args[0] {
+	case "text":
+		//activeDupeReport(args[1:])
+		withDatastoreLock(false, func() { searchForTEXT(args[1], args[2:]) })
+	case "filename":
+		//fileDupeReport(args[1:])
+		withDatastoreLock(false, func() { searchForFilename(args[1], args[2:]) })
+	case "hash":
+		withDatastoreLock(false, func() { searchForSHA256(args[1], args[2:]) })
+	case "hex":
+		withDatastoreLock(false, func() { searchForHex(args[1], args[2:]) })
+	case "os":
+		withDatastoreLock(false, func() { searchForOS(args[1], args[2:]) })
+	case "query":
+		withDatastoreLock(false, func() { searchForQuery(args[1], args[2:]) })
 	}
-}
 
-func quarantineWholeDisks(filter []string) {
-	dfc := &DuplicateWholeDiskCollection{}
-	Aggregate(AggregateDuplicateWholeDisks, dfc, filter)
+	return -1
 
-	reader := bufio.NewReader(os.Stdin)
+}
 
-	for _, list := range dfc.data {
+func shellSimilar(args []string) int {
 
-		if len(list) == 1 {
-			continue
+	count := defaultNearest
+	if len(args) > 0 {
+		if n, err := strconv.Atoi(args[0]); err == nil {
+			if n <= 0 {
+				os.Stderr.WriteString("Count must be at least 1\n")
+				return -1
+			}
+			count = n
+			args = args[1:]
 		}
+	}
 
-	wprompt:
+	r := -1
+	withDatastoreLock(false, func() { r = queryNearest(commandVolumes[commandTarget].Filename, count, args) })
 
-		fmt.Println("Which one to keep?")
-		fmt.Println("(0) Skip this...")
-		for i, v := range list {
-			fmt.Printf("(%d) %s\n", i+1, v.Fullpath)
-		}
-		fmt.Println()
-		fmt.Printf("Option (0-%d, q): ", len(list))
-		text, _ := reader.ReadString('\n')
-
-		text = strings.ToLower(strings.Trim(text, "\r\n"))
+	return r
+}
 
-		if text == "q" {
-			return
-		}
+func shellDedupe(args []string) int {
 
-		if text == "0" {
-			continue
+	mode, keep, dry := DedupeHard, *keepPolicy, *dryRun
+	var filter []string
+	for _, a := range args {
+		switch {
+		case a == DedupeHard || a == DedupeSymlink:
+			mode = a
+		case strings.HasPrefix(a, "keep="):
+			keep = strings.TrimPrefix(a, "keep=")
+		case a == "dry-run":
+			dry = true
+		default:
+			filter = append(filter, a)
 		}
+	}
 
-		tmp, _ := strconv.ParseInt(text, 10, 32)
-		idx := int(tmp) - 1
-
-		if idx < 0 || idx > len(list) {
-			goto wprompt
-		}
+	r := -1
+	withDatastoreLock(true, func() { r = dedupeWholeDisks(filter, mode, keep, dry) })
 
-		for i, v := range list {
-			if i == idx {
-				continue
-			}
-			path := v.Fullpath
-			path = strings.Replace(path, ":", "", -1)
-			path = strings.Replace(path, "\\", "/", -1)
+	return r
+}
 
-			bpath := binpath() + "/quarantine/" + path
-			err := moveFile(v.Fullpath, bpath)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
+func shellQuarantine(args []string) int {
 
-			err = moveFile(v.fingerprint, v.fingerprint+".q")
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
+	if args[0] == "restore" {
+		if len(args) < 2 {
+			os.Stderr.WriteString("quarantine restore needs a journal\n")
+			return -1
+		}
+		dry := len(args) > 2 && args[2] == "dry-run"
+		r := -1
+		withDatastoreLock(true, func() { r = restoreQuarantine(args[1], dry) })
+		return r
+	}
 
+	keep, dry := *keepPolicy, *dryRun
+	var filter []string
+	for _, a := range args[1:] {
+		switch {
+		case strings.HasPrefix(a, "keep="):
+			keep = strings.TrimPrefix(a, "keep=")
+		case a == "dry-run":
+			dry = true
+		default:
+			filter = append(filter, a)
 		}
+	}
 
+	r := -1
+	switch args[0] {
+	case "as-dupes":
+		withDatastoreLock(true, func() { r = quarantineDisks(QuarantineActiveDupes, filter, keep, dry) })
+	case "whole-dupes":
+		withDatastoreLock(true, func() { r = quarantineDisks(QuarantineWholeDupes, filter, keep, dry) })
+	case "file-subsets":
+		withDatastoreLock(true, func() { r = quarantineDisks(QuarantineFileSubsets, filter, keep, dry) })
+	default:
+		os.Stderr.WriteString("Unknown scan: " + args[0] + "\n")
 	}
+
+	return r
+
 }
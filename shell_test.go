@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSmartSplit(t *testing.T) {
+
+	tests := []struct {
+		line string
+		verb string
+		args []string
+	}{
+		{"", "", []string{}},
+		{"cat", "cat", []string{}},
+		{"mount  disk.dsk", "mount", []string{"disk.dsk"}},
+		{`mount "My Disks/game.dsk"`, "mount", []string{"My Disks/game.dsk"}},
+		{`mount My\ Disks/game.dsk`, "mount", []string{"My Disks/game.dsk"}},
+		{`search query "type:BIN size>8000"`, "search", []string{"query", "type:BIN size>8000"}},
+		{`search query name:~"^HGR"`, "search", []string{"query", `name:~"^HGR"`}},
+		{`search query name:"HELLO WORLD" /games`, "search", []string{"query", `name:"HELLO WORLD"`, "/games"}},
+		{`search query text:"say \"hi\""`, "search", []string{"query", `text:"say \"hi\""`}},
+		{`search query "type:BIN name:~\"^HGR\""`, "search", []string{"query", `type:BIN name:~"^HGR"`}},
+		{`search text "C:\games \\ here"`, "search", []string{"text", `C:\games \ here`}},
+	}
+
+	for _, test := range tests {
+		verb, args := smartSplit(test.line)
+		if args == nil {
+			args = []string{}
+		}
+		if verb != test.verb || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: expected %q %q, got %q %q", test.line, test.verb, test.args, verb, args)
+		}
+	}
+
+}
@@ -0,0 +1,839 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+	Fingerprint store...
+
+	All fingerprints live in one file, diskm8.db, at the top of the
+	datastore.  Records are keyed by the path the old per-disk .fgp file
+	would have had, so the rest of the code still deals in fingerprint
+	names.
+
+	  header   "DSKM8DB" version, offset of the latest index record (8 bytes)
+	  records  0xD8, op, payload length (4), crc32 of payload (4), payload
+
+	Ops are put (key and gob encoded Disk), delete (key) and index.  Records
+	are only ever appended; an index record holds the offset and search
+	terms of the fingerprints put or deleted since the index record before
+	it, plus how far into the file it covers.  Every so often a full index
+	is written instead, ending the chain.  Opening the store loads the
+	chain back from the latest index and replays any records written after
+	it, so a crash only loses the time to replay.
+
+	Secondary indexes (disk SHA256, active sector SHA256, file SHA256,
+	filename, format and the words in file text) are rebuilt in memory from
+	the index record.
+*/
+
+const storeFile = "diskm8.db"
+const storeVersion = 1
+const storeHeaderSize = 16
+const storeRecordHeaderSize = 10
+const storeRecordMagic = 0xd8
+
+// bumped when storeEntry changes, so older indexes are rebuilt
+const storeIndexVersion = 3
+
+// unindexed records tolerated before the index is rewritten
+const storeIndexThreshold = 256
+
+// partial index records written before a full one
+const storeIndexChain = 32
+
+const (
+	storeOpPut    = 1
+	storeOpDelete = 2
+	storeOpIndex  = 3
+)
+
+const (
+	IndexDiskSHA   = "sha256"
+	IndexActiveSHA = "active"
+	IndexFileSHA   = "file"
+	IndexFilename  = "name"
+	IndexFormat    = "format"
+	IndexWord      = "word"
+)
+
+var storeMagic = []byte{'D', 'S', 'K', 'M', '8', 'D', 'B', storeVersion}
+
+type storeEntry struct {
+	Offset    int64
+	Length    int
+	FullPath  string
+	Format    int
+	SHA256    string
+	ActiveSHA string
+	FileSHA   []string
+	Filenames []string
+	Words     []string
+}
+
+// storeIndexRecord is a full index when Previous is 0, otherwise the
+// changes since the index record at Previous.
+type storeIndexRecord struct {
+	Version  int
+	Covered  int64
+	Garbage  int64
+	Previous int64
+	Depth    int // partial records since the last full one
+	Entries  map[string]*storeEntry
+	Removed  []string
+}
+
+var errStoreIndexVersion = errors.New("index is from an older version")
+
+type storePutRecord struct {
+	Key  string
+	Disk *Disk
+}
+
+type Store struct {
+	sync.RWMutex
+	f         *os.File
+	filename  string
+	end       int64 // records up to here have been applied
+	covered   int64 // records up to here are in the last index record
+	pending   int   // records since the last index record
+	garbage   int64 // bytes taken by replaced or deleted records
+	index     int64 // offset of the last index record, 0 if none is usable
+	depth     int   // partial index records since the last full one
+	entries   map[string]*storeEntry
+	dirty     map[string]bool // keys put or deleted since the last index record
+	secondary map[string]map[string]map[string]bool
+}
+
+var store *Store
+var storeMutex sync.Mutex
+
+// getStore opens the datastore on first use
+func getStore() (*Store, error) {
+
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	if store != nil {
+		return store, nil
+	}
+
+	s, err := OpenStore(filepath.Join(*baseName, storeFile))
+	if err != nil {
+		return nil, err
+	}
+	store = s
+
+	return store, nil
+}
+
+// OpenStore opens or creates a fingerprint store
+func OpenStore(filename string) (*Store, error) {
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		f:        f,
+		filename: filename,
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		header := make([]byte, storeHeaderSize)
+		copy(header, storeMagic)
+		if _, err := f.WriteAt(header, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Store) load() error {
+
+	header := make([]byte, storeHeaderSize)
+	if _, err := s.f.ReadAt(header, 0); err != nil {
+		return errors.New("Datastore header is damaged: " + err.Error())
+	}
+	if !bytes.Equal(header[:8], storeMagic) {
+		return errors.New("Not a diskm8 datastore: " + s.filename)
+	}
+
+	s.end = storeHeaderSize
+	s.covered = storeHeaderSize
+	s.garbage = 0
+	s.pending = 0
+	s.index = 0
+	s.depth = 0
+	s.entries = make(map[string]*storeEntry)
+	s.dirty = make(map[string]bool)
+
+	if offset := int64(binary.LittleEndian.Uint64(header[8:])); offset != 0 {
+		chain, err := s.readIndexChain(offset)
+		switch {
+		case err == errStoreIndexVersion:
+			os.Stderr.WriteString("Datastore index is from an older version, rebuilding it\n")
+		case err != nil:
+			os.Stderr.WriteString("Datastore index is damaged, rebuilding it\n")
+		default:
+			// oldest first, so later changes win
+			for i := len(chain) - 1; i >= 0; i-- {
+				for key, e := range chain[i].Entries {
+					s.entries[key] = e
+				}
+				for _, key := range chain[i].Removed {
+					delete(s.entries, key)
+				}
+			}
+			s.garbage = chain[0].Garbage
+			s.end = chain[0].Covered
+			s.covered = chain[0].Covered
+			s.index = offset
+			s.depth = chain[0].Depth
+		}
+	}
+
+	s.rebuildSecondary()
+
+	return s.replay(false)
+}
+
+// readIndexChain reads the index record at offset and the ones before it
+// back to the last full index, newest first.
+func (s *Store) readIndexChain(offset int64) ([]*storeIndexRecord, error) {
+
+	var chain []*storeIndexRecord
+
+	for offset != 0 {
+
+		op, payload, _, err := s.readRecord(offset)
+		if err == nil && op != storeOpIndex {
+			err = errors.New("not an index record")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		idx := &storeIndexRecord{}
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(idx); err != nil {
+			return nil, err
+		}
+		if idx.Version != storeIndexVersion {
+			return nil, errStoreIndexVersion
+		}
+		if idx.Previous >= offset {
+			return nil, errors.New("index chain loops")
+		}
+
+		chain = append(chain, idx)
+		offset = idx.Previous
+	}
+
+	return chain, nil
+}
+
+// replay applies records written after s.end.  A damaged tail, from a
+// crash part way through a write, is cut off if repair is set.
+func (s *Store) replay(repair bool) error {
+
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	for s.end < info.Size() {
+
+		op, payload, size, err := s.readRecord(s.end)
+		if err != nil {
+			if !repair {
+				corruptFingerprints.Add(fmt.Sprintf("%s@%d", s.filename, s.end), err)
+				return nil
+			}
+			os.Stderr.WriteString(fmt.Sprintf("Datastore damaged at offset %d (%v), truncating\n", s.end, err))
+			return s.f.Truncate(s.end)
+		}
+
+		switch op {
+		case storeOpPut:
+			var rec storePutRecord
+			if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+				corruptFingerprints.Add(fmt.Sprintf("%s@%d", s.filename, s.end), err)
+				break
+			}
+			s.apply(rec.Key, newStoreEntry(s.end, size, rec.Disk))
+		case storeOpDelete:
+			s.apply(string(payload), nil)
+		case storeOpIndex:
+			s.garbage += int64(size)
+			s.end += int64(size)
+			continue
+		}
+
+		s.end += int64(size)
+		s.pending++
+	}
+
+	return nil
+}
+
+func (s *Store) readRecord(offset int64) (byte, []byte, int, error) {
+
+	header := make([]byte, storeRecordHeaderSize)
+	if _, err := s.f.ReadAt(header, offset); err != nil {
+		return 0, nil, 0, err
+	}
+	if header[0] != storeRecordMagic {
+		return 0, nil, 0, errors.New("bad record marker")
+	}
+
+	length := int(binary.LittleEndian.Uint32(header[2:]))
+	payload := make([]byte, length)
+	if _, err := s.f.ReadAt(payload, offset+storeRecordHeaderSize); err != nil {
+		return 0, nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[6:]) {
+		return 0, nil, 0, errors.New("checksum mismatch")
+	}
+
+	return header[1], payload, storeRecordHeaderSize + length, nil
+}
+
+// append writes a record at the end of the file, picking up anything other
+// processes have written first.
+func (s *Store) append(op byte, payload []byte) (int64, int, error) {
+
+	if err := s.replay(true); err != nil {
+		return 0, 0, err
+	}
+
+	buf := make([]byte, storeRecordHeaderSize, storeRecordHeaderSize+len(payload))
+	buf[0] = storeRecordMagic
+	buf[1] = op
+	binary.LittleEndian.PutUint32(buf[2:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[6:], crc32.ChecksumIEEE(payload))
+	buf = append(buf, payload...)
+
+	offset := s.end
+	if _, err := s.f.WriteAt(buf, offset); err != nil {
+		return 0, 0, err
+	}
+	s.end += int64(len(buf))
+
+	return offset, len(buf), nil
+}
+
+func newStoreEntry(offset int64, length int, d *Disk) *storeEntry {
+
+	e := &storeEntry{
+		Offset:    offset,
+		Length:    length,
+		FullPath:  d.FullPath,
+		Format:    int(d.FormatID.ID),
+		SHA256:    d.SHA256,
+		ActiveSHA: d.SHA256Active,
+	}
+
+	seen := make(map[string]bool)
+	words := make(map[string]bool)
+	for _, f := range d.Files {
+		for _, w := range textWords(f.Text) {
+			if !words[w.Word] {
+				e.Words = append(e.Words, w.Word)
+				words[w.Word] = true
+			}
+		}
+		// normalized checksums too, for -file with -file-hash normalized
+		for _, sha := range []string{f.SHA256, f.NormalizedSHA256} {
+			if sha != "" && !seen[sha] {
+				e.FileSHA = append(e.FileSHA, sha)
+				seen[sha] = true
+			}
+		}
+		name := strings.ToUpper(f.Filename)
+		if !seen["name:"+name] {
+			e.Filenames = append(e.Filenames, name)
+			seen["name:"+name] = true
+		}
+	}
+
+	return e
+}
+
+func (e *storeEntry) terms() map[string][]string {
+	return map[string][]string{
+		IndexDiskSHA:   {e.SHA256},
+		IndexActiveSHA: {e.ActiveSHA},
+		IndexFileSHA:   e.FileSHA,
+		IndexFilename:  e.Filenames,
+		IndexFormat:    {fmt.Sprintf("%d", e.Format)},
+		IndexWord:      e.Words,
+	}
+}
+
+// apply replaces (or with nil, removes) the entry for key
+func (s *Store) apply(key string, e *storeEntry) {
+
+	s.dirty[key] = true
+
+	if old, ok := s.entries[key]; ok {
+		s.garbage += int64(old.Length)
+		for index, values := range old.terms() {
+			for _, v := range values {
+				delete(s.secondary[index][v], key)
+				if len(s.secondary[index][v]) == 0 {
+					delete(s.secondary[index], v)
+				}
+			}
+		}
+		delete(s.entries, key)
+	}
+
+	if e == nil {
+		return
+	}
+
+	s.entries[key] = e
+	s.addSecondary(key, e)
+}
+
+func (s *Store) addSecondary(key string, e *storeEntry) {
+	for index, values := range e.terms() {
+		if s.secondary[index] == nil {
+			s.secondary[index] = make(map[string]map[string]bool)
+		}
+		for _, v := range values {
+			if s.secondary[index][v] == nil {
+				s.secondary[index][v] = make(map[string]bool)
+			}
+			s.secondary[index][v][key] = true
+		}
+	}
+}
+
+func (s *Store) rebuildSecondary() {
+	s.secondary = make(map[string]map[string]map[string]bool)
+	for key, e := range s.entries {
+		s.addSecondary(key, e)
+	}
+}
+
+// Put stores the fingerprint for a disk under key
+func (s *Store) Put(key string, d *Disk) error {
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(storePutRecord{Key: key, Disk: d}); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	offset, size, err := s.append(storeOpPut, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	s.apply(key, newStoreEntry(offset, size, d))
+	s.pending++
+
+	return nil
+}
+
+// Delete removes the fingerprint stored under key
+func (s *Store) Delete(key string) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.entries[key]; !ok {
+		return nil
+	}
+
+	_, size, err := s.append(storeOpDelete, []byte(key))
+	if err != nil {
+		return err
+	}
+	s.apply(key, nil)
+	s.garbage += int64(size)
+	s.pending++
+
+	return nil
+}
+
+// Get decodes the fingerprint stored under key
+func (s *Store) Get(key string) (*Disk, error) {
+
+	s.RLock()
+	e, ok := s.entries[key]
+	s.RUnlock()
+
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	op, payload, _, err := s.readRecord(e.Offset)
+	if err == nil && op != storeOpPut {
+		err = errors.New("not a fingerprint record")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rec storePutRecord
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+		return nil, err
+	}
+
+	return rec.Disk, nil
+}
+
+func (s *Store) Has(key string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	_, ok := s.entries[key]
+	return ok
+}
+
+// Source returns the image path a fingerprint was made from
+func (s *Store) Source(key string) string {
+	s.RLock()
+	defer s.RUnlock()
+	if e, ok := s.entries[key]; ok {
+		return e.FullPath
+	}
+	return ""
+}
+
+// Keys returns every fingerprint key, sorted
+func (s *Store) Keys() []string {
+
+	s.RLock()
+	out := make([]string, 0, len(s.entries))
+	for k := range s.entries {
+		out = append(out, k)
+	}
+	s.RUnlock()
+
+	sort.Strings(out)
+
+	return out
+}
+
+// Lookup returns the keys of fingerprints with value in the index
+func (s *Store) Lookup(index string, value string) []string {
+
+	s.RLock()
+	out := make([]string, 0, len(s.secondary[index][value]))
+	for k := range s.secondary[index][value] {
+		out = append(out, k)
+	}
+	s.RUnlock()
+
+	sort.Strings(out)
+
+	return out
+}
+
+// LookupFunc returns the keys of fingerprints with any value in the index
+// accepted by match.
+func (s *Store) LookupFunc(index string, match func(value string) bool) []string {
+
+	keys := make(map[string]bool)
+
+	s.RLock()
+	for v, list := range s.secondary[index] {
+		if match(v) {
+			for k := range list {
+				keys[k] = true
+			}
+		}
+	}
+	s.RUnlock()
+
+	out := make([]string, 0, len(keys))
+	for k := range keys {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// Flush writes a new index record if more than min records are unindexed.
+// Only the entries changed since the last index record are written, unless
+// a full index is due.
+func (s *Store) Flush(min int) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pending == 0 || s.pending < min {
+		return nil
+	}
+
+	if err := s.replay(true); err != nil {
+		return err
+	}
+
+	idx := storeIndexRecord{Version: storeIndexVersion, Covered: s.end, Garbage: s.garbage}
+	if s.index == 0 || s.depth >= storeIndexChain || 2*len(s.dirty) > len(s.entries) {
+		idx.Entries = s.entries
+	} else {
+		idx.Previous = s.index
+		idx.Depth = s.depth + 1
+		idx.Entries = make(map[string]*storeEntry)
+		for key := range s.dirty {
+			if e, ok := s.entries[key]; ok {
+				idx.Entries[key] = e
+			} else {
+				idx.Removed = append(idx.Removed, key)
+			}
+		}
+		sort.Strings(idx.Removed)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(idx); err != nil {
+		return err
+	}
+
+	offset, size, err := s.append(storeOpIndex, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	s.garbage += int64(size)
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+
+	pointer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(pointer, uint64(offset))
+	if _, err := s.f.WriteAt(pointer, 8); err != nil {
+		return err
+	}
+
+	s.covered = s.end
+	s.pending = 0
+	s.index = offset
+	s.depth = idx.Depth
+	s.dirty = make(map[string]bool)
+
+	return nil
+}
+
+// Compact rewrites the store without replaced and deleted records, if they
+// take up more room than the live ones.  Needs the exclusive lock.
+func (s *Store) Compact() error {
+
+	s.Lock()
+	live := s.end - s.garbage
+	due := s.garbage > 1024*1024 && s.garbage > live
+	s.Unlock()
+
+	if !due {
+		return nil
+	}
+
+	tmpname := s.filename + ".compact"
+	os.Remove(tmpname)
+
+	ns, err := OpenStore(tmpname)
+	if err != nil {
+		return err
+	}
+	for _, key := range s.Keys() {
+		d, err := s.Get(key)
+		if err != nil {
+			corruptFingerprints.Add(key, err)
+			continue
+		}
+		if err := ns.Put(key, d); err != nil {
+			ns.Close()
+			os.Remove(tmpname)
+			return err
+		}
+	}
+	if err := ns.Close(); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	if err := os.Rename(tmpname, s.filename); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	// carry on with the compacted file
+	s.Lock()
+	defer s.Unlock()
+
+	return s.reopen()
+}
+
+// reopen closes the store file and loads it again from its path
+func (s *Store) reopen() error {
+
+	s.f.Close()
+	f, err := os.OpenFile(s.filename, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	s.f = f
+
+	return s.load()
+}
+
+// refresh picks up records other processes have written, reopening the
+// file first if another process compacted it into a new one.  Needs the
+// datastore lock.
+func (s *Store) refresh(repair bool) error {
+
+	info, err := os.Stat(s.filename)
+	if err != nil {
+		return err
+	}
+	open, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(info, open) {
+		if err := s.reopen(); err != nil {
+			return err
+		}
+	}
+
+	return s.replay(repair)
+}
+
+// Close writes the index if anything has changed and closes the file
+func (s *Store) Close() error {
+
+	err := s.Flush(1)
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// fingerprintKey turns a fingerprint path in the datastore into a store key
+func fingerprintKey(filename string) string {
+
+	filename = strings.Replace(filename, "\\", "/", -1)
+	base := strings.TrimRight(strings.Replace(*baseName, "\\", "/", -1), "/") + "/"
+
+	return strings.TrimPrefix(filename, base)
+}
+
+// fingerprintPath is the inverse of fingerprintKey
+func fingerprintPath(key string) string {
+	return strings.TrimRight(strings.Replace(*baseName, "\\", "/", -1), "/") + "/" + key
+}
+
+func fingerprintExists(key string) bool {
+	s, err := getStore()
+	if err != nil {
+		return false
+	}
+	return s.Has(key)
+}
+
+// readFingerprintFile decodes an old style per-disk .fgp file
+func readFingerprintFile(filename string, d *Disk) error {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gob.NewDecoder(io.Reader(f)).Decode(d)
+}
+
+// moveFingerprint renames a fingerprint in the store, eg. to quarantine it
+func moveFingerprint(source, dest string) error {
+
+	return writeStore(func(s *Store) error {
+		d, err := s.Get(fingerprintKey(source))
+		if err != nil {
+			return err
+		}
+		if err := s.Put(fingerprintKey(dest), d); err != nil {
+			return err
+		}
+		return s.Delete(fingerprintKey(source))
+	})
+}
+
+// importFingerprintFiles copies the .fgp files of an older datastore into
+// the store.  The files are left in place, so it is safe to run again.
+func importFingerprintFiles() {
+
+	s, err := getStore()
+	if err != nil {
+		os.Stderr.WriteString("Failed to open datastore: " + err.Error() + "\n")
+		return
+	}
+
+	count := 0
+	filepath.Walk(*baseName, func(p string, info os.FileInfo, err error) error {
+
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		name := info.Name()
+		if !strings.HasSuffix(name, ".fgp") && !strings.HasSuffix(name, ".fgp.q") {
+			return nil
+		}
+
+		d := &Disk{}
+		if err := readFingerprintFile(p, d); err != nil {
+			corruptFingerprints.Add(p, err)
+			return nil
+		}
+
+		if err := s.Put(fingerprintKey(p), d); err != nil {
+			corruptFingerprints.Add(p, err)
+			return nil
+		}
+
+		count++
+		if count%100 == 0 {
+			os.Stderr.WriteString(fmt.Sprintf("\rImported %d fingerprints...", count))
+		}
+
+		return nil
+	})
+
+	fmt.Printf("\r%d fingerprint(s) imported into %s\n", count, s.filename)
+}
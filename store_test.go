@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func storeDisk(name string, sha string, text string) *Disk {
+	return &Disk{
+		FullPath:     "/disks/" + name,
+		Filename:     name,
+		SHA256:       sha,
+		SHA256Active: sha,
+		Files:        DiskCatalog{{Filename: "HELLO", SHA256: "f" + sha, Text: []byte(text)}},
+	}
+}
+
+// openTestStore opens a store and closes its file when the test ends
+func openTestStore(t *testing.T, filename string) *Store {
+	s, err := OpenStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.f.Close() })
+	return s
+}
+
+// latestIndex decodes the index record the header points at
+func latestIndex(t *testing.T, s *Store) *storeIndexRecord {
+
+	header := make([]byte, storeHeaderSize)
+	if _, err := s.f.ReadAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+	op, payload, _, err := s.readRecord(int64(binary.LittleEndian.Uint64(header[8:])))
+	if err != nil || op != storeOpIndex {
+		t.Fatalf("No index record: %v", err)
+	}
+	idx := &storeIndexRecord{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(idx); err != nil {
+		t.Fatal(err)
+	}
+
+	return idx
+}
+
+func expectKeys(t *testing.T, s *Store, keys ...string) {
+	t.Helper()
+	if got := s.Keys(); !reflect.DeepEqual(got, keys) && !(len(got) == 0 && len(keys) == 0) {
+		t.Fatalf("Expected keys %v, got %v", keys, got)
+	}
+	for _, key := range keys {
+		d, err := s.Get(key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if d.Filename != key {
+			t.Fatalf("%s: got the fingerprint of %s", key, d.Filename)
+		}
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), storeFile)
+	s := openTestStore(t, filename)
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := s.Put(name, storeDisk(name, "sha-"+name, "10 PRINT "+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put("b", storeDisk("b", "sha-b2", "10 HOME")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, s, "a", "b")
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, filename)
+	expectKeys(t, s, "a", "b")
+
+	tests := []struct {
+		index, value string
+		keys         []string
+	}{
+		{IndexDiskSHA, "sha-b2", []string{"b"}},
+		{IndexDiskSHA, "sha-b", []string{}},
+		{IndexActiveSHA, "sha-a", []string{"a"}},
+		{IndexFileSHA, "fsha-a", []string{"a"}},
+		{IndexFilename, "HELLO", []string{"a", "b"}},
+		{IndexWord, "print", []string{"a"}},
+		{IndexWord, "home", []string{"b"}},
+		{IndexWord, "c", []string{}},
+	}
+	for _, test := range tests {
+		if got := s.Lookup(test.index, test.value); !reflect.DeepEqual(got, test.keys) {
+			t.Errorf("%s %s: expected %v, got %v", test.index, test.value, test.keys, got)
+		}
+	}
+
+}
+
+func TestStoreIndexChanges(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), storeFile)
+	s := openTestStore(t, filename)
+
+	var keys []string
+	for _, name := range []string{"a", "b", "c", "d"} {
+		s.Put(name, storeDisk(name, "sha-"+name, ""))
+		keys = append(keys, name)
+	}
+	if err := s.Flush(1); err != nil {
+		t.Fatal(err)
+	}
+	if idx := latestIndex(t, s); idx.Previous != 0 || len(idx.Entries) != 4 {
+		t.Fatalf("Expected a full first index, got %d entries after %d", len(idx.Entries), idx.Previous)
+	}
+
+	// only the changes go in the next index record
+	s.Put("e", storeDisk("e", "sha-e", ""))
+	s.Delete("a")
+	if err := s.Flush(1); err != nil {
+		t.Fatal(err)
+	}
+	idx := latestIndex(t, s)
+	if idx.Previous == 0 || idx.Depth != 1 || len(idx.Entries) != 1 || idx.Entries["e"] == nil || !reflect.DeepEqual(idx.Removed, []string{"a"}) {
+		t.Fatalf("Expected only e put and a removed, got %d entries, removed %v", len(idx.Entries), idx.Removed)
+	}
+
+	// nothing changed, nothing written
+	info, _ := s.f.Stat()
+	if err := s.Flush(1); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := s.f.Stat(); after.Size() != info.Size() {
+		t.Fatalf("Expected no index record without changes")
+	}
+
+	// the chain ends in a full index
+	keys = []string{"b", "c", "d", "e"}
+	for i := 0; i < storeIndexChain; i++ {
+		s.Put("b", storeDisk("b", "sha-b", ""))
+		if err := s.Flush(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if idx := latestIndex(t, s); idx.Previous != 0 || len(idx.Entries) != len(keys) {
+		t.Fatalf("Expected a full index after %d partial ones, got depth %d", storeIndexChain, idx.Depth)
+	}
+	s.Put("f", storeDisk("f", "sha-f", ""))
+	keys = append(keys, "f")
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, filename)
+	expectKeys(t, s, keys...)
+	if s.pending != 0 {
+		t.Fatalf("Expected everything to come from the index, replayed %d records", s.pending)
+	}
+
+}
+
+func TestStoreReplay(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), storeFile)
+	s := openTestStore(t, filename)
+
+	s.Put("a", storeDisk("a", "sha-a", ""))
+	s.Put("b", storeDisk("b", "sha-b", ""))
+	if err := s.Flush(1); err != nil {
+		t.Fatal(err)
+	}
+	s.Put("c", storeDisk("c", "sha-c", ""))
+	s.Delete("a")
+
+	// stop without writing the index
+	s.f.Close()
+
+	s = openTestStore(t, filename)
+	expectKeys(t, s, "b", "c")
+	if s.pending != 2 {
+		t.Fatalf("Expected 2 records replayed, got %d", s.pending)
+	}
+	if got := s.Lookup(IndexDiskSHA, "sha-c"); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Fatalf("Expected the replayed record to be indexed, got %v", got)
+	}
+
+}
+
+func TestStoreTruncated(t *testing.T) {
+
+	defer reportCorruptFingerprints(io.Discard)
+
+	filename := filepath.Join(t.TempDir(), storeFile)
+	s := openTestStore(t, filename)
+
+	s.Put("a", storeDisk("a", "sha-a", ""))
+	if err := s.Flush(1); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := s.f.Stat()
+	s.Put("b", storeDisk("b", "sha-b", ""))
+	s.f.Close()
+
+	// a crash part way through writing b
+	for _, cut := range []int64{1, storeRecordHeaderSize, storeRecordHeaderSize + 5} {
+
+		if err := os.Truncate(filename, info.Size()+cut); err != nil {
+			t.Fatal(err)
+		}
+
+		s = openTestStore(t, filename)
+		expectKeys(t, s, "a")
+		s.f.Close()
+	}
+
+	// the damaged tail is cut off by the next write
+	s = openTestStore(t, filename)
+	if err := s.Put("c", storeDisk("c", "sha-c", "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, filename)
+	expectKeys(t, s, "a", "c")
+
+}
+
+func TestStoreCompact(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), storeFile)
+	s := openTestStore(t, filename)
+
+	data := bytes.Repeat([]byte{0xa9}, 64*1024)
+	for i := 0; i < 24; i++ {
+		d := storeDisk("a", "sha-a", "10 HOME")
+		d.Files[0].Data = data
+		if err := s.Put("a", d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Put("b", storeDisk("b", "sha-b", ""))
+	s.Put("c", storeDisk("c", "sha-c", ""))
+	s.Delete("c")
+	if err := s.Flush(1); err != nil {
+		t.Fatal(err)
+	}
+
+	before, _ := s.f.Stat()
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := s.f.Stat()
+	if after.Size() >= before.Size()/4 {
+		t.Fatalf("Expected the store to shrink, went from %d to %d bytes", before.Size(), after.Size())
+	}
+	if _, err := os.Stat(filename + ".compact"); err == nil {
+		t.Fatalf("Expected the compacted copy to be renamed")
+	}
+	expectKeys(t, s, "a", "b")
+	if d, _ := s.Get("a"); !bytes.Equal(d.Files[0].Data, data) {
+		t.Fatalf("Expected file data to survive compaction")
+	}
+
+	// nothing left to compact
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := s.f.Stat(); again.Size() != after.Size() {
+		t.Fatalf("Expected no second compaction")
+	}
+
+	s.Put("d", storeDisk("d", "sha-d", ""))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, filename)
+	expectKeys(t, s, "a", "b", "d")
+
+}
+
+func TestStoreCompactedElsewhere(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), storeFile)
+	s := openTestStore(t, filename)
+	other := openTestStore(t, filename)
+
+	data := bytes.Repeat([]byte{0xa9}, 64*1024)
+	for i := 0; i < 24; i++ {
+		d := storeDisk("a", "sha-a", "")
+		d.Files[0].Data = data
+		s.Put("a", d)
+	}
+	if err := s.Flush(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	s.Put("b", storeDisk("b", "sha-b", ""))
+
+	// as lockDatastore does before using a store that stayed open
+	other.Lock()
+	err := other.refresh(true)
+	other.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, other, "a", "b")
+
+	if err := other.Put("c", storeDisk("c", "sha-c", "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Lock()
+	err = s.refresh(true)
+	s.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, s, "a", "b", "c")
+
+	reopened := openTestStore(t, filename)
+	expectKeys(t, reopened, "a", "b", "c")
+
+}
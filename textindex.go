@@ -0,0 +1,513 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/paleotronic/diskm8/disk"
+)
+
+/*
+	Text search...
+
+	The words and identifiers in the text of every file (detokenized BASIC
+	listings and text files) go into the word index when a disk is stored,
+	so a search only has to open disks that can match.  Queries are made up
+	of:
+
+	  word        a whole word or identifier, eg. HOME or A$
+	  prefix*     any word starting with prefix
+	  "a phrase"  words next to each other on a line, in order ('single
+	              quotes' too)
+	  /regexp/    a regular expression matched against each line
+	  -term       or NOT term, files without the term
+	  OR          either side matches; terms are otherwise all needed
+
+	Matching is not case sensitive, and neither are OR, AND and NOT; quote
+	them to search for the words themselves.  Words longer than maxTextWord
+	are not indexed, so queries with them read every disk.
+*/
+
+const maxTextWord = 32
+
+// lines of context shown around a match
+const textContext = 1
+
+type textWord struct {
+	Word string
+	Line int
+	Pos  int // word number within the line, counting words too long to keep
+}
+
+func isWordChar(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_'
+}
+
+// textLines splits text on CR, LF or CRLF, as all of them turn up in Apple
+// II files.  Blank lines are kept so lines keep their numbers.
+func textLines(text []byte) []string {
+
+	if len(text) == 0 {
+		return nil
+	}
+
+	s := strings.Replace(string(text), "\r\n", "\n", -1)
+	s = strings.Replace(s, "\r", "\n", -1)
+
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// lineWords returns the lower case words and identifiers in a line,
+// including any too long to index.  Identifiers keep a trailing $ or %.
+func lineWords(line string) []string {
+
+	var out []string
+
+	for i := 0; i < len(line); {
+		if !isWordChar(line[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(line) && isWordChar(line[j]) {
+			j++
+		}
+		if j < len(line) && (line[j] == '$' || line[j] == '%') {
+			j++
+		}
+		out = append(out, strings.ToLower(line[i:j]))
+		i = j
+	}
+
+	return out
+}
+
+// textWords returns the words in text short enough to index, with the line
+// each is on and where in the line.
+func textWords(text []byte) []textWord {
+
+	var out []textWord
+
+	for n, line := range textLines(text) {
+		for pos, w := range lineWords(line) {
+			if len(w) <= maxTextWord {
+				out = append(out, textWord{Word: w, Line: n, Pos: pos})
+			}
+		}
+	}
+
+	return out
+}
+
+func hasLongWord(words []string) bool {
+	for _, w := range words {
+		if len(w) > maxTextWord {
+			return true
+		}
+	}
+	return false
+}
+
+// longWordPattern matches words the way the index would, for queries with
+// words too long to be in the index
+func longWordPattern(words []string, prefix bool) *regexp.Regexp {
+
+	parts := make([]string, len(words))
+	for i, w := range words {
+		parts[i] = regexp.QuoteMeta(w)
+	}
+
+	pattern := "(?i)(?:^|[^a-z0-9_])" + strings.Join(parts, "[^a-z0-9_]+")
+	if !prefix {
+		pattern += "(?:[^a-z0-9_$%]|$)"
+	}
+
+	return regexp.MustCompile(pattern)
+}
+
+const (
+	textTermWord = iota
+	textTermPrefix
+	textTermPhrase
+	textTermRegexp
+)
+
+type textTerm struct {
+	kind   int
+	words  []string
+	rxp    *regexp.Regexp
+	negate bool
+}
+
+// textQuery matches if any of its groups does, and a group matches if all
+// of its terms do.
+type textQuery struct {
+	groups [][]*textTerm
+}
+
+func parseTextQuery(q string) (*textQuery, error) {
+
+	query := &textQuery{}
+	var group []*textTerm
+	negate := false
+
+	endGroup := func() {
+		if len(group) > 0 {
+			query.groups = append(query.groups, group)
+		}
+		group = nil
+	}
+
+	add := func(t *textTerm) {
+		t.negate = negate
+		negate = false
+		group = append(group, t)
+	}
+
+	for i := 0; i < len(q); {
+
+		ch := q[i]
+		switch {
+		case ch == ' ' || ch == '\t':
+			i++
+
+		case ch == '"' || ch == '\'':
+			end := strings.IndexByte(q[i+1:], ch)
+			if end < 0 {
+				return nil, errors.New("Unterminated phrase in query")
+			}
+			words := lineWords(q[i+1 : i+1+end])
+			switch {
+			case hasLongWord(words):
+				add(&textTerm{kind: textTermRegexp, rxp: longWordPattern(words, false)})
+			case len(words) > 0:
+				add(&textTerm{kind: textTermPhrase, words: words})
+			}
+			i += end + 2
+
+		case ch == '/':
+			j := i + 1
+			for j < len(q) && q[j] != '/' {
+				if q[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(q) {
+				return nil, errors.New("Unterminated regular expression in query")
+			}
+			rxp, err := regexp.Compile("(?i)" + q[i+1:j])
+			if err != nil {
+				return nil, err
+			}
+			add(&textTerm{kind: textTermRegexp, rxp: rxp})
+			i = j + 1
+
+		case ch == '-' && !negate:
+			negate = true
+			i++
+
+		default:
+			j := i
+			for j < len(q) && q[j] != ' ' && q[j] != '\t' {
+				j++
+			}
+			word := q[i:j]
+			i = j
+
+			switch strings.ToUpper(word) {
+			case "OR":
+				endGroup()
+				continue
+			case "AND":
+				continue
+			case "NOT":
+				negate = true
+				continue
+			}
+
+			prefix := strings.HasSuffix(word, "*")
+			words := lineWords(strings.TrimSuffix(word, "*"))
+			switch {
+			case len(words) == 0:
+				negate = false
+			case hasLongWord(words):
+				// not in the index, so every line is scanned for it
+				add(&textTerm{kind: textTermRegexp, rxp: longWordPattern(words, prefix && len(words) == 1)})
+			case prefix && len(words) == 1:
+				add(&textTerm{kind: textTermPrefix, words: words})
+			case len(words) == 1:
+				add(&textTerm{kind: textTermWord, words: words})
+			default:
+				// eg. FN(X) is searched as the phrase "fn x"
+				add(&textTerm{kind: textTermPhrase, words: words})
+			}
+		}
+	}
+	endGroup()
+
+	if len(query.groups) == 0 {
+		return nil, errors.New("Nothing to search for")
+	}
+
+	return query, nil
+}
+
+// match returns the line of every occurrence of the term
+func (t *textTerm) match(words []textWord, lines []string) []int {
+
+	var out []int
+
+	switch t.kind {
+	case textTermWord:
+		for _, w := range words {
+			if w.Word == t.words[0] {
+				out = append(out, w.Line)
+			}
+		}
+	case textTermPrefix:
+		for _, w := range words {
+			if strings.HasPrefix(w.Word, t.words[0]) {
+				out = append(out, w.Line)
+			}
+		}
+	case textTermPhrase:
+		// the index only says a disk has each word, so check they are
+		// next to each other on the same line
+		for i := 0; i+len(t.words) <= len(words); i++ {
+			found := true
+			for j, pw := range t.words {
+				w := words[i+j]
+				if w.Word != pw || w.Line != words[i].Line || w.Pos != words[i].Pos+j {
+					found = false
+					break
+				}
+			}
+			if found {
+				out = append(out, words[i].Line)
+			}
+		}
+	case textTermRegexp:
+		for n, line := range lines {
+			for range t.rxp.FindAllStringIndex(line, -1) {
+				out = append(out, n)
+			}
+		}
+	}
+
+	return out
+}
+
+// Match scores the text of a file against the query, returning the lines
+// that matched.  A score of zero means no match.
+func (q *textQuery) Match(text []byte) (int, []int) {
+
+	if len(text) == 0 {
+		return 0, nil
+	}
+
+	words := textWords(text)
+	lines := textLines(text)
+
+	score := 0
+	hit := make(map[int]bool)
+
+	for _, group := range q.groups {
+		gscore := 0
+		ghit := make(map[int]bool)
+		ok := true
+		for _, t := range group {
+			found := t.match(words, lines)
+			if t.negate {
+				if len(found) > 0 {
+					ok = false
+					break
+				}
+				continue
+			}
+			if len(found) == 0 {
+				ok = false
+				break
+			}
+			gscore += len(found)
+			for _, n := range found {
+				ghit[n] = true
+			}
+		}
+		if !ok {
+			continue
+		}
+		if gscore == 0 {
+			// only negative terms
+			gscore = 1
+		}
+		score += gscore
+		for n := range ghit {
+			hit[n] = true
+		}
+	}
+
+	out := make([]int, 0, len(hit))
+	for n := range hit {
+		out = append(out, n)
+	}
+	sort.Ints(out)
+
+	return score, out
+}
+
+// candidates returns the store keys of disks that may match, or nil if
+// every disk needs to be looked at.
+func (q *textQuery) candidates(s *Store) map[string]bool {
+
+	out := make(map[string]bool)
+
+	for _, group := range q.groups {
+
+		var keys map[string]bool
+		for _, t := range group {
+			if t.negate || t.kind == textTermRegexp {
+				continue
+			}
+			for _, w := range t.words {
+				var found []string
+				if t.kind == textTermPrefix {
+					prefix := w
+					found = s.LookupFunc(IndexWord, func(v string) bool { return strings.HasPrefix(v, prefix) })
+				} else {
+					found = s.Lookup(IndexWord, w)
+				}
+				next := make(map[string]bool)
+				for _, k := range found {
+					if keys == nil || keys[k] {
+						next[k] = true
+					}
+				}
+				keys = next
+			}
+		}
+
+		if keys == nil {
+			// nothing in this group can use the index
+			return nil
+		}
+		for k := range keys {
+			out[k] = true
+		}
+	}
+
+	return out
+}
+
+func isBasicFile(f *DiskFile) bool {
+	switch f.TypeCode {
+	case TypeMask_AppleDOS | TypeCode(disk.FileTypeAPP),
+		TypeMask_AppleDOS | TypeCode(disk.FileTypeINT),
+		TypeMask_ProDOS | TypeCode(disk.FileType_PD_APP),
+		TypeMask_ProDOS | TypeCode(disk.FileType_PD_INT):
+		return true
+	}
+	return false
+}
+
+type textResult struct {
+	DiskPath string
+	File     *DiskFile
+	Score    int
+	Lines    []int
+}
+
+func searchText(query string, filter []string) ([]*textResult, error) {
+
+	q, err := parseTextQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	if keys := q.candidates(s); keys != nil {
+		paths := make([]string, 0, len(keys))
+		for k := range keys {
+			if strings.HasSuffix(k, ".fgp") {
+				paths = append(paths, fingerprintPath(k))
+			}
+		}
+		sort.Strings(paths)
+		_, matches = filterPaths(*baseName, filter, "*_*_*_*.fgp", paths)
+	} else {
+		_, matches = existsPattern(*baseName, filter, "*_*_*_*.fgp")
+	}
+
+	var out []*textResult
+	for diskname, list := range GetFilesFrom(matches) {
+		for _, f := range list {
+			if score, lines := q.Match(f.Text); score > 0 {
+				out = append(out, &textResult{DiskPath: diskname, File: f, Score: score, Lines: lines})
+			}
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		if out[i].DiskPath != out[j].DiskPath {
+			return out[i].DiskPath < out[j].DiskPath
+		}
+		return out[i].File.Filename < out[j].File.Filename
+	})
+
+	return out, nil
+}
+
+// printTextContext shows the matching lines with a line either side.  BASIC
+// lines carry their own line numbers, text lines are numbered from 1.
+func printTextContext(r *textResult) {
+
+	lines := textLines(r.File.Text)
+	basic := isBasicFile(r.File)
+
+	hit := make(map[int]bool)
+	for _, n := range r.Lines {
+		hit[n] = true
+	}
+
+	last := -1
+	for _, n := range r.Lines {
+		from, to := n-textContext, n+textContext
+		if from <= last {
+			from = last + 1
+		}
+		if from < 0 {
+			from = 0
+		}
+		if to >= len(lines) {
+			to = len(lines) - 1
+		}
+		if last >= 0 && from > last+1 {
+			fmt.Println("      ...")
+		}
+		for i := from; i <= to; i++ {
+			mark := " "
+			if hit[i] {
+				mark = ">"
+			}
+			if basic {
+				fmt.Printf("    %s %s\n", mark, strings.TrimSpace(lines[i]))
+			} else {
+				fmt.Printf("    %s %5d: %s\n", mark, i+1, lines[i])
+			}
+		}
+		if to > last {
+			last = to
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTextQuery(t *testing.T) {
+
+	type term struct {
+		kind   int
+		words  string
+		negate bool
+	}
+
+	tests := []struct {
+		query  string
+		groups [][]term
+	}{
+		{"HOME", [][]term{{{textTermWord, "home", false}}}},
+		{"A$ gr*", [][]term{{{textTermWord, "a$", false}, {textTermPrefix, "gr", false}}}},
+		{`"Hello  World"`, [][]term{{{textTermPhrase, "hello world", false}}}},
+		{`'call -151'`, [][]term{{{textTermPhrase, "call 151", false}}}},
+		{"FN(X)", [][]term{{{textTermPhrase, "fn x", false}}}},
+		{"/PR.NT/", [][]term{{{textTermRegexp, "", false}}}},
+		{"-goto home", [][]term{{{textTermWord, "goto", true}, {textTermWord, "home", false}}}},
+		{"NOT goto AND home", [][]term{{{textTermWord, "goto", true}, {textTermWord, "home", false}}}},
+		{"not goto and home", [][]term{{{textTermWord, "goto", true}, {textTermWord, "home", false}}}},
+		{"home OR text", [][]term{{{textTermWord, "home", false}}, {{textTermWord, "text", false}}}},
+		{"home or text Or gr", [][]term{{{textTermWord, "home", false}}, {{textTermWord, "text", false}}, {{textTermWord, "gr", false}}}},
+		{`"or" 'not'`, [][]term{{{textTermPhrase, "or", false}, {textTermPhrase, "not", false}}}},
+		{"- home", [][]term{{{textTermWord, "home", true}}}},
+		{strings.Repeat("x", maxTextWord+1), [][]term{{{textTermRegexp, "", false}}}},
+		{`"a ` + strings.Repeat("x", maxTextWord+1) + `"`, [][]term{{{textTermRegexp, "", false}}}},
+		{"-:: home", [][]term{{{textTermWord, "home", false}}}},
+	}
+
+	for _, test := range tests {
+
+		q, err := parseTextQuery(test.query)
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if len(q.groups) != len(test.groups) {
+			t.Errorf("%s: expected %d groups, got %d", test.query, len(test.groups), len(q.groups))
+			continue
+		}
+		for i, group := range test.groups {
+			if len(q.groups[i]) != len(group) {
+				t.Errorf("%s: expected %d terms in group %d, got %d", test.query, len(group), i, len(q.groups[i]))
+				continue
+			}
+			for j, want := range group {
+				got := q.groups[i][j]
+				if got.kind != want.kind || strings.Join(got.words, " ") != want.words || got.negate != want.negate {
+					t.Errorf("%s: expected %+v, got {%d %s %v}", test.query, want, got.kind, strings.Join(got.words, " "), got.negate)
+				}
+			}
+		}
+	}
+
+}
+
+func TestParseTextQueryErrors(t *testing.T) {
+
+	for _, query := range []string{
+		"",
+		"  ",
+		"OR",
+		"and or not",
+		"::",
+		`"home`,
+		`'home`,
+		"/home",
+		"/(/",
+	} {
+		if _, err := parseTextQuery(query); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+
+}
+
+func TestTextQueryMatch(t *testing.T) {
+
+	text := []byte("10 HOME\r20 PRINT \"HELLO WORLD\"\r30 DEF FN(X) = X * 2: GOTO 20\r40 PRINT " +
+		strings.Repeat("X", maxTextWord+1) + " WORLD\r50 REM HOME PRINT\r")
+
+	tests := []struct {
+		query string
+		score int
+		lines []int
+	}{
+		{"print", 3, []int{1, 3, 4}},
+		{`"hello world"`, 1, []int{1}},
+		{`"print hello"`, 1, []int{1}},
+		{`"HOME PRINT"`, 1, []int{4}},
+		{`"home print hello"`, 0, nil},
+		{`"goto 20 40"`, 0, nil},
+		{`"print world"`, 0, nil},
+		{"fn(x)", 1, []int{2}},
+		{`"x 2 goto"`, 1, []int{2}},
+		{"hel*", 1, []int{1}},
+		{"/pr.nt/", 3, []int{1, 3, 4}},
+		{"home -goto", 0, nil},
+		{"home not goto OR world", 2, []int{1, 3}},
+		{"-missing", 1, []int{}},
+		{strings.Repeat("x", maxTextWord+1), 1, []int{3}},
+		{strings.Repeat("x", maxTextWord+2), 0, nil},
+		{strings.Repeat("x", maxTextWord) + "*", 0, nil},
+		{strings.Repeat("x", maxTextWord+1) + "*", 1, []int{3}},
+		{`"print ` + strings.Repeat("x", maxTextWord+1) + ` world"`, 1, []int{3}},
+		{`"` + strings.Repeat("x", maxTextWord+1) + ` print"`, 0, nil},
+	}
+
+	for _, test := range tests {
+		q, err := parseTextQuery(test.query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		score, lines := q.Match(text)
+		if score != test.score {
+			t.Errorf("%s: expected score %d, got %d", test.query, test.score, score)
+		}
+		if score > 0 && !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: expected lines %v, got %v", test.query, test.lines, lines)
+		}
+	}
+
+}
+
+func TestTextLines(t *testing.T) {
+
+	tests := []struct {
+		text  string
+		lines []string
+	}{
+		{"", nil},
+		{"\r", []string{""}},
+		{"HOME", []string{"HOME"}},
+		{"A\rB\r", []string{"A", "B"}},
+		{"A\r\n\r\nB\rC\n\nD\n", []string{"A", "", "B", "C", "", "D"}},
+		{"\n\nA", []string{"", "", "A"}},
+	}
+
+	for _, test := range tests {
+		if lines := textLines([]byte(test.text)); !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%q: expected %q, got %q", test.text, test.lines, lines)
+		}
+	}
+
+}
+
+func TestTextQueryBlankLines(t *testing.T) {
+
+	text := []byte("Chapter one\r\n\r\nIt was dark.\r\n\r\n\r\nThe end\r\n")
+
+	tests := []struct {
+		query string
+		lines []int
+	}{
+		{"dark", []int{2}},
+		{`"the end"`, []int{5}},
+		{"chapter OR end", []int{0, 5}},
+	}
+
+	for _, test := range tests {
+		q, err := parseTextQuery(test.query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		if _, lines := q.Match(text); !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: expected lines %v, got %v", test.query, test.lines, lines)
+		}
+	}
+
+}